@@ -0,0 +1,382 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"sort"
+	"time"
+)
+
+const (
+	AlertRuleBoxOffline  = "box_offline"
+	AlertRuleBoxFault    = "box_fault"
+	AlertRulePacketLoss  = "packet_loss"
+	AlertRuleDiskUsage   = "disk_usage"
+	AlertRuleIncomeDrop  = "income_drop"
+	AlertRuleNatDegraded = "nat_degraded"
+
+	// alertBoxPageSize is the number of boxes loaded at once by the evaluation of the rules.
+	alertBoxPageSize = 500
+
+	// alertIncomePageSize is the number of daily incomes loaded at once by the income_drop rules.
+	alertIncomePageSize = 1000
+)
+
+// natRanks orders the NAT types from the most to the least reachable.
+var natRanks = map[string]int{
+	"NAT1":                 1,
+	"NAT2":                 2,
+	"NAT3":                 3,
+	"NAT4":                 4,
+	"Full Cone":            1,
+	"Restricted Cone":      2,
+	"Port Restricted Cone": 3,
+	"Symmetric":            4,
+}
+
+// alertMatch is a box matched by an alert rule.
+type alertMatch struct {
+	value   float64
+	summary string
+}
+
+// alertMatcher returns the boxes matched by the rule, by box id.
+type alertMatcher func(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error)
+
+// Alerter evaluates the alert rules over the boxes of an account, raising an alert for each box a rule
+// matches and resolving it once the rule no longer does.
+type Alerter struct {
+	rules    []config.AlertRule
+	matchers map[string]alertMatcher
+
+	boxes   dao.BoxStore
+	incomes dao.IncomeStore
+	metrics dao.MetricsStore
+	alerts  dao.AlertStore
+}
+
+func NewAlerter(stores *dao.Stores, cfg config.AlertsConfig) (*Alerter, error) {
+	a := &Alerter{
+		boxes:   stores.Boxes,
+		incomes: stores.Incomes,
+		metrics: stores.Metrics,
+		alerts:  stores.Alerts,
+	}
+
+	a.matchers = map[string]alertMatcher{
+		AlertRuleBoxOffline:  a.matchBoxOffline,
+		AlertRuleBoxFault:    a.matchBoxFault,
+		AlertRulePacketLoss:  a.matchPacketLoss,
+		AlertRuleDiskUsage:   a.matchDiskUsage,
+		AlertRuleIncomeDrop:  a.matchIncomeDrop,
+		AlertRuleNatDegraded: a.matchNatDegraded,
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range cfg.Rules {
+		if _, ok := a.matchers[rule.Type]; !ok {
+			return nil, fmt.Errorf("invalid alert rule type: %s", rule.Type)
+		}
+
+		if rule.Name == "" {
+			rule.Name = rule.Type
+		}
+
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate alert rule: %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		a.rules = append(a.rules, rule)
+	}
+
+	return a, nil
+}
+
+// kind returns the kind of the alerts raised by the rule, income for the income_drop rules and box for the others.
+func (a *Alerter) kind(rule string) string {
+	for _, r := range a.rules {
+		if r.Name == rule && r.Type == AlertRuleIncomeDrop {
+			return AlertKindIncome
+		}
+	}
+	return AlertKindBox
+}
+
+func dedupKey(rule, boxId string) string {
+	return rule + "/" + boxId
+}
+
+// Evaluate runs the rules over the boxes of the PaiNet account, and returns the alerts which started firing
+// or were resolved.
+func (a *Alerter) Evaluate(ctx context.Context, username string, now time.Time) ([]*model.Alert, error) {
+	boxes, err := a.allBoxes(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	boxesById := make(map[string]*model.Box)
+	for _, b := range boxes {
+		boxesById[b.BoxId] = b
+	}
+
+	matched := make(map[string]*model.Alert)
+	for _, rule := range a.rules {
+		matches, err := a.matchers[rule.Type](ctx, rule, username, boxes, now)
+		if err != nil {
+			return nil, fmt.Errorf("evaluate alert rule %s: %w", rule.Name, err)
+		}
+
+		for boxId, m := range matches {
+			box, ok := boxesById[boxId]
+			if !ok {
+				continue
+			}
+
+			key := dedupKey(rule.Name, boxId)
+			matched[key] = &model.Alert{
+				Username:      username,
+				DedupKey:      key,
+				Rule:          rule.Name,
+				Severity:      rule.Severity,
+				BoxId:         boxId,
+				SupplierBoxId: box.SupplierBoxId,
+				Status:        model.AlertStatusFiring,
+				Value:         m.value,
+				Summary:       m.summary,
+				StartsAt:      now,
+				UpdatedAt:     now,
+			}
+		}
+	}
+
+	firing, err := a.alerts.GetFiringAlerts(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed, updated []*model.Alert
+	for _, alert := range firing {
+		if m, ok := matched[alert.DedupKey]; ok {
+			alert.Value, alert.Summary, alert.UpdatedAt = m.Value, m.Summary, now
+			updated = append(updated, alert)
+			delete(matched, alert.DedupKey)
+			continue
+		}
+
+		resolvedAt := now
+		alert.Status, alert.ResolvedAt, alert.UpdatedAt = model.AlertStatusResolved, &resolvedAt, now
+		changed = append(changed, alert)
+	}
+
+	var fired []*model.Alert
+	for _, alert := range matched {
+		fired = append(fired, alert)
+	}
+	sort.Slice(fired, func(i, j int) bool {
+		return fired[i].DedupKey < fired[j].DedupKey
+	})
+	changed = append(changed, fired...)
+
+	if err := a.alerts.SaveAlerts(ctx, append(updated, changed...)); err != nil {
+		return nil, err
+	}
+
+	return changed, nil
+}
+
+func (a *Alerter) allBoxes(ctx context.Context, username string) ([]*model.Box, error) {
+	var out []*model.Box
+	for page := int64(1); ; page++ {
+		total, boxes, err := a.boxes.GetBoxesList(ctx, username, nil, page, alertBoxPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, boxes...)
+
+		if len(boxes) == 0 || page*alertBoxPageSize >= total {
+			return out, nil
+		}
+	}
+}
+
+func (a *Alerter) matchBoxOffline(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error) {
+	matches := make(map[string]alertMatch)
+	for i := 0; i < len(boxes); i += alertBoxPageSize {
+		var boxIds []string
+		for _, b := range boxes[i:min(i+alertBoxPageSize, len(boxes))] {
+			if b.Online != boxOnline {
+				boxIds = append(boxIds, b.BoxId)
+			}
+		}
+
+		uptimes, err := a.boxes.GetLatestBoxUptimes(ctx, boxIds)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range uptimes {
+			minutes := float64(now.Unix()-int64(u.StartTime)) / 60
+			if !u.Online && minutes > rule.Threshold {
+				matches[u.BoxId] = alertMatch{
+					value:   minutes,
+					summary: fmt.Sprintf("box %s has been offline for %.0f minutes", u.BoxId, minutes),
+				}
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+func (a *Alerter) matchBoxFault(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error) {
+	matches := make(map[string]alertMatch)
+	for _, b := range boxes {
+		if b.Fault != "" {
+			matches[b.BoxId] = alertMatch{summary: fmt.Sprintf("box %s reports a fault: %s", b.BoxId, b.Fault)}
+		}
+	}
+
+	return matches, nil
+}
+
+// matchPacketLoss compares the average packet loss of the latest hour synced for each box to the threshold.
+// Qualities are synced once a day, so the latest hour may be a day old.
+func (a *Alerter) matchPacketLoss(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error) {
+	rollups, err := a.metrics.GetBoxQualityRollups(ctx, dao.GranularityHour, username, nil, nil, now.AddDate(0, 0, -2).Unix(), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	latest := make(map[string]*model.BoxQualityRollup)
+	for _, r := range rollups {
+		if l, ok := latest[r.BoxId]; !ok || r.Time > l.Time {
+			latest[r.BoxId] = r
+		}
+	}
+
+	matches := make(map[string]alertMatch)
+	for boxId, r := range latest {
+		if r.PacketLossAvg > rule.Threshold {
+			matches[boxId] = alertMatch{
+				value:   r.PacketLossAvg,
+				summary: fmt.Sprintf("box %s lost %.2f%% of its packets", boxId, r.PacketLossAvg),
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+func (a *Alerter) matchDiskUsage(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error) {
+	matches := make(map[string]alertMatch)
+	for _, b := range boxes {
+		if b.DiskUsage > rule.Threshold {
+			matches[b.BoxId] = alertMatch{
+				value:   b.DiskUsage,
+				summary: fmt.Sprintf("box %s disk usage is %.2f%%", b.BoxId, b.DiskUsage),
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// matchIncomeDrop compares the income of each box yesterday, the last complete day, to its average over
+// the 7 days before. Boxes without income over those 7 days are skipped.
+func (a *Alerter) matchIncomeDrop(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error) {
+	yesterday := model.Date(now.AddDate(0, 0, -1).Format(time.DateOnly))
+	start := now.AddDate(0, 0, -8).Format(time.DateOnly)
+
+	last := make(map[string]float64)
+	previous := make(map[string]float64)
+	for page := int64(1); ; page++ {
+		total, _, incomes, err := a.incomes.GetBoxIncomeV2(ctx, username, nil, nil, nil, start, string(yesterday), page, alertIncomePageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, in := range incomes {
+			if in.Date == yesterday {
+				last[in.BoxId] += in.Amount.Float64()
+				continue
+			}
+			previous[in.BoxId] += in.Amount.Float64()
+		}
+
+		if len(incomes) == 0 || page*alertIncomePageSize >= total {
+			break
+		}
+	}
+
+	matches := make(map[string]alertMatch)
+	for boxId, sum := range previous {
+		average := sum / 7
+		if average <= 0 {
+			continue
+		}
+
+		drop := (average - last[boxId]) * 100 / average
+		if drop > rule.Threshold {
+			matches[boxId] = alertMatch{
+				value:   drop,
+				summary: fmt.Sprintf("box %s earned %.2f yesterday, %.0f%% below its 7 day average of %.2f", boxId, last[boxId], drop, average),
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+// matchNatDegraded matches the boxes whose TCP NAT type got less reachable on its latest change.
+func (a *Alerter) matchNatDegraded(ctx context.Context, rule config.AlertRule, username string, boxes []*model.Box, now time.Time) (map[string]alertMatch, error) {
+	changes, err := a.boxes.GetLatestBoxChanges(ctx, username, "tcpNatType")
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]string)
+	for _, b := range boxes {
+		current[b.BoxId] = b.TcpNatType
+	}
+
+	matches := make(map[string]alertMatch)
+	for _, c := range changes {
+		oldRank, newRank := natRanks[c.OldValue], natRanks[c.NewValue]
+		if current[c.BoxId] == c.NewValue && oldRank > 0 && newRank > oldRank {
+			matches[c.BoxId] = alertMatch{
+				value:   float64(newRank),
+				summary: fmt.Sprintf("box %s tcp nat type degraded from %s to %s", c.BoxId, c.OldValue, c.NewValue),
+			}
+		}
+	}
+
+	return matches, nil
+}
+
+func (d *DataService) evaluateAlerts(ctx context.Context, pi *model.PaiNetInfo) {
+	if d.Alerter == nil {
+		return
+	}
+
+	changed, err := d.Alerter.Evaluate(ctx, pi.PaiUsername, time.Now())
+	if err != nil {
+		log.Errorf("evaluate alerts of %s: %v", pi.PaiUsername, err)
+		return
+	}
+
+	for _, alert := range changed {
+		log.Infof("alert %s %s: %s", alert.DedupKey, alert.Status, alert.Summary)
+
+		event := model.WebhookEventAlertFired
+		if alert.Status == model.AlertStatusResolved {
+			event = model.WebhookEventAlertResolved
+		}
+		d.emit(ctx, pi.PaiUsername, event, alert)
+		d.notifyAlert(ctx, pi.PaiUsername, alert)
+	}
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func newTestAlerter(t *testing.T, store *dao.MemoryStore, rules ...config.AlertRule) *Alerter {
+	t.Helper()
+
+	a, err := NewAlerter(dao.NewStores(store), config.AlertsConfig{Rules: rules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAlertMatchers(t *testing.T) {
+	store := dao.NewMemoryStore()
+	ctx := context.Background()
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.Local)
+
+	boxes := []*model.Box{
+		{Username: "u", BoxId: "offline-long", Online: "0"},
+		{Username: "u", BoxId: "offline-short", Online: "0"},
+		{Username: "u", BoxId: "online", Online: boxOnline},
+		{Username: "u", BoxId: "faulty", Online: boxOnline, Fault: "disk error"},
+		{Username: "u", BoxId: "full", Online: boxOnline, DiskUsage: 95},
+		{Username: "u", BoxId: "roomy", Online: boxOnline, DiskUsage: 60},
+		{Username: "u", BoxId: "lossy", Online: boxOnline},
+		{Username: "u", BoxId: "recovered", Online: boxOnline},
+		{Username: "u", BoxId: "nat-worse", Online: boxOnline, TcpNatType: "NAT4"},
+		{Username: "u", BoxId: "nat-better", Online: boxOnline, TcpNatType: "NAT1"},
+		{Username: "u", BoxId: "nat-changed-back", Online: boxOnline, TcpNatType: "NAT1"},
+		{Username: "u", BoxId: "dropped", Online: boxOnline},
+		{Username: "u", BoxId: "steady", Online: boxOnline},
+	}
+	if err := store.BulkUpsertBoxes(ctx, boxes); err != nil {
+		t.Fatal(err)
+	}
+
+	uptimes := []*model.BoxUptime{
+		{Username: "u", BoxId: "offline-long", Online: true, StartTime: model.Timestamp(now.Add(-5 * time.Hour).Unix())},
+		{Username: "u", BoxId: "offline-long", Online: false, StartTime: model.Timestamp(now.Add(-90 * time.Minute).Unix())},
+		{Username: "u", BoxId: "offline-short", Online: false, StartTime: model.Timestamp(now.Add(-30 * time.Minute).Unix())},
+		{Username: "u", BoxId: "online", Online: true, StartTime: model.Timestamp(now.Add(-5 * time.Hour).Unix())},
+	}
+	if err := store.BulkUpsertBoxUptimes(ctx, uptimes); err != nil {
+		t.Fatal(err)
+	}
+
+	hour := func(h int) model.Timestamp {
+		return model.Timestamp(dao.RollupBucket(dao.GranularityHour, now.Add(time.Duration(h)*time.Hour).Unix()))
+	}
+	rollups := []*model.BoxQualityRollup{
+		{Username: "u", BoxId: "lossy", Time: hour(-3), PacketLossAvg: 1},
+		{Username: "u", BoxId: "lossy", Time: hour(-2), PacketLossAvg: 10},
+		{Username: "u", BoxId: "recovered", Time: hour(-3), PacketLossAvg: 50},
+		{Username: "u", BoxId: "recovered", Time: hour(-2), PacketLossAvg: 1},
+	}
+	if err := store.BulkUpsertBoxQualityRollups(ctx, dao.GranularityHour, rollups); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := []*model.BoxChange{
+		{Username: "u", BoxId: "nat-worse", Field: "tcpNatType", OldValue: "NAT1", NewValue: "NAT4"},
+		{Username: "u", BoxId: "nat-better", Field: "tcpNatType", OldValue: "NAT4", NewValue: "NAT1"},
+		{Username: "u", BoxId: "nat-changed-back", Field: "tcpNatType", OldValue: "NAT1", NewValue: "NAT3"},
+	}
+	if err := store.AddBoxChanges(ctx, changes); err != nil {
+		t.Fatal(err)
+	}
+
+	// The boxes moved away keep their income history, which fills more than a page of incomes ahead of
+	// the oldest days of the listed boxes.
+	var incomes []*model.BoxIncome
+	addIncome := func(boxId string, daysAgo int, amount string) {
+		d, err := model.ParseDecimal(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		date := model.Date(now.AddDate(0, 0, -daysAgo).Format(time.DateOnly))
+		incomes = append(incomes, &model.BoxIncome{Username: "u", BoxId: boxId, Date: date, Amount: d})
+	}
+
+	for i := 0; i < 2*alertIncomePageSize/8; i++ {
+		for day := 1; day <= 8; day++ {
+			addIncome(fmt.Sprintf("moved-%04d", i), day, "1")
+		}
+	}
+
+	for day := 2; day <= 8; day++ {
+		addIncome("dropped", day, "10")
+		addIncome("steady", day, "10")
+	}
+	addIncome("dropped", 1, "2")
+	addIncome("steady", 1, "9")
+	addIncome("dropped", 0, "0")
+
+	if err := store.BulkUpsertBoxDayIncome(ctx, incomes); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		rule config.AlertRule
+		want map[string]float64
+	}{
+		{rule: config.AlertRule{Type: AlertRuleBoxOffline, Threshold: 60}, want: map[string]float64{"offline-long": 90}},
+		{rule: config.AlertRule{Type: AlertRuleBoxFault}, want: map[string]float64{"faulty": 0}},
+		{rule: config.AlertRule{Type: AlertRulePacketLoss, Threshold: 5}, want: map[string]float64{"lossy": 10}},
+		{rule: config.AlertRule{Type: AlertRuleDiskUsage, Threshold: 90}, want: map[string]float64{"full": 95}},
+		{rule: config.AlertRule{Type: AlertRuleIncomeDrop, Threshold: 50}, want: map[string]float64{"dropped": 80}},
+		{rule: config.AlertRule{Type: AlertRuleNatDegraded}, want: map[string]float64{"nat-worse": 4}},
+	}
+
+	a := newTestAlerter(t, store)
+	listed, err := a.allBoxes(ctx, "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		matches, err := a.matchers[c.rule.Type](ctx, c.rule, "u", listed, now)
+		if err != nil {
+			t.Fatalf("%s: %v", c.rule.Type, err)
+		}
+
+		got := make(map[string]float64)
+		for boxId, m := range matches {
+			got[boxId] = m.value
+			if m.summary == "" {
+				t.Errorf("%s: box %s matched without a summary", c.rule.Type, boxId)
+			}
+		}
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: matched %v, want %v", c.rule.Type, got, c.want)
+		}
+	}
+}
+
+func TestAlerterEvaluate(t *testing.T) {
+	store := dao.NewMemoryStore()
+	ctx := context.Background()
+	a := newTestAlerter(t, store,
+		config.AlertRule{Type: AlertRuleDiskUsage, Threshold: 90, Severity: "warning"},
+		config.AlertRule{Name: "fault", Type: AlertRuleBoxFault, Severity: "critical"},
+	)
+
+	setBox := func(diskUsage float64, fault string) {
+		box := &model.Box{Username: "u", BoxId: "b", SupplierBoxId: "s", Online: boxOnline, DiskUsage: diskUsage, Fault: fault}
+		if err := store.BulkUpsertBoxes(ctx, []*model.Box{box}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name      string
+		diskUsage float64
+		fault     string
+		// changed and firing list the alerts as dedup key and status.
+		changed []string
+		firing  []string
+	}{
+		{name: "fires", diskUsage: 95, changed: []string{"disk_usage/b firing"}, firing: []string{"disk_usage/b firing"}},
+		{name: "keeps firing", diskUsage: 96, firing: []string{"disk_usage/b firing"}},
+		{name: "fires another rule", diskUsage: 97, fault: "disk error", changed: []string{"fault/b firing"}, firing: []string{"disk_usage/b firing", "fault/b firing"}},
+		{name: "resolves", diskUsage: 50, fault: "disk error", changed: []string{"disk_usage/b resolved"}, firing: []string{"fault/b firing"}},
+		{name: "fires again", diskUsage: 91, changed: []string{"fault/b resolved", "disk_usage/b firing"}, firing: []string{"disk_usage/b firing"}},
+	}
+
+	statuses := func(alerts []*model.Alert) []string {
+		var out []string
+		for _, alert := range alerts {
+			out = append(out, alert.DedupKey+" "+alert.Status)
+		}
+		return out
+	}
+
+	for i, step := range steps {
+		setBox(step.diskUsage, step.fault)
+		now := start.Add(time.Duration(i) * time.Minute)
+
+		changed, err := a.Evaluate(ctx, "u", now)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if got := statuses(changed); !reflect.DeepEqual(got, step.changed) {
+			t.Errorf("%s: changed %v, want %v", step.name, got, step.changed)
+		}
+
+		for _, alert := range changed {
+			if alert.Status == model.AlertStatusResolved && (alert.ResolvedAt == nil || !alert.ResolvedAt.Equal(now)) {
+				t.Errorf("%s: %s resolved at %v, want %v", step.name, alert.DedupKey, alert.ResolvedAt, now)
+			}
+		}
+
+		firing, err := store.GetFiringAlerts(ctx, "u")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Slice(firing, func(i, j int) bool {
+			return firing[i].DedupKey < firing[j].DedupKey
+		})
+		if got := statuses(firing); !reflect.DeepEqual(got, step.firing) {
+			t.Errorf("%s: firing %v, want %v", step.name, got, step.firing)
+		}
+
+		for _, alert := range firing {
+			if alert.UpdatedAt != now || alert.SupplierBoxId != "s" {
+				t.Errorf("%s: %s updated at %v for %q, want %v for s", step.name, alert.DedupKey, alert.UpdatedAt, alert.SupplierBoxId, now)
+			}
+
+			if alert.DedupKey == "disk_usage/b" && alert.Value != step.diskUsage {
+				t.Errorf("%s: disk usage alert value %v, want %v", step.name, alert.Value, step.diskUsage)
+			}
+		}
+	}
+
+	// The alert which fired again is a new one, the resolved one is kept.
+	_, resolved, err := store.GetAlerts(ctx, "u", &dao.AlertFilter{Status: model.AlertStatusResolved, Rule: "disk_usage"}, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resolved) != 1 || !resolved[0].StartsAt.Equal(start) {
+		t.Errorf("resolved disk usage alerts %v, want the one started at %v", statuses(resolved), start)
+	}
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAPIKeyTTL         = 90 * 24 * time.Hour
+	defaultAPIKeyRotateGrace = 24 * time.Hour
+	defaultMaxAPIKeys        = 20
+
+	maxAPIKeyTTL         = 365 * 24 * time.Hour
+	maxAPIKeyRotateGrace = 30 * 24 * time.Hour
+
+	// apiKeyTouchInterval throttles the writes of the last use of a key, which is only recorded again once
+	// the interval passed or the client ip changed.
+	apiKeyTouchInterval = time.Minute
+
+	// apiKeyContextKey holds the key authenticating the request, which the scope checks read.
+	apiKeyContextKey = "API_KEY"
+)
+
+// ValidateAPIKeyScopes requires at least one of read, the groups of endpoints and their read-only variants
+// such as box:read.
+func ValidateAPIKeyScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("missing api key scopes")
+	}
+
+	for _, scope := range scopes {
+		if scope == model.APIKeyScopeRead {
+			continue
+		}
+
+		group := strings.TrimSuffix(scope, model.APIKeyScopeReadSuffix)
+
+		valid := false
+		for _, g := range model.APIKeyScopeGroups {
+			if g == group {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			return fmt.Errorf("invalid api key scope: %s", scope)
+		}
+	}
+
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashSecret returns the hex SHA-256 kept of the random secrets, such as the refresh tokens.
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+// SecretBox seals the secrets of the api keys with AES-256-GCM. They cannot be kept hashed like the passwords,
+// as the server needs them back to check the HMAC signatures of the requests, so the database along with the
+// passphrase of the box gives them all away.
+type SecretBox struct {
+	aead cipher.AEAD
+}
+
+// NewSecretBox derives the key of the box from the passphrase.
+func NewSecretBox(passphrase string) (*SecretBox, error) {
+	if passphrase == "" {
+		return nil, errors.New("missing api key encryption key")
+	}
+
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretBox{aead: aead}, nil
+}
+
+// Seal returns the base64 of a random nonce followed by the encrypted secret.
+func (b *SecretBox) Seal(secret string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(b.aead.Seal(nonce, nonce, []byte(secret), nil)), nil
+}
+
+func (b *SecretBox) Open(sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < b.aead.NonceSize() {
+		return "", errors.New("sealed secret too short")
+	}
+
+	nonce, ciphertext := data[:b.aead.NonceSize()], data[b.aead.NonceSize():]
+	secret, err := b.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// NewAPIKey returns a key of the user expiring after ttl along with its secret, which is kept sealed.
+func NewAPIKey(box *SecretBox, username, name string, scopes []string, ttl time.Duration) (*model.APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("missing api key name")
+	}
+
+	if err := ValidateAPIKeyScopes(scopes); err != nil {
+		return nil, "", err
+	}
+
+	appKey, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+	return &model.APIKey{
+		Id:        uuid.NewString(),
+		Username:  username,
+		Name:      name,
+		AppKey:    appKey,
+		Secret:    sealed,
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: &expiresAt,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, secret, nil
+}
+
+// RotateAPIKey gives the key a new secret and returns it, the replaced one stays valid for the grace period.
+func RotateAPIKey(box *SecretBox, key *model.APIKey, grace time.Duration, now time.Time) (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := box.Seal(secret)
+	if err != nil {
+		return "", err
+	}
+
+	previousExpiresAt := now.Add(grace)
+	key.PreviousSecret, key.PreviousExpiresAt = key.Secret, &previousExpiresAt
+	key.Secret = sealed
+	key.UpdatedAt = now
+	return secret, nil
+}
+
+// apiKeySecrets returns the secrets the requests of the key may be signed with: its current one, and the
+// one replaced by the last rotation until its grace period ends.
+func (s *Server) apiKeySecrets(key *model.APIKey, now time.Time) ([]string, error) {
+	secret, err := s.secrets.Open(key.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []string{secret}
+	if key.PreviousSecret != "" && key.PreviousExpiresAt != nil && now.Before(*key.PreviousExpiresAt) {
+		previous, err := s.secrets.Open(key.PreviousSecret)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, previous)
+	}
+
+	return out, nil
+}
+
+// ImportUserAppKeys moves the key pairs the users got at their registration to their api keys, named
+// default, so that they can be listed, rotated and revoked like the others. They keep calling every
+// group, as they did, and never expire until rotated or revoked. It returns how many pairs were moved.
+func (s *Server) ImportUserAppKeys(ctx context.Context) (int, error) {
+	users, err := s.users.GetUsersWithAppKey(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, user := range users {
+		// a pair imported by a run which stopped before clearing it is only cleared
+		_, err := s.apiKeys.GetAPIKeyByAppKey(ctx, user.AppKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			sealed, err := s.secrets.Seal(user.AppSecret)
+			if err != nil {
+				return count, err
+			}
+
+			now := time.Now()
+			err = s.apiKeys.CreateAPIKey(ctx, &model.APIKey{
+				Id:        uuid.NewString(),
+				Username:  user.Username,
+				Name:      "default",
+				AppKey:    user.AppKey,
+				Secret:    sealed,
+				Scopes:    strings.Join(model.APIKeyScopeGroups, ","),
+				CreatedAt: now,
+				UpdatedAt: now,
+			})
+			if err != nil {
+				return count, err
+			}
+		} else if err != nil {
+			return count, err
+		}
+
+		if err := s.users.ClearUserAppKey(ctx, user.Username); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// requireScope rejects the requests authenticated by a named key which is not scoped to the group, write
+// telling the endpoints changing the data from the ones reading it. Other requests are let through.
+func requireScope(group string, write bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if v, ok := c.Get(apiKeyContextKey); ok && !v.(*model.APIKey).Allows(group, write) {
+			keyUnauthorized(c, http.StatusForbidden, "app key out of scope")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func readScope(group string) gin.HandlerFunc {
+	return requireScope(group, false)
+}
+
+func writeScope(group string) gin.HandlerFunc {
+	return requireScope(group, true)
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedRequest returns a request signed with HMAC-SHA256 by the secret of the app key.
+func signedRequest(method, target, appKey, secret, nonce string, at time.Time) *http.Request {
+	body := []byte(`{}`)
+	r := httptest.NewRequest(method, target, bytes.NewReader(body))
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	r.Header.Set("ak", appKey)
+	r.Header.Set("timestamp", timestamp)
+	r.Header.Set("nonce", nonce)
+	r.Header.Set("sign", SignRequest(secret, r, timestamp, nonce, body))
+	return r
+}
+
+func TestAPIKeyAuthorization(t *testing.T) {
+	store := dao.NewMemoryStore()
+	s := NewServer(dao.NewStores(store))
+	ctx := context.Background()
+
+	var err error
+	if s.secrets, err = NewSecretBox("test encryption key"); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	g := r.Group("/", s.AuthorizationMiddlewareFunc())
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	g.GET("/box", readScope(model.APIKeyScopeBox), ok)
+	g.POST("/webhooks", writeScope(model.APIKeyScopeWebhook), ok)
+
+	newKey := func(scopes []string, ttl time.Duration) (*model.APIKey, string) {
+		key, secret, err := NewAPIKey(s.secrets, "u", "test", scopes, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.CreateAPIKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		return key, secret
+	}
+
+	active, activeSecret := newKey([]string{"box:read"}, time.Hour)
+	expired, expiredSecret := newKey([]string{"box"}, -time.Second)
+
+	revoked, revokedSecret := newKey([]string{"box"}, time.Hour)
+	revokedAt := time.Now()
+	revoked.RevokedAt = &revokedAt
+	if err := store.UpdateAPIKey(ctx, revoked); err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func(grace time.Duration) (*model.APIKey, string, string) {
+		key, old := newKey([]string{"box"}, time.Hour)
+		secret, err := RotateAPIKey(s.secrets, key, grace, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.UpdateAPIKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		return key, old, secret
+	}
+
+	rotated, rotatedOld, rotatedNew := rotate(0)
+	graced, gracedOld, gracedNew := rotate(time.Hour)
+
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		appKey string
+		secret string
+		want   int
+	}{
+		{name: "active key", method: http.MethodGet, path: "/box", appKey: active.AppKey, secret: activeSecret, want: http.StatusOK},
+		{name: "wrong secret", method: http.MethodGet, path: "/box", appKey: active.AppKey, secret: expiredSecret, want: http.StatusUnauthorized},
+		{name: "unknown key", method: http.MethodGet, path: "/box", appKey: "unknown", secret: activeSecret, want: http.StatusUnauthorized},
+		{name: "out of scope", method: http.MethodPost, path: "/webhooks", appKey: active.AppKey, secret: activeSecret, want: http.StatusForbidden},
+		{name: "expired key", method: http.MethodGet, path: "/box", appKey: expired.AppKey, secret: expiredSecret, want: http.StatusUnauthorized},
+		{name: "revoked key", method: http.MethodGet, path: "/box", appKey: revoked.AppKey, secret: revokedSecret, want: http.StatusUnauthorized},
+		{name: "rotated secret", method: http.MethodGet, path: "/box", appKey: rotated.AppKey, secret: rotatedOld, want: http.StatusUnauthorized},
+		{name: "new secret", method: http.MethodGet, path: "/box", appKey: rotated.AppKey, secret: rotatedNew, want: http.StatusOK},
+		{name: "rotated secret within the grace period", method: http.MethodGet, path: "/box", appKey: graced.AppKey, secret: gracedOld, want: http.StatusOK},
+		{name: "new secret within the grace period", method: http.MethodGet, path: "/box", appKey: graced.AppKey, secret: gracedNew, want: http.StatusOK},
+	}
+
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signedRequest(c.method, c.path, c.appKey, c.secret, strconv.Itoa(i), time.Now()))
+
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d, body %s", c.name, w.Code, c.want, w.Body)
+		}
+	}
+
+	// a request is only accepted once
+	now := time.Now()
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, signedRequest(http.MethodGet, "/box", active.AppKey, activeSecret, "replayed", now))
+
+		if w.Code != want || (want != http.StatusOK && !bytes.Contains(w.Body.Bytes(), []byte("signature already used"))) {
+			t.Errorf("request %d: status %d, body %s, want %d", i, w.Code, w.Body, want)
+		}
+	}
+}
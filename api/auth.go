@@ -0,0 +1,524 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"io"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultVerifyCodeTTL      = 10 * time.Minute
+	defaultVerifyCodeInterval = time.Minute
+	defaultMaxLoginFailures   = 5
+	defaultMaxIPLoginFailures = 20
+	defaultLoginFailureWindow = 15 * time.Minute
+	defaultLoginLockout       = 15 * time.Minute
+	defaultAuthTimeout        = 10 * time.Second
+	defaultAccessTokenTTL     = 15 * time.Minute
+	defaultRefreshTokenTTL    = 30 * 24 * time.Hour
+	defaultTOTPIssuer         = "Titan Box"
+
+	minPasswordLength = 8
+	// maxPasswordLength is the most bcrypt hashes.
+	maxPasswordLength = 72
+
+	verifyCodeDigits = 6
+	// maxVerifyCodeAttempts is the number of wrong codes which discard the code of a target.
+	maxVerifyCodeAttempts = 5
+	// maxIPVerifyCodes bounds the codes a client ip requests within verifyCodeIPWindow.
+	maxIPVerifyCodes   = 10
+	verifyCodeIPWindow = time.Hour
+
+	// maxAuthKeys bounds the codes, the challenges and the throttled keys remembered by the process.
+	maxAuthKeys = 100000
+)
+
+var (
+	errVerifyCodeFrequent = errors.New("verify code requested too frequently")
+	errTooManyVerifyCodes = errors.New("too many verify codes requested")
+	errNoVerifyCodeSender = errors.New("no sender of the verify codes")
+)
+
+// ValidatePassword requires minPasswordLength to maxPasswordLength bytes, with letters and digits, which
+// differ from the username.
+func ValidatePassword(password, username string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return fmt.Errorf("password must have %d to %d characters", minPasswordLength, maxPasswordLength)
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		letter = letter || unicode.IsLetter(r)
+		digit = digit || unicode.IsDigit(r)
+	}
+
+	if !letter || !digit {
+		return errors.New("password must have letters and digits")
+	}
+
+	if strings.EqualFold(password, username) {
+		return errors.New("password must differ from the username")
+	}
+
+	return nil
+}
+
+// VerifyCodeSender delivers the verification codes to a phone number or an email address.
+type VerifyCodeSender interface {
+	SendVerifyCode(ctx context.Context, target, code string) error
+}
+
+// CaptchaVerifier checks the captcha solved by a client.
+type CaptchaVerifier interface {
+	VerifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// isEmail tells the email addresses from the phone numbers among the targets of the codes.
+func isEmail(target string) bool {
+	return strings.Contains(target, "@")
+}
+
+func validVerifyTarget(target string) bool {
+	if isEmail(target) {
+		addr, err := mail.ParseAddress(target)
+		return err == nil && addr.Address == target
+	}
+
+	digits := strings.TrimPrefix(target, "+")
+	if len(digits) < 6 || len(digits) > 20 {
+		return false
+	}
+
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Auth keeps the verification codes and the login failures, in the memory of the process, and checks the
+// captcha. Its senders and verifier can be replaced by other implementations.
+type Auth struct {
+	cfg config.AuthConfig
+
+	// SMS and Email send the codes, a target is rejected when the sender of its kind is nil.
+	SMS   VerifyCodeSender
+	Email VerifyCodeSender
+	// Captcha checks the logins and the codes requested, it is not required when nil.
+	Captcha CaptchaVerifier
+
+	codes      *verifyCodes
+	codeIPs    *throttle
+	loginUsers *throttle
+	loginIPs   *throttle
+	challenges *mfaChallenges
+}
+
+func NewAuth(cfg config.AuthConfig, notify config.NotifyConfig) *Auth {
+	if cfg.VerifyCodeTTL <= 0 {
+		cfg.VerifyCodeTTL = defaultVerifyCodeTTL
+	}
+
+	if cfg.VerifyCodeInterval <= 0 {
+		cfg.VerifyCodeInterval = defaultVerifyCodeInterval
+	}
+
+	if cfg.MaxLoginFailures <= 0 {
+		cfg.MaxLoginFailures = defaultMaxLoginFailures
+	}
+
+	if cfg.MaxIPLoginFailures <= 0 {
+		cfg.MaxIPLoginFailures = defaultMaxIPLoginFailures
+	}
+
+	if cfg.LoginFailureWindow <= 0 {
+		cfg.LoginFailureWindow = defaultLoginFailureWindow
+	}
+
+	if cfg.LoginLockout <= 0 {
+		cfg.LoginLockout = defaultLoginLockout
+	}
+
+	if cfg.AccessTokenTTL <= 0 {
+		cfg.AccessTokenTTL = defaultAccessTokenTTL
+	}
+
+	if cfg.RefreshTokenTTL <= 0 {
+		cfg.RefreshTokenTTL = defaultRefreshTokenTTL
+	}
+
+	if cfg.TOTPIssuer == "" {
+		cfg.TOTPIssuer = defaultTOTPIssuer
+	}
+
+	timeout := notify.Timeout
+	if timeout <= 0 {
+		timeout = defaultAuthTimeout
+	}
+
+	a := &Auth{
+		cfg:        cfg,
+		codes:      &verifyCodes{codes: make(map[string]*verifyCode), keys: newAuthKeys(maxAuthKeys)},
+		codeIPs:    newThrottle(maxIPVerifyCodes, verifyCodeIPWindow, verifyCodeIPWindow),
+		loginUsers: newThrottle(cfg.MaxLoginFailures, cfg.LoginFailureWindow, cfg.LoginLockout),
+		loginIPs:   newThrottle(cfg.MaxIPLoginFailures, cfg.LoginFailureWindow, cfg.LoginLockout),
+		challenges: &mfaChallenges{challenges: make(map[string]*mfaChallenge), keys: newAuthKeys(maxAuthKeys)},
+	}
+
+	if cfg.SkipVerifyCode {
+		log.Warn("the verify codes of the registrations are not checked, Auth.SkipVerifyCode is meant for development only")
+	}
+
+	if cfg.SMSURL != "" {
+		a.SMS = &smsCodeSender{url: cfg.SMSURL, client: &http.Client{Timeout: timeout}}
+	}
+
+	if notify.SMTP.Host != "" {
+		a.Email = &emailCodeSender{notifier: &emailNotifier{cfg: notify.SMTP, timeout: timeout}}
+	}
+
+	if cfg.Captcha.VerifyURL != "" {
+		a.Captcha = &siteVerifyCaptcha{url: cfg.Captcha.VerifyURL, secret: cfg.Captcha.Secret, client: &http.Client{Timeout: timeout}}
+	}
+
+	return a
+}
+
+// SendVerifyCode sends a new code to the target, at most once per VerifyCodeInterval and maxIPVerifyCodes
+// times per verifyCodeIPWindow from a client ip.
+func (a *Auth) SendVerifyCode(ctx context.Context, target, ip string) error {
+	now := time.Now()
+	if a.codeIPs.locked(ip, now) > 0 {
+		return errTooManyVerifyCodes
+	}
+
+	sender := a.SMS
+	if isEmail(target) {
+		sender = a.Email
+	}
+
+	if sender == nil {
+		return errNoVerifyCodeSender
+	}
+
+	code, err := randomDigits(verifyCodeDigits)
+	if err != nil {
+		return err
+	}
+
+	if err := a.codes.add(target, code, now, a.cfg.VerifyCodeTTL, a.cfg.VerifyCodeInterval); err != nil {
+		return err
+	}
+	a.codeIPs.add(ip, now)
+
+	if err := sender.SendVerifyCode(ctx, target, code); err != nil {
+		a.codes.remove(target)
+		return err
+	}
+
+	return nil
+}
+
+// CheckVerifyCode consumes the code of the target when it matches.
+func (a *Auth) CheckVerifyCode(target, code string) bool {
+	return a.codes.check(target, code, time.Now())
+}
+
+// LoginLockout returns how long the logins of the username or from the ip are still locked out.
+func (a *Auth) LoginLockout(username, ip string) time.Duration {
+	now := time.Now()
+	return max(a.loginUsers.locked(username, now), a.loginIPs.locked(ip, now))
+}
+
+func (a *Auth) LoginFailed(username, ip string) {
+	now := time.Now()
+	a.loginUsers.add(username, now)
+	a.loginIPs.add(ip, now)
+}
+
+func (a *Auth) LoginSucceeded(username string) {
+	a.loginUsers.reset(username)
+}
+
+func randomDigits(n int) (string, error) {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(byte('0' + d.Int64()))
+	}
+	return b.String(), nil
+}
+
+type verifyCode struct {
+	code      string
+	sentAt    time.Time
+	expiresAt time.Time
+	attempts  int
+}
+
+// authKeys orders the keys of an auth cache from the least to the most recently used. A full cache forgets
+// its least recently used key rather than refuse the new ones, which a spray of made up usernames would
+// otherwise turn into a lockout of every user.
+type authKeys struct {
+	limit    int
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newAuthKeys(limit int) *authKeys {
+	return &authKeys{limit: limit, order: list.New(), elements: make(map[string]*list.Element)}
+}
+
+// touch marks the key as the most recently used, it returns the key to forget once the keys exceed the limit.
+func (k *authKeys) touch(key string) (string, bool) {
+	if e, ok := k.elements[key]; ok {
+		k.order.MoveToBack(e)
+		return "", false
+	}
+
+	k.elements[key] = k.order.PushBack(key)
+	if k.order.Len() <= k.limit {
+		return "", false
+	}
+
+	oldest := k.order.Front().Value.(string)
+	k.remove(oldest)
+	return oldest, true
+}
+
+func (k *authKeys) remove(key string) {
+	if e, ok := k.elements[key]; ok {
+		k.order.Remove(e)
+		delete(k.elements, key)
+	}
+}
+
+type verifyCodes struct {
+	lk    sync.Mutex
+	codes map[string]*verifyCode
+	keys  *authKeys
+}
+
+func (v *verifyCodes) add(target, code string, now time.Time, ttl, interval time.Duration) error {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	if c, ok := v.codes[target]; ok && now.Sub(c.sentAt) < interval {
+		return errVerifyCodeFrequent
+	}
+
+	v.codes[target] = &verifyCode{code: code, sentAt: now, expiresAt: now.Add(ttl)}
+	if oldest, ok := v.keys.touch(target); ok {
+		delete(v.codes, oldest)
+	}
+
+	return nil
+}
+
+func (v *verifyCodes) remove(target string) {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	v.delete(target)
+}
+
+func (v *verifyCodes) delete(target string) {
+	delete(v.codes, target)
+	v.keys.remove(target)
+}
+
+func (v *verifyCodes) check(target, code string, now time.Time) bool {
+	v.lk.Lock()
+	defer v.lk.Unlock()
+
+	c, ok := v.codes[target]
+	if !ok || !now.Before(c.expiresAt) || code == "" {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(c.code), []byte(code)) == 1 {
+		v.delete(target)
+		return true
+	}
+
+	c.attempts++
+	if c.attempts >= maxVerifyCodeAttempts {
+		v.delete(target)
+	}
+
+	return false
+}
+
+// throttle counts the events of the keys within a window, and locks a key out for the lockout once it
+// counts max of them. It remembers the maxAuthKeys most recently counted keys.
+type throttle struct {
+	lk      sync.Mutex
+	max     int
+	window  time.Duration
+	lockout time.Duration
+	keys    map[string]*throttleKey
+	order   *authKeys
+}
+
+type throttleKey struct {
+	count       int
+	start       time.Time
+	lockedUntil time.Time
+}
+
+func newThrottle(limit int, window, lockout time.Duration) *throttle {
+	return &throttle{max: limit, window: window, lockout: lockout, keys: make(map[string]*throttleKey), order: newAuthKeys(maxAuthKeys)}
+}
+
+// locked returns how long the key is still locked out.
+func (t *throttle) locked(key string, now time.Time) time.Duration {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	if k, ok := t.keys[key]; ok && now.Before(k.lockedUntil) {
+		return k.lockedUntil.Sub(now)
+	}
+
+	return 0
+}
+
+// add counts an event of the key.
+func (t *throttle) add(key string, now time.Time) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	k, ok := t.keys[key]
+	if !ok {
+		k = &throttleKey{start: now}
+		t.keys[key] = k
+	}
+
+	if oldest, ok := t.order.touch(key); ok {
+		delete(t.keys, oldest)
+	}
+
+	if now.Sub(k.start) >= t.window {
+		k.count, k.start = 0, now
+	}
+
+	k.count++
+	if k.count >= t.max {
+		k.count, k.start, k.lockedUntil = 0, now, now.Add(t.lockout)
+	}
+}
+
+func (t *throttle) reset(key string) {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+
+	delete(t.keys, key)
+	t.order.remove(key)
+}
+
+// smsCodeSender posts the codes to an SMS gateway.
+type smsCodeSender struct {
+	url    string
+	client *http.Client
+}
+
+func (s *smsCodeSender) SendVerifyCode(ctx context.Context, target, code string) error {
+	body, err := json.Marshal(map[string]string{"phoneNumber": target, "code": code})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// the errors leave out the url, which may hold the credentials of the gateway
+	response, err := s.client.Do(request)
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		reply, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", response.StatusCode, reply)
+	}
+
+	return nil
+}
+
+// emailCodeSender mails the codes with the SMTP server of the notifications.
+type emailCodeSender struct {
+	notifier *emailNotifier
+}
+
+func (s *emailCodeSender) SendVerifyCode(ctx context.Context, target, code string) error {
+	return s.notifier.Notify(ctx, &model.NotifyChannel{Target: target}, &Message{
+		Title: "Titan Box verification code",
+		Text:  fmt.Sprintf("Your verification code is %s, it expires in a few minutes.", code),
+	})
+}
+
+// siteVerifyCaptcha checks the captcha with the siteverify api shared by reCAPTCHA, hCaptcha and Turnstile.
+type siteVerifyCaptcha struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (s *siteVerifyCaptcha) VerifyCaptcha(ctx context.Context, token, remoteIP string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+
+	form := url.Values{"secret": {s.secret}, "response": {token}, "remoteip": {remoteIP}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	var out struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&out); err != nil {
+		return false, err
+	}
+
+	return out.Success, nil
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestThrottleForgetsLeastRecentlyCounted(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name   string
+		counts []string
+		locked map[string]bool
+	}{
+		{
+			name:   "a spray does not lock out new keys",
+			counts: []string{"s1", "s2", "s3", "s4", "s5", "user", "user"},
+			locked: map[string]bool{"user": true, "other": false},
+		},
+		{
+			name:   "the least recently counted key is forgotten",
+			counts: []string{"user", "user", "s1", "s2", "s3", "user"},
+			locked: map[string]bool{"user": false},
+		},
+		{
+			name:   "recently counted keys are kept",
+			counts: []string{"user", "s1", "s2", "user", "s3", "user"},
+			locked: map[string]bool{"user": true},
+		},
+	}
+
+	for _, c := range cases {
+		th := newThrottle(2, time.Minute, time.Minute)
+		th.order = newAuthKeys(3)
+
+		for _, key := range c.counts {
+			th.add(key, now)
+		}
+
+		if len(th.keys) > 3 {
+			t.Errorf("%s: %d keys remembered, want at most 3", c.name, len(th.keys))
+		}
+
+		for key, want := range c.locked {
+			if got := th.locked(key, now) > 0; got != want {
+				t.Errorf("%s: %s locked = %v, want %v", c.name, key, got, want)
+			}
+		}
+	}
+}
+
+func TestAuthCachesForgetOldest(t *testing.T) {
+	now := time.Now()
+
+	codes := &verifyCodes{codes: make(map[string]*verifyCode), keys: newAuthKeys(3)}
+	challenges := &mfaChallenges{challenges: make(map[string]*mfaChallenge), keys: newAuthKeys(3)}
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprint("k", i)
+		if err := codes.add(key, "123456", now, time.Minute, time.Minute); err != nil {
+			t.Fatalf("add code %d: %v", i, err)
+		}
+		challenges.add(key, "user", now)
+	}
+
+	for i := 0; i < 5; i++ {
+		key, want := fmt.Sprint("k", i), i >= 2
+		if got := codes.check(key, "123456", now); got != want {
+			t.Errorf("code of %s accepted = %v, want %v", key, got, want)
+		}
+
+		if _, got := challenges.get(key, now); got != want {
+			t.Errorf("challenge %s found = %v, want %v", key, got, want)
+		}
+	}
+
+	if len(codes.codes) != 0 || codes.keys.order.Len() != 0 {
+		t.Errorf("%d codes, %d keys left after their use, want none", len(codes.codes), codes.keys.order.Len())
+	}
+}
@@ -1,25 +1,28 @@
 package api
 
 import (
+	"database/sql"
 	"fmt"
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/gnasnik/titan-box-api/core/dao"
 	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
-func QueryBoxListGet(c *gin.Context) {
+func (s *Server) QueryBoxListGet(c *gin.Context) {
 	page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
 	pageSize, _ := strconv.ParseInt(c.Query("pageSize"), 10, 64)
 
 	ctx := c.Request.Context()
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
@@ -42,7 +45,19 @@ func QueryBoxListGet(c *gin.Context) {
 		pageSize = 10
 	}
 
-	total, boxes, err := dao.GetBoxesList(ctx, username, boxIds, supplierBoxIds, page, pageSize)
+	filter := &dao.BoxFilter{
+		BoxIds:         boxIds,
+		SupplierBoxIds: supplierBoxIds,
+		OrderField:     c.Query("orderField"),
+		Order:          c.Query("order"),
+	}
+
+	if filter.OrderField != "" && !dao.IsValidBoxOrderField(filter.OrderField) {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		return
+	}
+
+	total, boxes, err := s.boxes.GetBoxesList(ctx, username, filter, page, pageSize)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
 		log.Errorf("get box list: %v", err)
@@ -57,21 +72,43 @@ func QueryBoxListGet(c *gin.Context) {
 	c.JSON(http.StatusOK, &out)
 }
 
-func QueryBoxListPost(c *gin.Context) {
+// boxFilterParams are the box filters accepted in the body of the POST box queries.
+type boxFilterParams struct {
+	BoxIds         []string `json:"boxIds"`
+	SupplierBoxIds []string `json:"supplierBoxIds"`
+	Isp            []string `json:"isp"`
+	Province       []string `json:"province"`
+	ProcessStatus  []string `json:"processStatus"`
+	Online         []string `json:"online"`
+	Fuzzy          bool     `json:"fuzzy"`
+	Remarks        []string `json:"remarks"`
+	OrderField     string   `json:"orderField"`
+	Order          string   `json:"order"`
+}
+
+func (p *boxFilterParams) filter() *dao.BoxFilter {
+	return &dao.BoxFilter{
+		BoxIds:         p.BoxIds,
+		SupplierBoxIds: p.SupplierBoxIds,
+		Isp:            p.Isp,
+		Province:       p.Province,
+		ProcessStatus:  p.ProcessStatus,
+		Online:         p.Online,
+		Remarks:        p.Remarks,
+		Fuzzy:          p.Fuzzy,
+		OrderField:     p.OrderField,
+		Order:          p.Order,
+	}
+}
+
+func (s *Server) QueryBoxListPost(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
 	type QueryBoxListRequest struct {
-		Page           string   `json:"page"`
-		PageSize       string   `json:"pageSize"`
-		BoxIds         []string `json:"boxIds"`
-		SupplierBoxIds []string `json:"supplierBoxIds"`
-		Isp            []string `json:"isp"`
-		Province       []string `json:"province"`
-		ProcessStatus  []string `json:"processStatus"`
-		Online         []string `json:"online"`
-		Fuzzy          bool     `json:"fuzzy"`
-		Remarks        []string `json:"remarks"`
+		Page     string `json:"page"`
+		PageSize string `json:"pageSize"`
+		boxFilterParams
 	}
 
 	var requestParam QueryBoxListRequest
@@ -93,12 +130,19 @@ func QueryBoxListPost(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
 
-	total, boxes, err := dao.GetBoxesList(ctx, username, requestParam.BoxIds, requestParam.SupplierBoxIds, page, pageSize)
+	filter := requestParam.filter()
+
+	if filter.OrderField != "" && !dao.IsValidBoxOrderField(filter.OrderField) {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		return
+	}
+
+	total, boxes, err := s.boxes.GetBoxesList(ctx, username, filter, page, pageSize)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
 		log.Errorf("get box list: %v", err)
@@ -113,7 +157,117 @@ func QueryBoxListPost(c *gin.Context) {
 	c.JSON(http.StatusOK, &out)
 }
 
-func QueryBoxIncomeV2Get(c *gin.Context) {
+type GetBoxUptimeResponse struct {
+	Fleet *UptimeReport      `json:"fleet"`
+	Boxes []*BoxUptimeReport `json:"list"`
+	Total string             `json:"total"`
+}
+
+func (s *Server) QueryBoxUptimePost(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	type QueryBoxUptimeRequest struct {
+		Page     string `json:"page"`
+		PageSize string `json:"pageSize"`
+		Date     string `json:"date"`
+		boxFilterParams
+	}
+
+	var requestParam QueryBoxUptimeRequest
+	if err := c.BindJSON(&requestParam); err != nil {
+		c.JSON(http.StatusBadRequest, nil)
+		log.Errorf("get box uptime: %v", err)
+		return
+	}
+
+	page, _ := strconv.ParseInt(requestParam.Page, 10, 64)
+	pageSize, _ := strconv.ParseInt(requestParam.PageSize, 10, 64)
+
+	if page == 0 {
+		page = 1
+	}
+
+	if pageSize == 0 {
+		pageSize = 10
+	}
+
+	now := time.Now()
+	date := now
+	if requestParam.Date != "" {
+		d, err := time.ParseInLocation(time.DateOnly, requestParam.Date, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+			return
+		}
+		date = d
+	}
+
+	filter := requestParam.filter()
+	if filter.OrderField != "" && !dao.IsValidBoxOrderField(filter.OrderField) {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		return
+	}
+
+	ctx := c.Request.Context()
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	fleet, reports, total, err := s.boxUptimeReports(ctx, username, filter, newUptimePeriods(date, now), page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get box uptime: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, GetBoxUptimeResponse{
+		Fleet: fleet,
+		Boxes: reports,
+		Total: strconv.FormatInt(total, 10),
+	})
+}
+
+type GetBoxHistoryResponse struct {
+	Changes []*model.BoxChange `json:"list"`
+	Total   string             `json:"total"`
+}
+
+func (s *Server) QueryBoxHistoryGet(c *gin.Context) {
+	page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
+	pageSize, _ := strconv.ParseInt(c.Query("pageSize"), 10, 64)
+
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	if page == 0 {
+		page = 1
+	}
+
+	if pageSize == 0 {
+		pageSize = 10
+	}
+
+	total, changes, err := s.boxes.GetBoxHistory(ctx, username, c.Param("boxId"), page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get box history: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, GetBoxHistoryResponse{
+		Changes: changes,
+		Total:   strconv.Itoa(int(total)),
+	})
+}
+
+func (s *Server) QueryBoxIncomeV2Get(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
@@ -145,7 +299,7 @@ func QueryBoxIncomeV2Get(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
@@ -158,7 +312,7 @@ func QueryBoxIncomeV2Get(c *gin.Context) {
 		pageSize = 10
 	}
 
-	totalNum, total, boxIncome, err := dao.GetBoxIncomeV2(ctx, username, boxIds, remarks, supplierBoxIds, start, end, page, pageSize)
+	totalNum, total, boxIncome, err := s.incomes.GetBoxIncomeV2(ctx, username, boxIds, remarks, supplierBoxIds, start, end, page, pageSize)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
 		log.Errorf("get box list: %v", err)
@@ -167,14 +321,14 @@ func QueryBoxIncomeV2Get(c *gin.Context) {
 
 	out := GetBoxIncomeResponse{
 		BoxIncome: boxIncome,
-		Total:     strconv.Itoa(int(total)),
+		Total:     total.String(),
 		TotalNum:  strconv.Itoa(int(totalNum)),
 	}
 
 	c.JSON(http.StatusOK, &out)
 }
 
-func QueryBoxIncomeV2Post(c *gin.Context) {
+func (s *Server) QueryBoxIncomeV2Post(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
@@ -196,7 +350,7 @@ func QueryBoxIncomeV2Post(c *gin.Context) {
 	}
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
@@ -220,7 +374,7 @@ func QueryBoxIncomeV2Post(c *gin.Context) {
 		pageSize = 10
 	}
 
-	totalNum, total, boxIncome, err := dao.GetBoxIncomeV2(ctx, username, requestParam.BoxIds, requestParam.Remarks, requestParam.SupplierBoxIds, requestParam.Start, requestParam.End, page, pageSize)
+	totalNum, total, boxIncome, err := s.incomes.GetBoxIncomeV2(ctx, username, requestParam.BoxIds, requestParam.Remarks, requestParam.SupplierBoxIds, requestParam.Start, requestParam.End, page, pageSize)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
 		log.Errorf("get box list: %v", err)
@@ -229,20 +383,51 @@ func QueryBoxIncomeV2Post(c *gin.Context) {
 
 	out := GetBoxIncomeResponse{
 		BoxIncome: boxIncome,
-		Total:     strconv.Itoa(int(total)),
+		Total:     total.String(),
 		TotalNum:  strconv.Itoa(int(totalNum)),
 	}
 
 	c.JSON(http.StatusOK, &out)
 }
 
-func QueryBoxBandwidthGet(c *gin.Context) {
+func (s *Server) QueryBoxIncomeSummaryGet(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	var incomeType int64
+	if c.Query("incomeType") != "" {
+		var err error
+		incomeType, err = strconv.ParseInt(c.Query("incomeType"), 10, 64)
+		if err != nil || !dao.IsValidIncomeType(int(incomeType)) {
+			c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	summary, err := s.incomes.GetBoxIncomeSummary(ctx, username, int(incomeType), time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get box income summary: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, summary)
+}
+
+func (s *Server) QueryBoxBandwidthGet(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
 	date := c.Query("date")
 	startHour := c.Query("startHour")
 	endHour := c.Query("endHour")
+	granularity := c.DefaultQuery("granularity", dao.GranularityRaw)
 	boxIds := c.QueryArray("boxIds")
 	if boxIds == nil {
 		boxIds = c.QueryArray("boxIds[]")
@@ -253,7 +438,7 @@ func QueryBoxBandwidthGet(c *gin.Context) {
 		supplierBoxIds = c.QueryArray("supplierBoxIds[]")
 	}
 
-	if date == "" {
+	if date == "" || !dao.IsValidGranularity(granularity) {
 		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
 		return
 	}
@@ -268,46 +453,42 @@ func QueryBoxBandwidthGet(c *gin.Context) {
 		endStr = fmt.Sprintf("%s 23:59:59", date)
 	}
 
-	start, _ := time.Parse(time.DateTime, startStr)
-	end, _ := time.Parse(time.DateTime, endStr)
+	start, _ := time.ParseInLocation(time.DateTime, startStr, time.Local)
+	end, _ := time.ParseInLocation(time.DateTime, endStr, time.Local)
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
 
-	bandwidths, err := dao.GetBoxBandwidth(ctx, username, boxIds, supplierBoxIds, start.Unix(), end.Unix())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
-		log.Errorf("get box bandwidth: %v", err)
-		return
-	}
-
-	tempBoxIds := make(map[string]*BoxBandwidths)
-	for _, b := range bandwidths {
-		if _, existing := tempBoxIds[b.BoxId]; !existing {
-			tempBoxIds[b.BoxId] = &BoxBandwidths{
-				BoxId:         b.BoxId,
-				SupplierBoxId: b.SupplierBoxId,
-				Bandwidths:    make([]*model.BoxBandwidth, 0),
-			}
+	if granularity != dao.GranularityRaw {
+		rollups, err := s.metrics.GetBoxBandwidthRollups(ctx, granularity, username, boxIds, supplierBoxIds, start.Unix(), end.Unix())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+			log.Errorf("get box bandwidth rollups: %v", err)
+			return
 		}
 
-		tempBoxIds[b.BoxId].Bandwidths = append(tempBoxIds[b.BoxId].Bandwidths, b)
+		c.JSON(http.StatusOK, GetBoxBandwidthResponse{
+			BoxBandwidths: groupBoxBandwidths(nil, rollups),
+		})
+		return
 	}
 
-	var boxBandwidths []*BoxBandwidths
-	for _, b := range tempBoxIds {
-		boxBandwidths = append(boxBandwidths, b)
+	bandwidths, err := s.metrics.GetBoxBandwidth(ctx, username, boxIds, supplierBoxIds, start.Unix(), end.Unix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get box bandwidth: %v", err)
+		return
 	}
 
 	c.JSON(http.StatusOK, GetBoxBandwidthResponse{
-		BoxBandwidths: boxBandwidths,
+		BoxBandwidths: groupBoxBandwidths(bandwidths, nil),
 	})
 }
 
-func QueryBoxBandwidthPost(c *gin.Context) {
+func (s *Server) QueryBoxBandwidthPost(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
@@ -317,6 +498,7 @@ func QueryBoxBandwidthPost(c *gin.Context) {
 		Date           string   `json:"date"`
 		StartHour      string   `json:"startHour"`
 		EndHour        string   `json:"endHour"`
+		Granularity    string   `json:"granularity"`
 	}
 
 	var requestParam QueryBoxBandwidthRequest
@@ -331,7 +513,12 @@ func QueryBoxBandwidthPost(c *gin.Context) {
 		remarks = c.QueryArray("remarks[]")
 	}
 
-	if requestParam.Date == "" || requestParam.BoxId == nil {
+	granularity := requestParam.Granularity
+	if granularity == "" {
+		granularity = dao.GranularityRaw
+	}
+
+	if requestParam.Date == "" || requestParam.BoxId == nil || !dao.IsValidGranularity(granularity) {
 		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
 		return
 	}
@@ -346,52 +533,49 @@ func QueryBoxBandwidthPost(c *gin.Context) {
 		endStr = fmt.Sprintf("%s 23:59:59", requestParam.Date)
 	}
 
-	start, _ := time.Parse(time.DateTime, startStr)
-	end, _ := time.Parse(time.DateTime, endStr)
+	start, _ := time.ParseInLocation(time.DateTime, startStr, time.Local)
+	end, _ := time.ParseInLocation(time.DateTime, endStr, time.Local)
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
 
-	bandwidths, err := dao.GetBoxBandwidth(ctx, username, requestParam.BoxId, requestParam.SupplierBoxIds, start.Unix(), end.Unix())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
-		log.Errorf("get box bandwidth: %v", err)
-		return
-	}
-
-	tempBoxIds := make(map[string]*BoxBandwidths)
-	for _, b := range bandwidths {
-		if _, existing := tempBoxIds[b.BoxId]; !existing {
-			tempBoxIds[b.BoxId] = &BoxBandwidths{
-				BoxId:         b.BoxId,
-				SupplierBoxId: b.SupplierBoxId,
-				Bandwidths:    make([]*model.BoxBandwidth, 0),
-			}
+	if granularity != dao.GranularityRaw {
+		rollups, err := s.metrics.GetBoxBandwidthRollups(ctx, granularity, username, requestParam.BoxId, requestParam.SupplierBoxIds, start.Unix(), end.Unix())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+			log.Errorf("get box bandwidth rollups: %v", err)
+			return
 		}
 
-		tempBoxIds[b.BoxId].Bandwidths = append(tempBoxIds[b.BoxId].Bandwidths, b)
+		c.JSON(http.StatusOK, GetBoxBandwidthResponse{
+			BoxBandwidths: groupBoxBandwidths(nil, rollups),
+		})
+		return
 	}
 
-	var boxBandwidths []*BoxBandwidths
-	for _, b := range tempBoxIds {
-		boxBandwidths = append(boxBandwidths, b)
+	bandwidths, err := s.metrics.GetBoxBandwidth(ctx, username, requestParam.BoxId, requestParam.SupplierBoxIds, start.Unix(), end.Unix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get box bandwidth: %v", err)
+		return
 	}
 
 	c.JSON(http.StatusOK, GetBoxBandwidthResponse{
-		BoxBandwidths: boxBandwidths,
+		BoxBandwidths: groupBoxBandwidths(bandwidths, nil),
 	})
 }
 
-func QueryBoxQualityGet(c *gin.Context) {
+func (s *Server) QueryBoxQualityGet(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
 	date := c.Query("date")
 	startHour := c.Query("startHour")
 	endHour := c.Query("endHour")
+	granularity := c.DefaultQuery("granularity", dao.GranularityRaw)
 	boxIds := c.QueryArray("boxIds")
 	if boxIds == nil {
 		boxIds = c.QueryArray("boxIds[]")
@@ -402,7 +586,7 @@ func QueryBoxQualityGet(c *gin.Context) {
 		supplierBoxIds = c.QueryArray("supplierBoxIds[]")
 	}
 
-	if date == "" {
+	if date == "" || !dao.IsValidGranularity(granularity) {
 		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
 		return
 	}
@@ -417,46 +601,42 @@ func QueryBoxQualityGet(c *gin.Context) {
 		endStr = fmt.Sprintf("%s 23:59:59", date)
 	}
 
-	start, _ := time.Parse(time.DateTime, startStr)
-	end, _ := time.Parse(time.DateTime, endStr)
+	start, _ := time.ParseInLocation(time.DateTime, startStr, time.Local)
+	end, _ := time.ParseInLocation(time.DateTime, endStr, time.Local)
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
 
-	qualities, err := dao.GetBoxQualities(ctx, username, boxIds, supplierBoxIds, start.Unix(), end.Unix())
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
-		log.Errorf("get box qualities: %v", err)
-		return
-	}
-
-	tempBoxIds := make(map[string]*BoxQualities)
-	for _, b := range qualities {
-		if _, existing := tempBoxIds[b.BoxId]; !existing {
-			tempBoxIds[b.BoxId] = &BoxQualities{
-				BoxId:         b.BoxId,
-				SupplierBoxId: b.SupplierBoxId,
-				Qualities:     make([]*model.BoxQuality, 0),
-			}
+	if granularity != dao.GranularityRaw {
+		rollups, err := s.metrics.GetBoxQualityRollups(ctx, granularity, username, boxIds, supplierBoxIds, start.Unix(), end.Unix())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+			log.Errorf("get box quality rollups: %v", err)
+			return
 		}
 
-		tempBoxIds[b.BoxId].Qualities = append(tempBoxIds[b.BoxId].Qualities, b)
+		c.JSON(http.StatusOK, GetBoxQualitiesResponse{
+			BoxQualities: groupBoxQualities(nil, rollups),
+		})
+		return
 	}
 
-	var boxQualities []*BoxQualities
-	for _, b := range tempBoxIds {
-		boxQualities = append(boxQualities, b)
+	qualities, err := s.metrics.GetBoxQualities(ctx, username, boxIds, supplierBoxIds, start.Unix(), end.Unix())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get box qualities: %v", err)
+		return
 	}
 
 	c.JSON(http.StatusOK, GetBoxQualitiesResponse{
-		BoxQualities: boxQualities,
+		BoxQualities: groupBoxQualities(qualities, nil),
 	})
 }
 
-func QueryBoxQualityPost(c *gin.Context) {
+func (s *Server) QueryBoxQualityPost(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
 
@@ -466,6 +646,7 @@ func QueryBoxQualityPost(c *gin.Context) {
 		Date           string   `json:"date"`
 		StartHour      string   `json:"startHour"`
 		EndHour        string   `json:"endHour"`
+		Granularity    string   `json:"granularity"`
 	}
 
 	var requestParam QueryBoxBandwidthRequest
@@ -475,7 +656,12 @@ func QueryBoxQualityPost(c *gin.Context) {
 		return
 	}
 
-	if requestParam.Date == "" || requestParam.BoxId == nil {
+	granularity := requestParam.Granularity
+	if granularity == "" {
+		granularity = dao.GranularityRaw
+	}
+
+	if requestParam.Date == "" || requestParam.BoxId == nil || !dao.IsValidGranularity(granularity) {
 		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
 		return
 	}
@@ -490,41 +676,765 @@ func QueryBoxQualityPost(c *gin.Context) {
 		endStr = fmt.Sprintf("%s 23:59:59", requestParam.Date)
 	}
 
-	start, _ := time.Parse(time.DateTime, startStr)
-	end, _ := time.Parse(time.DateTime, endStr)
+	start, _ := time.ParseInLocation(time.DateTime, startStr, time.Local)
+	end, _ := time.ParseInLocation(time.DateTime, endStr, time.Local)
 
 	ctx := c.Request.Context()
-	pi, err := dao.GetPaiNetInfoByUsername(ctx, username)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
 	if err == nil {
 		username = pi.PaiUsername
 	}
 
-	qualities, err := dao.GetBoxQualities(ctx, username, requestParam.BoxId, requestParam.SupplierBoxIds, start.Unix(), end.Unix())
+	if granularity != dao.GranularityRaw {
+		rollups, err := s.metrics.GetBoxQualityRollups(ctx, granularity, username, requestParam.BoxId, requestParam.SupplierBoxIds, start.Unix(), end.Unix())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+			log.Errorf("get box quality rollups: %v", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, GetBoxQualitiesResponse{
+			BoxQualities: groupBoxQualities(nil, rollups),
+		})
+		return
+	}
+
+	qualities, err := s.metrics.GetBoxQualities(ctx, username, requestParam.BoxId, requestParam.SupplierBoxIds, start.Unix(), end.Unix())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
 		log.Errorf("get box qualities: %v", err)
 		return
 	}
 
-	tempBoxIds := make(map[string]*BoxQualities)
-	for _, b := range qualities {
-		if _, existing := tempBoxIds[b.BoxId]; !existing {
-			tempBoxIds[b.BoxId] = &BoxQualities{
-				BoxId:         b.BoxId,
-				SupplierBoxId: b.SupplierBoxId,
+	c.JSON(http.StatusOK, GetBoxQualitiesResponse{
+		BoxQualities: groupBoxQualities(qualities, nil),
+	})
+}
+
+// groupBoxBandwidths groups the bandwidth points, or the rollups, by box.
+func groupBoxBandwidths(bandwidths []*model.BoxBandwidth, rollups []*model.BoxBandwidthRollup) []*BoxBandwidths {
+	var out []*BoxBandwidths
+	boxes := make(map[string]*BoxBandwidths)
+	group := func(boxId, supplierBoxId string) *BoxBandwidths {
+		if _, existing := boxes[boxId]; !existing {
+			boxes[boxId] = &BoxBandwidths{
+				BoxId:         boxId,
+				SupplierBoxId: supplierBoxId,
+				Bandwidths:    make([]*model.BoxBandwidth, 0),
+			}
+			out = append(out, boxes[boxId])
+		}
+		return boxes[boxId]
+	}
+
+	for _, b := range bandwidths {
+		g := group(b.BoxId, b.SupplierBoxId)
+		g.Bandwidths = append(g.Bandwidths, b)
+	}
+
+	for _, r := range rollups {
+		g := group(r.BoxId, r.SupplierBoxId)
+		g.Rollups = append(g.Rollups, r)
+	}
+
+	return out
+}
+
+// groupBoxQualities groups the quality points, or the rollups, by box.
+func groupBoxQualities(qualities []*model.BoxQuality, rollups []*model.BoxQualityRollup) []*BoxQualities {
+	var out []*BoxQualities
+	boxes := make(map[string]*BoxQualities)
+	group := func(boxId, supplierBoxId string) *BoxQualities {
+		if _, existing := boxes[boxId]; !existing {
+			boxes[boxId] = &BoxQualities{
+				BoxId:         boxId,
+				SupplierBoxId: supplierBoxId,
 				Qualities:     make([]*model.BoxQuality, 0),
 			}
+			out = append(out, boxes[boxId])
 		}
+		return boxes[boxId]
+	}
 
-		tempBoxIds[b.BoxId].Qualities = append(tempBoxIds[b.BoxId].Qualities, b)
+	for _, q := range qualities {
+		g := group(q.BoxId, q.SupplierBoxId)
+		g.Qualities = append(g.Qualities, q)
 	}
 
-	var boxQualities []*BoxQualities
-	for _, b := range tempBoxIds {
-		boxQualities = append(boxQualities, b)
+	for _, r := range rollups {
+		g := group(r.BoxId, r.SupplierBoxId)
+		g.Rollups = append(g.Rollups, r)
 	}
 
-	c.JSON(http.StatusOK, GetBoxQualitiesResponse{
-		BoxQualities: boxQualities,
+	return out
+}
+
+type GetAlertsResponse struct {
+	Alerts []*model.Alert `json:"list"`
+	Total  string         `json:"total"`
+}
+
+func (s *Server) QueryAlertsGet(c *gin.Context) {
+	page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
+	pageSize, _ := strconv.ParseInt(c.Query("pageSize"), 10, 64)
+
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	boxIds := c.QueryArray("boxIds")
+	if boxIds == nil {
+		boxIds = c.QueryArray("boxIds[]")
+	}
+
+	filter := &dao.AlertFilter{
+		Status: c.Query("status"),
+		Rule:   c.Query("rule"),
+		BoxIds: boxIds,
+	}
+
+	if filter.Status != "" && filter.Status != model.AlertStatusFiring && filter.Status != model.AlertStatusResolved {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		return
+	}
+
+	if page <= 0 {
+		page = 1
+	}
+
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+
+	total, alerts, err := s.alerts.GetAlerts(ctx, username, filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get alerts: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, GetAlertsResponse{
+		Alerts: alerts,
+		Total:  strconv.Itoa(int(total)),
 	})
 }
+
+// webhookEndpointResponse lists the events of the endpoint, its secret is only returned on creation.
+type webhookEndpointResponse struct {
+	*model.WebhookEndpoint
+	Events []string `json:"events"`
+}
+
+func newWebhookEndpointResponse(e *model.WebhookEndpoint) *webhookEndpointResponse {
+	events := make([]string, 0)
+	if e.Events != "" {
+		events = strings.Split(e.Events, ",")
+	}
+	return &webhookEndpointResponse{WebhookEndpoint: e, Events: events}
+}
+
+type GetWebhooksResponse struct {
+	Endpoints []*webhookEndpointResponse `json:"list"`
+	Total     string                     `json:"total"`
+}
+
+func (s *Server) QueryWebhooksGet(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	endpoints, err := s.webhooks.GetWebhookEndpoints(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get webhook endpoints: %v", err)
+		return
+	}
+
+	out := GetWebhooksResponse{
+		Endpoints: make([]*webhookEndpointResponse, 0, len(endpoints)),
+		Total:     strconv.Itoa(len(endpoints)),
+	}
+	for _, e := range endpoints {
+		e.Secret = ""
+		out.Endpoints = append(out.Endpoints, newWebhookEndpointResponse(e))
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (s *Server) CreateWebhookPost(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	type CreateWebhookRequest struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+
+	var requestParam CreateWebhookRequest
+	if err := c.BindJSON(&requestParam); err != nil {
+		c.JSON(http.StatusBadRequest, nil)
+		log.Errorf("create webhook: %v", err)
+		return
+	}
+
+	endpoint, err := NewWebhookEndpoint(ctx, username, requestParam.URL, requestParam.Events, requestParam.Secret, s.allowPrivateWebhooks)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		log.Errorf("create webhook: %v", err)
+		return
+	}
+
+	if err := s.webhooks.CreateWebhookEndpoint(ctx, endpoint); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("create webhook: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newWebhookEndpointResponse(endpoint))
+}
+
+func (s *Server) DeleteWebhook(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	err = s.webhooks.DeleteWebhookEndpoint(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("delete webhook: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
+type GetWebhookDeliveriesResponse struct {
+	Deliveries []*model.WebhookDelivery `json:"list"`
+	Total      string                   `json:"total"`
+}
+
+func (s *Server) QueryWebhookDeliveriesGet(c *gin.Context) {
+	page, _ := strconv.ParseInt(c.Query("page"), 10, 64)
+	pageSize, _ := strconv.ParseInt(c.Query("pageSize"), 10, 64)
+
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	filter := &dao.WebhookDeliveryFilter{
+		EndpointId: c.Query("endpointId"),
+		Event:      c.Query("event"),
+		Status:     c.Query("status"),
+	}
+
+	if filter.Status != "" && filter.Status != model.WebhookDeliveryPending && filter.Status != model.WebhookDeliveryDelivered && filter.Status != model.WebhookDeliveryFailed {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		return
+	}
+
+	if page <= 0 {
+		page = 1
+	}
+
+	if pageSize <= 0 {
+		pageSize = 10
+	}
+
+	total, deliveries, err := s.webhooks.GetWebhookDeliveries(ctx, username, filter, page, pageSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get webhook deliveries: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, GetWebhookDeliveriesResponse{
+		Deliveries: deliveries,
+		Total:      strconv.Itoa(int(total)),
+	})
+}
+
+// RedeliverWebhookPost queues the payload of a delivery again, it is sent on the next poll of the outbox.
+func (s *Server) RedeliverWebhookPost(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	delivery, err := s.webhooks.GetWebhookDelivery(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get webhook delivery: %v", err)
+		return
+	}
+
+	redelivery := Redelivery(delivery, time.Now())
+	if err := s.webhooks.AddWebhookDeliveries(ctx, []*model.WebhookDelivery{redelivery}); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("redeliver webhook: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, redelivery)
+}
+
+// notifyChannelResponse lists the severities routed to the channel, its secret is never returned.
+type notifyChannelResponse struct {
+	*model.NotifyChannel
+	Severities []string `json:"severities"`
+}
+
+func newNotifyChannelResponse(c *model.NotifyChannel) *notifyChannelResponse {
+	severities := make([]string, 0)
+	if c.Severities != "" {
+		severities = strings.Split(c.Severities, ",")
+	}
+	return &notifyChannelResponse{NotifyChannel: c, Severities: severities}
+}
+
+type GetNotifyChannelsResponse struct {
+	Channels []*notifyChannelResponse `json:"list"`
+	Total    string                   `json:"total"`
+}
+
+type notifyChannelRequest struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Target     string   `json:"target"`
+	Secret     string   `json:"secret"`
+	Severities []string `json:"severities"`
+	Template   string   `json:"template"`
+	QuietStart string   `json:"quietStart"`
+	QuietEnd   string   `json:"quietEnd"`
+}
+
+func (r *notifyChannelRequest) apply(c *model.NotifyChannel) {
+	c.Name, c.Type, c.Target = r.Name, r.Type, r.Target
+	c.Severities = strings.Join(r.Severities, ",")
+	c.Template, c.QuietStart, c.QuietEnd = r.Template, r.QuietStart, r.QuietEnd
+	c.UpdatedAt = time.Now()
+
+	// an empty secret keeps the one of the channel
+	if r.Secret != "" {
+		c.Secret = r.Secret
+	}
+}
+
+func (s *Server) QueryNotifyChannelsGet(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	channels, err := s.channels.GetNotifyChannels(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get notify channels: %v", err)
+		return
+	}
+
+	out := GetNotifyChannelsResponse{
+		Channels: make([]*notifyChannelResponse, 0, len(channels)),
+		Total:    strconv.Itoa(len(channels)),
+	}
+	for _, ch := range channels {
+		out.Channels = append(out.Channels, newNotifyChannelResponse(ch))
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+func (s *Server) CreateNotifyChannelPost(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	var requestParam notifyChannelRequest
+	if err := c.BindJSON(&requestParam); err != nil {
+		c.JSON(http.StatusBadRequest, nil)
+		log.Errorf("create notify channel: %v", err)
+		return
+	}
+
+	channel := &model.NotifyChannel{
+		Id:        uuid.NewString(),
+		Username:  username,
+		CreatedAt: time.Now(),
+	}
+	requestParam.apply(channel)
+
+	if err := ValidateNotifyChannel(channel); err != nil {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		log.Errorf("create notify channel: %v", err)
+		return
+	}
+
+	if err := s.channels.CreateNotifyChannel(ctx, channel); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("create notify channel: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newNotifyChannelResponse(channel))
+}
+
+func (s *Server) UpdateNotifyChannelPut(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	var requestParam notifyChannelRequest
+	if err := c.BindJSON(&requestParam); err != nil {
+		c.JSON(http.StatusBadRequest, nil)
+		log.Errorf("update notify channel: %v", err)
+		return
+	}
+
+	channel, err := s.channels.GetNotifyChannel(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get notify channel: %v", err)
+		return
+	}
+
+	requestParam.apply(channel)
+
+	if err := ValidateNotifyChannel(channel); err != nil {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		log.Errorf("update notify channel: %v", err)
+		return
+	}
+
+	if err := s.channels.UpdateNotifyChannel(ctx, channel); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("update notify channel: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newNotifyChannelResponse(channel))
+}
+
+func (s *Server) DeleteNotifyChannel(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	err = s.channels.DeleteNotifyChannel(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("delete notify channel: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
+// TestNotifyChannelPost sends a sample alert through the channel, ignoring its routing and quiet hours.
+func (s *Server) TestNotifyChannelPost(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	pi, err := s.users.GetPaiNetInfoByUsername(ctx, username)
+	if err == nil {
+		username = pi.PaiUsername
+	}
+
+	channel, err := s.channels.GetNotifyChannel(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get notify channel: %v", err)
+		return
+	}
+
+	alert := &AlertNotification{
+		Alert: &model.Alert{
+			DedupKey: "test",
+			Rule:     "test",
+			Severity: AlertSeverityCritical,
+			Status:   model.AlertStatusFiring,
+			Summary:  "test notification of channel " + channel.Name,
+			StartsAt: time.Now(),
+		},
+		Kind: AlertKindBox,
+	}
+
+	if err := s.notifications.Send(ctx, channel, alert); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		log.Errorf("test notify channel %s: %v", channel.Id, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, nil)
+}
+
+// apiKeyResponse lists the scopes and the status of the key, its secret is only set when created or rotated.
+type apiKeyResponse struct {
+	*model.APIKey
+	Scopes []string `json:"scopes"`
+	Status string   `json:"status"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+func newAPIKeyResponse(k *model.APIKey, secret string) *apiKeyResponse {
+	scopes := make([]string, 0)
+	if k.Scopes != "" {
+		scopes = strings.Split(k.Scopes, ",")
+	}
+	return &apiKeyResponse{APIKey: k, Scopes: scopes, Status: k.Status(time.Now()), Secret: secret}
+}
+
+type GetAPIKeysResponse struct {
+	Keys  []*apiKeyResponse `json:"list"`
+	Total string            `json:"total"`
+}
+
+// QueryAPIKeysGet lists the keys of the user of the api, rather than of its PaiNet account, as they authenticate it.
+func (s *Server) QueryAPIKeysGet(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	keys, err := s.apiKeys.GetAPIKeys(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get api keys: %v", err)
+		return
+	}
+
+	out := GetAPIKeysResponse{
+		Keys:  make([]*apiKeyResponse, 0, len(keys)),
+		Total: strconv.Itoa(len(keys)),
+	}
+	for _, k := range keys {
+		out.Keys = append(out.Keys, newAPIKeyResponse(k, ""))
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// CreateAPIKeyPost returns the new key along with its secret, which cannot be read again.
+func (s *Server) CreateAPIKeyPost(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	type CreateAPIKeyRequest struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		// ExpiresIn is the lifetime of the key, such as 720h, the configured one when empty.
+		ExpiresIn string `json:"expiresIn"`
+	}
+
+	var requestParam CreateAPIKeyRequest
+	if err := c.BindJSON(&requestParam); err != nil {
+		c.JSON(http.StatusBadRequest, nil)
+		log.Errorf("create api key: %v", err)
+		return
+	}
+
+	ttl := s.apiKeyTTL
+	if requestParam.ExpiresIn != "" {
+		d, err := time.ParseDuration(requestParam.ExpiresIn)
+		if err != nil || d <= 0 || d > maxAPIKeyTTL {
+			c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+			return
+		}
+		ttl = d
+	}
+
+	keys, err := s.apiKeys.GetAPIKeys(ctx, username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get api keys: %v", err)
+		return
+	}
+
+	var active int
+	for _, k := range keys {
+		if k.Status(time.Now()) == model.APIKeyStatusActive {
+			active++
+		}
+	}
+
+	if active >= s.maxAPIKeys {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		log.Errorf("create api key: %s has %d active keys", username, active)
+		return
+	}
+
+	key, secret, err := NewAPIKey(s.secrets, username, requestParam.Name, requestParam.Scopes, ttl)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		log.Errorf("create api key: %v", err)
+		return
+	}
+
+	if err := s.apiKeys.CreateAPIKey(ctx, key); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("create api key: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newAPIKeyResponse(key, secret))
+}
+
+// RotateAPIKeyPost returns a new secret of the key, the replaced one is accepted until the grace period ends.
+func (s *Server) RotateAPIKeyPost(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	type RotateAPIKeyRequest struct {
+		// GracePeriod, such as 1h, is the configured one when empty and 0s revokes the replaced secret at once.
+		GracePeriod string `json:"gracePeriod"`
+	}
+
+	var requestParam RotateAPIKeyRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&requestParam); err != nil {
+			c.JSON(http.StatusBadRequest, nil)
+			log.Errorf("rotate api key: %v", err)
+			return
+		}
+	}
+
+	grace := s.rotateGrace
+	if requestParam.GracePeriod != "" {
+		d, err := time.ParseDuration(requestParam.GracePeriod)
+		if err != nil || d < 0 || d > maxAPIKeyRotateGrace {
+			c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+			return
+		}
+		grace = d
+	}
+
+	key, err := s.apiKeys.GetAPIKey(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get api key: %v", err)
+		return
+	}
+
+	now := time.Now()
+	if key.Status(now) != model.APIKeyStatusActive {
+		c.JSON(http.StatusBadRequest, errors.New("BadRequest"))
+		return
+	}
+
+	secret, err := RotateAPIKey(s.secrets, key, grace, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("rotate api key: %v", err)
+		return
+	}
+
+	if err := s.apiKeys.UpdateAPIKey(ctx, key); err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("rotate api key: %v", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, newAPIKeyResponse(key, secret))
+}
+
+// RevokeAPIKey rejects the key from now on, it is still listed with its last use.
+func (s *Server) RevokeAPIKey(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	key, err := s.apiKeys.GetAPIKey(ctx, username, c.Param("id"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, errors.New("NotFound"))
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+		log.Errorf("get api key: %v", err)
+		return
+	}
+
+	if key.RevokedAt == nil {
+		now := time.Now()
+		key.RevokedAt, key.UpdatedAt = &now, now
+
+		if err := s.apiKeys.UpdateAPIKey(ctx, key); err != nil {
+			c.JSON(http.StatusInternalServerError, errors.New("InternalServerError"))
+			log.Errorf("revoke api key: %v", err)
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, newAPIKeyResponse(key, ""))
+}
@@ -0,0 +1,161 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	jwt "github.com/appleboy/gin-jwt/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withLocal runs the test in the zone, the rollups following the local days and hours.
+func withLocal(t *testing.T, loc *time.Location) {
+	local := time.Local
+	time.Local = loc
+	t.Cleanup(func() { time.Local = local })
+}
+
+// request calls the handler as the user, with the query string of a GET or the JSON body of a POST.
+func request(t *testing.T, handler gin.HandlerFunc, username, method, query string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(method, "/?"+query, bytes.NewReader(b))
+	c.Request.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{identityKey: username})
+	}
+
+	handler(c)
+	return w
+}
+
+// serve calls the handler like request and decodes its successful response into out.
+func serve(t *testing.T, handler gin.HandlerFunc, username, method, query string, body interface{}, out interface{}) {
+	t.Helper()
+
+	w := request(t, handler, username, method, query, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d, body %s", method, query, w.Code, w.Body)
+	}
+
+	if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSeriesQueriesFollowLocalDays(t *testing.T) {
+	withLocal(t, time.FixedZone("UTC+8", 8*3600))
+
+	store := dao.NewMemoryStore()
+	s := NewServer(dao.NewStores(store))
+	ctx := context.Background()
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	var (
+		bwRollups = map[string][]*model.BoxBandwidthRollup{}
+		qRollups  = map[string][]*model.BoxQualityRollup{}
+	)
+
+	add := func(granularity string, at time.Time) {
+		bucket := model.Timestamp(dao.RollupBucket(granularity, at.Unix()))
+		bwRollups[granularity] = append(bwRollups[granularity], &model.BoxBandwidthRollup{Username: "u", BoxId: "b", SupplierBoxId: "s", Time: bucket, Samples: 1})
+		qRollups[granularity] = append(qRollups[granularity], &model.BoxQualityRollup{Username: "u", BoxId: "b", SupplierBoxId: "s", Time: bucket, Samples: 1})
+	}
+
+	for d := -1; d <= 1; d++ {
+		add(dao.GranularityDay, day.AddDate(0, 0, d))
+	}
+
+	for h := 0; h < 24; h++ {
+		add(dao.GranularityHour, day.Add(time.Duration(h)*time.Hour))
+	}
+
+	for _, granularity := range dao.RollupGranularities {
+		if err := store.BulkUpsertBoxBandwidthRollups(ctx, granularity, bwRollups[granularity]); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := store.BulkUpsertBoxQualityRollups(ctx, granularity, qRollups[granularity]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hour := func(h int) model.Timestamp {
+		return model.Timestamp(day.Add(time.Duration(h) * time.Hour).Unix())
+	}
+
+	cases := []struct {
+		name        string
+		granularity string
+		startHour   string
+		endHour     string
+		want        []model.Timestamp
+	}{
+		{name: "a single day", granularity: dao.GranularityDay, want: []model.Timestamp{hour(0)}},
+		{name: "local hours", granularity: dao.GranularityHour, startHour: "09", endHour: "10", want: []model.Timestamp{hour(9), hour(10)}},
+	}
+
+	for _, c := range cases {
+		query := "date=2024-05-01&boxIds=b&granularity=" + c.granularity + "&startHour=" + c.startHour + "&endHour=" + c.endHour
+		body := map[string]interface{}{
+			"boxId": []string{"b"}, "date": "2024-05-01", "granularity": c.granularity, "startHour": c.startHour, "endHour": c.endHour,
+		}
+
+		bandwidth := func(handler gin.HandlerFunc, method string, body interface{}) []model.Timestamp {
+			var resp GetBoxBandwidthResponse
+			serve(t, handler, "u", method, query, body, &resp)
+
+			var times []model.Timestamp
+			for _, b := range resp.BoxBandwidths {
+				for _, r := range b.Rollups {
+					times = append(times, r.Time)
+				}
+			}
+			return times
+		}
+
+		quality := func(handler gin.HandlerFunc, method string, body interface{}) []model.Timestamp {
+			var resp GetBoxQualitiesResponse
+			serve(t, handler, "u", method, query, body, &resp)
+
+			var times []model.Timestamp
+			for _, q := range resp.BoxQualities {
+				for _, r := range q.Rollups {
+					times = append(times, r.Time)
+				}
+			}
+			return times
+		}
+
+		got := map[string][]model.Timestamp{
+			"bandwidth get":  bandwidth(s.QueryBoxBandwidthGet, http.MethodGet, nil),
+			"bandwidth post": bandwidth(s.QueryBoxBandwidthPost, http.MethodPost, body),
+			"quality get":    quality(s.QueryBoxQualityGet, http.MethodGet, nil),
+			"quality post":   quality(s.QueryBoxQualityPost, http.MethodPost, body),
+		}
+
+		for handler, times := range got {
+			if !reflect.DeepEqual(times, c.want) {
+				t.Errorf("%s, %s: buckets %v, want %v", c.name, handler, times, c.want)
+			}
+		}
+	}
+}
@@ -6,11 +6,12 @@ import (
 	"fmt"
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
-	"github.com/gnasnik/titan-box-api/core/dao"
 	xerrors "github.com/gnasnik/titan-box-api/core/errors"
 	"github.com/gnasnik/titan-box-api/core/generated/model"
 	"golang.org/x/crypto/bcrypt"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -24,26 +25,35 @@ type login struct {
 	Password  string `json:"password"`
 	Chaptcode string `json:"chaptcode"`
 	Host      string `json:"host"`
+	// TotpCode is the TOTP or a backup code of the users with a second factor. It comes along with the
+	// password, or with the MfaToken answering a login which required it.
+	TotpCode string `json:"totpCode"`
+	MfaToken string `json:"mfaToken"`
 }
 
 type loginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	Expire       int64  `json:"expire"`
 }
 
 var identityKey = "id"
 
-func jwtGinMiddleware(secretKey string) (*jwt.GinJWTMiddleware, error) {
+// loginRetryAfterKey holds the lockout of a login refused by the throttling.
+const loginRetryAfterKey = "LOGIN_RETRY_AFTER"
+
+func (s *Server) jwtGinMiddleware(secretKey string) (*jwt.GinJWTMiddleware, error) {
 	return jwt.New(&jwt.GinJWTMiddleware{
 		Realm:             "User",
 		Key:               []byte(secretKey),
-		Timeout:           30 * 24 * time.Hour,
-		MaxRefresh:        30 * 24 * time.Hour,
+		Timeout:           s.auth.cfg.AccessTokenTTL,
 		IdentityKey:       identityKey,
 		SendAuthorization: true,
 		PayloadFunc: func(data interface{}) jwt.MapClaims {
-			if v, ok := data.(*model.User); ok {
+			if v, ok := data.(*tokenIdentity); ok {
 				return jwt.MapClaims{
 					identityKey: v.Username,
+					sessionKey:  v.SessionId,
 				}
 			}
 			return jwt.MapClaims{}
@@ -54,9 +64,24 @@ func jwtGinMiddleware(secretKey string) (*jwt.GinJWTMiddleware, error) {
 				Username: claims[identityKey].(string),
 			}
 		},
+		// the tokens without a session, issued before the sessions, are rejected along with the revoked ones
+		Authorizator: func(data interface{}, c *gin.Context) bool {
+			claims := jwt.ExtractClaims(c)
+			username, _ := claims[identityKey].(string)
+			sessionId, _ := claims[sessionKey].(string)
+			return s.activeSession(c.Request.Context(), username, sessionId)
+		},
+		HTTPStatusMessageFunc: func(e error, c *gin.Context) string {
+			if errors.Is(e, jwt.ErrForbidden) {
+				return "session revoked or expired"
+			}
+			return e.Error()
+		},
 		LoginResponse: func(c *gin.Context, code int, token string, expire time.Time) {
 			c.JSON(http.StatusOK, loginResponse{
-				Token: token,
+				Token:        token,
+				RefreshToken: c.GetString(refreshTokenKey),
+				Expire:       expire.Unix(),
 			})
 		},
 		LogoutResponse: func(c *gin.Context, code int) {
@@ -70,27 +95,123 @@ func jwtGinMiddleware(secretKey string) (*jwt.GinJWTMiddleware, error) {
 				return "", fmt.Errorf("invalid input params")
 			}
 
+			// an unknown or expired challenge starts the login over, with the password
+			if loginParams.MfaToken != "" {
+				username, ok := s.auth.MFAChallenge(loginParams.MfaToken)
+				if !ok {
+					return nil, xerrors.ErrTOTPRequired
+				}
+				loginParams.Username = username
+			}
+
 			if loginParams.Username == "" {
 				return "", jwt.ErrMissingLoginValues
 			}
 
-			user, err := dao.GetUserByUsername(c.Request.Context(), loginParams.Username)
-			if errors.Is(err, sql.ErrNoRows) {
-				return nil, xerrors.ErrUserNotFound
+			ctx := c.Request.Context()
+			ip := c.ClientIP()
+
+			if lockout := s.auth.LoginLockout(loginParams.Username, ip); lockout > 0 {
+				c.Set(loginRetryAfterKey, lockout)
+				return nil, xerrors.ErrTooManyAttempts
 			}
 
+			// the password and the captcha were checked by the login which issued the challenge
+			if loginParams.MfaToken == "" {
+				if s.auth.Captcha != nil {
+					ok, err := s.auth.Captcha.VerifyCaptcha(ctx, loginParams.Chaptcode, ip)
+					if err != nil {
+						log.Errorf("verify captcha: %v", err)
+						return nil, xerrors.ErrInternalServer
+					}
+
+					if !ok {
+						return nil, xerrors.ErrInvalidCaptcha
+					}
+				}
+
+				user, err := s.users.GetUserByUsername(ctx, loginParams.Username)
+				if errors.Is(err, sql.ErrNoRows) {
+					s.auth.LoginFailed(loginParams.Username, ip)
+					return nil, xerrors.ErrUserNotFound
+				}
+
+				if err != nil {
+					log.Errorf("get user by username: %v", err)
+					return nil, xerrors.ErrInternalServer
+				}
+
+				if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginParams.Password)); err != nil {
+					s.auth.LoginFailed(loginParams.Username, ip)
+					return nil, xerrors.ErrInvalidPassword
+				}
+			}
+
+			totp, err := s.enabledTOTP(ctx, loginParams.Username)
 			if err != nil {
-				log.Errorf("get user by username: %v", err)
+				log.Errorf("get user totp: %v", err)
 				return nil, xerrors.ErrInternalServer
 			}
 
-			if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(loginParams.Password)); err != nil {
-				return nil, xerrors.ErrInvalidPassword
+			if totp != nil {
+				if loginParams.TotpCode == "" {
+					token, err := s.auth.NewMFAChallenge(loginParams.Username)
+					if err != nil {
+						log.Errorf("new mfa challenge: %v", err)
+						return nil, xerrors.ErrInternalServer
+					}
+					c.Set(mfaTokenKey, token)
+					return nil, xerrors.ErrTOTPRequired
+				}
+
+				ok, err := s.verifySecondFactor(ctx, totp, loginParams.TotpCode)
+				if err != nil {
+					log.Errorf("verify second factor: %v", err)
+					return nil, xerrors.ErrInternalServer
+				}
+
+				if !ok {
+					s.auth.LoginFailed(loginParams.Username, ip)
+					return nil, xerrors.ErrInvalidTOTPCode
+				}
+			}
+
+			if loginParams.MfaToken != "" {
+				s.auth.ConsumeMFAChallenge(loginParams.MfaToken)
 			}
 
-			return &model.User{Uid: user.Uid, Username: user.Username}, nil
+			s.auth.LoginSucceeded(loginParams.Username)
+
+			session, refreshToken, err := s.createSession(c, loginParams.Username)
+			if err != nil {
+				log.Errorf("create session: %v", err)
+				return nil, xerrors.ErrInternalServer
+			}
+			c.Set(refreshTokenKey, refreshToken)
+
+			return &tokenIdentity{Username: loginParams.Username, SessionId: session.Id}, nil
 		},
 		Unauthorized: func(c *gin.Context, code int, message string) {
+			if v, ok := c.Get(loginRetryAfterKey); ok {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(v.(time.Duration).Seconds()))))
+				c.JSON(http.StatusTooManyRequests, gin.H{
+					"code":    http.StatusTooManyRequests,
+					"msg":     message,
+					"success": false,
+				})
+				return
+			}
+
+			if token, ok := c.Get(mfaTokenKey); ok {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"code":     401,
+					"msg":      message,
+					"success":  false,
+					"mfaToken": token,
+				})
+				return
+			}
+
 			c.JSON(http.StatusBadRequest, gin.H{
 				"code":    401,
 				"msg":     message,
@@ -2,11 +2,19 @@ package api
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
-	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -36,39 +44,223 @@ func RequestLoggerMiddleware() gin.HandlerFunc {
 	}
 }
 
-func AuthorizationMiddlewareFunc() gin.HandlerFunc {
+const (
+	defaultSignSkew       = 5 * time.Minute
+	defaultNonceCacheSize = 100000
+
+	// maxSignedBodySize bounds the body read to hash a signed request.
+	maxSignedBodySize = 10 << 20
+
+	SignMethodMD5        = "md5"
+	SignMethodHmacSHA256 = "hmac-sha256"
+)
+
+// nonceCache remembers the signatures of the requests for as long as their timestamp is accepted, so that
+// a captured request cannot be replayed. It is local to the process. Each AppKey remembers up to size
+// signatures, so that a key sending too many requests only throttles itself.
+type nonceCache struct {
+	lk   sync.Mutex
+	ttl  time.Duration
+	size int
+	seen map[string]map[string]time.Time
+}
+
+func newNonceCache(ttl time.Duration, size int) *nonceCache {
+	return &nonceCache{ttl: ttl, size: size, seen: make(map[string]map[string]time.Time)}
+}
+
+// add records the signature of the AppKey and reports whether it was not seen yet. Once the signatures of
+// the key fill its budget, its new ones are refused until the oldest expire, rather than forgetting
+// signatures which could then be replayed.
+func (n *nonceCache) add(appKey, signature string, now time.Time) (bool, error) {
+	n.lk.Lock()
+	defer n.lk.Unlock()
+
+	seen, ok := n.seen[appKey]
+	if !ok {
+		seen = make(map[string]time.Time)
+		n.seen[appKey] = seen
+	}
+
+	if expiry, ok := seen[signature]; ok && now.Before(expiry) {
+		return false, nil
+	}
+
+	if len(seen) >= n.size {
+		for s, expiry := range seen {
+			if !now.Before(expiry) {
+				delete(seen, s)
+			}
+		}
+	}
+
+	if len(seen) >= n.size {
+		return false, errors.New("nonce cache of the app key is full")
+	}
+
+	seen[signature] = now.Add(n.ttl)
+	return true, nil
+}
+
+// stringToSign is the canonical request signed with HMAC-SHA256: the method, the escaped path, the sorted
+// query, the timestamp, the nonce and the hex SHA-256 of the body, one per line.
+func stringToSign(r *http.Request, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.Query().Encode(),
+		timestamp,
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// SignRequest returns the HMAC-SHA256 signature of the request with the secret of an api key.
+func SignRequest(appSecret string, r *http.Request, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(appSecret))
+	mac.Write([]byte(stringToSign(r, timestamp, nonce, body)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func keyUnauthorized(c *gin.Context, code int, message string) {
+	c.AbortWithStatusJSON(code, gin.H{
+		"code":    code,
+		"msg":     message,
+		"success": false,
+	})
+}
+
+// AuthorizationMiddlewareFunc authenticates the machine clients by the api keys of their user, instead of
+// a JWT. The ak, timestamp and sign headers are required, and the signMethod header selects the signature
+// made with the secret of the key:
+//   - hmac-sha256, the default, signs the request itself, see stringToSign, along with a random nonce header
+//   - md5 signs md5(secret#timestamp#username) like the PaiNet open api. It neither covers the request nor
+//     changes but with the timestamp, which allows one request per second, so it is refused unless the
+//     APIKey.AllowMD5 config enables it.
+//
+// The timestamp, in seconds, must be within the skew window of the server time, and a signature is only
+// accepted once. The user is then exposed to the handlers like the JWT middleware does, along with the key
+// for the scope checks.
+func (s *Server) AuthorizationMiddlewareFunc() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ak := c.Request.Header.Get("ak")
 		timestampStr := c.Request.Header.Get("timestamp")
 		sign := c.Request.Header.Get("sign")
+		nonce := c.Request.Header.Get("nonce")
+		method := strings.ToLower(c.Request.Header.Get("signMethod"))
 
 		if ak == "" || timestampStr == "" || sign == "" {
-			c.JSON(http.StatusUnauthorized, nil)
-			c.Abort()
+			keyUnauthorized(c, http.StatusUnauthorized, "missing signature headers")
+			return
+		}
+
+		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+		if err != nil {
+			keyUnauthorized(c, http.StatusUnauthorized, "invalid timestamp")
+			return
+		}
+
+		now := time.Now()
+		if skew := now.Sub(time.Unix(timestamp, 0)); skew > s.signSkew || skew < -s.signSkew {
+			keyUnauthorized(c, http.StatusUnauthorized, "timestamp out of the skew window")
+			return
+		}
+
+		var body []byte
+		switch method {
+		case SignMethodMD5:
+			if !s.allowMD5 {
+				keyUnauthorized(c, http.StatusUnauthorized, "sign method not allowed")
+				return
+			}
+		case "", SignMethodHmacSHA256:
+			if nonce == "" {
+				keyUnauthorized(c, http.StatusUnauthorized, "missing nonce")
+				return
+			}
+
+			body, err = io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBodySize))
+			if err != nil {
+				keyUnauthorized(c, http.StatusBadRequest, "invalid body")
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		default:
+			keyUnauthorized(c, http.StatusUnauthorized, "invalid sign method")
+			return
+		}
+
+		ctx := c.Request.Context()
+		key, err := s.apiKeys.GetAPIKeyByAppKey(ctx, ak)
+		if errors.Is(err, sql.ErrNoRows) {
+			keyUnauthorized(c, http.StatusUnauthorized, "invalid app key")
 			return
 		}
 
-		userKey, err := dao.GetUserKeyByAPIKey(c.Request.Context(), ak)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, nil)
-			c.Abort()
+			log.Errorf("get api key: %v", err)
+			keyUnauthorized(c, http.StatusInternalServerError, "internal server error")
 			return
 		}
 
-		timestamp, _ := strconv.ParseInt(timestampStr, 10, 64)
-		expectSign := generateMD5Hash(userKey.APISecret, userKey.Username, timestamp)
-		if expectSign != sign {
-			c.JSON(http.StatusUnauthorized, nil)
-			c.Abort()
+		secrets, err := s.apiKeySecrets(key, now)
+		if err != nil {
+			log.Errorf("open secret of api key %s: %v", key.Id, err)
+			keyUnauthorized(c, http.StatusInternalServerError, "internal server error")
 			return
 		}
 
-		if time.Unix(timestamp, 0).Add(5 * time.Minute).Before(time.Now()) {
-			c.JSON(http.StatusUnauthorized, nil)
-			c.Abort()
+		var matched string
+		for _, secret := range secrets {
+			expectSign := SignRequest(secret, c.Request, timestampStr, nonce, body)
+			if method == SignMethodMD5 {
+				expectSign = generateMD5Hash(secret, key.Username, timestamp)
+			}
+
+			if hmac.Equal([]byte(expectSign), []byte(strings.ToLower(sign))) {
+				matched = expectSign
+				break
+			}
+		}
+
+		if matched == "" {
+			keyUnauthorized(c, http.StatusUnauthorized, "invalid signature")
 			return
 		}
 
+		switch key.Status(now) {
+		case model.APIKeyStatusRevoked:
+			keyUnauthorized(c, http.StatusUnauthorized, "app key revoked")
+			return
+		case model.APIKeyStatusExpired:
+			keyUnauthorized(c, http.StatusUnauthorized, "app key expired")
+			return
+		}
+
+		fresh, err := s.nonces.add(ak, matched, now)
+		if err != nil {
+			log.Warnf("reject signed request of %s: %v", key.Username, err)
+			keyUnauthorized(c, http.StatusTooManyRequests, "too many requests")
+			return
+		}
+
+		if !fresh {
+			keyUnauthorized(c, http.StatusUnauthorized, "signature already used")
+			return
+		}
+
+		ip := c.ClientIP()
+		if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval || key.LastUsedIp != ip {
+			if err := s.apiKeys.TouchAPIKey(ctx, key.Id, now, ip); err != nil {
+				log.Warnf("touch api key %s: %v", key.Id, err)
+			}
+		}
+
+		c.Set(apiKeyContextKey, key)
+		c.Set("JWT_PAYLOAD", jwt.MapClaims{identityKey: key.Username})
+		c.Set(identityKey, &model.User{Username: key.Username})
+
 		c.Next()
 	}
 }
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNonceCacheBudgetPerAppKey(t *testing.T) {
+	now := time.Now()
+	nonces := newNonceCache(time.Minute, 2)
+
+	cases := []struct {
+		name      string
+		appKey    string
+		signature string
+		at        time.Time
+		wantFresh bool
+		wantErr   bool
+	}{
+		{name: "first", appKey: "a", signature: "s1", at: now, wantFresh: true},
+		{name: "replay", appKey: "a", signature: "s1", at: now},
+		{name: "same signature of another key", appKey: "b", signature: "s1", at: now, wantFresh: true},
+		{name: "budget filled", appKey: "a", signature: "s2", at: now, wantFresh: true},
+		{name: "over the budget", appKey: "a", signature: "s3", at: now, wantErr: true},
+		{name: "other keys still pass", appKey: "b", signature: "s2", at: now, wantFresh: true},
+		{name: "replay over the budget", appKey: "a", signature: "s2", at: now},
+		{name: "budget freed once expired", appKey: "a", signature: "s3", at: now.Add(time.Minute), wantFresh: true},
+	}
+
+	for _, c := range cases {
+		fresh, err := nonces.add(c.appKey, c.signature, c.at)
+		if fresh != c.wantFresh || (err != nil) != c.wantErr {
+			t.Errorf("%s: fresh = %v, error = %v, want fresh %v, error %v", c.name, fresh, err, c.wantFresh, c.wantErr)
+		}
+	}
+}
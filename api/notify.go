@@ -0,0 +1,497 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultNotifyTimeout = 10 * time.Second
+
+	defaultDingTalkURL = "https://oapi.dingtalk.com/robot/send"
+	defaultFeishuURL   = "https://open.feishu.cn/open-apis/bot/v2/hook"
+	defaultWeComURL    = "https://qyapi.weixin.qq.com/cgi-bin/webhook/send"
+	defaultTelegramURL = "https://api.telegram.org"
+
+	// AlertSeverityCritical alerts are still sent during the quiet hours of the channels.
+	AlertSeverityCritical = "critical"
+
+	AlertKindBox    = "box"
+	AlertKindIncome = "income"
+
+	quietHourLayout = "15:04"
+)
+
+// markdownAlertTemplate is the default message of the channels rendering markdown, DingTalk and WeCom.
+const markdownAlertTemplate = `### [{{.Severity}}] {{.Kind}} alert {{.Status}}: {{.Rule}}
+- **box**: {{.BoxId}} {{.SupplierBoxId}}
+- **summary**: {{.Summary}}
+- **since**: {{.StartsAt.Format "2006-01-02 15:04:05"}}{{if .ResolvedAt}}
+- **resolved**: {{.ResolvedAt.Format "2006-01-02 15:04:05"}}{{end}}`
+
+const textAlertTemplate = `[{{.Severity}}] {{.Kind}} alert {{.Status}}: {{.Rule}}
+box: {{.BoxId}} {{.SupplierBoxId}}
+summary: {{.Summary}}
+since: {{.StartsAt.Format "2006-01-02 15:04:05"}}{{if .ResolvedAt}}
+resolved: {{.ResolvedAt.Format "2006-01-02 15:04:05"}}{{end}}`
+
+var defaultAlertTemplates = map[string]string{
+	model.NotifyChannelDingTalk: markdownAlertTemplate,
+	model.NotifyChannelFeishu:   textAlertTemplate,
+	model.NotifyChannelWeCom:    markdownAlertTemplate,
+	model.NotifyChannelTelegram: textAlertTemplate,
+	model.NotifyChannelEmail:    textAlertTemplate,
+}
+
+// AlertNotification is the data the templates of the channels are executed with.
+type AlertNotification struct {
+	*model.Alert
+	// Kind is income for the alerts of the income_drop rules, and box for the others.
+	Kind string
+}
+
+// Message is a notification rendered for a channel.
+type Message struct {
+	Title string
+	Text  string
+}
+
+// Notifier sends the messages through one type of channel.
+type Notifier interface {
+	Notify(ctx context.Context, channel *model.NotifyChannel, msg *Message) error
+}
+
+// Notifications sends the alerts of the users to their channels, according to the severities routed to each
+// channel and its quiet hours.
+type Notifications struct {
+	store     dao.NotifyChannelStore
+	notifiers map[string]Notifier
+}
+
+func NewNotifications(store dao.NotifyChannelStore, cfg config.NotifyConfig) *Notifications {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultNotifyTimeout
+	}
+
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	return &Notifications{
+		store: store,
+		notifiers: map[string]Notifier{
+			model.NotifyChannelDingTalk: &dingTalkNotifier{url: orDefault(cfg.DingTalkURL, defaultDingTalkURL), client: client},
+			model.NotifyChannelFeishu:   &feishuNotifier{url: orDefault(cfg.FeishuURL, defaultFeishuURL), client: client},
+			model.NotifyChannelWeCom:    &weComNotifier{url: orDefault(cfg.WeComURL, defaultWeComURL), client: client},
+			model.NotifyChannelTelegram: &telegramNotifier{url: orDefault(cfg.TelegramURL, defaultTelegramURL), token: cfg.TelegramToken, client: client},
+			model.NotifyChannelEmail:    &emailNotifier{cfg: cfg.SMTP, timeout: cfg.Timeout},
+		},
+	}
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// ValidateNotifyChannel checks the channel requested by a user, and keeps the bare address of an email target
+// given with a display name.
+func ValidateNotifyChannel(c *model.NotifyChannel) error {
+	if _, ok := defaultAlertTemplates[c.Type]; !ok {
+		return fmt.Errorf("invalid notify channel type: %s", c.Type)
+	}
+
+	if c.Target == "" {
+		return fmt.Errorf("missing notify channel target")
+	}
+
+	if c.Type == model.NotifyChannelEmail {
+		addr, err := mail.ParseAddress(c.Target)
+		if err != nil {
+			return fmt.Errorf("invalid email address %s: %w", c.Target, err)
+		}
+		c.Target = addr.Address
+	}
+
+	if c.Template != "" {
+		if _, err := template.New(c.Type).Parse(c.Template); err != nil {
+			return fmt.Errorf("invalid notify template: %w", err)
+		}
+	}
+
+	if (c.QuietStart == "") != (c.QuietEnd == "") {
+		return fmt.Errorf("quiet hours need both a start and an end")
+	}
+
+	for _, hour := range []string{c.QuietStart, c.QuietEnd} {
+		if _, err := time.Parse(quietHourLayout, hour); hour != "" && err != nil {
+			return fmt.Errorf("invalid quiet hour %s", hour)
+		}
+	}
+
+	return nil
+}
+
+// inQuietHours reports whether now, in the local time, falls within the quiet hours of the channel. The
+// quiet hours wrap around midnight when they end before they start.
+func inQuietHours(c *model.NotifyChannel, now time.Time) bool {
+	start, err1 := time.Parse(quietHourLayout, c.QuietStart)
+	end, err2 := time.Parse(quietHourLayout, c.QuietEnd)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+
+	minute := func(t time.Time) int { return t.Hour()*60 + t.Minute() }
+	m, s, e := minute(now), minute(start), minute(end)
+
+	if s <= e {
+		return s <= m && m < e
+	}
+	return m >= s || m < e
+}
+
+func renderAlert(c *model.NotifyChannel, alert *AlertNotification) (*Message, error) {
+	text := c.Template
+	if text == "" {
+		text = defaultAlertTemplates[c.Type]
+	}
+
+	tmpl, err := template.New(c.Type).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, alert); err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Title: fmt.Sprintf("[%s] %s alert %s: %s", alert.Severity, alert.Kind, alert.Status, alert.Rule),
+		Text:  buf.String(),
+	}, nil
+}
+
+// Send renders the alert with the template of the channel and sends it, whatever the routing of the channel.
+func (n *Notifications) Send(ctx context.Context, c *model.NotifyChannel, alert *AlertNotification) error {
+	notifier, ok := n.notifiers[c.Type]
+	if !ok {
+		return fmt.Errorf("invalid notify channel type: %s", c.Type)
+	}
+
+	msg, err := renderAlert(c, alert)
+	if err != nil {
+		return err
+	}
+
+	return notifier.Notify(ctx, c, msg)
+}
+
+// NotifyAlert sends the alert to the channels of the user routing its severity, the channels in their quiet
+// hours only receive the critical alerts. A failing channel does not hold back the others.
+func (n *Notifications) NotifyAlert(ctx context.Context, username string, alert *AlertNotification, now time.Time) error {
+	channels, err := n.store.GetNotifyChannels(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range channels {
+		if !c.Routes(alert.Severity) {
+			continue
+		}
+
+		if alert.Severity != AlertSeverityCritical && inQuietHours(c, now) {
+			log.Debugf("skip alert %s to channel %s in its quiet hours", alert.DedupKey, c.Name)
+			continue
+		}
+
+		if err := n.Send(ctx, c, alert); err != nil {
+			log.Errorf("notify alert %s to %s channel %s: %v", alert.DedupKey, c.Type, c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// postJSON posts body to the bot and decodes its JSON reply into out. The errors leave out the url, which
+// holds the token of the bot.
+func postJSON(ctx context.Context, client *http.Client, endpoint string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("invalid bot url")
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(request)
+	if urlErr, ok := err.(*url.Error); ok {
+		return urlErr.Err
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	reply, err := io.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d: %s", response.StatusCode, reply)
+	}
+
+	return json.Unmarshal(reply, out)
+}
+
+// signBot returns the base64 HMAC-SHA256 signature of the DingTalk and Feishu bots.
+func signBot(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type dingTalkNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *dingTalkNotifier) Notify(ctx context.Context, c *model.NotifyChannel, msg *Message) error {
+	query := url.Values{"access_token": {c.Target}}
+	if c.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		query.Set("timestamp", timestamp)
+		query.Set("sign", signBot(c.Secret, timestamp+"\n"+c.Secret))
+	}
+
+	body := map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"title": msg.Title, "text": msg.Text},
+	}
+
+	var reply struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := postJSON(ctx, n.client, n.url+"?"+query.Encode(), body, &reply); err != nil {
+		return err
+	}
+
+	if reply.ErrCode != 0 {
+		return fmt.Errorf("dingtalk error %d: %s", reply.ErrCode, reply.ErrMsg)
+	}
+	return nil
+}
+
+type feishuNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *feishuNotifier) Notify(ctx context.Context, c *model.NotifyChannel, msg *Message) error {
+	body := map[string]interface{}{
+		"msg_type": "text",
+		"content":  map[string]string{"text": msg.Text},
+	}
+
+	if c.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		body["timestamp"] = timestamp
+		body["sign"] = signBot(timestamp+"\n"+c.Secret, "")
+	}
+
+	var reply struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err := postJSON(ctx, n.client, n.url+"/"+url.PathEscape(c.Target), body, &reply); err != nil {
+		return err
+	}
+
+	if reply.Code != 0 {
+		return fmt.Errorf("feishu error %d: %s", reply.Code, reply.Msg)
+	}
+	return nil
+}
+
+type weComNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *weComNotifier) Notify(ctx context.Context, c *model.NotifyChannel, msg *Message) error {
+	body := map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"content": msg.Text},
+	}
+
+	var reply struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err := postJSON(ctx, n.client, n.url+"?"+url.Values{"key": {c.Target}}.Encode(), body, &reply); err != nil {
+		return err
+	}
+
+	if reply.ErrCode != 0 {
+		return fmt.Errorf("wecom error %d: %s", reply.ErrCode, reply.ErrMsg)
+	}
+	return nil
+}
+
+type telegramNotifier struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (n *telegramNotifier) Notify(ctx context.Context, c *model.NotifyChannel, msg *Message) error {
+	token := n.token
+	if c.Secret != "" {
+		token = c.Secret
+	}
+
+	if token == "" {
+		return fmt.Errorf("missing telegram bot token")
+	}
+
+	body := map[string]interface{}{
+		"chat_id": c.Target,
+		"text":    msg.Text,
+	}
+
+	var reply struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := postJSON(ctx, n.client, n.url+"/bot"+token+"/sendMessage", body, &reply); err != nil {
+		return err
+	}
+
+	if !reply.Ok {
+		return fmt.Errorf("telegram error: %s", reply.Description)
+	}
+	return nil
+}
+
+type emailNotifier struct {
+	cfg     config.SMTPConfig
+	timeout time.Duration
+}
+
+// Notify sends the message as a plain text email, upgrading the connection with STARTTLS when the server
+// offers it.
+func (n *emailNotifier) Notify(ctx context.Context, c *model.NotifyChannel, msg *Message) error {
+	if n.cfg.Host == "" {
+		return fmt.Errorf("smtp is not configured")
+	}
+
+	// the SMTP commands take the bare addresses, the headers keep the display names
+	from, err := mail.ParseAddress(n.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid smtp from address: %w", err)
+	}
+
+	to, err := mail.ParseAddress(c.Target)
+	if err != nil {
+		return fmt.Errorf("invalid email address %s: %w", c.Target, err)
+	}
+
+	addr := net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port))
+	conn, err := (&net.Dialer{Timeout: n.timeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(n.timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.cfg.Host}); err != nil {
+			return err
+		}
+	}
+
+	if n.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.cfg.Username, n.cfg.Password, n.cfg.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	header := []string{
+		"From: " + from.String(),
+		"To: " + to.String(),
+		"Subject: " + mime.QEncoding.Encode("utf-8", msg.Title),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+	}
+	body := strings.Join(header, "\r\n") + "\r\n\r\n" + strings.ReplaceAll(msg.Text, "\n", "\r\n") + "\r\n"
+
+	if _, err := w.Write([]byte(body)); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+func (d *DataService) notifyAlert(ctx context.Context, username string, alert *model.Alert) {
+	if d.Notifications == nil {
+		return
+	}
+
+	notification := &AlertNotification{Alert: alert, Kind: d.Alerter.kind(alert.Rule)}
+	if err := d.Notifications.NotifyAlert(ctx, username, notification, time.Now()); err != nil {
+		log.Errorf("notify alert %s of %s: %v", alert.DedupKey, username, err)
+	}
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testBotToken  = "bot-token"
+	testBotSecret = "SECabc"
+)
+
+func testBotSign(key, message string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newBotStandIn serves the DingTalk, Feishu, WeCom and Telegram bot apis, checking the tokens and the
+// signatures as the real ones document them.
+func newBotStandIn(t *testing.T) *httptest.Server {
+	reply := func(w http.ResponseWriter, ok bool, codeKey string) {
+		code := 0
+		if !ok {
+			code = 310000
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{codeKey: code, "ok": ok, "errmsg": "sign not match", "msg": "sign not match"})
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dingtalk", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		timestamp := q.Get("timestamp")
+		ok := q.Get("access_token") == testBotToken && q.Get("sign") == testBotSign(testBotSecret, timestamp+"\n"+testBotSecret)
+		reply(w, ok, "errcode")
+	})
+
+	mux.HandleFunc("/feishu/", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Timestamp string `json:"timestamp"`
+			Sign      string `json:"sign"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		ok := strings.TrimPrefix(r.URL.Path, "/feishu/") == testBotToken && body.Sign == testBotSign(body.Timestamp+"\n"+testBotSecret, "")
+		reply(w, ok, "code")
+	})
+
+	mux.HandleFunc("/wecom", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, r.URL.Query().Get("key") == testBotToken, "errcode")
+	})
+
+	mux.HandleFunc("/telegram/", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, r.URL.Path == "/telegram/bot"+testBotSecret+"/sendMessage", "error_code")
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestBotNotifiers(t *testing.T) {
+	srv := newBotStandIn(t)
+	n := NewNotifications(nil, config.NotifyConfig{
+		DingTalkURL: srv.URL + "/dingtalk",
+		FeishuURL:   srv.URL + "/feishu",
+		WeComURL:    srv.URL + "/wecom",
+		TelegramURL: srv.URL + "/telegram",
+	})
+
+	cases := []struct {
+		name    string
+		channel *model.NotifyChannel
+		wantErr bool
+	}{
+		{name: "dingtalk", channel: &model.NotifyChannel{Type: model.NotifyChannelDingTalk, Target: testBotToken, Secret: testBotSecret}},
+		{name: "dingtalk wrong secret", channel: &model.NotifyChannel{Type: model.NotifyChannelDingTalk, Target: testBotToken, Secret: "SECwrong"}, wantErr: true},
+		{name: "feishu", channel: &model.NotifyChannel{Type: model.NotifyChannelFeishu, Target: testBotToken, Secret: testBotSecret}},
+		{name: "feishu wrong secret", channel: &model.NotifyChannel{Type: model.NotifyChannelFeishu, Target: testBotToken, Secret: "SECwrong"}, wantErr: true},
+		{name: "wecom", channel: &model.NotifyChannel{Type: model.NotifyChannelWeCom, Target: testBotToken}},
+		{name: "wecom wrong key", channel: &model.NotifyChannel{Type: model.NotifyChannelWeCom, Target: "other"}, wantErr: true},
+		{name: "telegram", channel: &model.NotifyChannel{Type: model.NotifyChannelTelegram, Target: "42", Secret: testBotSecret}},
+		{name: "telegram without a token", channel: &model.NotifyChannel{Type: model.NotifyChannelTelegram, Target: "42"}, wantErr: true},
+	}
+
+	alert := &AlertNotification{Alert: &model.Alert{Rule: "offline", Severity: "warning", Status: "firing", BoxId: "b", StartsAt: time.Now()}, Kind: AlertKindBox}
+	for _, c := range cases {
+		if err := n.Send(context.Background(), c.channel, alert); (err != nil) != c.wantErr {
+			t.Errorf("%s: error = %v, want error %v", c.name, err, c.wantErr)
+		}
+	}
+}
+
+type smtpMessage struct {
+	from, rcpt, data string
+}
+
+// newSMTPStandIn accepts one message on a local port, without TLS nor authentication.
+func newSMTPStandIn(t *testing.T) (string, <-chan *smtpMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	messages := make(chan *smtpMessage, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		msg := &smtpMessage{}
+		tp.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+
+			verb := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(verb, "EHLO"), strings.HasPrefix(verb, "HELO"):
+				tp.PrintfLine("250 localhost")
+			case strings.HasPrefix(verb, "MAIL FROM:"):
+				msg.from = line[len("MAIL FROM:"):]
+				tp.PrintfLine("250 OK")
+			case strings.HasPrefix(verb, "RCPT TO:"):
+				msg.rcpt = line[len("RCPT TO:"):]
+				tp.PrintfLine("250 OK")
+			case verb == "DATA":
+				tp.PrintfLine("354 go ahead")
+				data, err := tp.ReadDotLines()
+				if err != nil {
+					return
+				}
+				msg.data = strings.Join(data, "\n")
+				tp.PrintfLine("250 OK")
+			case verb == "QUIT":
+				tp.PrintfLine("221 bye")
+				messages <- msg
+				return
+			default:
+				tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	return l.Addr().String(), messages
+}
+
+func TestEmailNotifier(t *testing.T) {
+	channel := &model.NotifyChannel{Type: model.NotifyChannelEmail, Target: "Ops Team <ops@example.com>"}
+	if err := ValidateNotifyChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	if channel.Target != "ops@example.com" {
+		t.Errorf("validated target = %q, want ops@example.com", channel.Target)
+	}
+
+	cases := []struct {
+		name   string
+		target string
+	}{
+		{name: "validated target", target: channel.Target},
+		{name: "target stored with a display name", target: "Ops Team <ops@example.com>"},
+	}
+
+	for _, c := range cases {
+		addr, messages := newSMTPStandIn(t)
+		host, port, _ := net.SplitHostPort(addr)
+		portNum, _ := strconv.Atoi(port)
+
+		n := &emailNotifier{cfg: config.SMTPConfig{Host: host, Port: portNum, From: "Titan Box <alerts@example.com>"}, timeout: 5 * time.Second}
+		err := n.Notify(context.Background(), &model.NotifyChannel{Type: model.NotifyChannelEmail, Target: c.target}, &Message{Title: "告警", Text: "box offline"})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		msg := <-messages
+		if msg.from != "<alerts@example.com>" || msg.rcpt != "<ops@example.com>" {
+			t.Errorf("%s: envelope from %s to %s, want <alerts@example.com> to <ops@example.com>", c.name, msg.from, msg.rcpt)
+		}
+
+		if !strings.Contains(msg.data, "To: <ops@example.com>") && !strings.Contains(msg.data, `To: "Ops Team" <ops@example.com>`) {
+			t.Errorf("%s: message %q lacks the To header", c.name, msg.data)
+		}
+
+		if !strings.Contains(msg.data, "box offline") {
+			t.Errorf("%s: message %q lacks the text", c.name, msg.data)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package api
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// API endpoint for fetching boxes
+	defaultPaiNetBaseUrl = "https://openapi.painet.work"
+
+	defaultPaiNetTimeout = 60 * time.Second
+
+	defaultPaiNetRateLimit  = 5
+	defaultPaiNetRateBurst  = 10
+	defaultPaiNetMaxRetries = 5
+	defaultPaiNetMinBackoff = 500 * time.Millisecond
+	defaultPaiNetMaxBackoff = 30 * time.Second
+	// defaultPaiNetMaxRetryAfter bounds the wait a Retry-After header asks for.
+	defaultPaiNetMaxRetryAfter = 5 * time.Minute
+)
+
+// PaiNetClient fetches the box data of a supplier account from the PaiNet open api.
+type PaiNetClient interface {
+	GetBoxList(ctx context.Context, pi *model.PaiNetInfo, page, pageSize int) (*GetBoxListResponse, error)
+	GetBoxIncome(ctx context.Context, pi *model.PaiNetInfo, start, end string, page, pageSize int) (*GetBoxIncomeResponse, error)
+	GetBoxBandwidth(ctx context.Context, pi *model.PaiNetInfo, date string, boxIds []string) (*GetBoxBandwidthResponse, error)
+	GetBoxQualities(ctx context.Context, pi *model.PaiNetInfo, date string, boxIds []string) (*GetBoxQualitiesResponse, error)
+}
+
+type PaiNetClientOption func(*paiNetClient)
+
+// WithBaseUrl points the client at another PaiNet deployment, such as a staging or a fake server.
+func WithBaseUrl(baseUrl string) PaiNetClientOption {
+	return func(c *paiNetClient) {
+		if baseUrl != "" {
+			c.baseUrl = strings.TrimRight(baseUrl, "/")
+		}
+	}
+}
+
+func WithTimeout(timeout time.Duration) PaiNetClientOption {
+	return func(c *paiNetClient) {
+		if timeout > 0 {
+			c.httpClient.Timeout = timeout
+		}
+	}
+}
+
+func WithTransport(transport http.RoundTripper) PaiNetClientOption {
+	return func(c *paiNetClient) {
+		if transport != nil {
+			c.httpClient.Transport = transport
+		}
+	}
+}
+
+// WithRateLimit caps the requests sent on behalf of a single PaiNet account to rps per second,
+// allowing bursts of up to burst requests.
+func WithRateLimit(rps float64, burst int) PaiNetClientOption {
+	return func(c *paiNetClient) {
+		if rps > 0 {
+			c.rateLimit = rate.Limit(rps)
+		}
+		if burst > 0 {
+			c.rateBurst = burst
+		}
+	}
+}
+
+// WithRetry retries a failed request up to maxRetries times, backing off exponentially with jitter
+// between minBackoff and maxBackoff unless the server asks for a longer Retry-After, which is capped by
+// WithMaxRetryAfter. Zero values keep the defaults, a negative maxRetries disables retrying.
+func WithRetry(maxRetries int, minBackoff, maxBackoff time.Duration) PaiNetClientOption {
+	return func(c *paiNetClient) {
+		if maxRetries < 0 {
+			c.maxRetries = 0
+		} else if maxRetries > 0 {
+			c.maxRetries = maxRetries
+		}
+		if minBackoff > 0 {
+			c.minBackoff = minBackoff
+		}
+		if maxBackoff > 0 {
+			c.maxBackoff = maxBackoff
+		}
+	}
+}
+
+// WithMaxRetryAfter caps the wait before a retry which a Retry-After header asks for, a zero value keeps
+// the default.
+func WithMaxRetryAfter(maxRetryAfter time.Duration) PaiNetClientOption {
+	return func(c *paiNetClient) {
+		if maxRetryAfter > 0 {
+			c.maxRetryAfter = maxRetryAfter
+		}
+	}
+}
+
+type paiNetClient struct {
+	baseUrl    string
+	httpClient *http.Client
+
+	rateLimit rate.Limit
+	rateBurst int
+
+	maxRetries    int
+	minBackoff    time.Duration
+	maxBackoff    time.Duration
+	maxRetryAfter time.Duration
+
+	lk       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+var _ PaiNetClient = (*paiNetClient)(nil)
+
+func NewPaiNetClient(opts ...PaiNetClientOption) PaiNetClient {
+	c := &paiNetClient{
+		baseUrl: defaultPaiNetBaseUrl,
+		httpClient: &http.Client{
+			Timeout:   defaultPaiNetTimeout,
+			Transport: http.DefaultTransport,
+		},
+		rateLimit:     defaultPaiNetRateLimit,
+		rateBurst:     defaultPaiNetRateBurst,
+		maxRetries:    defaultPaiNetMaxRetries,
+		minBackoff:    defaultPaiNetMinBackoff,
+		maxBackoff:    defaultPaiNetMaxBackoff,
+		maxRetryAfter: defaultPaiNetMaxRetryAfter,
+		limiters:      make(map[string]*rate.Limiter),
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+func (c *paiNetClient) GetBoxList(ctx context.Context, pi *model.PaiNetInfo, page, pageSize int) (*GetBoxListResponse, error) {
+	params := url.Values{}
+	params.Set("page", strconv.Itoa(page))
+	params.Set("pageSize", strconv.Itoa(pageSize))
+
+	var res GetBoxListResponse
+	if err := c.get(ctx, pi, "/boxsupplier/v1/box/list", params, &res); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch boxes")
+	}
+
+	return &res, nil
+}
+
+func (c *paiNetClient) GetBoxIncome(ctx context.Context, pi *model.PaiNetInfo, start, end string, page, pageSize int) (*GetBoxIncomeResponse, error) {
+	params := url.Values{}
+	params.Set("start", start)
+	params.Set("end", end)
+	params.Set("pageSize", strconv.Itoa(pageSize))
+	params.Set("pageIndex", strconv.Itoa(page))
+
+	var res GetBoxIncomeResponse
+	if err := c.get(ctx, pi, "/boxsupplier/v1/supplier/income_v2", params, &res); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch boxes income")
+	}
+
+	return &res, nil
+}
+
+func (c *paiNetClient) GetBoxBandwidth(ctx context.Context, pi *model.PaiNetInfo, date string, boxIds []string) (*GetBoxBandwidthResponse, error) {
+	params := url.Values{}
+	params.Set("date", date)
+	params["boxId"] = boxIds
+
+	var res GetBoxBandwidthResponse
+	if err := c.get(ctx, pi, "/boxsupplier/v1/box/bandwidth", params, &res); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch boxes bandwidth")
+	}
+
+	return &res, nil
+}
+
+func (c *paiNetClient) GetBoxQualities(ctx context.Context, pi *model.PaiNetInfo, date string, boxIds []string) (*GetBoxQualitiesResponse, error) {
+	params := url.Values{}
+	params.Set("date", date)
+	params["boxId"] = boxIds
+
+	var res GetBoxQualitiesResponse
+	if err := c.get(ctx, pi, "/boxsupplier/v1/box/quality", params, &res); err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch boxes qualities")
+	}
+
+	return &res, nil
+}
+
+func (c *paiNetClient) get(ctx context.Context, pi *model.PaiNetInfo, path string, params url.Values, out interface{}) error {
+	response, err := c.doRequest(ctx, pi, fmt.Sprintf("%s%s?%s", c.baseUrl, path, params.Encode()))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(response, out)
+}
+
+// limiter returns the token bucket shared by every request of the account.
+func (c *paiNetClient) limiter(pi *model.PaiNetInfo) *rate.Limiter {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+
+	l, ok := c.limiters[pi.APIKey]
+	if !ok {
+		l = rate.NewLimiter(c.rateLimit, c.rateBurst)
+		c.limiters[pi.APIKey] = l
+	}
+
+	return l
+}
+
+func (c *paiNetClient) doRequest(ctx context.Context, pi *model.PaiNetInfo, url string) ([]byte, error) {
+	limiter := c.limiter(pi)
+
+	for attempt := 0; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return nil, err
+		}
+
+		body, err := c.doRequestOnce(ctx, pi, url)
+		if err == nil {
+			return body, nil
+		}
+
+		if attempt >= c.maxRetries || !IsRetryable(err) || ctx.Err() != nil {
+			return nil, err
+		}
+
+		wait := c.backoff(attempt)
+		var paiNetErr *PaiNetError
+		if errors.As(err, &paiNetErr) && paiNetErr.RetryAfter > wait {
+			wait = min(paiNetErr.RetryAfter, c.maxRetryAfter)
+		}
+
+		log.Warnf("request %s failed (attempt %d/%d), retrying in %s: %v", url, attempt+1, c.maxRetries+1, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff returns a random duration between half and all of minBackoff * 2^attempt, kept within
+// minBackoff ~ maxBackoff.
+func (c *paiNetClient) backoff(attempt int) time.Duration {
+	backoff := c.maxBackoff
+	if attempt < 32 && c.minBackoff<<attempt < c.maxBackoff {
+		backoff = c.minBackoff << attempt
+	}
+
+	jittered := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+	return min(max(jittered, c.minBackoff), c.maxBackoff)
+}
+
+func (c *paiNetClient) doRequestOnce(ctx context.Context, pi *model.PaiNetInfo, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now().Unix()
+	sign := generateMD5Hash(pi.APISecret, pi.PaiUsername, timestamp)
+
+	request.Header.Set("ak", pi.APIKey)
+	request.Header.Set("timestamp", fmt.Sprintf("%d", timestamp))
+	request.Header.Set("sign", sign)
+
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newPaiNetError(resp, body)
+	}
+
+	return body, nil
+}
+
+func generateMD5Hash(as, account string, timestamp int64) string {
+	text := fmt.Sprintf("%s#%d#%s", as, timestamp, account)
+	hash := md5.Sum([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// PaiNetError is returned when the PaiNet api answers with a non-200 status. The Response envelope
+// is decoded from the body when the api provides one.
+type PaiNetError struct {
+	Response
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *PaiNetError) Error() string {
+	if e.Reason == "" && e.Message == "" {
+		return fmt.Sprintf("painet: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	return fmt.Sprintf("painet: %d %s: code=%d reason=%s message=%s", e.StatusCode, http.StatusText(e.StatusCode), e.Code, e.Reason, e.Message)
+}
+
+// Temporary reports whether the request may succeed if sent again: the api is throttling us or failed on its side.
+func (e *PaiNetError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+func newPaiNetError(resp *http.Response, body []byte) *PaiNetError {
+	e := &PaiNetError{
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+
+	_ = json.Unmarshal(body, &e.Response)
+	return e
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header, delay seconds and an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+
+	return 0
+}
+
+// IsRetryable tells transient failures, such as throttling, upstream 5xx and network errors, apart from
+// permanent ones like bad credentials or malformed requests.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var paiNetErr *PaiNetError
+	if errors.As(err, &paiNetErr) {
+		return paiNetErr.Temporary()
+	}
+
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
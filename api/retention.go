@@ -0,0 +1,262 @@
+package api
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"time"
+)
+
+const (
+	defaultRetentionBatchSize = 1000
+
+	archiveFormatNDJSON = "ndjson"
+)
+
+// RetentionReport describes the expired rows of a table, those removed by a run or that would be by a dry run.
+type RetentionReport struct {
+	Table   string    `json:"table"`
+	TTL     string    `json:"ttl"`
+	Cutoff  time.Time `json:"cutoff"`
+	Expired int64     `json:"expired"`
+	Deleted int64     `json:"deleted"`
+	Archive string    `json:"archive,omitempty"`
+	DryRun  bool      `json:"dryRun"`
+}
+
+// Retention deletes the rows of the time-series tables older than their TTL, archiving them first when
+// an archive directory is configured.
+type Retention struct {
+	cfg   config.RetentionConfig
+	store dao.RetentionStore
+}
+
+func NewRetention(store dao.RetentionStore, cfg config.RetentionConfig) (*Retention, error) {
+	for table, ttl := range cfg.TTL {
+		if !dao.IsRetentionTable(table) {
+			return nil, fmt.Errorf("invalid retention table: %s", table)
+		}
+
+		if ttl < 0 {
+			return nil, fmt.Errorf("invalid retention ttl of %s: %s", table, ttl)
+		}
+	}
+
+	if cfg.ArchiveFormat == "" {
+		cfg.ArchiveFormat = archiveFormatNDJSON
+	}
+
+	if cfg.ArchiveFormat != archiveFormatNDJSON {
+		return nil, fmt.Errorf("unsupported archive format: %s", cfg.ArchiveFormat)
+	}
+
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = defaultRetentionBatchSize
+	}
+
+	return &Retention{cfg: cfg, store: store}, nil
+}
+
+// tables returns the tables with a TTL, in a stable order.
+func (r *Retention) tables() []string {
+	var tables []string
+	for table, ttl := range r.cfg.TTL {
+		if ttl > 0 {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// Report returns what a run at now would remove, without removing anything.
+func (r *Retention) Report(ctx context.Context, now time.Time) ([]*RetentionReport, error) {
+	var reports []*RetentionReport
+	for _, table := range r.tables() {
+		report := r.newReport(table, now)
+		report.DryRun = true
+
+		expired, err := r.store.CountExpiredRows(ctx, table, report.Cutoff)
+		if err != nil {
+			return nil, err
+		}
+		report.Expired = expired
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// Run removes the expired rows of every table, only reporting them when the retention is a dry run.
+func (r *Retention) Run(ctx context.Context, now time.Time) ([]*RetentionReport, error) {
+	if r.cfg.DryRun {
+		return r.Report(ctx, now)
+	}
+
+	var reports []*RetentionReport
+	for _, table := range r.tables() {
+		report := r.newReport(table, now)
+		if err := r.expire(ctx, report, now); err != nil {
+			return reports, fmt.Errorf("expire %s: %w", table, err)
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func (r *Retention) newReport(table string, now time.Time) *RetentionReport {
+	ttl := r.cfg.TTL[table]
+	return &RetentionReport{
+		Table:  table,
+		TTL:    ttl.String(),
+		Cutoff: now.Add(-ttl),
+	}
+}
+
+// expire deletes the expired rows of the table batch by batch, each batch is written to the archive
+// before it is deleted so that an interrupted run loses nothing.
+func (r *Retention) expire(ctx context.Context, report *RetentionReport, now time.Time) error {
+	var archive *archiveWriter
+	defer func() {
+		if archive != nil {
+			if err := archive.Close(); err != nil {
+				log.Errorf("close archive %s: %v", archive.path, err)
+			}
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		batch, err := r.store.GetExpiredRows(ctx, report.Table, report.Cutoff, r.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		if len(batch.Rows) == 0 {
+			return nil
+		}
+
+		if r.cfg.ArchiveDir != "" {
+			if archive == nil {
+				archive, err = createArchive(r.cfg.ArchiveDir, report.Table, report.Cutoff, now)
+				if err != nil {
+					return err
+				}
+				report.Archive = archive.path
+			}
+
+			if err := archive.Write(batch.Rows); err != nil {
+				return err
+			}
+		}
+
+		deleted, err := r.store.DeleteExpiredRows(ctx, batch, report.Cutoff)
+		if err != nil {
+			return err
+		}
+
+		report.Expired += int64(len(batch.Rows))
+		report.Deleted += deleted
+
+		if len(batch.Rows) < r.cfg.BatchSize {
+			return nil
+		}
+	}
+}
+
+// archiveWriter writes the rows as gzip compressed NDJSON, one object of the row columns per line.
+type archiveWriter struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+}
+
+func createArchive(dir, table string, cutoff, now time.Time) (*archiveWriter, error) {
+	dir = filepath.Join(dir, table)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%s-%s-%s.ndjson.gz", table, cutoff.Format("20060102"), now.Format("20060102T150405"))
+	path := filepath.Join(dir, name)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	return &archiveWriter{path: path, file: file, gz: gz, enc: json.NewEncoder(gz)}, nil
+}
+
+// Write appends the rows and syncs them to disk, they are safe to delete once it returns.
+func (w *archiveWriter) Write(rows []interface{}) error {
+	for _, row := range rows {
+		if err := w.enc.Encode(columnsOf(row)); err != nil {
+			return err
+		}
+	}
+
+	if err := w.gz.Flush(); err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+func (w *archiveWriter) Close() error {
+	if err := w.gz.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// columnsOf maps the db columns of a row to their values, the json tags of the models hide some of them.
+func columnsOf(row interface{}) map[string]interface{} {
+	v := reflect.Indirect(reflect.ValueOf(row))
+	columns := make(map[string]interface{})
+	for i := 0; i < v.NumField(); i++ {
+		column := v.Type().Field(i).Tag.Get("db")
+		if column == "" || column == "-" {
+			continue
+		}
+		columns[column] = v.Field(i).Interface()
+	}
+	return columns
+}
+
+func (d *DataService) startRetention(ctx context.Context) {
+	if !d.acquire("retention") {
+		log.Warnf("retention is still running, skipped")
+		return
+	}
+	defer d.release("retention")
+
+	reports, err := d.Retention.Run(ctx, time.Now())
+	for _, report := range reports {
+		if report.DryRun {
+			log.Infof("retention dry run: %d rows of %s older than %s would be removed", report.Expired, report.Table, report.Cutoff.Format(time.DateTime))
+			continue
+		}
+		log.Infof("retention: removed %d rows of %s older than %s", report.Deleted, report.Table, report.Cutoff.Format(time.DateTime))
+	}
+
+	if err != nil {
+		log.Errorf("retention: %v", err)
+	}
+}
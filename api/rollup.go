@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"math"
+	"sort"
+)
+
+// rollupBatchSize bounds the rows of one upsert, to stay below the bind variable limits of the databases.
+const rollupBatchSize = 1000
+
+// seriesSpan returns the boxes and the whole days covered by the points, which are the rollup buckets to rebuild.
+func seriesSpan(boxIds map[string]bool, times []model.Timestamp) ([]string, int64, int64) {
+	var ids []string
+	for id := range boxIds {
+		ids = append(ids, id)
+	}
+
+	start, end := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, t := range times {
+		start = min(start, dao.RollupBucket(dao.GranularityDay, int64(t)))
+		end = max(end, dao.RollupBucketEnd(dao.GranularityDay, int64(t))-1)
+	}
+
+	return ids, start, end
+}
+
+// percentile returns the p-th percentile of the sorted values using the nearest rank method.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return sorted[rank]
+}
+
+type stats struct {
+	avg, max, min, p95 float64
+}
+
+func statsOf(values []float64) stats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+
+	return stats{
+		avg: sum / float64(len(sorted)),
+		max: sorted[len(sorted)-1],
+		min: sorted[0],
+		p95: percentile(sorted, 95),
+	}
+}
+
+func average(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+type bucketKey struct {
+	boxId string
+	time  int64
+}
+
+func bandwidthRollups(granularity string, points []*model.BoxBandwidth) []*model.BoxBandwidthRollup {
+	buckets := make(map[bucketKey][]*model.BoxBandwidth)
+	var keys []bucketKey
+	for _, p := range points {
+		key := bucketKey{boxId: p.BoxId, time: dao.RollupBucket(granularity, int64(p.Time))}
+		if _, ok := buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+		buckets[key] = append(buckets[key], p)
+	}
+
+	var out []*model.BoxBandwidthRollup
+	for _, key := range keys {
+		bucket := buckets[key]
+
+		var uploads, downloads []float64
+		for _, p := range bucket {
+			uploads = append(uploads, p.Upload)
+			downloads = append(downloads, p.Download)
+		}
+
+		upload, download := statsOf(uploads), statsOf(downloads)
+		out = append(out, &model.BoxBandwidthRollup{
+			Username:      bucket[0].Username,
+			BoxId:         key.boxId,
+			SupplierBoxId: bucket[0].SupplierBoxId,
+			Time:          model.Timestamp(key.time),
+			Samples:       int64(len(bucket)),
+			UploadAvg:     upload.avg,
+			UploadMax:     upload.max,
+			UploadMin:     upload.min,
+			UploadP95:     upload.p95,
+			DownloadAvg:   download.avg,
+			DownloadMax:   download.max,
+			DownloadMin:   download.min,
+			DownloadP95:   download.p95,
+		})
+	}
+
+	return out
+}
+
+func qualityRollups(granularity string, points []*model.BoxQuality) []*model.BoxQualityRollup {
+	buckets := make(map[bucketKey][]*model.BoxQuality)
+	var keys []bucketKey
+	for _, p := range points {
+		key := bucketKey{boxId: p.BoxId, time: dao.RollupBucket(granularity, int64(p.Time))}
+		if _, ok := buckets[key]; !ok {
+			keys = append(keys, key)
+		}
+		buckets[key] = append(buckets[key], p)
+	}
+
+	var out []*model.BoxQualityRollup
+	for _, key := range keys {
+		bucket := buckets[key]
+
+		var packetLoss, cpu, memory, disk []float64
+		for _, p := range bucket {
+			packetLoss = append(packetLoss, p.PacketLoss)
+			cpu = append(cpu, p.CpuUsage)
+			memory = append(memory, p.MemoryUsage)
+			disk = append(disk, p.DiskUsage)
+		}
+
+		out = append(out, &model.BoxQualityRollup{
+			Username:       bucket[0].Username,
+			BoxId:          key.boxId,
+			SupplierBoxId:  bucket[0].SupplierBoxId,
+			Time:           model.Timestamp(key.time),
+			Samples:        int64(len(bucket)),
+			PacketLossAvg:  average(packetLoss),
+			CpuUsageAvg:    average(cpu),
+			MemoryUsageAvg: average(memory),
+			DiskUsageAvg:   average(disk),
+		})
+	}
+
+	return out
+}
+
+// rollupBandwidth rebuilds the hourly and daily bandwidth rollups of the boxes over the days touched by a sync,
+// from the raw points stored for those days.
+func (d *DataService) rollupBandwidth(ctx context.Context, username string, saved []*model.BoxBandwidth) error {
+	if len(saved) == 0 {
+		return nil
+	}
+
+	boxIds := make(map[string]bool)
+	var times []model.Timestamp
+	for _, b := range saved {
+		boxIds[b.BoxId] = true
+		times = append(times, b.Time)
+	}
+
+	ids, start, end := seriesSpan(boxIds, times)
+	points, err := d.metrics.GetBoxBandwidth(ctx, username, ids, nil, start, end)
+	if err != nil || len(points) == 0 {
+		return err
+	}
+
+	for _, granularity := range dao.RollupGranularities {
+		rollups := bandwidthRollups(granularity, points)
+		for i := 0; i < len(rollups); i += rollupBatchSize {
+			batch := rollups[i:min(i+rollupBatchSize, len(rollups))]
+			if err := d.metrics.BulkUpsertBoxBandwidthRollups(ctx, granularity, batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollupQualities rebuilds the hourly and daily quality rollups of the boxes over the days touched by a sync,
+// from the raw points stored for those days.
+func (d *DataService) rollupQualities(ctx context.Context, username string, saved []*model.BoxQuality) error {
+	if len(saved) == 0 {
+		return nil
+	}
+
+	boxIds := make(map[string]bool)
+	var times []model.Timestamp
+	for _, q := range saved {
+		boxIds[q.BoxId] = true
+		times = append(times, q.Time)
+	}
+
+	ids, start, end := seriesSpan(boxIds, times)
+	points, err := d.metrics.GetBoxQualities(ctx, username, ids, nil, start, end)
+	if err != nil || len(points) == 0 {
+		return err
+	}
+
+	for _, granularity := range dao.RollupGranularities {
+		rollups := qualityRollups(granularity, points)
+		for i := 0; i < len(rollups); i += rollupBatchSize {
+			batch := rollups[i:min(i+rollupBatchSize, len(rollups))]
+			if err := d.metrics.BulkUpsertBoxQualityRollups(ctx, granularity, batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,46 +1,231 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
 	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
 	logging "github.com/ipfs/go-log/v2"
+	"net/http"
+	"time"
 )
 
 var log = logging.Logger("api")
 
-func ServerAPI(cfg *config.Config) {
+const shutdownTimeout = 30 * time.Second
+
+// Server serves the api handlers from the injected stores.
+type Server struct {
+	boxes    dao.BoxStore
+	incomes  dao.IncomeStore
+	metrics  dao.MetricsStore
+	alerts   dao.AlertStore
+	webhooks dao.WebhookStore
+	channels dao.NotifyChannelStore
+	apiKeys  dao.APIKeyStore
+	sessions dao.SessionStore
+	totp     dao.TOTPStore
+	users    dao.UserStore
+
+	// notifications sends the test messages of the notify channels.
+	notifications *Notifications
+	// auth verifies the registrations and throttles the logins.
+	auth *Auth
+	// tokens issues the access tokens of the sessions.
+	tokens *jwt.GinJWTMiddleware
+
+	// signSkew and nonces check the timestamps and the replays of the requests signed with an AppKey,
+	// allowMD5 accepts the legacy md5 signatures.
+	signSkew time.Duration
+	nonces   *nonceCache
+	allowMD5 bool
+
+	// secrets seals the secrets of the api keys.
+	secrets *SecretBox
+
+	// allowPrivateWebhooks accepts the webhook endpoints on the internal network.
+	allowPrivateWebhooks bool
+
+	// apiKeyTTL, rotateGrace and maxAPIKeys bound the named keys of the users.
+	apiKeyTTL   time.Duration
+	rotateGrace time.Duration
+	maxAPIKeys  int
+}
+
+func NewServer(stores *dao.Stores) *Server {
+	return &Server{
+		boxes:       stores.Boxes,
+		incomes:     stores.Incomes,
+		metrics:     stores.Metrics,
+		alerts:      stores.Alerts,
+		webhooks:    stores.Webhooks,
+		channels:    stores.Channels,
+		apiKeys:     stores.APIKeys,
+		sessions:    stores.Sessions,
+		totp:        stores.TOTP,
+		users:       stores.Users,
+		signSkew:    defaultSignSkew,
+		nonces:      newNonceCache(2*defaultSignSkew, defaultNonceCacheSize),
+		apiKeyTTL:   defaultAPIKeyTTL,
+		rotateGrace: defaultAPIKeyRotateGrace,
+		maxAPIKeys:  defaultMaxAPIKeys,
+		auth:        NewAuth(config.AuthConfig{}, config.NotifyConfig{}),
+	}
+}
+
+// supplierRoutes registers the handlers of the supplier api on a group authenticating its users, each in
+// the scope of the named keys it belongs to.
+func (s *Server) supplierRoutes(g *gin.RouterGroup) {
+	//https://box.painet.work/api/boxsupplier/v1/supplier/income_v2/summary?incomeType=0
+	g.GET("/supplier/income_v2/summary", readScope(model.APIKeyScopeIncome), s.QueryBoxIncomeSummaryGet)
+	g.GET("/box/list", readScope(model.APIKeyScopeBox), s.QueryBoxListGet)
+	g.POST("/box/list", readScope(model.APIKeyScopeBox), s.QueryBoxListPost)
+	g.GET("/box/:boxId/history", readScope(model.APIKeyScopeBox), s.QueryBoxHistoryGet)
+	g.POST("/box/uptime", readScope(model.APIKeyScopeBox), s.QueryBoxUptimePost)
+	g.GET("/supplier/income_v2", readScope(model.APIKeyScopeIncome), s.QueryBoxIncomeV2Get)
+	g.POST("/supplier/income_v2", readScope(model.APIKeyScopeIncome), s.QueryBoxIncomeV2Post)
+	g.GET("/box/bandwidth", readScope(model.APIKeyScopeBox), s.QueryBoxBandwidthGet)
+	g.POST("/box/bandwidth", readScope(model.APIKeyScopeBox), s.QueryBoxBandwidthPost)
+	g.GET("/box/quality", readScope(model.APIKeyScopeBox), s.QueryBoxQualityGet)
+	g.POST("/box/quality", readScope(model.APIKeyScopeBox), s.QueryBoxQualityPost)
+	g.GET("/alerts", readScope(model.APIKeyScopeAlert), s.QueryAlertsGet)
+	g.GET("/webhooks", readScope(model.APIKeyScopeWebhook), s.QueryWebhooksGet)
+	g.POST("/webhooks", writeScope(model.APIKeyScopeWebhook), s.CreateWebhookPost)
+	g.DELETE("/webhooks/:id", writeScope(model.APIKeyScopeWebhook), s.DeleteWebhook)
+	g.GET("/webhooks/deliveries", readScope(model.APIKeyScopeWebhook), s.QueryWebhookDeliveriesGet)
+	g.POST("/webhooks/deliveries/:id/redeliver", writeScope(model.APIKeyScopeWebhook), s.RedeliverWebhookPost)
+	g.GET("/notify/channels", readScope(model.APIKeyScopeNotify), s.QueryNotifyChannelsGet)
+	g.POST("/notify/channels", writeScope(model.APIKeyScopeNotify), s.CreateNotifyChannelPost)
+	g.PUT("/notify/channels/:id", writeScope(model.APIKeyScopeNotify), s.UpdateNotifyChannelPut)
+	g.DELETE("/notify/channels/:id", writeScope(model.APIKeyScopeNotify), s.DeleteNotifyChannel)
+	g.POST("/notify/channels/:id/test", writeScope(model.APIKeyScopeNotify), s.TestNotifyChannelPost)
+}
+
+// ServerAPI serves the http api until ctx is cancelled, then stops accepting connections and waits
+// up to shutdownTimeout for the requests in flight to complete.
+func ServerAPI(ctx context.Context, cfg *config.Config, stores *dao.Stores) error {
+	s := NewServer(stores)
+	s.notifications = NewNotifications(stores.Channels, cfg.Notify)
+	s.auth = NewAuth(cfg.Auth, cfg.Notify)
+
+	if cfg.APIKey.Skew > 0 {
+		s.signSkew = cfg.APIKey.Skew
+	}
+
+	nonceCacheSize := defaultNonceCacheSize
+	if cfg.APIKey.NonceCacheSize > 0 {
+		nonceCacheSize = cfg.APIKey.NonceCacheSize
+	}
+	s.nonces = newNonceCache(2*s.signSkew, nonceCacheSize)
+	s.allowMD5 = cfg.APIKey.AllowMD5
+	s.allowPrivateWebhooks = cfg.Webhooks.AllowPrivateTargets
+
+	if cfg.APIKey.TTL > 0 {
+		s.apiKeyTTL = min(cfg.APIKey.TTL, maxAPIKeyTTL)
+	}
+
+	if cfg.APIKey.RotateGrace > 0 {
+		s.rotateGrace = min(cfg.APIKey.RotateGrace, maxAPIKeyRotateGrace)
+	}
+
+	if cfg.APIKey.MaxKeys > 0 {
+		s.maxAPIKeys = cfg.APIKey.MaxKeys
+	}
+
+	if cfg.APIKey.EncryptionKey == config.ExampleEncryptionKey {
+		return errors.New("the api key encryption key is left at its example value")
+	}
+
+	secrets, err := NewSecretBox(cfg.APIKey.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	s.secrets = secrets
+
+	imported, err := s.ImportUserAppKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("import user app keys: %w", err)
+	}
+
+	if imported > 0 {
+		log.Infof("moved the app keys of %d users to their api keys", imported)
+	}
+
 	gin.SetMode(cfg.Mode)
 	r := gin.Default()
 	r.Use(Cors())
 	r.Use(RequestLoggerMiddleware())
 
-	authMiddleware, err := jwtGinMiddleware(cfg.SecretKey)
+	authMiddleware, err := s.jwtGinMiddleware(cfg.SecretKey)
 	if err != nil {
 		log.Fatalf("jwt auth middleware: %v", err)
 	}
+	s.tokens = authMiddleware
 
 	managerV1 := r.Group("/boxmanager/v1")
 	// https://box.painet.work/api/boxmanager/v1/supplier/login
 	managerV1.POST("/supplier/login", authMiddleware.LoginHandler)
 	// https://box.painet.work/api/boxmanager/v1/supplier/info
-	managerV1.GET("/supplier/info", QueryUserInfoHandler)
+	managerV1.GET("/supplier/info", authMiddleware.MiddlewareFunc(), s.QueryUserInfoHandler)
 	// https://box.painet.work/api/boxmanager/v1/supplier/register
-	managerV1.POST("/supplier/register", UserRegister)
+	managerV1.POST("/supplier/register", s.UserRegister)
+	managerV1.POST("/supplier/verify_code", s.SendVerifyCodeHandler)
+	managerV1.POST("/supplier/refresh_token", s.RefreshTokenHandler)
+	managerV1.POST("/supplier/logout", authMiddleware.MiddlewareFunc(), s.LogoutHandler)
+	managerV1.POST("/supplier/password", authMiddleware.MiddlewareFunc(), s.ChangePasswordHandler)
+	managerV1.GET("/supplier/sessions", authMiddleware.MiddlewareFunc(), s.QuerySessionsHandler)
+	managerV1.DELETE("/supplier/sessions/:id", authMiddleware.MiddlewareFunc(), s.RevokeSessionHandler)
+	managerV1.GET("/supplier/2fa", authMiddleware.MiddlewareFunc(), s.QueryTOTPHandler)
+	managerV1.POST("/supplier/2fa/enroll", authMiddleware.MiddlewareFunc(), s.EnrollTOTPHandler)
+	managerV1.POST("/supplier/2fa/confirm", authMiddleware.MiddlewareFunc(), s.ConfirmTOTPHandler)
+	managerV1.POST("/supplier/2fa/disable", authMiddleware.MiddlewareFunc(), s.DisableTOTPHandler)
 
 	apiV1 := r.Group("/boxsupplier/v1")
 	apiV1.Use(authMiddleware.MiddlewareFunc())
-	//https://box.painet.work/api/boxsupplier/v1/supplier/income_v2/summary?incomeType=0
-	apiV1.GET("/supplier/income_v2/summary")
-	apiV1.GET("/box/list", QueryBoxListGet)
-	apiV1.POST("/box/list", QueryBoxListPost)
-	apiV1.GET("/supplier/income_v2", QueryBoxIncomeV2Get)
-	apiV1.POST("/supplier/income_v2", QueryBoxIncomeV2Post)
-	apiV1.GET("/box/bandwidth", QueryBoxBandwidthGet)
-	apiV1.POST("/box/bandwidth", QueryBoxBandwidthPost)
-	apiV1.GET("/box/quality", QueryBoxQualityGet)
-	apiV1.POST("/box/quality", QueryBoxQualityPost)
-
-	if err := r.Run(cfg.ApiListen); err != nil {
-		log.Fatalf("starting server: %v\n", err)
+	s.supplierRoutes(apiV1)
+	// the api keys are only managed with a JWT, never with a key
+	apiV1.GET("/apikeys", s.QueryAPIKeysGet)
+	apiV1.POST("/apikeys", s.CreateAPIKeyPost)
+	apiV1.POST("/apikeys/:id/rotate", s.RotateAPIKeyPost)
+	apiV1.DELETE("/apikeys/:id", s.RevokeAPIKey)
+
+	// the machine clients call the same handlers with requests signed by the api keys of their user
+	openV1 := r.Group("/openapi/boxsupplier/v1")
+	openV1.Use(s.AuthorizationMiddlewareFunc())
+	s.supplierRoutes(openV1)
+
+	srv := &http.Server{
+		Addr:    cfg.ApiListen,
+		Handler: r,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Info("shutting down api server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
 	}
+
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
 }
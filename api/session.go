@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+const (
+	// sessionKey is the claim of the JWTs holding the id of their session.
+	sessionKey = "sid"
+	// refreshTokenKey holds the refresh token of a login until the response is written.
+	refreshTokenKey = "REFRESH_TOKEN"
+
+	maxUserAgentLength = 512
+)
+
+var errInvalidRefreshToken = errors.New("invalid refresh token")
+
+// tokenIdentity is the payload of the access tokens.
+type tokenIdentity struct {
+	Username  string
+	SessionId string
+}
+
+// newRefreshToken returns a refresh token of the session, as "sessionId.secret", and the hash kept of it.
+func newRefreshToken(sessionId string) (string, string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+	return sessionId + "." + secret, hashSecret(secret), nil
+}
+
+func parseRefreshToken(token string) (string, string, bool) {
+	sessionId, secret, ok := strings.Cut(token, ".")
+	return sessionId, secret, ok && sessionId != "" && secret != ""
+}
+
+// createSession starts a session of the user logging in from the client of c and returns its refresh token.
+func (s *Server) createSession(c *gin.Context, username string) (*model.Session, string, error) {
+	now := time.Now()
+	session := &model.Session{
+		Id:         uuid.NewString(),
+		Username:   username,
+		UserAgent:  truncate(c.Request.UserAgent(), maxUserAgentLength),
+		Ip:         c.ClientIP(),
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(s.auth.cfg.RefreshTokenTTL),
+	}
+
+	token, hash, err := newRefreshToken(session.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	session.RefreshTokenHash = hash
+
+	if err := s.sessions.CreateSession(c.Request.Context(), session); err != nil {
+		return nil, "", err
+	}
+
+	return session, token, nil
+}
+
+// rotateSession exchanges a refresh token for a new one. A refresh token is only accepted once: presenting
+// the one replaced by the last rotation again, as a thief or the legitimate client would after the other
+// used it, revokes the session.
+func (s *Server) rotateSession(c *gin.Context, refreshToken string) (*model.Session, string, error) {
+	ctx := c.Request.Context()
+
+	sessionId, secret, ok := parseRefreshToken(refreshToken)
+	if !ok {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	session, err := s.sessions.GetSession(ctx, sessionId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	now := time.Now()
+	if !session.Active(now) {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	hash := hashSecret(secret)
+	if session.PreviousTokenHash != "" && hash == session.PreviousTokenHash {
+		log.Warnf("refresh token of session %s of %s reused, revoking the session", session.Id, session.Username)
+		if err := s.sessions.RevokeSession(ctx, session.Username, session.Id, now); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, "", err
+		}
+		return nil, "", errInvalidRefreshToken
+	}
+
+	if hash != session.RefreshTokenHash {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	token, newHash, err := newRefreshToken(session.Id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	session.PreviousTokenHash, session.RefreshTokenHash = session.RefreshTokenHash, newHash
+	session.UserAgent, session.Ip = truncate(c.Request.UserAgent(), maxUserAgentLength), c.ClientIP()
+	session.LastSeenAt, session.ExpiresAt = now, now.Add(s.auth.cfg.RefreshTokenTTL)
+
+	err = s.sessions.RotateSession(ctx, session, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", errInvalidRefreshToken
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return session, token, nil
+}
+
+// activeSession reports whether the session of the access token was neither revoked nor expired, which the
+// JWT middleware checks on every request.
+func (s *Server) activeSession(ctx context.Context, username, sessionId string) bool {
+	if sessionId == "" {
+		return false
+	}
+
+	session, err := s.sessions.GetSession(ctx, sessionId)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Errorf("get session: %v", err)
+		}
+		return false
+	}
+
+	return session.Username == username && session.Active(time.Now())
+}
@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testContext() *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+	return c
+}
+
+func TestRotateSession(t *testing.T) {
+	s := NewServer(dao.NewStores(dao.NewMemoryStore()))
+	ctx := context.Background()
+
+	session, first, err := s.createSession(testContext(), "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, second, err := s.rotateSession(testContext(), first)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name       string
+		token      string
+		wantErr    bool
+		wantActive bool
+	}{
+		{name: "malformed token", token: "garbage", wantErr: true, wantActive: true},
+		{name: "unknown session", token: "missing." + "00", wantErr: true, wantActive: true},
+		{name: "wrong secret", token: session.Id + ".00", wantErr: true, wantActive: true},
+		{name: "reused rotated token", token: first, wantErr: true},
+		{name: "current token of the revoked session", token: second, wantErr: true},
+	}
+
+	for _, c := range cases {
+		_, _, err := s.rotateSession(testContext(), c.token)
+		if (err != nil) != c.wantErr || (err != nil && !errors.Is(err, errInvalidRefreshToken)) {
+			t.Errorf("%s: error = %v, want %v", c.name, err, errInvalidRefreshToken)
+		}
+
+		if active := s.activeSession(ctx, "u", session.Id); active != c.wantActive {
+			t.Errorf("%s: session active = %v, want %v", c.name, active, c.wantActive)
+		}
+	}
+}
+
+func TestAccessTokenOfRevokedSession(t *testing.T) {
+	s := NewServer(dao.NewStores(dao.NewMemoryStore()))
+
+	mw, err := s.jwtGinMiddleware("test secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/info", mw.MiddlewareFunc(), func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	session, _, err := s.createSession(testContext(), "u")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(identity *tokenIdentity) string {
+		tok, _, err := mw.TokenGenerator(identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+
+	cases := []struct {
+		name   string
+		token  string
+		revoke bool
+		want   int
+	}{
+		{name: "active session", token: token(&tokenIdentity{Username: "u", SessionId: session.Id}), want: http.StatusOK},
+		{name: "without a session", token: token(&tokenIdentity{Username: "u"}), want: http.StatusBadRequest},
+		{name: "session of another user", token: token(&tokenIdentity{Username: "v", SessionId: session.Id}), want: http.StatusBadRequest},
+		{name: "revoked session", token: token(&tokenIdentity{Username: "u", SessionId: session.Id}), revoke: true, want: http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		if c.revoke {
+			if err := s.sessions.RevokeSession(context.Background(), "u", session.Id, time.Now()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/info", nil)
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		r.ServeHTTP(w, req)
+
+		if w.Code != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
@@ -2,41 +2,93 @@ package api
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
+	"database/sql"
+	"github.com/gnasnik/titan-box-api/config"
 	"github.com/gnasnik/titan-box-api/core/dao"
 	"github.com/gnasnik/titan-box-api/core/generated/model"
 	"github.com/pkg/errors"
 	"github.com/robfig/cron/v3"
-	"io"
-	"net/http"
+	"golang.org/x/sync/errgroup"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	// API endpoint for fetching boxes
-	paiNetBaseUrl = "https://openapi.painet.work"
-
 	defaultPageSize = 200
+
+	// syncDataTypeBoxList names the box list syncs in the sync.failed events, they have no checkpoints.
+	syncDataTypeBoxList = "box_list"
+
+	defaultAccountConcurrency = 4
+	defaultPageConcurrency    = 4
+	defaultAccountTimeout     = 30 * time.Minute
+
+	writeGracePeriod = 30 * time.Second
 )
 
 type DataService struct {
 	Interval time.Duration
 
-	lk sync.Mutex
-	//Fetchers map[string]DataFetcher
+	// AccountConcurrency bounds how many PaiNet accounts are synced at once, PageConcurrency how many
+	// pages of a single account are fetched at once.
+	AccountConcurrency int
+	PageConcurrency    int
+	// AccountTimeout bounds one sync run of an account, so a slow supplier cannot hold a worker forever.
+	AccountTimeout time.Duration
+	// Retention, when set, expires the old rows of the time-series tables on its schedule.
+	Retention *Retention
+	// Alerter, when set, evaluates the alert rules after each sync of an account.
+	Alerter *Alerter
+	// Webhooks, when set, receives the events of the syncs and delivers them to the endpoints of the users.
+	Webhooks *Webhooks
+	// Notifications, when set, sends the alerts raised to the chat and email channels of the users.
+	Notifications *Notifications
+
+	client      PaiNetClient
+	boxes       dao.BoxStore
+	incomes     dao.IncomeStore
+	metrics     dao.MetricsStore
+	users       dao.UserStore
+	checkpoints dao.CheckpointStore
+
+	lk      sync.Mutex
+	running map[string]bool
 }
 
-func NewDataService() *DataService {
-	return &DataService{
-		Interval: 10 * time.Minute,
-		//Fetchers: make(map[string]DataFetcher),
+func NewDataService(client PaiNetClient, stores *dao.Stores, cfg config.SyncConfig) *DataService {
+	if client == nil {
+		client = NewPaiNetClient()
+	}
+
+	d := &DataService{
+		Interval:           10 * time.Minute,
+		AccountConcurrency: defaultAccountConcurrency,
+		PageConcurrency:    defaultPageConcurrency,
+		AccountTimeout:     defaultAccountTimeout,
+		client:             client,
+		boxes:              stores.Boxes,
+		incomes:            stores.Incomes,
+		metrics:            stores.Metrics,
+		users:              stores.Users,
+		checkpoints:        stores.Checkpoints,
+		running:            make(map[string]bool),
+	}
+
+	if cfg.AccountConcurrency > 0 {
+		d.AccountConcurrency = cfg.AccountConcurrency
 	}
+
+	if cfg.PageConcurrency > 0 {
+		d.PageConcurrency = cfg.PageConcurrency
+	}
+
+	if cfg.AccountTimeout > 0 {
+		d.AccountTimeout = cfg.AccountTimeout
+	}
+
+	return d
 }
 
 type Response struct {
@@ -45,6 +97,8 @@ type Response struct {
 	Message string `json:"message"`
 }
 
+// Run syncs the PaiNet accounts until ctx is cancelled. It returns once the cron scheduler stopped and the
+// syncs in flight have wound down.
 func (d *DataService) Run(ctx context.Context) {
 	ticker := time.NewTicker(d.Interval)
 	defer ticker.Stop()
@@ -54,151 +108,215 @@ func (d *DataService) Run(ctx context.Context) {
 		cron.WithLocation(time.Local),
 	)
 
-	c.AddFunc("0 0 10 * * *", d.startSyncTimer)
+	c.AddFunc("0 0 10 * * *", func() {
+		d.startSyncTimer(ctx)
+	})
+
+	if d.Retention != nil && d.Retention.cfg.Schedule != "" {
+		if _, err := c.AddFunc(d.Retention.cfg.Schedule, func() {
+			d.startRetention(ctx)
+		}); err != nil {
+			log.Errorf("invalid retention schedule %q: %v", d.Retention.cfg.Schedule, err)
+		}
+	}
 
 	c.Start()
 
-	d.startSyncTicker()
+	var wg sync.WaitGroup
+	if d.Webhooks != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.Webhooks.Run(ctx)
+		}()
+	}
+
+	d.startSyncTicker(ctx)
 
 	for {
 		select {
 		case <-ticker.C:
-			d.startSyncTicker()
+			d.startSyncTicker(ctx)
 		case <-ctx.Done():
-			break
+			log.Info("stopping data service")
+			<-c.Stop().Done()
+			wg.Wait()
+			return
 		}
 	}
 }
 
-func (d *DataService) startSyncTicker() {
-	paiNetInfo, err := dao.GetUserKeys(context.Background())
-	if err != nil {
-		log.Errorf("get user keys: %v", err)
-		return
-	}
-
-	ctx := context.Background()
-
-	for _, pi := range paiNetInfo {
-		if pi.Status == 1 {
-			continue
-		}
-
+func (d *DataService) startSyncTicker(ctx context.Context) {
+	d.forEachAccount(ctx, "ticker", func(ctx context.Context, pi *model.PaiNetInfo) {
 		var wg sync.WaitGroup
 
 		wg.Add(1)
-		go func(pi *model.PaiNetInfo) {
+		go func() {
 			defer wg.Done()
 
-			fmt.Println("start-> sync box list", pi.PaiUsername)
+			log.Infof("start sync box list of %s", pi.PaiUsername)
 			if err := d.syncBoxList(ctx, pi); err != nil {
 				log.Errorf("sync box list error: %v", err)
+				d.emit(ctx, pi.PaiUsername, model.WebhookEventSyncFailed, &SyncFailedEvent{DataType: syncDataTypeBoxList, Error: err.Error()})
 			}
-		}(pi)
+		}()
 
 		wg.Add(1)
-		go func(pi *model.PaiNetInfo) {
+		go func() {
 			defer wg.Done()
 
 			start := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
 			end := time.Now().Format(time.DateOnly)
 
-			if err := d.syncBoxIncome(pi, start, end); err != nil {
+			if _, err := d.syncBoxIncome(ctx, pi, start, end); err != nil {
 				log.Errorf("sync box income error: %v", err)
+				d.emit(ctx, pi.PaiUsername, model.WebhookEventSyncFailed, &SyncFailedEvent{DataType: model.SyncDataTypeIncome, Start: start, End: end, Error: err.Error()})
 			}
-
-		}(pi)
+		}()
 
 		wg.Wait()
-	}
 
+		d.evaluateAlerts(ctx, pi)
+	})
 }
 
-func (d *DataService) startSyncTimer() {
-	paiNetInfo, err := dao.GetUserKeys(context.Background())
-	if err != nil {
-		log.Errorf("get user keys: %v", err)
-		return
-	}
-
-	for _, pi := range paiNetInfo {
-		if pi.Status == 1 {
-			continue
+func (d *DataService) startSyncTimer(ctx context.Context) {
+	d.forEachAccount(ctx, "timer", func(ctx context.Context, pi *model.PaiNetInfo) {
+		yesterday := syncWindow{
+			start: time.Now().AddDate(0, 0, -1).Format(time.DateOnly),
+			end:   time.Now().Format(time.DateOnly),
 		}
 
 		var wg sync.WaitGroup
 
 		wg.Add(1)
-		go func(pi *model.PaiNetInfo) {
+		go func() {
 			defer wg.Done()
 
-			yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
-			if err := d.syncBoxBandwidth(pi, yesterday); err != nil {
+			if err := d.syncWindowWithCheckpoint(ctx, pi, model.SyncDataTypeBandwidth, yesterday); err != nil {
 				log.Errorf("sync box bandwidth error: %v", err)
 			}
-
-		}(pi)
+		}()
 
 		wg.Add(1)
-		go func(pi *model.PaiNetInfo) {
+		go func() {
 			defer wg.Done()
 
-			yesterday := time.Now().AddDate(0, 0, -1).Format(time.DateOnly)
-			if err := d.syncBoxQualities(pi, yesterday); err != nil {
+			if err := d.syncWindowWithCheckpoint(ctx, pi, model.SyncDataTypeQuality, yesterday); err != nil {
 				log.Errorf("sync box qualities error: %v", err)
 			}
-
-		}(pi)
+		}()
 
 		wg.Wait()
+
+		d.evaluateAlerts(ctx, pi)
+	})
+}
+
+// forEachAccount runs job for every enabled PaiNet account on at most AccountConcurrency workers. Each run
+// gets its own timeout, and an account whose previous run of the same job is still going is skipped, so a
+// slow or failing supplier never holds back the others.
+func (d *DataService) forEachAccount(ctx context.Context, name string, job func(ctx context.Context, pi *model.PaiNetInfo)) {
+	paiNetInfo, err := d.users.GetUserKeys(ctx)
+	if err != nil {
+		log.Errorf("get user keys: %v", err)
+		return
 	}
 
+	g := new(errgroup.Group)
+	g.SetLimit(d.AccountConcurrency)
+
+	for _, pi := range paiNetInfo {
+		if pi.Status == 1 {
+			continue
+		}
+
+		pi := pi
+		key := name + "/" + pi.PaiUsername
+		if !d.acquire(key) {
+			log.Warnf("%s sync of %s is still running, skipped", name, pi.PaiUsername)
+			continue
+		}
+
+		g.Go(func() error {
+			defer d.release(key)
+
+			accountCtx, cancel := context.WithTimeout(ctx, d.AccountTimeout)
+			defer cancel()
+
+			job(accountCtx, pi)
+			return nil
+		})
+	}
+
+	_ = g.Wait()
 }
 
-type GetBoxListResponse struct {
-	Boxes []*model.Box `json:"boxes"`
-	Total string       `json:"total"`
+func (d *DataService) acquire(key string) bool {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if d.running[key] {
+		return false
+	}
+
+	d.running[key] = true
+	return true
+}
+
+func (d *DataService) release(key string) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	delete(d.running, key)
 }
 
-func getBox(ctx context.Context, pi *model.PaiNetInfo, page, size int) (*GetBoxListResponse, error) {
-	url := fmt.Sprintf("%s/boxsupplier/v1/box/list?page=%d&pageSize=%d", paiNetBaseUrl, page, size)
-	response, err := doRequest(pi, url)
+// syncPages syncs the first page to learn the total number of items, then the remaining pages on
+// at most PageConcurrency workers. The first error cancels the pages still in flight.
+func (d *DataService) syncPages(ctx context.Context, pageSize int, syncPage func(ctx context.Context, page int) (int64, error)) error {
+	total, err := syncPage(ctx, 1)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Failed to fetch boxes size")
+		return err
 	}
 
-	var res GetBoxListResponse
-	if err := json.Unmarshal(response, &res); err != nil {
-		return nil, err
+	pages := int((total + int64(pageSize) - 1) / int64(pageSize))
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(d.PageConcurrency)
+
+	for page := 2; page <= pages; page++ {
+		page := page
+		g.Go(func() error {
+			_, err := syncPage(gctx, page)
+			return err
+		})
 	}
 
-	return &res, nil
+	return g.Wait()
 }
 
-func (d *DataService) syncBoxList(ctx context.Context, pi *model.PaiNetInfo) error {
-
-	var (
-		count int64 = 0
-	)
+type GetBoxListResponse struct {
+	Boxes []*model.Box `json:"boxes"`
+	Total string       `json:"total"`
+}
 
-	for page := 1; ; page++ {
-		log.Infof("Starting to query boxes income")
+func (d *DataService) syncBoxList(ctx context.Context, pi *model.PaiNetInfo) error {
+	err := d.syncPages(ctx, defaultPageSize, func(ctx context.Context, page int) (int64, error) {
+		log.Infof("Starting to query boxes on page: %d", page)
 
-		response, err := getBox(ctx, pi, page, defaultPageSize)
+		response, err := d.client.GetBoxList(ctx, pi, page, defaultPageSize)
 		if err != nil {
-			//return errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
-			//errChan <- errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
 			log.Errorf("Failed to fetch boxes from page %d", page)
-			return errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
+			return 0, errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
 		}
 
 		total, err := strconv.ParseInt(response.Total, 10, 64)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		if total == 0 {
-			return nil
+		if len(response.Boxes) == 0 {
+			return total, nil
 		}
 
 		var diskInfos []*model.DiskInfo
@@ -211,130 +329,120 @@ func (d *DataService) syncBoxList(ctx context.Context, pi *model.PaiNetInfo) err
 				diskInfo.SupplierBoxId = box.SupplierBoxId
 				diskInfos = append(diskInfos, diskInfo)
 			}
-			diskInfos = append(diskInfos)
 		}
 
-		if err := SaveBoxList(ctx, response.Boxes, diskInfos); err != nil {
-			//errChan <- errors.Wrapf(err, "Failed to save boxes from page %d", page)
+		if err := d.SaveBoxList(ctx, response.Boxes, diskInfos); err != nil {
 			log.Errorf("Failed to save boxes from page %d", page)
-			return errors.Wrapf(err, "Failed to save boxes from page %d", page)
+			return 0, errors.Wrapf(err, "Failed to save boxes from page %d", page)
 		}
 
-		count += int64(len(response.Boxes))
-		if count >= total {
-			break
-		}
+		return total, nil
+	})
+	if err != nil {
+		return err
 	}
 
 	log.Info("Synchronization of boxes list completed successfully.")
 
-	//response, err := getBox(ctx, pi, 1, 1)
-	//if err != nil {
-	//	return errors.Wrapf(err, "Failed to fetch boxes from page max size")
-	//}
-	//
-	//total, err := strconv.ParseInt(response.Total, 10, 64)
-	//if err != nil {
-	//	return err
-	//}
-	//
-	//if total == 0 {
-	//	fmt.Println("get box list, total 0")
-	//	return nil
-	//}
-
-	//wg := sync.WaitGroup{}
-	//boxesChan := make(chan *GetBoxListResponse)
-	//doneChan := make(chan interface{}, 1)
-	//errChan := make(chan error)
-
-	//maxPage := int(total) / defaultPageSize
-
-	//for page := 1; page <= 1; page++ {
-	//	//wg.Add(1)
-	//
-	//	log.Infof("Starting to query boxes on page: %d", page)
-	//
-	//	response, err = getBox(ctx, pi, page, defaultPageSize)
-	//	if err != nil {
-	//		//return errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
-	//		//errChan <- errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
-	//		log.Errorf("Failed to fetch boxes from page %d", page)
-	//		return errors.Wrapf(err, "Failed to fetch boxes from page %d", page)
-	//	}
-	//
-	//	var diskInfos []*model.DiskInfo
-	//
-	//	for _, box := range response.Boxes {
-	//		box.Username = pi.PaiUsername
-	//
-	//		for _, diskInfo := range box.DiskInfos {
-	//			diskInfo.BoxId = box.BoxId
-	//			diskInfo.SupplierBoxId = box.SupplierBoxId
-	//			diskInfos = append(diskInfos, diskInfo)
-	//		}
-	//		diskInfos = append(diskInfos)
-	//	}
-	//
-	//	if err := SaveBoxList(ctx, response.Boxes, diskInfos); err != nil {
-	//		//errChan <- errors.Wrapf(err, "Failed to save boxes from page %d", page)
-	//		log.Errorf("Failed to save boxes from page %d", page)
-	//		return errors.Wrapf(err, "Failed to save boxes from page %d", page)
-	//	}
-	//
-	//}
-
-	//wg.Wait()
-
-	//go func() {
-	//	wg.Wait()
-	//
-	//	doneChan <- nil
-	//}()
-	//
-	//for {
-	//	select {
-	//	case <-ctx.Done():
-	//		return ctx.Err()
-	//	case err := <-errChan:
-	//		return err
-	//	case boxesRes := <-boxesChan:
-	//		fmt.Println("+++=>", "get", len(boxesRes.Boxes))
-	//		var diskInfos []*model.DiskInfo
-	//
-	//		for _, box := range boxesRes.Boxes {
-	//			box.Username = pi.PaiUsername
-	//
-	//			for _, diskInfo := range box.DiskInfos {
-	//				diskInfo.BoxId = box.BoxId
-	//				diskInfo.SupplierBoxId = box.SupplierBoxId
-	//				diskInfos = append(diskInfos, diskInfo)
-	//			}
-	//			diskInfos = append(diskInfos)
-	//		}
-	//
-	//		if err := SaveBoxList(ctx, boxesRes.Boxes, diskInfos); err != nil {
-	//			return err
-	//		}
-	//	case <-doneChan:
-	//		log.Info("Synchronization of boxes list completed successfully.")
-	//		return nil
-	//	}
-	//}
 	return nil
 }
 
-func SaveBoxList(ctx context.Context, boxes []*model.Box, diskInfos []*model.DiskInfo) error {
-	err := dao.BulkUpsertBoxes(ctx, boxes)
+// writeContext lets a write that already started finish when ctx is cancelled, within writeGracePeriod.
+// A write that overruns it is aborted and the database rolls the statement back.
+func writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), writeGracePeriod)
+}
+
+// trackedBoxFields are the fields of a box whose changes are recorded in the box history.
+var trackedBoxFields = []struct {
+	name  string
+	value func(b *model.Box) string
+}{
+	{"online", func(b *model.Box) string { return b.Online }},
+	{"publicIp", func(b *model.Box) string { return b.PublicIp }},
+	{"privateIp", func(b *model.Box) string { return b.PrivateIp }},
+	{"isp", func(b *model.Box) string { return b.Isp }},
+	{"province", func(b *model.Box) string { return b.Province }},
+	{"city", func(b *model.Box) string { return b.City }},
+	{"tcpNatType", func(b *model.Box) string { return b.TcpNatType }},
+	{"udpNatType", func(b *model.Box) string { return b.UdpNatType }},
+	{"pluginVersion", func(b *model.Box) string { return b.PluginVersion }},
+	{"processStatus", func(b *model.Box) string { return b.ProcessStatus }},
+}
+
+// boxChanges compares the synced boxes to the stored ones and returns their tracked fields that changed.
+// Boxes seen for the first time have no history.
+func (d *DataService) boxChanges(ctx context.Context, boxes []*model.Box) ([]*model.BoxChange, error) {
+	boxIds := make(map[string][]string)
+	for _, b := range boxes {
+		boxIds[b.Username] = append(boxIds[b.Username], b.BoxId)
+	}
+
+	stored := make(map[string]*model.Box)
+	for username, ids := range boxIds {
+		_, olds, err := d.boxes.GetBoxesList(ctx, username, &dao.BoxFilter{BoxIds: ids}, 1, int64(len(ids)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, old := range olds {
+			stored[old.BoxId] = old
+		}
+	}
+
+	var changes []*model.BoxChange
+	for _, b := range boxes {
+		old, ok := stored[b.BoxId]
+		if !ok {
+			continue
+		}
+
+		for _, field := range trackedBoxFields {
+			if oldValue, newValue := field.value(old), field.value(b); oldValue != newValue {
+				changes = append(changes, &model.BoxChange{
+					Username:      b.Username,
+					BoxId:         b.BoxId,
+					SupplierBoxId: b.SupplierBoxId,
+					Field:         field.name,
+					OldValue:      oldValue,
+					NewValue:      newValue,
+				})
+			}
+		}
+	}
+
+	return changes, nil
+}
+
+func (d *DataService) SaveBoxList(ctx context.Context, boxes []*model.Box, diskInfos []*model.DiskInfo) error {
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+
+	changes, err := d.boxChanges(ctx, boxes)
 	if err != nil {
 		return err
 	}
 
+	err = d.boxes.BulkUpsertBoxes(ctx, boxes)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) > 0 {
+		if err := d.boxes.AddBoxChanges(ctx, changes); err != nil {
+			return err
+		}
+	}
+
+	if err := d.trackUptime(ctx, boxes, time.Now()); err != nil {
+		return err
+	}
+
 	if len(diskInfos) == 0 {
 		return nil
 	}
 
-	err = dao.BulkUpsertBoxDiskInfo(ctx, diskInfos)
+	err = d.boxes.BulkUpsertBoxDiskInfo(ctx, diskInfos)
 	if err != nil {
 		return err
 	}
@@ -348,201 +456,254 @@ type GetBoxIncomeResponse struct {
 	TotalNum  string             `json:"totalNum"`
 }
 
-func (d *DataService) syncBoxIncome(pi *model.PaiNetInfo, start, end string) error {
-	var (
-		count int64 = 0
-		ctx         = context.Background()
-	)
-
-	for page := 1; ; page++ {
-		log.Infof("Starting to query boxes income")
+func (d *DataService) syncBoxIncome(ctx context.Context, pi *model.PaiNetInfo, start, end string) (int64, error) {
+	var rows int64 = 0
 
-		url := fmt.Sprintf("%s/boxsupplier/v1/supplier/income_v2?start=%s&end=%s&pageSize=%d&pageIndex=%d", paiNetBaseUrl, start, end, defaultPageSize, page)
+	err := d.syncPages(ctx, defaultPageSize, func(ctx context.Context, page int) (int64, error) {
+		log.Infof("Starting to query boxes income on page: %d", page)
 
-		fmt.Println("url=>", url)
-		response, err := doRequest(pi, url)
+		res, err := d.client.GetBoxIncome(ctx, pi, start, end, page, defaultPageSize)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to fetch boxes income")
-		}
-
-		fmt.Println(string(response))
-
-		var res GetBoxIncomeResponse
-		if err := json.Unmarshal(response, &res); err != nil {
-			return err
+			return 0, err
 		}
 
 		total, err := strconv.ParseInt(res.TotalNum, 10, 64)
 		if err != nil {
-			return err
+			return 0, err
 		}
 
-		if total == 0 {
-			return nil
+		if len(res.BoxIncome) == 0 {
+			return total, nil
 		}
 
 		if err := d.saveBoxIncome(ctx, pi.PaiUsername, res.BoxIncome); err != nil {
-			return err
+			return 0, err
 		}
 
-		count += int64(len(res.BoxIncome))
-		if count >= total {
-			break
-		}
+		atomic.AddInt64(&rows, int64(len(res.BoxIncome)))
+		return total, nil
+	})
+	if err != nil {
+		return atomic.LoadInt64(&rows), err
 	}
 
 	log.Info("Synchronization of boxes income completed successfully.")
 
-	return nil
+	d.emit(ctx, pi.PaiUsername, model.WebhookEventIncomeSynced, &IncomeSyncedEvent{Start: start, End: end, Rows: rows})
+
+	return rows, nil
 }
 
 func (d *DataService) saveBoxIncome(ctx context.Context, username string, boxIncome []*model.BoxIncome) error {
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+
 	for _, b := range boxIncome {
 		b.Username = username
 	}
 
-	err := dao.BulkUpsertBoxDayIncome(ctx, boxIncome)
+	err := d.incomes.BulkUpsertBoxDayIncome(ctx, boxIncome)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func generateMD5Hash(as, account string, timestamp int64) string {
-	text := fmt.Sprintf("%s#%d#%s", as, timestamp, account)
-	hash := md5.Sum([]byte(text))
-	return hex.EncodeToString(hash[:])
-}
-
-func doRequest(pi *model.PaiNetInfo, url string) ([]byte, error) {
-	request, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return nil, err
+func (d *DataService) StartSyncBoxList(ctx context.Context, pi *model.PaiNetInfo) {
+	if err := d.syncBoxList(ctx, pi); err != nil {
+		log.Infof("syncBoxList: %v", err)
 	}
 
-	timestamp := time.Now().Unix()
-	sign := generateMD5Hash(pi.APISecret, pi.PaiUsername, timestamp)
+}
 
-	request.Header.Set("ak", pi.APIKey)
-	request.Header.Set("timestamp", fmt.Sprintf("%d", timestamp))
-	request.Header.Set("sign", sign)
+// syncWindowDays is the size of the date windows each data type is backfilled in.
+var syncWindowDays = map[string]int{
+	model.SyncDataTypeIncome:    10,
+	model.SyncDataTypeBandwidth: 1,
+	model.SyncDataTypeQuality:   1,
+}
 
-	resp, err := http.DefaultClient.Do(request)
-	if err != nil {
-		return nil, err
-	}
+type syncWindow struct {
+	start string
+	end   string
+}
 
-	defer resp.Body.Close()
+// historyWindows splits the days from date up to today into windows of the given size. Without a date
+// it covers the current month. The windows end at today's midnight at the latest, so that today, whose data
+// is still coming in, is only synced by a later window.
+func historyWindows(date string, days int) ([]syncWindow, error) {
+	year, month, day := time.Now().Date()
+	startTime := time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
+	endTime := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+
+	if date != "" {
+		dateTime, err := time.ParseInLocation(time.DateOnly, date, time.Local)
+		if err != nil {
+			return nil, err
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
+		startTime = dateTime
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	var windows []syncWindow
+	for startTime.Before(endTime) {
+		windowEnd := startTime.AddDate(0, 0, days)
+		if windowEnd.After(endTime) {
+			windowEnd = endTime
+		}
+
+		windows = append(windows, syncWindow{
+			start: startTime.Format(time.DateOnly),
+			end:   windowEnd.Format(time.DateOnly),
+		})
+		startTime = startTime.AddDate(0, 0, days)
 	}
 
-	return body, nil
+	return windows, nil
 }
 
-func (d *DataService) StartSyncBoxList(pi *model.PaiNetInfo) {
-	if err := d.syncBoxList(context.Background(), pi); err != nil {
-		log.Infof("syncBoxList: %v", err)
+func (d *DataService) syncDataWindow(ctx context.Context, pi *model.PaiNetInfo, dataType string, w syncWindow) (int64, error) {
+	switch dataType {
+	case model.SyncDataTypeIncome:
+		return d.syncBoxIncome(ctx, pi, w.start, w.end)
+	case model.SyncDataTypeBandwidth:
+		return d.syncBoxBandwidth(ctx, pi, w.start)
+	case model.SyncDataTypeQuality:
+		return d.syncBoxQualities(ctx, pi, w.start)
+	default:
+		return 0, errors.Errorf("unsupported data type %s", dataType)
 	}
-
 }
 
-func (d *DataService) StartSyncBoxIncomeHistoryFrom(pi *model.PaiNetInfo, date string) {
-	var startTime, endTime time.Time
+// syncWindowWithCheckpoint syncs a date window and records the outcome in the sync_checkpoint table.
+// Windows that already finished are skipped.
+func (d *DataService) syncWindowWithCheckpoint(ctx context.Context, pi *model.PaiNetInfo, dataType string, w syncWindow) error {
+	checkpoint, err := d.checkpoints.GetSyncCheckpoint(ctx, pi.PaiUsername, dataType, w.start, w.end)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return errors.Wrap(err, "get sync checkpoint")
+	}
 
-	if date == "" {
-		year, month, day := time.Now().Date()
-		startTime = time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
-		endTime = time.Date(year, month, day, 0, 0, 0, 0, time.Local)
-	} else {
-		dateTime, err := time.Parse(time.DateOnly, date)
-		if err != nil {
-			log.Errorf("parse date: %v", err)
-			return
+	if checkpoint == nil {
+		checkpoint = &model.SyncCheckpoint{
+			PaiUsername: pi.PaiUsername,
+			DataType:    dataType,
+			WindowStart: w.start,
+			WindowEnd:   w.end,
 		}
+	}
 
-		startTime = dateTime
-		endTime = time.Now()
+	if checkpoint.Finished() {
+		log.Debugf("skip finished %s window %s ~ %s of %s", dataType, w.start, w.end, pi.PaiUsername)
+		return nil
 	}
 
-	for startTime.Before(endTime) {
-		start := startTime.Format(time.DateOnly)
-		end := startTime.AddDate(0, 0, 10).Format(time.DateOnly)
-		startTime = startTime.AddDate(0, 0, 10)
+	checkpoint.Status = model.SyncStatusRunning
+	checkpoint.Attempts++
+	if err := d.checkpoints.UpsertSyncCheckpoint(ctx, checkpoint); err != nil {
+		return errors.Wrap(err, "save sync checkpoint")
+	}
 
-		fmt.Println(" ==>", start)
-		if err := d.syncBoxIncome(pi, start, end); err != nil {
-			log.Infof("syncBoxIncome: start: %s, end: %s, %v", start, end, err)
-		}
+	rows, syncErr := d.syncDataWindow(ctx, pi, dataType, w)
+
+	checkpoint.RowCount = rows
+	checkpoint.Status = model.SyncStatusDone
+	checkpoint.LastError = ""
+	if syncErr != nil {
+		checkpoint.Status = model.SyncStatusFailed
+		checkpoint.LastError = syncErr.Error()
+	}
+
+	writeCtx, cancel := writeContext(ctx)
+	defer cancel()
+
+	if err := d.checkpoints.UpsertSyncCheckpoint(writeCtx, checkpoint); err != nil {
+		log.Errorf("save sync checkpoint: %v", err)
+	}
+
+	if syncErr != nil {
+		d.emit(ctx, pi.PaiUsername, model.WebhookEventSyncFailed, &SyncFailedEvent{DataType: dataType, Start: w.start, End: w.end, Error: syncErr.Error()})
 	}
 
+	return syncErr
 }
 
-func (d *DataService) StartSyncBoxDayBandwidthHistoryFrom(pi *model.PaiNetInfo, date string) {
-	var startTime, endTime time.Time
+// StartSyncHistoryFrom backfills a data type of the account from date, skipping the windows that already finished.
+func (d *DataService) StartSyncHistoryFrom(ctx context.Context, pi *model.PaiNetInfo, dataType, date string) {
+	windows, err := historyWindows(date, syncWindowDays[dataType])
+	if err != nil {
+		log.Errorf("parse date: %v", err)
+		return
+	}
 
-	if date == "" {
-		year, month, day := time.Now().Date()
-		startTime = time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
-		endTime = time.Date(year, month, day, 0, 0, 0, 0, time.Local)
-	} else {
-		dateTime, err := time.Parse(time.DateOnly, date)
-		if err != nil {
-			log.Errorf("parse date: %v", err)
+	for _, w := range windows {
+		if ctx.Err() != nil {
 			return
 		}
 
-		startTime = dateTime
-		endTime = time.Now()
+		if err := d.syncWindowWithCheckpoint(ctx, pi, dataType, w); err != nil {
+			log.Infof("sync %s: start: %s, end: %s, %v", dataType, w.start, w.end, err)
+		}
 	}
+}
 
-	for startTime.Before(endTime) {
-		start := startTime.Format(time.DateOnly)
-		end := startTime.AddDate(0, 0, 1).Format(time.DateOnly)
-		startTime = startTime.AddDate(0, 0, 1)
+// ResumeSyncHistory retries the windows of a data type that failed or were interrupted, and fills the windows
+// missing from the checkpoint table since date, or since the earliest recorded window if date is empty.
+func (d *DataService) ResumeSyncHistory(ctx context.Context, pi *model.PaiNetInfo, dataType, date string) {
+	checkpoints, err := d.checkpoints.GetSyncCheckpoints(ctx, pi.PaiUsername, dataType)
+	if err != nil {
+		log.Errorf("get sync checkpoints: %v", err)
+		return
+	}
 
-		if err := d.syncBoxBandwidth(pi, start); err != nil {
-			log.Infof("syncBoxBandwidth: start: %s, end: %s, %v", start, end, err)
-		}
+	if date == "" && len(checkpoints) == 0 {
+		log.Infof("no %s checkpoints of %s to resume from", dataType, pi.PaiUsername)
+		return
 	}
 
-}
+	if date == "" {
+		date = checkpoints[0].WindowStart
+	}
 
-func (d *DataService) StartSyncBoxDayQualitiesHistoryFrom(pi *model.PaiNetInfo, date string) {
-	var startTime, endTime time.Time
+	windows, err := historyWindows(date, syncWindowDays[dataType])
+	if err != nil {
+		log.Errorf("parse date: %v", err)
+		return
+	}
 
-	if date == "" {
-		year, month, day := time.Now().Date()
-		startTime = time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
-		endTime = time.Date(year, month, day, 0, 0, 0, 0, time.Local)
-	} else {
-		dateTime, err := time.Parse(time.DateOnly, date)
-		if err != nil {
-			log.Errorf("parse date: %v", err)
-			return
-		}
+	known := make(map[syncWindow]bool)
+	for _, w := range windows {
+		known[w] = true
+	}
 
-		startTime = dateTime
-		endTime = time.Now()
+	// windows recorded with another layout or before date still get retried
+	for _, checkpoint := range checkpoints {
+		w := syncWindow{start: checkpoint.WindowStart, end: checkpoint.WindowEnd}
+		if !known[w] && !checkpoint.Finished() {
+			windows = append(windows, w)
+		}
 	}
 
-	for startTime.Before(endTime) {
-		start := startTime.Format(time.DateOnly)
-		end := startTime.AddDate(0, 0, 1).Format(time.DateOnly)
-		startTime = startTime.AddDate(0, 0, 1)
+	for _, w := range windows {
+		if ctx.Err() != nil {
+			return
+		}
 
-		if err := d.syncBoxQualities(pi, start); err != nil {
-			fmt.Println("==>", err)
-			log.Infof("syncBoxQualities: start: %s, end: %s, %v", start, end, err)
+		if err := d.syncWindowWithCheckpoint(ctx, pi, dataType, w); err != nil {
+			log.Infof("resume %s: start: %s, end: %s, %v", dataType, w.start, w.end, err)
 		}
 	}
+}
+
+func (d *DataService) StartSyncBoxIncomeHistoryFrom(ctx context.Context, pi *model.PaiNetInfo, date string) {
+	d.StartSyncHistoryFrom(ctx, pi, model.SyncDataTypeIncome, date)
+}
 
+func (d *DataService) StartSyncBoxDayBandwidthHistoryFrom(ctx context.Context, pi *model.PaiNetInfo, date string) {
+	d.StartSyncHistoryFrom(ctx, pi, model.SyncDataTypeBandwidth, date)
+}
+
+func (d *DataService) StartSyncBoxDayQualitiesHistoryFrom(ctx context.Context, pi *model.PaiNetInfo, date string) {
+	d.StartSyncHistoryFrom(ctx, pi, model.SyncDataTypeQuality, date)
 }
 
 type GetBoxBandwidthResponse struct {
@@ -553,9 +714,14 @@ type BoxBandwidths struct {
 	BoxId         string                `json:"boxId"`
 	SupplierBoxId string                `json:"supplierBoxId"`
 	Bandwidths    []*model.BoxBandwidth `json:"bandwidths"`
+	// Rollups replace the Bandwidths when the api is queried at an hourly or daily granularity.
+	Rollups []*model.BoxBandwidthRollup `json:"rollups,omitempty"`
 }
 
 func (d *DataService) saveBoxBandwidth(ctx context.Context, username string, boxBandwidths []*BoxBandwidths) error {
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+
 	bandwidthMap := make(map[string][]*model.BoxBandwidth)
 
 	for _, box := range boxBandwidths {
@@ -576,68 +742,63 @@ func (d *DataService) saveBoxBandwidth(ctx context.Context, username string, box
 		}
 	}
 
+	var saved []*model.BoxBandwidth
 	for _, bandwidths := range bandwidthMap {
-		err := dao.BulkUpsertBoxBandwidth(ctx, bandwidths)
+		err := d.metrics.BulkUpsertBoxBandwidth(ctx, bandwidths)
 		if err != nil {
 			return err
 		}
+		saved = append(saved, bandwidths...)
 	}
 
-	return nil
+	return d.rollupBandwidth(ctx, username, saved)
 }
 
-func (d *DataService) syncBoxBandwidth(pi *model.PaiNetInfo, date string) error {
+func (d *DataService) syncBoxBandwidth(ctx context.Context, pi *model.PaiNetInfo, date string) (int64, error) {
 	var (
-		count    int64 = 0
-		ctx            = context.Background()
+		rows     int64 = 0
 		pageSize       = 100
 	)
 
-	for page := 1; ; page++ {
-		log.Infof("Starting to query boxes bandwidth")
+	err := d.syncPages(ctx, pageSize, func(ctx context.Context, page int) (int64, error) {
+		log.Infof("Starting to query boxes bandwidth on page: %d", page)
 
-		total, boxes, err := dao.GetBoxesList(ctx, pi.PaiUsername, nil, nil, int64(page), int64(pageSize))
+		total, boxes, err := d.boxes.GetBoxesList(ctx, pi.PaiUsername, nil, int64(page), int64(pageSize))
 		if err != nil {
-			return errors.Wrapf(err, "query boxes list")
+			return 0, errors.Wrapf(err, "query boxes list")
+		}
+
+		if len(boxes) == 0 {
+			return total, nil
 		}
 
 		var boxIds []string
 		for _, box := range boxes {
-			boxIds = append(boxIds, "boxId="+box.BoxId)
+			boxIds = append(boxIds, box.BoxId)
 		}
 
-		url := fmt.Sprintf("%s/boxsupplier/v1/box/bandwidth?date=%s&%s", paiNetBaseUrl, date, strings.Join(boxIds, "&"))
-
-		fmt.Println(url)
-		response, err := doRequest(pi, url)
+		res, err := d.client.GetBoxBandwidth(ctx, pi, date, boxIds)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to fetch boxes income")
-		}
-
-		fmt.Println("=>", string(response))
-
-		var res GetBoxBandwidthResponse
-		if err := json.Unmarshal(response, &res); err != nil {
-			return err
-		}
-
-		if len(res.BoxBandwidths) == 0 {
-			return nil
+			return 0, err
 		}
 
 		if err := d.saveBoxBandwidth(ctx, pi.PaiUsername, res.BoxBandwidths); err != nil {
-			return err
+			return 0, err
 		}
 
-		count += int64(len(res.BoxBandwidths))
-		if count >= total {
-			break
+		for _, b := range res.BoxBandwidths {
+			atomic.AddInt64(&rows, int64(len(b.Bandwidths)))
 		}
+
+		return total, nil
+	})
+	if err != nil {
+		return atomic.LoadInt64(&rows), err
 	}
 
 	log.Info("Synchronization of boxes bandwidth completed successfully.")
 
-	return nil
+	return rows, nil
 }
 
 type GetBoxQualitiesResponse struct {
@@ -648,9 +809,13 @@ type BoxQualities struct {
 	BoxId         string              `json:"boxId"`
 	SupplierBoxId string              `json:"supplierBoxId"`
 	Qualities     []*model.BoxQuality `json:"qualities"`
+	// Rollups replace the Qualities when the api is queried at an hourly or daily granularity.
+	Rollups []*model.BoxQualityRollup `json:"rollups,omitempty"`
 }
 
 func (d *DataService) saveBoxQualities(ctx context.Context, username string, boxQualities []*BoxQualities) error {
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
 
 	qualitiesMap := make(map[string][]*model.BoxQuality)
 
@@ -676,66 +841,61 @@ func (d *DataService) saveBoxQualities(ctx context.Context, username string, box
 		}
 	}
 
-	for _, bandwidths := range qualitiesMap {
-		err := dao.BulkUpsertBoxQualities(ctx, bandwidths)
+	var saved []*model.BoxQuality
+	for _, qualities := range qualitiesMap {
+		err := d.metrics.BulkUpsertBoxQualities(ctx, qualities)
 		if err != nil {
 			return err
 		}
+		saved = append(saved, qualities...)
 	}
 
-	return nil
-
+	return d.rollupQualities(ctx, username, saved)
 }
 
-func (d *DataService) syncBoxQualities(pi *model.PaiNetInfo, date string) error {
+func (d *DataService) syncBoxQualities(ctx context.Context, pi *model.PaiNetInfo, date string) (int64, error) {
 	var (
-		count    int64 = 0
-		ctx            = context.Background()
+		rows     int64 = 0
 		pageSize       = 100
 	)
 
-	for page := 1; ; page++ {
-		log.Infof("Starting to query boxes qualities")
+	err := d.syncPages(ctx, pageSize, func(ctx context.Context, page int) (int64, error) {
+		log.Infof("Starting to query boxes qualities on page: %d", page)
 
-		total, boxes, err := dao.GetBoxesList(ctx, pi.PaiUsername, nil, nil, int64(page), int64(pageSize))
+		total, boxes, err := d.boxes.GetBoxesList(ctx, pi.PaiUsername, nil, int64(page), int64(pageSize))
 		if err != nil {
-			return errors.Wrapf(err, "query boxes list")
+			return 0, errors.Wrapf(err, "query boxes list")
+		}
+
+		if len(boxes) == 0 {
+			return total, nil
 		}
 
 		var boxIds []string
 		for _, box := range boxes {
-			boxIds = append(boxIds, "boxId="+box.BoxId)
+			boxIds = append(boxIds, box.BoxId)
 		}
 
-		url := fmt.Sprintf("%s/boxsupplier/v1/box/quality?date=%s&%s", paiNetBaseUrl, date, strings.Join(boxIds, "&"))
-
-		response, err := doRequest(pi, url)
+		res, err := d.client.GetBoxQualities(ctx, pi, date, boxIds)
 		if err != nil {
-			return errors.Wrapf(err, "Failed to fetch boxes income")
-		}
-
-		//fmt.Println("=>", string(response))
-
-		var res GetBoxQualitiesResponse
-		if err := json.Unmarshal(response, &res); err != nil {
-			return err
-		}
-
-		if len(res.BoxQualities) == 0 {
-			return nil
+			return 0, err
 		}
 
 		if err := d.saveBoxQualities(ctx, pi.PaiUsername, res.BoxQualities); err != nil {
-			return err
+			return 0, err
 		}
 
-		count += int64(len(res.BoxQualities))
-		if count >= total {
-			break
+		for _, b := range res.BoxQualities {
+			atomic.AddInt64(&rows, int64(len(b.Qualities)))
 		}
+
+		return total, nil
+	})
+	if err != nil {
+		return atomic.LoadInt64(&rows), err
 	}
 
 	log.Info("Synchronization of boxes qualities completed successfully.")
 
-	return nil
+	return rows, nil
 }
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"context"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/gnasnik/titan-box-api/internal/paifake"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testPaiUsername = "supplier"
+	testSyncDate    = "2024-05-01"
+)
+
+type syncFixture struct {
+	srv   *paifake.Server
+	pi    *model.PaiNetInfo
+	store dao.Store
+	ds    *DataService
+}
+
+// newSyncFixture syncs against a fake PaiNet account of fleetSize boxes into a migrated SQLite store.
+func newSyncFixture(t *testing.T, fleetSize int, opts ...PaiNetClientOption) *syncFixture {
+	t.Helper()
+
+	srv := paifake.NewServer()
+	t.Cleanup(srv.Close)
+
+	store, err := dao.Open("sqlite://" + filepath.Join(t.TempDir(), "sync.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	opts = append([]PaiNetClientOption{
+		WithBaseUrl(srv.URL),
+		WithRateLimit(1000, 1000),
+		WithRetry(3, time.Millisecond, 10*time.Millisecond),
+	}, opts...)
+
+	return &syncFixture{
+		srv:   srv,
+		pi:    srv.AddAccount(testPaiUsername, fleetSize),
+		store: store,
+		ds:    NewDataService(NewPaiNetClient(opts...), dao.NewStores(store), config.SyncConfig{}),
+	}
+}
+
+func syncDay(t *testing.T) (time.Time, int64, int64) {
+	t.Helper()
+
+	day, err := time.ParseInLocation(time.DateOnly, testSyncDate, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return day, day.Unix(), day.AddDate(0, 0, 1).Unix() - 1
+}
+
+func TestSyncBoxList(t *testing.T) {
+	f := newSyncFixture(t, 250)
+	ctx := context.Background()
+
+	if err := f.ds.syncBoxList(ctx, f.pi); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.srv.Requests(paifake.BoxListPath); n != 2 {
+		t.Errorf("box list requests = %d, want 2 pages", n)
+	}
+
+	total, boxes, err := f.store.GetBoxesList(ctx, testPaiUsername, nil, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total != 250 || len(boxes) != 250 {
+		t.Fatalf("stored %d boxes (total %d), want 250", len(boxes), total)
+	}
+
+	want := f.srv.Fleet(testPaiUsername).Boxes()
+	for i, b := range boxes {
+		w := want[i]
+		if b.BoxId != w.BoxId || b.SupplierBoxId != w.SupplierBoxId || b.Online != w.Online || b.Isp != w.Isp || b.Remark != w.Remark {
+			t.Fatalf("box %d = %+v, want %+v", i, b, w)
+		}
+
+		if b.Username != testPaiUsername {
+			t.Fatalf("box %s username = %q, want %q", b.BoxId, b.Username, testPaiUsername)
+		}
+
+		if len(b.DiskInfos) != 1 || b.DiskInfos[0].DiskSize != w.DiskInfos[0].DiskSize || b.DiskInfos[0].DiskUsed != w.DiskInfos[0].DiskUsed {
+			t.Fatalf("box %s disks = %+v, want %+v", b.BoxId, *b.DiskInfos[0], *w.DiskInfos[0])
+		}
+	}
+
+	uptimes, err := f.store.GetLatestBoxUptimes(ctx, []string{want[0].BoxId})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uptimes) != 1 || uptimes[0].Online != (want[0].Online == boxOnline) {
+		t.Errorf("uptime of %s = %+v, want one interval online=%v", want[0].BoxId, uptimes, want[0].Online == boxOnline)
+	}
+}
+
+func TestSyncBoxIncome(t *testing.T) {
+	f := newSyncFixture(t, 30)
+	ctx := context.Background()
+
+	day, _, _ := syncDay(t)
+	end := day.AddDate(0, 0, 9).Format(time.DateOnly)
+
+	rows, err := f.ds.syncBoxIncome(ctx, f.pi, testSyncDate, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := f.srv.Fleet(testPaiUsername).Income(day, day.AddDate(0, 0, 9))
+	if rows != int64(len(records)) {
+		t.Fatalf("synced %d income rows, want %d", rows, len(records))
+	}
+
+	var want model.Decimal
+	for _, r := range records {
+		amount, err := model.ParseDecimal(r.Amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want += amount
+	}
+
+	totalNum, total, page, err := f.store.GetBoxIncomeV2(ctx, testPaiUsername, nil, nil, nil, testSyncDate, end, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if totalNum != int64(len(records)) {
+		t.Errorf("stored %d income rows, want %d", totalNum, len(records))
+	}
+
+	if total != want {
+		t.Errorf("stored income total = %s, want %s", total, want)
+	}
+
+	if len(page) != 10 || page[0].Username != testPaiUsername {
+		t.Errorf("income page = %d rows of %q, want 10 of %q", len(page), page[0].Username, testPaiUsername)
+	}
+}
+
+func TestSyncBoxBandwidth(t *testing.T) {
+	f := newSyncFixture(t, 120)
+	ctx := context.Background()
+
+	if err := f.ds.syncBoxList(ctx, f.pi); err != nil {
+		t.Fatal(err)
+	}
+
+	day, start, end := syncDay(t)
+	rows, err := f.ds.syncBoxBandwidth(ctx, f.pi, testSyncDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := f.srv.Requests(paifake.BandwidthPath); n != 2 {
+		t.Errorf("bandwidth requests = %d, want 2 pages", n)
+	}
+
+	fleet := f.srv.Fleet(testPaiUsername)
+	boxId := fleet.Boxes()[0].BoxId
+	want := fleet.Bandwidth(boxId, day)
+	if rows != int64(120*len(want)) {
+		t.Fatalf("synced %d bandwidth rows, want %d", rows, 120*len(want))
+	}
+
+	stored, err := f.store.GetBoxBandwidth(ctx, testPaiUsername, []string{boxId}, nil, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != len(want) {
+		t.Fatalf("stored %d bandwidth points of %s, want %d", len(stored), boxId, len(want))
+	}
+
+	byTime := make(map[model.Timestamp]*model.BoxBandwidth)
+	for _, b := range stored {
+		byTime[b.Time] = b
+	}
+
+	for _, w := range want {
+		var tm model.Timestamp
+		if err := tm.UnmarshalJSON([]byte(w.Time)); err != nil {
+			t.Fatal(err)
+		}
+
+		b, ok := byTime[tm]
+		if !ok || b.Upload != w.Upload || b.Download != w.Download {
+			t.Fatalf("bandwidth of %s at %s = %+v, want %+v", boxId, w.Time, b, w)
+		}
+	}
+
+	rollups, err := f.store.GetBoxBandwidthRollups(ctx, dao.GranularityDay, testPaiUsername, []string{boxId}, nil, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rollups) != 1 || rollups[0].Samples != int64(len(want)) {
+		t.Errorf("daily rollups of %s = %+v, want one of %d samples", boxId, rollups, len(want))
+	}
+}
+
+func TestSyncBoxQualities(t *testing.T) {
+	f := newSyncFixture(t, 20)
+	ctx := context.Background()
+
+	if err := f.ds.syncBoxList(ctx, f.pi); err != nil {
+		t.Fatal(err)
+	}
+
+	day, start, end := syncDay(t)
+	rows, err := f.ds.syncBoxQualities(ctx, f.pi, testSyncDate)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fleet := f.srv.Fleet(testPaiUsername)
+	box := fleet.Boxes()[3]
+	want := fleet.Quality(box.BoxId, day)
+	if rows != int64(20*len(want)) {
+		t.Fatalf("synced %d quality rows, want %d", rows, 20*len(want))
+	}
+
+	stored, err := f.store.GetBoxQualities(ctx, testPaiUsername, nil, []string{box.SupplierBoxId}, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != len(want) {
+		t.Fatalf("stored %d quality points of %s, want %d", len(stored), box.BoxId, len(want))
+	}
+
+	for _, q := range stored {
+		if q.BoxId != box.BoxId || q.TcpNatType != box.TcpNatType || q.DiskUsage != box.DiskUsage {
+			t.Fatalf("quality point %+v does not match box %+v", q, box)
+		}
+	}
+}
+
+func TestSyncRetriesInjectedFailures(t *testing.T) {
+	cases := []struct {
+		name     string
+		failure  paifake.Failure
+		wantErr  bool
+		requests int
+		boxes    int64
+	}{
+		{
+			name:     "server errors are retried",
+			failure:  paifake.Failure{Path: paifake.BoxListPath, Status: http.StatusServiceUnavailable, Times: 2},
+			requests: 3,
+			boxes:    5,
+		},
+		{
+			name:     "throttling is retried",
+			failure:  paifake.Failure{Path: paifake.BoxListPath, Status: http.StatusTooManyRequests},
+			requests: 2,
+			boxes:    5,
+		},
+		{
+			name:     "retries run out",
+			failure:  paifake.Failure{Path: paifake.BoxListPath, Status: http.StatusBadGateway, Times: 10},
+			wantErr:  true,
+			requests: 4,
+		},
+		{
+			name:     "client errors are not retried",
+			failure:  paifake.Failure{Path: paifake.BoxListPath, Status: http.StatusBadRequest, Reason: "BAD_REQUEST"},
+			wantErr:  true,
+			requests: 1,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newSyncFixture(t, 5)
+			f.srv.InjectFailure(c.failure)
+
+			err := f.ds.syncBoxList(context.Background(), f.pi)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("syncBoxList error = %v, want error %v", err, c.wantErr)
+			}
+
+			if n := f.srv.Requests(paifake.BoxListPath); n != c.requests {
+				t.Errorf("box list requests = %d, want %d", n, c.requests)
+			}
+
+			total, _, err := f.store.GetBoxesList(context.Background(), testPaiUsername, nil, 1, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if total != c.boxes {
+				t.Errorf("stored %d boxes, want %d", total, c.boxes)
+			}
+		})
+	}
+}
+
+func TestSyncWaitsRetryAfter(t *testing.T) {
+	cases := []struct {
+		name          string
+		maxRetryAfter time.Duration
+		atLeast       time.Duration
+		below         time.Duration
+	}{
+		{name: "honored", atLeast: time.Second, below: 5 * time.Second},
+		{name: "capped", maxRetryAfter: 50 * time.Millisecond, atLeast: 50 * time.Millisecond, below: time.Second},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newSyncFixture(t, 5, WithMaxRetryAfter(c.maxRetryAfter))
+			f.srv.InjectFailure(paifake.Failure{Path: paifake.IncomePath, Status: http.StatusTooManyRequests, RetryAfter: time.Second})
+
+			started := time.Now()
+			rows, err := f.ds.syncBoxIncome(context.Background(), f.pi, testSyncDate, testSyncDate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if elapsed := time.Since(started); elapsed < c.atLeast || elapsed >= c.below {
+				t.Errorf("sync took %s, want %s ~ %s", elapsed, c.atLeast, c.below)
+			}
+
+			if rows != 5 {
+				t.Errorf("synced %d income rows, want 5", rows)
+			}
+
+			if n := f.srv.Requests(paifake.IncomePath); n != 2 {
+				t.Errorf("income requests = %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestHistoryWindows(t *testing.T) {
+	year, month, day := time.Now().Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+	daysAgo := func(n int) string {
+		return today.AddDate(0, 0, -n).Format(time.DateOnly)
+	}
+
+	cases := []struct {
+		name  string
+		date  string
+		days  int
+		first string
+		count int
+	}{
+		{name: "daily windows", date: daysAgo(3), days: 1, first: daysAgo(3), count: 3},
+		{name: "a window running past today", date: daysAgo(3), days: 10, first: daysAgo(3), count: 1},
+		{name: "several windows", date: daysAgo(25), days: 10, first: daysAgo(25), count: 3},
+		{name: "from today", date: daysAgo(0), days: 1},
+		{name: "the current month", days: 1, first: daysAgo(day - 1), count: day - 1},
+	}
+
+	for _, c := range cases {
+		windows, err := historyWindows(c.date, c.days)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if len(windows) != c.count {
+			t.Fatalf("%s: %d windows %v, want %d", c.name, len(windows), windows, c.count)
+		}
+
+		if c.count == 0 {
+			continue
+		}
+
+		if windows[0].start != c.first {
+			t.Errorf("%s: first window starts %s, want %s", c.name, windows[0].start, c.first)
+		}
+
+		// every day before today is covered, today only by the end of the last window
+		for i, w := range windows {
+			if w.end > daysAgo(0) || (i > 0 && w.start != windows[i-1].end) {
+				t.Errorf("%s: windows %v, want contiguous windows ending by %s", c.name, windows, daysAgo(0))
+				break
+			}
+		}
+
+		if last := windows[len(windows)-1]; last.end != daysAgo(0) {
+			t.Errorf("%s: last window ends %s, want %s", c.name, last.end, daysAgo(0))
+		}
+	}
+}
+
+func TestSyncCheckpointFinished(t *testing.T) {
+	year, month, day := time.Now().Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, time.Local)
+
+	cases := []struct {
+		name      string
+		status    string
+		windowEnd time.Time
+		updatedAt time.Time
+		want      bool
+	}{
+		{name: "synced after the window closed", status: model.SyncStatusDone, windowEnd: today.AddDate(0, 0, -1), updatedAt: today.Add(time.Hour), want: true},
+		{name: "synced on its last day", status: model.SyncStatusDone, windowEnd: today, updatedAt: today.Add(23 * time.Hour)},
+		{name: "synced on its last day, read in UTC", status: model.SyncStatusDone, windowEnd: today, updatedAt: today.Add(23 * time.Hour).UTC()},
+		{name: "failed", status: model.SyncStatusFailed, windowEnd: today.AddDate(0, 0, -1), updatedAt: today.Add(time.Hour)},
+	}
+
+	for _, c := range cases {
+		checkpoint := &model.SyncCheckpoint{Status: c.status, WindowEnd: c.windowEnd.Format(time.DateOnly), UpdatedAt: c.updatedAt}
+		if got := checkpoint.Finished(); got != c.want {
+			t.Errorf("%s: finished = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
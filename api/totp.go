@@ -0,0 +1,262 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/google/uuid"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the codes follow RFC 6238 with the defaults of the authenticator apps: HMAC-SHA1, 6 digits every 30s.
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSecretLen = 20
+	// totpSkew is the number of steps a code may be off either way, for the drift of the clocks.
+	totpSkew = 1
+
+	backupCodeCount = 10
+
+	// mfaChallengeTTL is how long the second step of a login may follow the password.
+	mfaChallengeTTL = 5 * time.Minute
+
+	// mfaTokenKey holds the challenge of a login waiting for its TOTP code.
+	mfaTokenKey = "MFA_TOKEN"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random secret, base32 encoded as the authenticator apps expect.
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth uri of the secret, which the clients render as a QR code for the
+// authenticator apps to scan.
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + account, RawQuery: q.Encode()}
+	return u.String()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// TOTPCode returns the code of the secret at the time step.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// matchTOTPStep returns the step within totpSkew of now the code belongs to.
+func matchTOTPStep(secret, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newBackupCodes returns backupCodeCount codes formatted as xxxxx-xxxxx, along with the hashes kept of them.
+func newBackupCodes(username string, now time.Time) ([]string, []*model.BackupCode, error) {
+	codes := make([]string, 0, backupCodeCount)
+	hashes := make([]*model.BackupCode, 0, backupCodeCount)
+	for i := 0; i < backupCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, &model.BackupCode{
+			Id:        uuid.NewString(),
+			Username:  username,
+			CodeHash:  hashSecret(code),
+			CreatedAt: now,
+		})
+	}
+
+	return codes, hashes, nil
+}
+
+// normalizeBackupCode ignores the dashes, the spaces and the case the users type the codes with.
+func normalizeBackupCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// enabledTOTP returns the confirmed TOTP of the user, nil when the user has no second factor.
+func (s *Server) enabledTOTP(ctx context.Context, username string) (*model.UserTOTP, error) {
+	totp, err := s.totp.GetUserTOTP(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !totp.Enabled() {
+		return nil, nil
+	}
+
+	return totp, nil
+}
+
+// verifySecondFactor checks a TOTP code, which is accepted once, or else consumes a backup code of the user.
+func (s *Server) verifySecondFactor(ctx context.Context, totp *model.UserTOTP, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	if isTOTPCode(code) {
+		step, ok := matchTOTPStep(totp.Secret, code, time.Now())
+		if !ok || step <= totp.LastStep {
+			return false, nil
+		}
+
+		err := s.totp.UseTOTPStep(ctx, totp.Username, step)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	err := s.totp.UseBackupCode(ctx, totp.Username, hashSecret(normalizeBackupCode(code)), time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// NewMFAChallenge returns the token of a login whose password was checked, which a second login presents
+// along with the TOTP code of the user within mfaChallengeTTL.
+func (a *Auth) NewMFAChallenge(username string) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	a.challenges.add(token, username, time.Now())
+	return token, nil
+}
+
+// MFAChallenge returns the user of a challenge not expired yet.
+func (a *Auth) MFAChallenge(token string) (string, bool) {
+	return a.challenges.get(token, time.Now())
+}
+
+// ConsumeMFAChallenge discards the challenge of a login completed.
+func (a *Auth) ConsumeMFAChallenge(token string) {
+	a.challenges.remove(token)
+}
+
+type mfaChallenge struct {
+	username  string
+	expiresAt time.Time
+}
+
+type mfaChallenges struct {
+	lk         sync.Mutex
+	challenges map[string]*mfaChallenge
+	keys       *authKeys
+}
+
+func (m *mfaChallenges) add(token, username string, now time.Time) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	m.challenges[token] = &mfaChallenge{username: username, expiresAt: now.Add(mfaChallengeTTL)}
+	if oldest, ok := m.keys.touch(token); ok {
+		delete(m.challenges, oldest)
+	}
+}
+
+func (m *mfaChallenges) get(token string, now time.Time) (string, bool) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	c, ok := m.challenges[token]
+	if !ok {
+		return "", false
+	}
+
+	if !now.Before(c.expiresAt) {
+		delete(m.challenges, token)
+		m.keys.remove(token)
+		return "", false
+	}
+
+	return c.username, true
+}
+
+func (m *mfaChallenges) remove(token string) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	delete(m.challenges, token)
+	m.keys.remove(token)
+}
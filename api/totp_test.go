@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the SHA-1 vectors of RFC 6238 appendix B, whose 8 digits codes end with the 6 digits ones
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	cases := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, c := range cases {
+		got, err := TOTPCode(secret, totpStep(time.Unix(c.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != c.want {
+			t.Errorf("TOTPCode at %d = %s, want %s", c.unix, got, c.want)
+		}
+	}
+}
+
+func TestMatchTOTPStep(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	step := totpStep(now)
+
+	cases := []struct {
+		name   string
+		step   int64
+		wantOk bool
+	}{
+		{name: "current", step: step, wantOk: true},
+		{name: "previous", step: step - totpSkew, wantOk: true},
+		{name: "next", step: step + totpSkew, wantOk: true},
+		{name: "too old", step: step - totpSkew - 1},
+		{name: "too early", step: step + totpSkew + 1},
+	}
+
+	for _, c := range cases {
+		code, err := TOTPCode(secret, c.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, ok := matchTOTPStep(secret, code, now)
+		if ok != c.wantOk || (ok && got != c.step) {
+			t.Errorf("%s: step %d, %v, want %d, %v", c.name, got, ok, c.step, c.wantOk)
+		}
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	store := dao.NewMemoryStore()
+	s := NewServer(dao.NewStores(store))
+	ctx := context.Background()
+	now := time.Now()
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.CreateUserTOTP(ctx, &model.UserTOTP{Username: "u", Secret: secret, CreatedAt: now, UpdatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	codes, hashes, err := newBackupCodes("u", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the code confirming the secret used the step before the current one
+	if err := store.EnableUserTOTP(ctx, "u", totpStep(now)-1, now, hashes); err != nil {
+		t.Fatal(err)
+	}
+
+	code := func(step int64) string {
+		c, err := TOTPCode(secret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	cases := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{name: "current code", code: code(totpStep(now)), want: true},
+		{name: "replayed code", code: code(totpStep(now))},
+		{name: "code of an earlier step", code: code(totpStep(now) - 1)},
+		{name: "backup code", code: codes[0], want: true},
+		{name: "backup code used again", code: codes[0]},
+		{name: "backup code typed loosely", code: " " + strings.ToUpper(strings.ReplaceAll(codes[1], "-", " ")) + " ", want: true},
+		{name: "unknown backup code", code: "00000-00000"},
+		{name: "empty", code: ""},
+	}
+
+	for _, c := range cases {
+		totp, err := s.enabledTOTP(ctx, "u")
+		if err != nil || totp == nil {
+			t.Fatalf("%s: totp %v, %v", c.name, totp, err)
+		}
+
+		got, err := s.verifySecondFactor(ctx, totp, c.code)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if got != c.want {
+			t.Errorf("%s: accepted = %v, want %v", c.name, got, c.want)
+		}
+	}
+
+	if left, err := store.CountBackupCodes(ctx, "u"); err != nil || left != backupCodeCount-2 {
+		t.Errorf("backup codes left = %d (%v), want %d", left, err, backupCodeCount-2)
+	}
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"context"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"time"
+)
+
+const boxOnline = "1"
+
+// trackUptime extends the latest uptime interval of the boxes whose online state did not change since
+// the previous sync, and opens a new interval for the others. When the syncs are more than three sync
+// intervals apart the state in between is unknown, and the new interval starts at now. The boxes which
+// went offline are reported to the webhooks.
+func (d *DataService) trackUptime(ctx context.Context, boxes []*model.Box, now time.Time) error {
+	var boxIds []string
+	for _, b := range boxes {
+		boxIds = append(boxIds, b.BoxId)
+	}
+
+	latest, err := d.boxes.GetLatestBoxUptimes(ctx, boxIds)
+	if err != nil {
+		return err
+	}
+
+	latestByBox := make(map[string]*model.BoxUptime)
+	for _, u := range latest {
+		latestByBox[u.BoxId] = u
+	}
+
+	t := model.Timestamp(now.Unix())
+	maxGap := model.Timestamp(3 * d.Interval / time.Second)
+
+	var (
+		uptimes []*model.BoxUptime
+		offline []*model.BoxUptime
+	)
+	for _, b := range boxes {
+		online := b.Online == boxOnline
+		last, ok := latestByBox[b.BoxId]
+		if ok && t-last.EndTime <= maxGap && last.Online == online {
+			last.EndTime = max(last.EndTime, t)
+			uptimes = append(uptimes, last)
+			continue
+		}
+
+		uptime := &model.BoxUptime{
+			Username:      b.Username,
+			BoxId:         b.BoxId,
+			SupplierBoxId: b.SupplierBoxId,
+			Online:        online,
+			StartTime:     t,
+			EndTime:       t,
+		}
+
+		// The state changed somewhere between the two syncs, the new state is counted from the previous one.
+		// The new interval must not start with the previous one, which it would replace, as when that one
+		// only holds a single observation.
+		if ok && t-last.EndTime <= maxGap {
+			uptime.StartTime = max(last.EndTime, last.StartTime+1)
+			uptime.EndTime = max(uptime.EndTime, uptime.StartTime)
+		}
+
+		if ok && last.Online && !online {
+			offline = append(offline, uptime)
+		}
+
+		uptimes = append(uptimes, uptime)
+	}
+
+	if err := d.boxes.BulkUpsertBoxUptimes(ctx, uptimes); err != nil {
+		return err
+	}
+
+	remarks := make(map[string]string)
+	for _, b := range boxes {
+		remarks[b.BoxId] = b.Remark
+	}
+
+	for _, u := range offline {
+		d.emit(ctx, u.Username, model.WebhookEventBoxOffline, &BoxOfflineEvent{
+			BoxId:         u.BoxId,
+			SupplierBoxId: u.SupplierBoxId,
+			Remark:        remarks[u.BoxId],
+			OfflineSince:  u.StartTime,
+		})
+	}
+
+	return nil
+}
+
+// UptimeStats sums the online and offline time of a box, or a fleet, over the Start ~ End period. The time
+// not covered by the syncs is neither online nor offline.
+type UptimeStats struct {
+	Start          model.Timestamp `json:"start"`
+	End            model.Timestamp `json:"end"`
+	Uptime         float64         `json:"uptime"`
+	OnlineSeconds  int64           `json:"onlineSeconds"`
+	OfflineSeconds int64           `json:"offlineSeconds"`
+	Outages        int64           `json:"outages"`
+	LongestOutage  int64           `json:"longestOutage"`
+}
+
+func totalsStats(t *dao.UptimeTotals, period [2]int64) *UptimeStats {
+	stats := &UptimeStats{
+		Start:          model.Timestamp(period[0]),
+		End:            model.Timestamp(period[1]),
+		OnlineSeconds:  t.OnlineSeconds,
+		OfflineSeconds: t.OfflineSeconds,
+		Outages:        t.Outages,
+		LongestOutage:  t.LongestOutage,
+	}
+
+	stats.computeUptime()
+	return stats
+}
+
+// computeUptime sets Uptime to the percentage of the observed time spent online.
+func (s *UptimeStats) computeUptime() {
+	s.Uptime = 0
+	if observed := s.OnlineSeconds + s.OfflineSeconds; observed > 0 {
+		s.Uptime = float64(s.OnlineSeconds) * 100 / float64(observed)
+	}
+}
+
+func uptimeStats(uptimes []*model.BoxUptime, start, end int64) *UptimeStats {
+	stats := &UptimeStats{Start: model.Timestamp(start), End: model.Timestamp(end)}
+	for _, u := range uptimes {
+		from, to := max(int64(u.StartTime), start), min(int64(u.EndTime), end)
+		if from >= to {
+			continue
+		}
+
+		if u.Online {
+			stats.OnlineSeconds += to - from
+			continue
+		}
+
+		stats.OfflineSeconds += to - from
+		stats.Outages++
+		stats.LongestOutage = max(stats.LongestOutage, to-from)
+	}
+
+	stats.computeUptime()
+	return stats
+}
+
+// UptimeReport is the uptime over the day, the week (Monday to Sunday) and the month of a date, up to now.
+type UptimeReport struct {
+	Day   *UptimeStats `json:"day"`
+	Week  *UptimeStats `json:"week"`
+	Month *UptimeStats `json:"month"`
+}
+
+type uptimePeriods struct {
+	day, week, month [2]int64
+}
+
+func newUptimePeriods(date, now time.Time) uptimePeriods {
+	day := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.Local)
+	week := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	month := time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.Local)
+
+	period := func(start, end time.Time) [2]int64 {
+		return [2]int64{start.Unix(), min(end.Unix(), max(now.Unix(), start.Unix()))}
+	}
+
+	return uptimePeriods{
+		day:   period(day, day.AddDate(0, 0, 1)),
+		week:  period(week, week.AddDate(0, 0, 7)),
+		month: period(month, month.AddDate(0, 1, 0)),
+	}
+}
+
+// span returns the range covering the three periods.
+func (p uptimePeriods) span() (int64, int64) {
+	return min(p.week[0], p.month[0]), max(p.week[1], p.month[1])
+}
+
+func (p uptimePeriods) report(uptimes []*model.BoxUptime) *UptimeReport {
+	return &UptimeReport{
+		Day:   uptimeStats(uptimes, p.day[0], p.day[1]),
+		Week:  uptimeStats(uptimes, p.week[0], p.week[1]),
+		Month: uptimeStats(uptimes, p.month[0], p.month[1]),
+	}
+}
+
+// fleetReport sums the uptime of all the boxes matching the filter in the store.
+func (p uptimePeriods) fleetReport(ctx context.Context, store dao.BoxStore, username string, filter *dao.BoxFilter) (*UptimeReport, error) {
+	totals, err := store.GetBoxUptimeTotals(ctx, username, filter, [][2]int64{p.day, p.week, p.month})
+	if err != nil {
+		return nil, err
+	}
+
+	return &UptimeReport{
+		Day:   totalsStats(totals[0], p.day),
+		Week:  totalsStats(totals[1], p.week),
+		Month: totalsStats(totals[2], p.month),
+	}, nil
+}
+
+type BoxUptimeReport struct {
+	BoxId         string `json:"boxId"`
+	SupplierBoxId string `json:"supplierBoxId"`
+	Remark        string `json:"remark"`
+	*UptimeReport
+}
+
+// boxUptimeReports reports the uptime of a page of the boxes matching the filter, along with the number of
+// boxes matching it and the uptime of the whole fleet.
+func (s *Server) boxUptimeReports(ctx context.Context, username string, filter *dao.BoxFilter, periods uptimePeriods, page, pageSize int64) (*UptimeReport, []*BoxUptimeReport, int64, error) {
+	total, boxes, err := s.boxes.GetBoxesList(ctx, username, filter, page, pageSize)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var boxIds []string
+	for _, b := range boxes {
+		boxIds = append(boxIds, b.BoxId)
+	}
+
+	start, end := periods.span()
+	uptimes, err := s.boxes.GetBoxUptimes(ctx, username, boxIds, start, end)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	uptimesByBox := make(map[string][]*model.BoxUptime)
+	for _, u := range uptimes {
+		uptimesByBox[u.BoxId] = append(uptimesByBox[u.BoxId], u)
+	}
+
+	reports := make([]*BoxUptimeReport, 0, len(boxes))
+	for _, b := range boxes {
+		reports = append(reports, &BoxUptimeReport{
+			BoxId:         b.BoxId,
+			SupplierBoxId: b.SupplierBoxId,
+			Remark:        b.Remark,
+			UptimeReport:  periods.report(uptimesByBox[b.BoxId]),
+		})
+	}
+
+	fleet, err := periods.fleetReport(ctx, s.boxes, username, filter)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	return fleet, reports, total, nil
+}
@@ -5,13 +5,13 @@ import (
 	"errors"
 	jwt "github.com/appleboy/gin-jwt/v2"
 	"github.com/gin-gonic/gin"
-	"github.com/gnasnik/titan-box-api/core/dao"
 	xerrors "github.com/gnasnik/titan-box-api/core/errors"
 	"github.com/gnasnik/titan-box-api/core/generated/model"
-	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type registerParams struct {
@@ -19,12 +19,14 @@ type registerParams struct {
 	PhoneNumber string `json:"phoneNumber"`
 	VerifyCode  string `json:"verifyCode"`
 	Password    string `json:"password"`
-	Src         string `json:"src"`
-	Public      bool   `json:"public"`
-	Code        string `json:"code"`
+	// Src was the channel of the registration, which is not recorded, the registrations giving one are refused.
+	Src    string `json:"src"`
+	Public bool   `json:"public"`
+	// Code is the invite code, the username of a user who can invite and becomes the parent of the new user.
+	Code string `json:"code"`
 }
 
-func UserRegister(c *gin.Context) {
+func (s *Server) UserRegister(c *gin.Context) {
 	var params registerParams
 	if err := c.BindJSON(&params); err != nil {
 		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
@@ -37,12 +39,51 @@ func UserRegister(c *gin.Context) {
 	}
 
 	passwd := params.Password
-	if userInfo.Username == "" {
+	if userInfo.Username == "" || params.Src != "" {
 		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
 		return
 	}
 
-	_, err := dao.GetUserByUsername(c.Request.Context(), userInfo.Username)
+	if err := ValidatePassword(passwd, userInfo.Username); err != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrWeakPassword))
+		return
+	}
+
+	if !s.auth.cfg.SkipVerifyCode {
+		// the phone number is verified when given, the username otherwise which must then be an email address
+		target := userInfo.PhoneNumber
+		if target == "" {
+			target = userInfo.Username
+		}
+
+		if !validVerifyTarget(target) {
+			c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+			return
+		}
+
+		if !s.auth.CheckVerifyCode(target, params.VerifyCode) {
+			c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidVerifyCode))
+			return
+		}
+	}
+
+	if params.Code != "" {
+		inviter, err := s.users.GetUserByUsername(c.Request.Context(), params.Code)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && !inviter.CanInvite) {
+			c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidInviteCode))
+			return
+		}
+
+		if err != nil {
+			log.Errorf("GetUserByUsername: %v", err)
+			c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+			return
+		}
+
+		userInfo.ParentId = inviter.Username
+	}
+
+	_, err := s.users.GetUserByUsername(c.Request.Context(), userInfo.Username)
 	if err == nil {
 		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrUserExist))
 		return
@@ -60,10 +101,8 @@ func UserRegister(c *gin.Context) {
 		return
 	}
 	userInfo.Password = string(passHash)
-	userInfo.AppKey = strings.ReplaceAll(uuid.NewString(), "-", "")
-	userInfo.AppSecret = strings.ReplaceAll(uuid.NewString(), "-", "")
 
-	err = dao.CreateUser(c.Request.Context(), userInfo)
+	err = s.users.CreateUser(c.Request.Context(), userInfo)
 	if err != nil {
 		log.Errorf("create user : %v", err)
 		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
@@ -75,13 +114,472 @@ func UserRegister(c *gin.Context) {
 	})
 }
 
-func QueryUserInfoHandler(c *gin.Context) {
+func (s *Server) QueryUserInfoHandler(c *gin.Context) {
 	claims := jwt.ExtractClaims(c)
 	username := claims[identityKey].(string)
-	user, err := dao.GetUserByUsername(c.Request.Context(), username)
+	user, err := s.users.GetUserByUsername(c.Request.Context(), username)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, respError(xerrors.ErrUserNotFound))
 		return
 	}
 	c.JSON(http.StatusOK, user)
 }
+
+type verifyCodeParams struct {
+	// Target is the phone number or the email address the code is sent to.
+	Target    string `json:"target"`
+	Chaptcode string `json:"chaptcode"`
+}
+
+// SendVerifyCodeHandler sends the code the registration of a phone number or an email address requires.
+func (s *Server) SendVerifyCodeHandler(c *gin.Context) {
+	var params verifyCodeParams
+	if err := c.BindJSON(&params); err != nil || !validVerifyTarget(params.Target) {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+		return
+	}
+
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+
+	if s.auth.Captcha != nil {
+		ok, err := s.auth.Captcha.VerifyCaptcha(ctx, params.Chaptcode, ip)
+		if err != nil {
+			log.Errorf("verify captcha: %v", err)
+			c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+			return
+		}
+
+		if !ok {
+			c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidCaptcha))
+			return
+		}
+	}
+
+	err := s.auth.SendVerifyCode(ctx, params.Target, ip)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, JsonObject{
+			"msg": "success",
+		})
+	case errors.Is(err, errNoVerifyCodeSender):
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+	case errors.Is(err, errVerifyCodeFrequent):
+		c.JSON(http.StatusTooManyRequests, respError(xerrors.ErrVerifyCodeFrequent))
+	case errors.Is(err, errTooManyVerifyCodes):
+		c.JSON(http.StatusTooManyRequests, respError(xerrors.ErrTooManyAttempts))
+	default:
+		log.Errorf("send verify code: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+	}
+}
+
+type refreshTokenParams struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token and a new refresh token.
+func (s *Server) RefreshTokenHandler(c *gin.Context) {
+	var params refreshTokenParams
+	if err := c.BindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+		return
+	}
+
+	session, refreshToken, err := s.rotateSession(c, params.RefreshToken)
+	if errors.Is(err, errInvalidRefreshToken) {
+		keyUnauthorized(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if err != nil {
+		log.Errorf("rotate session: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	token, expire, err := s.tokens.TokenGenerator(&tokenIdentity{Username: session.Username, SessionId: session.Id})
+	if err != nil {
+		log.Errorf("generate token: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, loginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		Expire:       expire.Unix(),
+	})
+}
+
+// LogoutHandler revokes the session of the access token, along with its refresh token.
+func (s *Server) LogoutHandler(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	sessionId, _ := claims[sessionKey].(string)
+
+	err := s.sessions.RevokeSession(c.Request.Context(), username, sessionId, time.Now())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Errorf("revoke session: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, JsonObject{
+		"msg": "success",
+	})
+}
+
+type sessionResponse struct {
+	*model.Session
+	// Current tells the session of the access token listing them.
+	Current bool `json:"current"`
+}
+
+type GetSessionsResponse struct {
+	Sessions []*sessionResponse `json:"list"`
+	Total    string             `json:"total"`
+}
+
+func (s *Server) QuerySessionsHandler(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	sessionId, _ := claims[sessionKey].(string)
+
+	sessions, err := s.sessions.GetActiveSessions(c.Request.Context(), username, time.Now())
+	if err != nil {
+		log.Errorf("get sessions: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	out := GetSessionsResponse{
+		Sessions: make([]*sessionResponse, 0, len(sessions)),
+		Total:    strconv.Itoa(len(sessions)),
+	}
+	for _, session := range sessions {
+		out.Sessions = append(out.Sessions, &sessionResponse{Session: session, Current: session.Id == sessionId})
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// RevokeSessionHandler kills a session of the user, its access tokens are rejected from now on.
+func (s *Server) RevokeSessionHandler(c *gin.Context) {
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	err := s.sessions.RevokeSession(c.Request.Context(), username, c.Param("id"), time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, respError(xerrors.ErrNotFound))
+		return
+	}
+
+	if err != nil {
+		log.Errorf("revoke session: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, JsonObject{
+		"msg": "success",
+	})
+}
+
+type changePasswordParams struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ChangePasswordHandler replaces the password of the user and revokes every other session.
+func (s *Server) ChangePasswordHandler(c *gin.Context) {
+	var params changePasswordParams
+	if err := c.BindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+		return
+	}
+
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+	sessionId, _ := claims[sessionKey].(string)
+
+	if s.auth.LoginLockout(username, ip) > 0 {
+		c.JSON(http.StatusTooManyRequests, respError(xerrors.ErrTooManyAttempts))
+		return
+	}
+
+	user, err := s.users.GetUserByUsername(ctx, username)
+	if err != nil {
+		log.Errorf("get user by username: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.OldPassword)); err != nil {
+		s.auth.LoginFailed(username, ip)
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidPassword))
+		return
+	}
+
+	if err := ValidatePassword(params.NewPassword, username); err != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrWeakPassword))
+		return
+	}
+
+	passHash, err := bcrypt.GenerateFromPassword([]byte(params.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if err := s.users.UpdateUserPassword(ctx, username, string(passHash)); err != nil {
+		log.Errorf("update user password: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if err := s.sessions.RevokeUserSessions(ctx, username, sessionId, time.Now()); err != nil {
+		log.Errorf("revoke sessions of %s: %v", username, err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, JsonObject{
+		"msg": "success",
+	})
+}
+
+type totpStatusResponse struct {
+	Enabled         bool       `json:"enabled"`
+	ConfirmedAt     *time.Time `json:"confirmedAt,omitempty"`
+	BackupCodesLeft int64      `json:"backupCodesLeft"`
+}
+
+// QueryTOTPHandler tells whether the logins of the user require a TOTP code.
+func (s *Server) QueryTOTPHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	totp, err := s.enabledTOTP(ctx, username)
+	if err != nil {
+		log.Errorf("get user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if totp == nil {
+		c.JSON(http.StatusOK, totpStatusResponse{})
+		return
+	}
+
+	left, err := s.totp.CountBackupCodes(ctx, username)
+	if err != nil {
+		log.Errorf("count backup codes: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, totpStatusResponse{
+		Enabled:         true,
+		ConfirmedAt:     totp.ConfirmedAt,
+		BackupCodesLeft: left,
+	})
+}
+
+type enrollTOTPResponse struct {
+	Secret string `json:"secret"`
+	// OtpauthURI is rendered as a QR code for the authenticator apps to scan.
+	OtpauthURI string `json:"otpauthUri"`
+}
+
+// EnrollTOTPHandler returns a new secret of the user, which the logins require once confirmed. Enrolling
+// again before confirming replaces the secret.
+func (s *Server) EnrollTOTPHandler(c *gin.Context) {
+	ctx := c.Request.Context()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	totp, err := s.enabledTOTP(ctx, username)
+	if err != nil {
+		log.Errorf("get user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if totp != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrTOTPEnabled))
+		return
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	now := time.Now()
+	err = s.totp.CreateUserTOTP(ctx, &model.UserTOTP{
+		Username:  username,
+		Secret:    secret,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+	if err != nil {
+		log.Errorf("create user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, enrollTOTPResponse{
+		Secret:     secret,
+		OtpauthURI: TOTPURI(s.auth.cfg.TOTPIssuer, username, secret),
+	})
+}
+
+type confirmTOTPParams struct {
+	Code string `json:"code"`
+}
+
+// ConfirmTOTPHandler enables the second factor with a code of the secret enrolled, and returns the backup
+// codes of the user, which are not shown again.
+func (s *Server) ConfirmTOTPHandler(c *gin.Context) {
+	var params confirmTOTPParams
+	if err := c.BindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+		return
+	}
+
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	if s.auth.LoginLockout(username, ip) > 0 {
+		c.JSON(http.StatusTooManyRequests, respError(xerrors.ErrTooManyAttempts))
+		return
+	}
+
+	totp, err := s.totp.GetUserTOTP(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, respError(xerrors.ErrNotFound))
+		return
+	}
+
+	if err != nil {
+		log.Errorf("get user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if totp.Enabled() {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrTOTPEnabled))
+		return
+	}
+
+	now := time.Now()
+	step, ok := matchTOTPStep(totp.Secret, strings.TrimSpace(params.Code), now)
+	if !ok {
+		s.auth.LoginFailed(username, ip)
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidTOTPCode))
+		return
+	}
+
+	codes, hashes, err := newBackupCodes(username, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	err = s.totp.EnableUserTOTP(ctx, username, step, now, hashes)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrTOTPEnabled))
+		return
+	}
+
+	if err != nil {
+		log.Errorf("enable user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, JsonObject{
+		"backupCodes": codes,
+	})
+}
+
+type disableTOTPParams struct {
+	Password string `json:"password"`
+	// Code is a TOTP or a backup code.
+	Code string `json:"code"`
+}
+
+// DisableTOTPHandler removes the second factor of the user, who authenticates again with the password and
+// a code, as a stolen access token must not be enough to turn it off.
+func (s *Server) DisableTOTPHandler(c *gin.Context) {
+	var params disableTOTPParams
+	if err := c.BindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidParams))
+		return
+	}
+
+	ctx := c.Request.Context()
+	ip := c.ClientIP()
+	claims := jwt.ExtractClaims(c)
+	username := claims[identityKey].(string)
+
+	if s.auth.LoginLockout(username, ip) > 0 {
+		c.JSON(http.StatusTooManyRequests, respError(xerrors.ErrTooManyAttempts))
+		return
+	}
+
+	user, err := s.users.GetUserByUsername(ctx, username)
+	if err != nil {
+		log.Errorf("get user by username: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(params.Password)); err != nil {
+		s.auth.LoginFailed(username, ip)
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidPassword))
+		return
+	}
+
+	totp, err := s.enabledTOTP(ctx, username)
+	if err != nil {
+		log.Errorf("get user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if totp == nil {
+		c.JSON(http.StatusNotFound, respError(xerrors.ErrNotFound))
+		return
+	}
+
+	ok, err := s.verifySecondFactor(ctx, totp, params.Code)
+	if err != nil {
+		log.Errorf("verify second factor: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	if !ok {
+		s.auth.LoginFailed(username, ip)
+		c.JSON(http.StatusBadRequest, respError(xerrors.ErrInvalidTOTPCode))
+		return
+	}
+
+	if err := s.totp.DeleteUserTOTP(ctx, username); err != nil {
+		log.Errorf("delete user totp: %v", err)
+		c.JSON(http.StatusInternalServerError, respError(xerrors.ErrInternalServer))
+		return
+	}
+
+	c.JSON(http.StatusOK, JsonObject{
+		"msg": "success",
+	})
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	xerrors "github.com/gnasnik/titan-box-api/core/errors"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserRegister(t *testing.T) {
+	const password = "Correct-Horse-42"
+
+	cases := []struct {
+		name       string
+		skipVerify bool
+		params     registerParams
+		sentCode   string
+		wantErr    error
+		wantParent string
+	}{
+		{name: "verified", params: registerParams{Username: "a@example.com", VerifyCode: "123456"}, sentCode: "123456"},
+		{name: "no verify code", params: registerParams{Username: "a@example.com"}, sentCode: "123456", wantErr: xerrors.ErrInvalidVerifyCode},
+		{name: "wrong verify code", params: registerParams{Username: "a@example.com", VerifyCode: "654321"}, sentCode: "123456", wantErr: xerrors.ErrInvalidVerifyCode},
+		{name: "no code sent", params: registerParams{Username: "a@example.com", VerifyCode: "123456"}, wantErr: xerrors.ErrInvalidVerifyCode},
+		{name: "verification skipped", skipVerify: true, params: registerParams{Username: "dev"}},
+		{name: "invited", skipVerify: true, params: registerParams{Username: "dev", Code: "inviter"}, wantParent: "inviter"},
+		{name: "inviter who cannot invite", skipVerify: true, params: registerParams{Username: "dev", Code: "member"}, wantErr: xerrors.ErrInvalidInviteCode},
+		{name: "unknown inviter", skipVerify: true, params: registerParams{Username: "dev", Code: "nobody"}, wantErr: xerrors.ErrInvalidInviteCode},
+		{name: "source given", skipVerify: true, params: registerParams{Username: "dev", Src: "web"}, wantErr: xerrors.ErrInvalidParams},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store := dao.NewMemoryStore()
+			ctx := context.Background()
+			for _, u := range []*model.User{{Username: "inviter", CanInvite: true}, {Username: "member"}} {
+				if err := store.CreateUser(ctx, u); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			s := NewServer(dao.NewStores(store))
+			s.auth = NewAuth(config.AuthConfig{SkipVerifyCode: c.skipVerify}, config.NotifyConfig{})
+			if c.sentCode != "" {
+				if err := s.auth.codes.add(c.params.Username, c.sentCode, time.Now(), time.Minute, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			c.params.Password = password
+			w := request(t, s.UserRegister, "", http.MethodPost, "", c.params)
+
+			if c.wantErr != nil {
+				var resp struct {
+					Code int `json:"code"`
+				}
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+
+				if want := c.wantErr.(xerrors.ApiError).Code(); w.Code != http.StatusBadRequest || resp.Code != want {
+					t.Fatalf("status %d, code %d, want %d, code %d", w.Code, resp.Code, http.StatusBadRequest, want)
+				}
+
+				if _, err := store.GetUserByUsername(ctx, c.params.Username); err == nil {
+					t.Errorf("user %s registered", c.params.Username)
+				}
+				return
+			}
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d, body %s", w.Code, w.Body)
+			}
+
+			user, err := store.GetUserByUsername(ctx, c.params.Username)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if user.ParentId != c.wantParent {
+				t.Errorf("parent = %q, want %q", user.ParentId, c.wantParent)
+			}
+		})
+	}
+}
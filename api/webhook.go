@@ -0,0 +1,457 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/config"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultWebhookPollInterval = 10 * time.Second
+	defaultWebhookTimeout      = 10 * time.Second
+	defaultWebhookMaxAttempts  = 8
+	defaultWebhookMinBackoff   = 30 * time.Second
+	defaultWebhookMaxBackoff   = 6 * time.Hour
+	defaultWebhookConcurrency  = 4
+
+	// webhookBatchSize is the number of due deliveries loaded from the outbox at once.
+	webhookBatchSize = 100
+	// maxWebhookErrorLength bounds the error recorded for a failed attempt, including the start of the response body.
+	maxWebhookErrorLength = 1024
+
+	WebhookHeaderEvent     = "X-Titan-Event"
+	WebhookHeaderDelivery  = "X-Titan-Delivery"
+	WebhookHeaderTimestamp = "X-Titan-Timestamp"
+	WebhookHeaderSignature = "X-Titan-Signature"
+)
+
+// WebhookPayload is the JSON body posted to the endpoints. Its Id is shared by the deliveries of the event
+// to every endpoint and kept on redelivery, so that receivers can drop the duplicates.
+type WebhookPayload struct {
+	Id        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+type BoxOfflineEvent struct {
+	BoxId         string          `json:"boxId"`
+	SupplierBoxId string          `json:"supplierBoxId"`
+	Remark        string          `json:"remark"`
+	OfflineSince  model.Timestamp `json:"offlineSince"`
+}
+
+type IncomeSyncedEvent struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Rows  int64  `json:"rows"`
+}
+
+type SyncFailedEvent struct {
+	DataType string `json:"dataType"`
+	Start    string `json:"start,omitempty"`
+	End      string `json:"end,omitempty"`
+	Error    string `json:"error"`
+}
+
+// Webhooks queues the events of the users in the webhook_deliveries outbox and posts them to the endpoints
+// subscribed, retrying the failed deliveries with an exponential backoff.
+type Webhooks struct {
+	cfg    config.WebhooksConfig
+	store  dao.WebhookStore
+	client *http.Client
+}
+
+func NewWebhooks(store dao.WebhookStore, cfg config.WebhooksConfig) *Webhooks {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultWebhookPollInterval
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultWebhookTimeout
+	}
+
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = defaultWebhookMaxAttempts
+	}
+
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = defaultWebhookMinBackoff
+	}
+
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = defaultWebhookMaxBackoff
+	}
+
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = defaultWebhookConcurrency
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !cfg.AllowPrivateTargets {
+		// The deliveries connect directly, the address dialed is checked again as the host may resolve
+		// elsewhere than when the endpoint was registered, or redirect.
+		dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicTargetControl}
+		transport.Proxy = nil
+		transport.DialContext = dialer.DialContext
+	}
+
+	return &Webhooks{
+		cfg:    cfg,
+		store:  store,
+		client: &http.Client{Timeout: cfg.Timeout, Transport: transport},
+	}
+}
+
+var errPrivateWebhookTarget = errors.New("webhook target is not a public address")
+
+// nonPublicNetworks are the ranges refused on top of the loopback, private, link-local and multicast
+// addresses: "this" network, the carrier-grade NAT and the benchmarking ranges.
+var nonPublicNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("198.18.0.0/15"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// isPublicIP reports whether ip is routable on the internet, which excludes the cloud metadata
+// address 169.254.169.254 along with the link-local range.
+func isPublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func publicTargetControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !isPublicIP(net.ParseIP(host)) {
+		return fmt.Errorf("%w: %s", errPrivateWebhookTarget, host)
+	}
+
+	return nil
+}
+
+// checkWebhookHost refuses the hosts which are, or resolve to, a non public address.
+func checkWebhookHost(ctx context.Context, host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return fmt.Errorf("%w: %s", errPrivateWebhookTarget, host)
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("resolve webhook host %s: %w", host, err)
+	}
+
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", errPrivateWebhookTarget, host, addr.IP)
+		}
+	}
+
+	return nil
+}
+
+func IsWebhookEvent(event string) bool {
+	for _, e := range model.WebhookEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// NewWebhookEndpoint validates the endpoint requested by a user, a secret is generated when none is given.
+// The endpoints on the internal network are refused unless allowPrivate is set.
+func NewWebhookEndpoint(ctx context.Context, username, rawURL string, events []string, secret string, allowPrivate bool) (*model.WebhookEndpoint, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid webhook url: %s", rawURL)
+	}
+
+	if !allowPrivate {
+		if err := checkWebhookHost(ctx, u.Hostname()); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, event := range events {
+		if !IsWebhookEvent(event) {
+			return nil, fmt.Errorf("invalid webhook event: %s", event)
+		}
+	}
+
+	if secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	now := time.Now()
+	return &model.WebhookEndpoint{
+		Id:        uuid.NewString(),
+		Username:  username,
+		URL:       rawURL,
+		Secret:    secret,
+		Events:    strings.Join(events, ","),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}, nil
+}
+
+// Emit queues a delivery of the event for every endpoint of the user subscribed to it.
+func (w *Webhooks) Emit(ctx context.Context, username, event string, data interface{}) error {
+	endpoints, err := w.store.GetWebhookEndpoints(ctx, username)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	payload, err := json.Marshal(WebhookPayload{
+		Id:        uuid.NewString(),
+		Event:     event,
+		CreatedAt: now,
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	var deliveries []*model.WebhookDelivery
+	for _, e := range endpoints {
+		if !e.Subscribes(event) {
+			continue
+		}
+
+		deliveries = append(deliveries, &model.WebhookDelivery{
+			Id:            uuid.NewString(),
+			EndpointId:    e.Id,
+			Username:      username,
+			Event:         event,
+			Payload:       string(payload),
+			Status:        model.WebhookDeliveryPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		})
+	}
+
+	return w.store.AddWebhookDeliveries(ctx, deliveries)
+}
+
+// Redelivery returns a new pending delivery of the payload of d, the log of d is left as is.
+func Redelivery(d *model.WebhookDelivery, now time.Time) *model.WebhookDelivery {
+	return &model.WebhookDelivery{
+		Id:            uuid.NewString(),
+		EndpointId:    d.EndpointId,
+		Username:      d.Username,
+		Event:         d.Event,
+		Payload:       d.Payload,
+		Status:        model.WebhookDeliveryPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+}
+
+// Run delivers the due deliveries of the outbox every PollInterval until ctx is cancelled.
+func (w *Webhooks) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Dispatch(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("dispatch webhooks: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Dispatch sends the deliveries due until none is left, on at most Concurrency workers.
+func (w *Webhooks) Dispatch(ctx context.Context) error {
+	for ctx.Err() == nil {
+		deliveries, err := w.store.GetDueWebhookDeliveries(ctx, time.Now(), webhookBatchSize)
+		if err != nil {
+			return err
+		}
+
+		g := new(errgroup.Group)
+		g.SetLimit(w.cfg.Concurrency)
+
+		for _, d := range deliveries {
+			d := d
+			g.Go(func() error {
+				return w.deliver(ctx, d)
+			})
+		}
+
+		if err := g.Wait(); err != nil {
+			return err
+		}
+
+		if len(deliveries) < webhookBatchSize {
+			return nil
+		}
+	}
+
+	return ctx.Err()
+}
+
+// deliver makes one attempt at the delivery and records its outcome, the delivery is retried after a
+// backoff until it runs out of attempts.
+func (w *Webhooks) deliver(ctx context.Context, d *model.WebhookDelivery) error {
+	endpoint, err := w.store.GetWebhookEndpoint(ctx, d.EndpointId)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	var code int
+	if endpoint != nil {
+		code, err = w.post(ctx, endpoint, d)
+	} else {
+		err = errors.New("webhook endpoint deleted")
+	}
+
+	now := time.Now()
+	d.Attempts++
+	d.ResponseCode = int64(code)
+	d.UpdatedAt = now
+
+	switch {
+	case err == nil:
+		d.Status, d.LastError, d.DeliveredAt = model.WebhookDeliveryDelivered, "", &now
+	case endpoint == nil || d.Attempts >= int64(w.cfg.MaxAttempts):
+		d.Status, d.LastError = model.WebhookDeliveryFailed, truncate(err.Error(), maxWebhookErrorLength)
+	default:
+		d.LastError = truncate(err.Error(), maxWebhookErrorLength)
+		d.NextAttemptAt = now.Add(w.backoff(int(d.Attempts) - 1))
+	}
+
+	if err != nil {
+		log.Warnf("webhook delivery %s of %s to %s failed (attempt %d/%d): %v", d.Id, d.Event, d.EndpointId, d.Attempts, w.cfg.MaxAttempts, err)
+	}
+
+	writeCtx, cancel := writeContext(ctx)
+	defer cancel()
+
+	return w.store.UpdateWebhookDelivery(writeCtx, d)
+}
+
+// post sends the payload signed with the endpoint secret, any response but a 2xx is an error.
+func (w *Webhooks) post(ctx context.Context, endpoint *model.WebhookEndpoint, d *model.WebhookDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewBufferString(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "titan-box-api-webhook")
+	request.Header.Set(WebhookHeaderEvent, d.Event)
+	request.Header.Set(WebhookHeaderDelivery, d.Id)
+	request.Header.Set(WebhookHeaderTimestamp, timestamp)
+	request.Header.Set(WebhookHeaderSignature, "sha256="+SignWebhook(endpoint.Secret, timestamp, []byte(d.Payload)))
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, maxWebhookErrorLength))
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return response.StatusCode, fmt.Errorf("unexpected status %d: %s", response.StatusCode, body)
+	}
+
+	return response.StatusCode, nil
+}
+
+// SignWebhook returns the hex encoded HMAC-SHA256 of "timestamp.body" keyed with the endpoint secret. Receivers
+// recompute it from the X-Titan-Timestamp header and the raw body, and reject the stale timestamps.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns minBackoff * 2^attempt, capped at maxBackoff.
+func (w *Webhooks) backoff(attempt int) time.Duration {
+	if attempt < 32 && w.cfg.MinBackoff<<attempt < w.cfg.MaxBackoff {
+		return w.cfg.MinBackoff << attempt
+	}
+	return w.cfg.MaxBackoff
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// emit queues an event for the webhooks of the PaiNet account, a failure is only logged so the syncs go on.
+func (d *DataService) emit(ctx context.Context, username, event string, data interface{}) {
+	if d.Webhooks == nil {
+		return
+	}
+
+	ctx, cancel := writeContext(ctx)
+	defer cancel()
+
+	if err := d.Webhooks.Emit(ctx, username, event, data); err != nil {
+		log.Errorf("emit %s webhook of %s: %v", event, username, err)
+	}
+}
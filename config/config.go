@@ -1,10 +1,178 @@
 package config
 
+import "time"
+
 var Cfg Config
 
 type Config struct {
-	Mode        string
-	ApiListen   string
+	Mode      string
+	ApiListen string
+	// DatabaseURL is a MySQL DSN, a postgres:// url, or a sqlite:// url pointing to the database file.
 	DatabaseURL string
 	SecretKey   string
+	Auth        AuthConfig
+	APIKey      APIKeyConfig
+	// AutoMigrate applies the pending schema migrations at startup.
+	AutoMigrate bool
+	PaiNet      PaiNetConfig
+	Sync        SyncConfig
+	Retention   RetentionConfig
+	Alerts      AlertsConfig
+	Webhooks    WebhooksConfig
+	Notify      NotifyConfig
+}
+
+// AuthConfig secures the registration and the login of the users.
+type AuthConfig struct {
+	// The registration verifies the phone number, or the username which must then be an email address, with a
+	// code sent to it. SkipVerifyCode turns the check off, for the development setups only.
+	SkipVerifyCode bool
+	// VerifyCodeTTL defaults to 10m.
+	VerifyCodeTTL time.Duration
+	// VerifyCodeInterval is the least time between two codes sent to the same target, defaults to 1m.
+	VerifyCodeInterval time.Duration
+	// SMSURL is the gateway the codes of the phone numbers are posted to as {"phoneNumber": "", "code": ""},
+	// the email addresses get theirs from the Notify.SMTP server.
+	SMSURL string
+	// MaxLoginFailures of a username, defaults to 5, or MaxIPLoginFailures of a client ip, defaults to 20,
+	// within LoginFailureWindow lock the logins out for LoginLockout. Both durations default to 15m.
+	MaxLoginFailures   int
+	MaxIPLoginFailures int
+	LoginFailureWindow time.Duration
+	LoginLockout       time.Duration
+	Captcha            CaptchaConfig
+	// AccessTokenTTL is the lifetime of the JWTs, defaults to 15m. RefreshTokenTTL, 720h by default, is how
+	// long a session lasts without refreshing them.
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// TOTPIssuer names the service in the authenticator apps of the users, defaults to Titan Box.
+	TOTPIssuer string
+}
+
+// CaptchaConfig checks the captcha of the logins with a reCAPTCHA, hCaptcha or Turnstile compatible service.
+type CaptchaConfig struct {
+	// VerifyURL is the siteverify endpoint of the service, the captcha is not required when empty.
+	VerifyURL string
+	Secret    string
+}
+
+// APIKeyConfig tunes the checks of the requests signed with the api keys the users manage.
+type APIKeyConfig struct {
+	// Skew is how far the timestamp of a request may be from the server time, either way. Defaults to 5m.
+	Skew time.Duration
+	// NonceCacheSize bounds the signatures of each AppKey remembered to reject the replays, defaults to 100000.
+	// The requests of a key beyond it within twice the Skew are refused, those of the other keys still pass.
+	NonceCacheSize int
+	// AllowMD5 accepts the md5 signatures of the PaiNet open api, which do not cover the requests. Only the
+	// hmac-sha256 ones are accepted by default.
+	AllowMD5 bool
+	// TTL is the lifetime of the keys created without one, defaults to 90 days.
+	TTL time.Duration
+	// RotateGrace is how long the secret replaced by a rotation stays valid when the request sets none,
+	// defaults to 24h.
+	RotateGrace time.Duration
+	// MaxKeys bounds the active keys of a user, defaults to 20.
+	MaxKeys int
+	// EncryptionKey seals the secrets of the keys in the database with AES-256-GCM. Unlike the passwords and
+	// the refresh tokens, only kept hashed, the secrets are needed back to check the HMAC signatures of the
+	// requests, so a leak of the database along with this key exposes all of them: keep it apart from the
+	// database and its backups. The server refuses to start without it or with ExampleEncryptionKey.
+	// Changing it invalidates every key, the deployments which sealed them with the SecretKey set it to that.
+	EncryptionKey string
+}
+
+// ExampleEncryptionKey is the APIKey.EncryptionKey of config.toml-example.
+const ExampleEncryptionKey = "replace-with-a-long-random-string"
+
+type PaiNetConfig struct {
+	// BaseURL of the PaiNet open api, defaults to https://openapi.painet.work
+	BaseURL string
+	Timeout time.Duration
+	// RateLimit is the number of requests per second allowed for each PaiNet account, with bursts up to RateBurst.
+	RateLimit  float64
+	RateBurst  int
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxRetryAfter caps the wait a Retry-After header of the PaiNet api asks for, defaults to 5m.
+	MaxRetryAfter time.Duration
+}
+
+type SyncConfig struct {
+	// AccountConcurrency is the number of PaiNet accounts synced in parallel.
+	AccountConcurrency int
+	// PageConcurrency is the number of pages of one account fetched in parallel.
+	PageConcurrency int
+	AccountTimeout  time.Duration
+}
+
+type RetentionConfig struct {
+	// Schedule is the cron spec, with seconds, of the retention runs. Nothing expires when it is empty.
+	Schedule string
+	// TTL maps the time-series tables, box_bandwidth, box_quality and box_income, to the age their rows
+	// are deleted at. Tables without a TTL are kept forever.
+	TTL       map[string]time.Duration
+	BatchSize int
+	// ArchiveDir receives the expired rows before they are deleted, they are not archived when empty.
+	ArchiveDir string
+	// ArchiveFormat of the archive files, only gzip compressed "ndjson" is supported.
+	ArchiveFormat string
+	// DryRun only reports the rows that would be removed.
+	DryRun bool
+}
+
+type AlertsConfig struct {
+	Rules []AlertRule
+}
+
+// AlertRule raises an alert for every box matching it, each time the boxes of an account are synced.
+type AlertRule struct {
+	// Name identifies the rule in its alerts, it defaults to the Type.
+	Name string
+	// Type is one of box_offline, box_fault, packet_loss, disk_usage, income_drop and nat_degraded.
+	Type string
+	// Threshold is in minutes for box_offline, in percents for packet_loss, disk_usage and income_drop,
+	// and unused by box_fault and nat_degraded.
+	Threshold float64
+	Severity  string
+}
+
+type WebhooksConfig struct {
+	// PollInterval is how often the outbox is scanned for the deliveries due, defaults to 10s.
+	PollInterval time.Duration
+	// Timeout of one delivery attempt, defaults to 10s.
+	Timeout time.Duration
+	// MaxAttempts before a delivery is given up, with a backoff from MinBackoff doubling up to MaxBackoff
+	// between the attempts.
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	// Concurrency is the number of deliveries sent in parallel.
+	Concurrency int
+	// AllowPrivateTargets accepts the endpoints on loopback, private and link-local addresses, which are
+	// refused by default so that the users cannot reach the internal network. Only for local receivers.
+	AllowPrivateTargets bool
+}
+
+// NotifyConfig points the notification channels at their services, the bot urls default to the public
+// apis and can be pointed at local stand-ins.
+type NotifyConfig struct {
+	// Timeout of one notification, defaults to 10s.
+	Timeout     time.Duration
+	DingTalkURL string
+	FeishuURL   string
+	WeComURL    string
+	TelegramURL string
+	// TelegramToken of the bot sending to the chats of the users, unless a channel has its own.
+	TelegramToken string
+	SMTP          SMTPConfig
+}
+
+type SMTPConfig struct {
+	Host string
+	Port int
+	// Username and Password authenticate with PLAIN auth, which needs TLS unless the host is local.
+	Username string
+	Password string
+	From     string
 }
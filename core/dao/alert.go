@@ -0,0 +1,111 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+)
+
+type AlertFilter struct {
+	Status string
+	Rule   string
+	BoxIds []string
+}
+
+func (f *AlertFilter) where(username string) (string, []interface{}, error) {
+	var (
+		where = `where username = ? `
+		args  = []interface{}{username}
+	)
+
+	if f == nil {
+		return where, args, nil
+	}
+
+	if f.Status != "" {
+		where += ` and status = ?`
+		args = append(args, f.Status)
+	}
+
+	if f.Rule != "" {
+		where += ` and rule = ?`
+		args = append(args, f.Rule)
+	}
+
+	if len(f.BoxIds) > 0 {
+		inQuery, inArgs, err := inCondition("boxId", f.BoxIds)
+		if err != nil {
+			return "", nil, err
+		}
+		where += inQuery
+		args = append(args, inArgs...)
+	}
+
+	return where, args, nil
+}
+
+// SaveAlerts inserts the new alerts and updates the state of those already stored, in one transaction.
+func (s *SQLStore) SaveAlerts(ctx context.Context, alerts []*model.Alert) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var created []*model.Alert
+	for _, a := range alerts {
+		if a.Id == 0 {
+			created = append(created, a)
+			continue
+		}
+
+		query := `UPDATE alerts SET status = :status, value = :value, summary = :summary, resolvedAt = :resolvedAt,
+			updatedAt = :updatedAt WHERE id = :id`
+		if _, err := tx.NamedExecContext(ctx, s.rebind(query), a); err != nil {
+			return err
+		}
+	}
+
+	if len(created) > 0 {
+		query := `INSERT INTO alerts(username, dedupKey, rule, severity, boxId, supplierBoxId, status, value, summary, startsAt, resolvedAt, updatedAt)
+		VALUES(:username, :dedupKey, :rule, :severity, :boxId, :supplierBoxId, :status, :value, :summary, :startsAt, :resolvedAt, :updatedAt)`
+		if _, err := tx.NamedExecContext(ctx, s.rebind(query), created); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAlerts returns the alerts matching the filter, most recent first.
+func (s *SQLStore) GetAlerts(ctx context.Context, username string, filter *AlertFilter, page, pageSize int64) (int64, []*model.Alert, error) {
+	where, args, err := filter.where(username)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var total int64
+	if err := s.db.GetContext(ctx, &total, s.rebind(`select count(1) from alerts `+where), args...); err != nil {
+		return 0, nil, err
+	}
+
+	query := fmt.Sprintf(`select * from alerts %s order by startsAt desc, id desc limit %d offset %d`, where, pageSize, (page-1)*pageSize)
+
+	var out []*model.Alert
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
+		return 0, nil, err
+	}
+
+	return total, out, nil
+}
+
+// GetFiringAlerts returns every alert of the user still firing.
+func (s *SQLStore) GetFiringAlerts(ctx context.Context, username string) ([]*model.Alert, error) {
+	var out []*model.Alert
+	query := `select * from alerts where username = ? and status = ? order by startsAt desc, id desc`
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username, model.AlertStatusFiring); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
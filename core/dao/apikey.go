@@ -0,0 +1,74 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"time"
+)
+
+func (s *SQLStore) CreateAPIKey(ctx context.Context, key *model.APIKey) error {
+	query := `INSERT INTO api_keys(id, username, name, appKey, secret, previousSecret, previousExpiresAt, scopes, expiresAt, lastUsedAt, lastUsedIp, revokedAt, createdAt, updatedAt)
+		VALUES(:id, :username, :name, :appKey, :secret, :previousSecret, :previousExpiresAt, :scopes, :expiresAt, :lastUsedAt, :lastUsedIp, :revokedAt, :createdAt, :updatedAt)`
+
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), key)
+	return err
+}
+
+// UpdateAPIKey saves the secrets and the revocation of the key, it returns sql.ErrNoRows when the user has
+// no such key.
+func (s *SQLStore) UpdateAPIKey(ctx context.Context, key *model.APIKey) error {
+	query := `UPDATE api_keys SET secret = :secret, previousSecret = :previousSecret, previousExpiresAt = :previousExpiresAt,
+		revokedAt = :revokedAt, updatedAt = :updatedAt WHERE id = :id and username = :username`
+
+	result, err := s.db.NamedExecContext(ctx, s.rebind(query), key)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// TouchAPIKey records the last use of the key.
+func (s *SQLStore) TouchAPIKey(ctx context.Context, id string, at time.Time, ip string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`UPDATE api_keys SET lastUsedAt = ?, lastUsedIp = ? WHERE id = ?`), at, ip, id)
+	return err
+}
+
+func (s *SQLStore) GetAPIKeys(ctx context.Context, username string) ([]*model.APIKey, error) {
+	var out []*model.APIKey
+	query := `select * from api_keys where username = ? order by createdAt, id`
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// GetAPIKey returns sql.ErrNoRows when the user has no such key.
+func (s *SQLStore) GetAPIKey(ctx context.Context, username, id string) (*model.APIKey, error) {
+	var out model.APIKey
+	query := `select * from api_keys where username = ? and id = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), username, id).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// GetAPIKeyByAppKey returns sql.ErrNoRows when no key has the AppKey.
+func (s *SQLStore) GetAPIKeyByAppKey(ctx context.Context, appKey string) (*model.APIKey, error) {
+	var out model.APIKey
+	query := `select * from api_keys where appKey = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), appKey).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"github.com/gnasnik/titan-box-api/core/generated/model"
 	"github.com/jmoiron/sqlx"
+	"strings"
+	"time"
 )
 
-func BulkUpsertBoxes(ctx context.Context, boxes []*model.Box) error {
+func (s *SQLStore) BulkUpsertBoxes(ctx context.Context, boxes []*model.Box) error {
 	query := `INSERT INTO box (username, boxId, supplierBoxId, online, tcpNatType, udpNatType, publicIp, privateIp, isp, province,
 		city, cpuArch, cpuCores, memorySize, os, pluginVersion, pluginDeployTime, processStatus,
 		fault, upload, download, diskUsage, upnp, notDeployReason, reportUpBandwidth, planTask, pressBandwidth, remark,
@@ -15,95 +17,211 @@ func BulkUpsertBoxes(ctx context.Context, boxes []*model.Box) error {
 	VALUES(:username, :boxId, :supplierBoxId, :online, :tcpNatType, :udpNatType, :publicIp, :privateIp, :isp, :province,
 		:city, :cpuArch, :cpuCores, :memorySize, :os, :pluginVersion, :pluginDeployTime, :processStatus,
 		:fault, :upload, :download, :diskUsage, :upnp, :notDeployReason, :reportUpBandwidth, :planTask, :pressBandwidth, :remark,
-		:icmpv6Out, now(), now() ) ON DUPLICATE KEY UPDATE 
-		online = VALUES(online), tcpNatType = VALUES(tcpNatType), udpNatType = VALUES(udpNatType), publicIp = VALUES(publicIp),
-		privateIp = VALUES(privateIp), isp = VALUES(isp), province = VALUES(province), city = VALUES(city), cpuArch = VALUES(cpuArch),
-	    cpuCores = VALUES(cpuCores), memorySize = VALUES(memorySize), os = VALUES(os), pluginVersion = VALUES(pluginVersion), 
-	    pluginDeployTime = VALUES(pluginDeployTime),pluginDeployTime = VALUES(pluginDeployTime),
-	    processStatus = VALUES(processStatus), fault = VALUES(fault), upload = VALUES(upload), download = VALUES(download), diskUsage = VALUES(diskUsage),
-	 	upnp = VALUES(upnp), notDeployReason = VALUES(notDeployReason), reportUpBandwidth = VALUES(reportUpBandwidth), planTask = VALUES(planTask), 
-		pressBandwidth = VALUES(pressBandwidth), remark = VALUES(remark), icmpv6Out = VALUES(icmpv6Out), updatedAt = now()`
-
-	if _, err := DB.NamedExecContext(ctx, query, boxes); err != nil {
+		:icmpv6Out, %[1]s, %[1]s )`
+
+	query = fmt.Sprintf(query, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId"},
+		"online", "tcpNatType", "udpNatType", "publicIp", "privateIp", "isp", "province", "city", "cpuArch",
+		"cpuCores", "memorySize", "os", "pluginVersion", "pluginDeployTime", "processStatus", "fault", "upload", "download", "diskUsage",
+		"upnp", "notDeployReason", "reportUpBandwidth", "planTask", "pressBandwidth", "remark", "icmpv6Out", "updatedAt")
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), boxes); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func BulkUpsertBoxDiskInfo(ctx context.Context, diskInfo []*model.DiskInfo) error {
+func (s *SQLStore) BulkUpsertBoxDiskInfo(ctx context.Context, diskInfo []*model.DiskInfo) error {
 	query := `INSERT INTO box_diskinfo(boxId, supplierBoxId, diskId, diskSize, diskMedia, diskUsed)
-	VALUES(:boxId, :supplierBoxId, :diskId, :diskSize, :diskMedia, :diskUsed)  ON DUPLICATE KEY UPDATE 
-	diskSize = VALUES(diskSize), diskMedia = VALUES(diskMedia), diskUsed = VALUES(diskUsed)`
+	VALUES(:boxId, :supplierBoxId, :diskId, :diskSize, :diskMedia, :diskUsed)` +
+		s.dialect.Upsert([]string{"boxId", "diskId"}, "diskSize", "diskMedia", "diskUsed")
 
-	if _, err := DB.NamedExecContext(ctx, query, diskInfo); err != nil {
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), diskInfo); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func BulkUpsertBoxDayIncome(ctx context.Context, diskInfo []*model.BoxIncome) error {
+func (s *SQLStore) BulkUpsertBoxDayIncome(ctx context.Context, diskInfo []*model.BoxIncome) error {
 	query := `INSERT INTO box_income(username, boxId, supplierBoxId, date, remark, bw, bwAmount, amount, activityIncome, distPercent, inviterId, updatedAt)
-	VALUES(:username, :boxId, :supplierBoxId, :date, :remark, :bw, :bwAmount, :amount, :activityIncome, :distPercent, :inviterId, now())  ON DUPLICATE KEY UPDATE 
-	remark = VALUES(remark), bw = VALUES(bw), amount = VALUES(amount), updatedAt = now()`
+	VALUES(:username, :boxId, :supplierBoxId, :date, :remark, :bw, :bwAmount, :amount, :activityIncome, :distPercent, :inviterId, %s)`
+
+	query = fmt.Sprintf(query, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId", "date"},
+		"remark", "bw", "bwAmount", "amount", "activityIncome", "distPercent", "updatedAt")
 
-	if _, err := DB.NamedExecContext(ctx, query, diskInfo); err != nil {
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), diskInfo); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func BulkUpsertBoxBandwidth(ctx context.Context, bandwidths []*model.BoxBandwidth) error {
+func (s *SQLStore) BulkUpsertBoxBandwidth(ctx context.Context, bandwidths []*model.BoxBandwidth) error {
 	query := `INSERT INTO box_bandwidth(username, boxId, supplierBoxId, time, upload, download, updatedAt)
-	VALUES(:username, :boxId, :supplierBoxId, :time, :upload, :download, now())  ON DUPLICATE KEY UPDATE 
-	upload = VALUES(upload), download = VALUES(download), updatedAt = now()`
+	VALUES(:username, :boxId, :supplierBoxId, :time, :upload, :download, %s)`
 
-	if _, err := DB.NamedExecContext(ctx, query, bandwidths); err != nil {
+	query = fmt.Sprintf(query, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId", "time"}, "upload", "download", "updatedAt")
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), bandwidths); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func BulkUpsertBoxQualities(ctx context.Context, qualities []*model.BoxQuality) error {
+func (s *SQLStore) BulkUpsertBoxQualities(ctx context.Context, qualities []*model.BoxQuality) error {
 	query := `INSERT INTO box_quality(username, boxId, supplierBoxId, time, packetLoss, tcpNatType, udpNatType, cpuUsage, memoryUsage, diskUsage, updatedAt)
-	VALUES(:username, :boxId, :supplierBoxId, :time, :packetLoss, :tcpNatType, :udpNatType, :cpuUsage, :memoryUsage, :diskUsage, now())  ON DUPLICATE KEY UPDATE 
-	packetLoss = VALUES(packetLoss), tcpNatType = VALUES(tcpNatType), udpNatType = VALUES(udpNatType), cpuUsage = VALUES(cpuUsage), memoryUsage = VALUES(memoryUsage), 
-	diskUsage = VALUES(diskUsage), updatedAt = now()`
+	VALUES(:username, :boxId, :supplierBoxId, :time, :packetLoss, :tcpNatType, :udpNatType, :cpuUsage, :memoryUsage, :diskUsage, %s)`
+
+	query = fmt.Sprintf(query, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId", "time"},
+		"packetLoss", "tcpNatType", "udpNatType", "cpuUsage", "memoryUsage", "diskUsage", "updatedAt")
 
-	if _, err := DB.NamedExecContext(ctx, query, qualities); err != nil {
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), qualities); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func GetBoxesList(ctx context.Context, username string, boxIds []string, supplierBoxIds []string, page, pageSize int64) (int64, []*model.Box, error) {
-	query := `select b.*, ifnull(d.diskSize,'') as diskSize, ifnull(d.diskMedia,'') as diskMedia, ifnull(d.diskUsed,'') as diskUsed from (%s) b left join box_diskinfo d on b.boxId = d.boxId `
+// BoxFilter narrows down the boxes returned by GetBoxesList. Empty fields are ignored.
+type BoxFilter struct {
+	BoxIds         []string
+	SupplierBoxIds []string
+	Isp            []string
+	Province       []string
+	ProcessStatus  []string
+	Online         []string
+	Remarks        []string
+	// Fuzzy turns the box id matches into prefix searches and the remark matches into substring searches.
+	Fuzzy bool
+
+	OrderField string
+	Order      string
+}
+
+// boxOrderFields lists the box columns GetBoxesList can sort on.
+var boxOrderFields = map[string]bool{
+	"boxId": true, "supplierBoxId": true, "online": true, "tcpNatType": true, "udpNatType": true, "publicIp": true,
+	"privateIp": true, "isp": true, "province": true, "city": true, "cpuArch": true, "cpuCores": true, "memorySize": true,
+	"os": true, "pluginVersion": true, "pluginDeployTime": true, "processStatus": true, "planTask": true,
+	"pressBandwidth": true, "fault": true, "upload": true, "download": true, "diskUsage": true, "upnp": true,
+	"notDeployReason": true, "reportUpBandwidth": true, "remark": true, "icmpv6Out": true, "createdAt": true, "updatedAt": true,
+}
+
+func IsValidBoxOrderField(field string) bool {
+	return boxOrderFields[field]
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
 
+func inCondition(column string, values []string) (string, []interface{}, error) {
+	return sqlx.In(fmt.Sprintf(` and %s in (?)`, column), values)
+}
+
+func likeCondition(column string, values []string, format, escape string) (string, []interface{}) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	for _, v := range values {
+		conditions = append(conditions, fmt.Sprintf(`%s like ?%s`, column, escape))
+		args = append(args, fmt.Sprintf(format, likeEscaper.Replace(v)))
+	}
+
+	return fmt.Sprintf(` and (%s)`, strings.Join(conditions, " or ")), args
+}
+
+func (f *BoxFilter) where(username string, dialect Dialect) (string, []interface{}, error) {
 	var (
 		where = `where username = ? `
 		args  = []interface{}{username}
 	)
 
-	if len(boxIds) > 0 {
-		boxQuery, boxArgs, err := sqlx.In(` and boxId in (?)`, boxIds)
+	if f == nil {
+		return where, args, nil
+	}
+
+	fuzzyColumns := []struct {
+		column string
+		values []string
+		format string
+	}{
+		{"boxId", f.BoxIds, "%s%%"},
+		{"supplierBoxId", f.SupplierBoxIds, "%s%%"},
+		{"remark", f.Remarks, "%%%s%%"},
+	}
+
+	for _, fc := range fuzzyColumns {
+		if len(fc.values) == 0 {
+			continue
+		}
+
+		if f.Fuzzy {
+			likeQuery, likeArgs := likeCondition(fc.column, fc.values, fc.format, dialect.LikeEscape())
+			where += likeQuery
+			args = append(args, likeArgs...)
+			continue
+		}
+
+		inQuery, inArgs, err := inCondition(fc.column, fc.values)
 		if err != nil {
-			return 0, nil, err
+			return "", nil, err
 		}
-		where += boxQuery
-		args = append(args, boxArgs...)
+		where += inQuery
+		args = append(args, inArgs...)
 	}
 
-	if len(supplierBoxIds) > 0 {
-		supplierQuery, supplierArgs, err := sqlx.In(` and supplierBoxId in (?)`, supplierBoxIds)
+	exactColumns := []struct {
+		column string
+		values []string
+	}{
+		{"isp", f.Isp},
+		{"province", f.Province},
+		{"processStatus", f.ProcessStatus},
+		{"online", f.Online},
+	}
+
+	for _, ec := range exactColumns {
+		if len(ec.values) == 0 {
+			continue
+		}
+
+		inQuery, inArgs, err := inCondition(ec.column, ec.values)
 		if err != nil {
-			return 0, nil, err
+			return "", nil, err
 		}
-		where += supplierQuery
-		args = append(args, supplierArgs...)
+		where += inQuery
+		args = append(args, inArgs...)
+	}
+
+	return where, args, nil
+}
+
+func (f *BoxFilter) orderBy(prefix string) string {
+	field, order := "boxId", "asc"
+	if f != nil && boxOrderFields[f.OrderField] {
+		field = f.OrderField
+	}
+
+	if f != nil && strings.EqualFold(f.Order, "desc") {
+		order = "desc"
+	}
+
+	if field == "boxId" {
+		return fmt.Sprintf(` order by %sboxId %s`, prefix, order)
+	}
+
+	return fmt.Sprintf(` order by %s%s %s, %sboxId asc`, prefix, field, order, prefix)
+}
+
+func (s *SQLStore) GetBoxesList(ctx context.Context, username string, filter *BoxFilter, page, pageSize int64) (int64, []*model.Box, error) {
+	query := `select b.*, coalesce(d.diskSize,'') as diskSize, coalesce(d.diskMedia,'') as diskMedia, coalesce(d.diskUsed,'') as diskUsed from (%s) b left join box_diskinfo d on b.boxId = d.boxId `
+
+	where, args, err := filter.where(username, s.dialect)
+	if err != nil {
+		return 0, nil, err
 	}
 
 	limit := pageSize
@@ -113,11 +231,11 @@ func GetBoxesList(ctx context.Context, username string, boxIds []string, supplie
 	countQry := `SELECT count(1) from box ` + where
 
 	var total int64
-	if err := DB.GetContext(ctx, &total, countQry, args...); err != nil {
+	if err := s.db.GetContext(ctx, &total, s.rebind(countQry), args...); err != nil {
 		return 0, nil, err
 	}
 
-	query = fmt.Sprintf(query, subQry+where+fmt.Sprintf(" limit %d offset %d", limit, offset))
+	query = fmt.Sprintf(query, subQry+where+filter.orderBy("")+fmt.Sprintf(" limit %d offset %d", limit, offset)) + filter.orderBy("b.")
 
 	type BoxAndDisk struct {
 		model.Box
@@ -125,7 +243,7 @@ func GetBoxesList(ctx context.Context, username string, boxIds []string, supplie
 	}
 
 	var bds []*BoxAndDisk
-	if err := DB.SelectContext(ctx, &bds, query, args...); err != nil {
+	if err := s.db.SelectContext(ctx, &bds, s.rebind(query), args...); err != nil {
 		return 0, nil, err
 	}
 
@@ -144,7 +262,7 @@ func GetBoxesList(ctx context.Context, username string, boxIds []string, supplie
 	return total, out, nil
 }
 
-func GetBoxIncomeV2(ctx context.Context, username string, boxIds, remarks, supplierBoxIds []string, start, end string, page, pageSize int64) (int64, int64, []*model.BoxIncome, error) {
+func (s *SQLStore) GetBoxIncomeV2(ctx context.Context, username string, boxIds, remarks, supplierBoxIds []string, start, end string, page, pageSize int64) (int64, model.Decimal, []*model.BoxIncome, error) {
 	query := `select * from box_income `
 
 	var (
@@ -179,30 +297,104 @@ func GetBoxIncomeV2(ctx context.Context, username string, boxIds, remarks, suppl
 		args = append(args, remarkArgs...)
 	}
 
-	countQry := `SELECT ifnull(sum(amount),0) as total, ifnull(count(1),0) as totalNum from box_income ` + where
+	countQry := `SELECT coalesce(sum(amount),0) as total, coalesce(count(1),0) as totalNum from box_income ` + where
 	type Count struct {
-		Total    int64 `db:"total"`
-		TotalNum int64 `db:"totalNum"`
+		Total    model.Decimal `db:"total"`
+		TotalNum int64         `db:"totalNum"`
 	}
 
 	var count Count
-	if err := DB.GetContext(ctx, &count, countQry, args...); err != nil {
+	if err := s.db.GetContext(ctx, &count, s.rebind(countQry), args...); err != nil {
 		return 0, 0, nil, err
 	}
 
 	limit := pageSize
 	offset := (page - 1) * pageSize
-	query = query + where + fmt.Sprintf(" order by date desc limit %d offset %d", limit, offset)
+	query = query + where + fmt.Sprintf(" order by date desc, boxId limit %d offset %d", limit, offset)
 
 	var out []*model.BoxIncome
-	if err := DB.SelectContext(ctx, &out, query, args...); err != nil {
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
 		return 0, 0, nil, err
 	}
 
 	return count.TotalNum, count.Total, out, nil
 }
 
-func GetBoxBandwidth(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidth, error) {
+const (
+	IncomeTypeTotal = iota
+	IncomeTypeBandwidth
+	IncomeTypeActivity
+)
+
+// incomeTypeColumns maps the incomeType query parameter to the box_income column it sums.
+var incomeTypeColumns = map[int]string{
+	IncomeTypeTotal:     "amount",
+	IncomeTypeBandwidth: "bwAmount",
+	IncomeTypeActivity:  "activityIncome",
+}
+
+func IsValidIncomeType(incomeType int) bool {
+	_, ok := incomeTypeColumns[incomeType]
+	return ok
+}
+
+func incomePeriodsQuery(column string) string {
+	return fmt.Sprintf(`select coalesce(sum(case when date = ? then %[1]s else 0 end),0) as today,
+		coalesce(sum(case when date = ? then %[1]s else 0 end),0) as yesterday,
+		coalesce(sum(case when date >= ? then %[1]s else 0 end),0) as thisMonth,
+		coalesce(sum(case when date >= ? and date < ? then %[1]s else 0 end),0) as lastMonth,
+		coalesce(sum(%[1]s),0) as total`, column)
+}
+
+func incomePeriodsArgs(now time.Time) []interface{} {
+	year, month, day := now.Date()
+	today := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	thisMonth := time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+
+	return []interface{}{
+		today.Format(time.DateOnly),
+		today.AddDate(0, 0, -1).Format(time.DateOnly),
+		thisMonth.Format(time.DateOnly),
+		thisMonth.AddDate(0, -1, 0).Format(time.DateOnly),
+		thisMonth.Format(time.DateOnly),
+	}
+}
+
+// GetBoxIncomeSummary sums the box income of the user for today, yesterday, this month, last month and all time,
+// along with the same totals broken down by remark and by income type.
+func (s *SQLStore) GetBoxIncomeSummary(ctx context.Context, username string, incomeType int, now time.Time) (*model.IncomeSummary, error) {
+	column, ok := incomeTypeColumns[incomeType]
+	if !ok {
+		return nil, fmt.Errorf("invalid income type: %d", incomeType)
+	}
+
+	periodArgs := incomePeriodsArgs(now)
+	args := append(periodArgs, username)
+
+	var out model.IncomeSummary
+	query := incomePeriodsQuery(column) + ` from box_income where username = ?`
+	if err := s.db.GetContext(ctx, &out.IncomePeriods, s.rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	remarkQuery := incomePeriodsQuery(column) + `, remark from box_income where username = ? group by remark order by total desc`
+	if err := s.db.SelectContext(ctx, &out.Remarks, s.rebind(remarkQuery), args...); err != nil {
+		return nil, err
+	}
+
+	for _, it := range []int{IncomeTypeTotal, IncomeTypeBandwidth, IncomeTypeActivity} {
+		income := &model.IncomeTypeIncome{IncomeType: it}
+		query := incomePeriodsQuery(incomeTypeColumns[it]) + ` from box_income where username = ?`
+		if err := s.db.GetContext(ctx, &income.IncomePeriods, s.rebind(query), args...); err != nil {
+			return nil, err
+		}
+		out.IncomeTypes = append(out.IncomeTypes, income)
+	}
+
+	return &out, nil
+}
+
+func (s *SQLStore) GetBoxBandwidth(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidth, error) {
 	query := `select * from box_bandwidth `
 
 	var (
@@ -228,17 +420,17 @@ func GetBoxBandwidth(ctx context.Context, username string, boxIds, supplierBoxId
 		args = append(args, supplierArgs...)
 	}
 
-	query = query + where
+	query = query + where + ` order by boxId, time`
 
 	var out []*model.BoxBandwidth
-	if err := DB.SelectContext(ctx, &out, query, args...); err != nil {
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
 		return nil, err
 	}
 
 	return out, nil
 }
 
-func GetBoxQualities(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQuality, error) {
+func (s *SQLStore) GetBoxQualities(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQuality, error) {
 	query := `select * from box_quality `
 
 	var (
@@ -264,44 +456,43 @@ func GetBoxQualities(ctx context.Context, username string, boxIds, supplierBoxId
 		args = append(args, supplierArgs...)
 	}
 
-	query = query + where
-	fmt.Println("query=>", query)
+	query = query + where + ` order by boxId, time`
 
 	var out []*model.BoxQuality
-	if err := DB.SelectContext(ctx, &out, query, args...); err != nil {
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
 		return nil, err
 	}
 
 	return out, nil
 }
 
-func GetUserKeys(ctx context.Context) ([]*model.PaiNetInfo, error) {
+func (s *SQLStore) GetUserKeys(ctx context.Context) ([]*model.PaiNetInfo, error) {
 	query := `select * from pai_userkey`
 
 	var out []*model.PaiNetInfo
-	if err := DB.SelectContext(ctx, &out, query); err != nil {
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query)); err != nil {
 		return nil, err
 	}
 
 	return out, nil
 }
 
-func GetUserKeyByAPIKey(ctx context.Context, key string) (*model.PaiNetInfo, error) {
+func (s *SQLStore) GetUserKeyByAPIKey(ctx context.Context, key string) (*model.PaiNetInfo, error) {
 	query := `select * from pai_userkey where apiKey = ?`
 
 	var out model.PaiNetInfo
-	if err := DB.GetContext(ctx, &out, query, key); err != nil {
+	if err := s.db.GetContext(ctx, &out, s.rebind(query), key); err != nil {
 		return nil, err
 	}
 
 	return &out, nil
 }
 
-func GetPaiNetInfoByUsername(ctx context.Context, username string) (*model.PaiNetInfo, error) {
+func (s *SQLStore) GetPaiNetInfoByUsername(ctx context.Context, username string) (*model.PaiNetInfo, error) {
 	query := `select * from pai_userkey where username = ?`
 
 	var out model.PaiNetInfo
-	if err := DB.GetContext(ctx, &out, query, username); err != nil {
+	if err := s.db.GetContext(ctx, &out, s.rebind(query), username); err != nil {
 		return nil, err
 	}
 
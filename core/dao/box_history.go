@@ -0,0 +1,51 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+)
+
+func (s *SQLStore) AddBoxChanges(ctx context.Context, changes []*model.BoxChange) error {
+	query := `INSERT INTO box_history(username, boxId, supplierBoxId, field, oldValue, newValue, changedAt)
+	VALUES(:username, :boxId, :supplierBoxId, :field, :oldValue, :newValue, %s)`
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(fmt.Sprintf(query, s.dialect.Now())), changes); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetBoxHistory returns the changes of the box, most recent first.
+func (s *SQLStore) GetBoxHistory(ctx context.Context, username, boxId string, page, pageSize int64) (int64, []*model.BoxChange, error) {
+	where := `where username = ? and boxId = ?`
+
+	var total int64
+	if err := s.db.GetContext(ctx, &total, s.rebind(`select count(1) from box_history `+where), username, boxId); err != nil {
+		return 0, nil, err
+	}
+
+	query := fmt.Sprintf(`select * from box_history %s order by changedAt desc, id desc limit %d offset %d`, where, pageSize, (page-1)*pageSize)
+
+	var out []*model.BoxChange
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username, boxId); err != nil {
+		return 0, nil, err
+	}
+
+	return total, out, nil
+}
+
+// GetLatestBoxChanges returns the most recent change of the field of each box of the user.
+func (s *SQLStore) GetLatestBoxChanges(ctx context.Context, username, field string) ([]*model.BoxChange, error) {
+	query := `select h.* from box_history h join (
+		select max(id) as id from box_history where username = ? and field = ? group by boxId
+	) l on h.id = l.id`
+
+	var out []*model.BoxChange
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username, field); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
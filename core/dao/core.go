@@ -3,16 +3,9 @@ package dao
 import (
 	"database/sql"
 	"fmt"
-	"github.com/gnasnik/titan-box-api/config"
 	_ "github.com/go-sql-driver/mysql"
 	logging "github.com/ipfs/go-log"
 	"github.com/jmoiron/sqlx"
-	"time"
-)
-
-var (
-	// DB reference to database
-	DB *sqlx.DB
 )
 
 const (
@@ -40,23 +33,44 @@ func Int64From(i int64) sql.NullInt64 {
 	return sql.NullInt64{Int64: i, Valid: true}
 }
 
-func Init(cfg *config.Config) error {
-	if cfg.DatabaseURL == "" {
-		return fmt.Errorf("database url not setup")
+// SQLStore implements the stores on top of a MySQL, Postgres or SQLite database.
+type SQLStore struct {
+	db      *sqlx.DB
+	dialect Dialect
+}
+
+// Open connects to the database at databaseURL, the dialect is picked from the url scheme.
+func Open(databaseURL string) (*SQLStore, error) {
+	if databaseURL == "" {
+		return nil, fmt.Errorf("database url not setup")
+	}
+
+	d, err := dialectFor(databaseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn, err := d.DSN(databaseURL)
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sqlx.Connect("mysql", cfg.DatabaseURL)
+	db, err := sqlx.Connect(d.DriverName(), dsn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	db.SetMaxOpenConns(maxOpenConnections)
-	db.SetConnMaxLifetime(connMaxLifetime * time.Second)
-	db.SetMaxIdleConns(maxIdleConnections)
-	db.SetConnMaxIdleTime(connMaxIdleTime * time.Second)
+	d.Configure(db)
+
+	return NewSQLStore(db, d), nil
+}
+
+func NewSQLStore(db *sqlx.DB, dialect Dialect) *SQLStore {
+	return &SQLStore{db: db, dialect: dialect}
+}
 
-	DB = db
-	return nil
+func (s *SQLStore) Close() error {
+	return s.db.Close()
 }
 
 type QueryOption struct {
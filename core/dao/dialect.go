@@ -0,0 +1,283 @@
+package dao
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Dialect hides the SQL differences between the supported database backends.
+type Dialect interface {
+	// Name of the dialect, also the directory holding its migrations.
+	Name() string
+	DriverName() string
+	// DSN converts the configured DatabaseURL to the data source name the driver expects.
+	DSN(databaseURL string) (string, error)
+	Configure(db *sqlx.DB)
+	// Now is the SQL expression for the current time.
+	Now() string
+	// Upsert returns the clause appended to an INSERT to update the given columns when a row with the same keys exists.
+	Upsert(keys []string, columns ...string) string
+	// LikeEscape returns the clause that makes a backslash escape the LIKE wildcards.
+	LikeEscape() string
+	MigrationsTable() string
+	// TransactionalDDL reports whether the schema changes can be rolled back along with the data changes.
+	TransactionalDDL() bool
+	// Rewrite adapts a query written in the MySQL flavour used throughout this package to the dialect.
+	Rewrite(query string) string
+}
+
+// dialectFor picks the dialect from the scheme of the database url, urls without a scheme are MySQL DSNs.
+func dialectFor(databaseURL string) (Dialect, error) {
+	scheme, _, ok := strings.Cut(databaseURL, "://")
+	if !ok {
+		return mysqlDialect{}, nil
+	}
+
+	switch scheme {
+	case "mysql":
+		return mysqlDialect{}, nil
+	case "sqlite", "sqlite3":
+		return sqliteDialect{}, nil
+	case "postgres", "postgresql":
+		return postgresDialect{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported database scheme: %s", scheme)
+	}
+}
+
+// rebind prepares a query for the dialect of the store and converts its ? placeholders to the driver's bind type.
+func (s *SQLStore) rebind(query string) string {
+	return s.db.Rebind(s.dialect.Rewrite(query))
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) DriverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) DSN(databaseURL string) (string, error) {
+	return strings.TrimPrefix(databaseURL, "mysql://"), nil
+}
+
+func (mysqlDialect) Configure(db *sqlx.DB) {
+	db.SetMaxOpenConns(maxOpenConnections)
+	db.SetConnMaxLifetime(connMaxLifetime * time.Second)
+	db.SetMaxIdleConns(maxIdleConnections)
+	db.SetConnMaxIdleTime(connMaxIdleTime * time.Second)
+}
+
+func (mysqlDialect) Now() string {
+	return "now()"
+}
+
+func (mysqlDialect) Upsert(keys []string, columns ...string) string {
+	var updates []string
+	for _, c := range columns {
+		updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", c, c))
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+}
+
+func (mysqlDialect) Rewrite(query string) string {
+	return query
+}
+
+func (mysqlDialect) LikeEscape() string {
+	return ""
+}
+
+func (mysqlDialect) MigrationsTable() string {
+	return `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint(20) NOT NULL,
+		name varchar(255) NOT NULL DEFAULT '',
+		appliedAt datetime(3) NOT NULL DEFAULT 0,
+		PRIMARY KEY (version)
+	)`
+}
+
+func (mysqlDialect) TransactionalDDL() bool {
+	return false
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) DriverName() string {
+	return "sqlite3"
+}
+
+// DSN accepts sqlite://path/to/file.db and sqlite:///absolute/path.db, with optional driver parameters in the query.
+func (sqliteDialect) DSN(databaseURL string) (string, error) {
+	_, dsn, _ := strings.Cut(databaseURL, "://")
+	file, rawQuery, _ := strings.Cut(dsn, "?")
+	if file == "" {
+		return "", fmt.Errorf("sqlite database file not setup")
+	}
+
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", err
+	}
+
+	defaults := map[string]string{
+		"_busy_timeout": "5000",
+		"_journal_mode": "WAL",
+		"_foreign_keys": "1",
+	}
+	for k, v := range defaults {
+		if !params.Has(k) {
+			params.Set(k, v)
+		}
+	}
+
+	return "file:" + file + "?" + params.Encode(), nil
+}
+
+// Configure keeps a single connection open, SQLite allows one writer at a time and concurrent
+// writes from the sync workers would otherwise fail with "database is locked".
+func (sqliteDialect) Configure(db *sqlx.DB) {
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+}
+
+func (sqliteDialect) Now() string {
+	return "CURRENT_TIMESTAMP"
+}
+
+func (sqliteDialect) Upsert(keys []string, columns ...string) string {
+	var updates []string
+	for _, c := range columns {
+		updates = append(updates, fmt.Sprintf("%s = excluded.%s", c, c))
+	}
+	return fmt.Sprintf(" ON CONFLICT(%s) DO UPDATE SET %s", strings.Join(keys, ", "), strings.Join(updates, ", "))
+}
+
+func (sqliteDialect) Rewrite(query string) string {
+	return query
+}
+
+func (sqliteDialect) LikeEscape() string {
+	return ` escape '\'`
+}
+
+func (sqliteDialect) MigrationsTable() string {
+	return `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint NOT NULL,
+		name varchar(255) NOT NULL DEFAULT '',
+		appliedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (version)
+	)`
+}
+
+func (sqliteDialect) TransactionalDDL() bool {
+	return true
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) DriverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) DSN(databaseURL string) (string, error) {
+	return databaseURL, nil
+}
+
+func (postgresDialect) Configure(db *sqlx.DB) {
+	mysqlDialect{}.Configure(db)
+}
+
+func (postgresDialect) Now() string {
+	return "now()"
+}
+
+func (postgresDialect) Upsert(keys []string, columns ...string) string {
+	return sqliteDialect{}.Upsert(keys, columns...)
+}
+
+func (postgresDialect) LikeEscape() string {
+	return ""
+}
+
+func (postgresDialect) MigrationsTable() string {
+	return `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint NOT NULL,
+		name varchar(255) NOT NULL DEFAULT '',
+		"appliedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (version)
+	)`
+}
+
+func (postgresDialect) TransactionalDDL() bool {
+	return true
+}
+
+var (
+	// camelCaseIdentRegexp matches the camelCase identifiers, which Postgres folds to lower case unless quoted.
+	// Named parameters such as :boxId are left alone.
+	camelCaseIdentRegexp = regexp.MustCompile(`(^|[^:\w"])([a-z][a-z0-9]*[A-Z]\w*)`)
+	// reservedIdentRegexp matches the table names that are reserved words in Postgres.
+	reservedIdentRegexp = regexp.MustCompile(`\b(user)\b`)
+)
+
+// Rewrite quotes the identifiers outside of the string literals, which are left as written.
+func (postgresDialect) Rewrite(query string) string {
+	return outsideLiterals(query, func(part string) string {
+		part = camelCaseIdentRegexp.ReplaceAllString(part, `$1"$2"`)
+		return reservedIdentRegexp.ReplaceAllString(part, `"$1"`)
+	})
+}
+
+// outsideLiterals applies rewrite to the parts of the query between the single-quoted string literals,
+// whose quotes are escaped by doubling them.
+func outsideLiterals(query string, rewrite func(string) string) string {
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(query, '\'')
+		if start < 0 {
+			b.WriteString(rewrite(query))
+			return b.String()
+		}
+		b.WriteString(rewrite(query[:start]))
+
+		end := start + 1
+		for {
+			i := strings.IndexByte(query[end:], '\'')
+			if i < 0 {
+				// an unterminated literal is left to the database to report.
+				b.WriteString(query[start:])
+				return b.String()
+			}
+
+			end += i + 1
+			if end < len(query) && query[end] == '\'' {
+				end++
+				continue
+			}
+			break
+		}
+
+		b.WriteString(query[start:end])
+		query = query[end:]
+	}
+}
@@ -0,0 +1,36 @@
+package dao
+
+import "testing"
+
+func TestPostgresRewrite(t *testing.T) {
+	cases := []struct {
+		query, want string
+	}{
+		{
+			`select boxId from box where supplierBoxId = ?`,
+			`select "boxId" from box where "supplierBoxId" = ?`,
+		},
+		{
+			`select * from user where remark = 'boxId' and isp = 'user'`,
+			`select * from "user" where remark = 'boxId' and isp = 'user'`,
+		},
+		{
+			`select 'it''s boxId' as note, updatedAt from box`,
+			`select 'it''s boxId' as note, "updatedAt" from box`,
+		},
+		{
+			`insert into box(boxId) values(:boxId)`,
+			`insert into box("boxId") values(:boxId)`,
+		},
+		{
+			`select "boxId" from box where remark = 'unterminated boxId`,
+			`select "boxId" from box where remark = 'unterminated boxId`,
+		},
+	}
+
+	for _, c := range cases {
+		if got := (postgresDialect{}).Rewrite(c.query); got != c.want {
+			t.Errorf("Rewrite(%q) = %q, want %q", c.query, got, c.want)
+		}
+	}
+}
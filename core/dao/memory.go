@@ -0,0 +1,1650 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type boxTimeKey struct {
+	boxId string
+	time  model.Timestamp
+}
+
+type rollupKey struct {
+	granularity string
+	boxTimeKey
+}
+
+type checkpointKey struct {
+	paiUsername, dataType, windowStart, windowEnd string
+}
+
+// MemoryStore implements the stores in memory. It behaves like SQLStore for the queries the api and
+// the data service run, which makes it suitable for unit tests.
+type MemoryStore struct {
+	lk sync.RWMutex
+
+	boxes       map[string]*model.Box
+	diskInfos   map[string]map[string]*model.DiskInfo
+	boxHistory  []*model.BoxChange
+	uptimes     map[boxTimeKey]*model.BoxUptime
+	alerts      []*model.Alert
+	endpoints   map[string]*model.WebhookEndpoint
+	deliveries  []*model.WebhookDelivery
+	channels    map[string]*model.NotifyChannel
+	apiKeys     map[string]*model.APIKey
+	sessions    map[string]*model.Session
+	totps       map[string]*model.UserTOTP
+	backupCodes []*model.BackupCode
+	incomes     map[string]map[model.Date]*model.BoxIncome
+	bandwidths  map[boxTimeKey]*model.BoxBandwidth
+	qualities   map[boxTimeKey]*model.BoxQuality
+	bwRollups   map[rollupKey]*model.BoxBandwidthRollup
+	qRollups    map[rollupKey]*model.BoxQualityRollup
+	users       map[string]*model.User
+	userKeys    []*model.PaiNetInfo
+	checkpoints map[checkpointKey]*model.SyncCheckpoint
+	nextUid     int
+	nextId      int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		boxes:       make(map[string]*model.Box),
+		diskInfos:   make(map[string]map[string]*model.DiskInfo),
+		uptimes:     make(map[boxTimeKey]*model.BoxUptime),
+		endpoints:   make(map[string]*model.WebhookEndpoint),
+		channels:    make(map[string]*model.NotifyChannel),
+		apiKeys:     make(map[string]*model.APIKey),
+		sessions:    make(map[string]*model.Session),
+		totps:       make(map[string]*model.UserTOTP),
+		incomes:     make(map[string]map[model.Date]*model.BoxIncome),
+		bandwidths:  make(map[boxTimeKey]*model.BoxBandwidth),
+		qualities:   make(map[boxTimeKey]*model.BoxQuality),
+		bwRollups:   make(map[rollupKey]*model.BoxBandwidthRollup),
+		qRollups:    make(map[rollupKey]*model.BoxQualityRollup),
+		users:       make(map[string]*model.User),
+		checkpoints: make(map[checkpointKey]*model.SyncCheckpoint),
+		nextUid:     100000,
+		nextId:      1,
+	}
+}
+
+// AddPaiNetInfo binds a PaiNet account to a user, the pai_userkey table is maintained by hand for SQLStore.
+func (m *MemoryStore) AddPaiNetInfo(pi *model.PaiNetInfo) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	info := *pi
+	m.userKeys = append(m.userKeys, &info)
+}
+
+func (m *MemoryStore) BulkUpsertBoxes(ctx context.Context, boxes []*model.Box) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, b := range boxes {
+		box := *b
+		box.DiskInfos = nil
+		box.UpdatedAt = now
+		box.CreatedAt = now
+		if old, ok := m.boxes[b.BoxId]; ok {
+			box.Username = old.Username
+			box.SupplierBoxId = old.SupplierBoxId
+			box.CreatedAt = old.CreatedAt
+		}
+		m.boxes[b.BoxId] = &box
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxDiskInfo(ctx context.Context, diskInfo []*model.DiskInfo) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, d := range diskInfo {
+		disks, ok := m.diskInfos[d.BoxId]
+		if !ok {
+			disks = make(map[string]*model.DiskInfo)
+			m.diskInfos[d.BoxId] = disks
+		}
+
+		disk := *d
+		if old, ok := disks[d.DiskId]; ok {
+			disk.SupplierBoxId = old.SupplierBoxId
+		}
+		disks[d.DiskId] = &disk
+	}
+
+	return nil
+}
+
+func matchAny(value string, values []string, match func(value, v string) bool) bool {
+	if len(values) == 0 {
+		return true
+	}
+
+	for _, v := range values {
+		if match(value, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equal(value, v string) bool {
+	return value == v
+}
+
+func (f *BoxFilter) match(b *model.Box) bool {
+	if f == nil {
+		return true
+	}
+
+	idMatch, remarkMatch := equal, equal
+	if f.Fuzzy {
+		idMatch, remarkMatch = strings.HasPrefix, strings.Contains
+	}
+
+	return matchAny(b.BoxId, f.BoxIds, idMatch) &&
+		matchAny(b.SupplierBoxId, f.SupplierBoxIds, idMatch) &&
+		matchAny(b.Remark, f.Remarks, remarkMatch) &&
+		matchAny(b.Isp, f.Isp, equal) &&
+		matchAny(b.Province, f.Province, equal) &&
+		matchAny(b.ProcessStatus, f.ProcessStatus, equal) &&
+		matchAny(b.Online, f.Online, equal)
+}
+
+// fieldByColumn returns the field of the struct v tagged with the column name.
+func fieldByColumn(v reflect.Value, column string) reflect.Value {
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("db") == column {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+func compareValues(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Float32, reflect.Float64:
+		switch {
+		case a.Float() < b.Float():
+			return -1
+		case a.Float() > b.Float():
+			return 1
+		}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		switch {
+		case a.Int() < b.Int():
+			return -1
+		case a.Int() > b.Int():
+			return 1
+		}
+	case reflect.Bool:
+		switch {
+		case !a.Bool() && b.Bool():
+			return -1
+		case a.Bool() && !b.Bool():
+			return 1
+		}
+	case reflect.Struct:
+		if t, ok := a.Interface().(time.Time); ok {
+			return t.Compare(b.Interface().(time.Time))
+		}
+	}
+	return 0
+}
+
+func (f *BoxFilter) sort(boxes []*model.Box) {
+	field, desc := "boxId", false
+	if f != nil && boxOrderFields[f.OrderField] {
+		field = f.OrderField
+	}
+
+	if f != nil && strings.EqualFold(f.Order, "desc") {
+		desc = true
+	}
+
+	sort.Slice(boxes, func(i, j int) bool {
+		c := compareValues(fieldByColumn(reflect.ValueOf(*boxes[i]), field), fieldByColumn(reflect.ValueOf(*boxes[j]), field))
+		if desc {
+			c = -c
+		}
+
+		if c == 0 {
+			return boxes[i].BoxId < boxes[j].BoxId
+		}
+
+		return c < 0
+	})
+}
+
+// paginate returns the bounds of the page in a list of total items.
+func paginate(total int, page, pageSize int64) (int, int) {
+	start := (page - 1) * pageSize
+	if start < 0 || pageSize <= 0 || start >= int64(total) {
+		return 0, 0
+	}
+
+	end := start + pageSize
+	if end > int64(total) {
+		end = int64(total)
+	}
+
+	return int(start), int(end)
+}
+
+func (m *MemoryStore) GetBoxesList(ctx context.Context, username string, filter *BoxFilter, page, pageSize int64) (int64, []*model.Box, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var matched []*model.Box
+	for _, b := range m.boxes {
+		if b.Username == username && filter.match(b) {
+			box := *b
+			matched = append(matched, &box)
+		}
+	}
+
+	filter.sort(matched)
+
+	start, end := paginate(len(matched), page, pageSize)
+	out := matched[start:end]
+	for _, box := range out {
+		box.DiskInfos = make([]*model.DiskInfo, 0)
+		for _, d := range m.diskInfos[box.BoxId] {
+			disk := *d
+			box.DiskInfos = append(box.DiskInfos, &disk)
+		}
+
+		sort.Slice(box.DiskInfos, func(i, j int) bool {
+			return box.DiskInfos[i].DiskId < box.DiskInfos[j].DiskId
+		})
+	}
+
+	return int64(len(matched)), out, nil
+}
+
+func (m *MemoryStore) AddBoxChanges(ctx context.Context, changes []*model.BoxChange) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, c := range changes {
+		change := *c
+		change.Id = m.nextId
+		change.ChangedAt = now
+		m.nextId++
+		m.boxHistory = append(m.boxHistory, &change)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetBoxHistory(ctx context.Context, username, boxId string, page, pageSize int64) (int64, []*model.BoxChange, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var matched []*model.BoxChange
+	for i := len(m.boxHistory) - 1; i >= 0; i-- {
+		if c := m.boxHistory[i]; c.Username == username && c.BoxId == boxId {
+			change := *c
+			matched = append(matched, &change)
+		}
+	}
+
+	from, to := paginate(len(matched), page, pageSize)
+	return int64(len(matched)), matched[from:to], nil
+}
+
+func (m *MemoryStore) GetLatestBoxChanges(ctx context.Context, username, field string) ([]*model.BoxChange, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	latest := make(map[string]*model.BoxChange)
+	for _, c := range m.boxHistory {
+		if c.Username == username && c.Field == field {
+			latest[c.BoxId] = c
+		}
+	}
+
+	var out []*model.BoxChange
+	for _, c := range latest {
+		change := *c
+		out = append(out, &change)
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxUptimes(ctx context.Context, uptimes []*model.BoxUptime) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, u := range uptimes {
+		key := boxTimeKey{boxId: u.BoxId, time: u.StartTime}
+		uptime := *u
+		uptime.UpdatedAt = now
+		if old, ok := m.uptimes[key]; ok {
+			uptime.Username = old.Username
+			uptime.SupplierBoxId = old.SupplierBoxId
+		}
+		m.uptimes[key] = &uptime
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetLatestBoxUptimes(ctx context.Context, boxIds []string) ([]*model.BoxUptime, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	latest := make(map[string]*model.BoxUptime)
+	for _, u := range m.uptimes {
+		if len(boxIds) == 0 || !matchAny(u.BoxId, boxIds, equal) {
+			continue
+		}
+
+		if l, ok := latest[u.BoxId]; !ok || u.StartTime > l.StartTime {
+			latest[u.BoxId] = u
+		}
+	}
+
+	var out []*model.BoxUptime
+	for _, u := range latest {
+		uptime := *u
+		out = append(out, &uptime)
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetBoxUptimes(ctx context.Context, username string, boxIds []string, start, end int64) ([]*model.BoxUptime, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.BoxUptime
+	for _, u := range m.uptimes {
+		if len(boxIds) == 0 || u.Username != username || int64(u.EndTime) <= start || int64(u.StartTime) >= end ||
+			!matchAny(u.BoxId, boxIds, equal) {
+			continue
+		}
+
+		uptime := *u
+		out = append(out, &uptime)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BoxId != out[j].BoxId {
+			return out[i].BoxId < out[j].BoxId
+		}
+		return out[i].StartTime < out[j].StartTime
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetBoxUptimeTotals(ctx context.Context, username string, filter *BoxFilter, periods [][2]int64) ([]*UptimeTotals, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	if len(periods) == 0 {
+		return nil, nil
+	}
+
+	matched := make(map[string]bool)
+	for _, b := range m.boxes {
+		if b.Username == username && filter.match(b) {
+			matched[b.BoxId] = true
+		}
+	}
+
+	out := make([]*UptimeTotals, len(periods))
+	for i, p := range periods {
+		totals := &UptimeTotals{}
+		for _, u := range m.uptimes {
+			if u.Username != username || !matched[u.BoxId] {
+				continue
+			}
+
+			d := min(int64(u.EndTime), p[1]) - max(int64(u.StartTime), p[0])
+			if d <= 0 {
+				continue
+			}
+
+			if u.Online {
+				totals.OnlineSeconds += d
+				continue
+			}
+
+			totals.OfflineSeconds += d
+			totals.Outages++
+			totals.LongestOutage = max(totals.LongestOutage, d)
+		}
+		out[i] = totals
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxDayIncome(ctx context.Context, incomes []*model.BoxIncome) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, in := range incomes {
+		byDate, ok := m.incomes[in.BoxId]
+		if !ok {
+			byDate = make(map[model.Date]*model.BoxIncome)
+			m.incomes[in.BoxId] = byDate
+		}
+
+		income := *in
+		income.UpdatedAt = now
+		if old, ok := byDate[in.Date]; ok {
+			income.Username = old.Username
+			income.SupplierBoxId = old.SupplierBoxId
+			income.InviterId = old.InviterId
+		}
+		byDate[in.Date] = &income
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetBoxIncomeV2(ctx context.Context, username string, boxIds, remarks, supplierBoxIds []string, start, end string, page, pageSize int64) (int64, model.Decimal, []*model.BoxIncome, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var (
+		matched []*model.BoxIncome
+		total   model.Decimal
+	)
+	for _, byDate := range m.incomes {
+		for _, in := range byDate {
+			if in.Username != username || string(in.Date) < start || string(in.Date) > end ||
+				!matchAny(in.BoxId, boxIds, equal) || !matchAny(in.Remark, remarks, equal) || !matchAny(in.SupplierBoxId, supplierBoxIds, equal) {
+				continue
+			}
+
+			income := *in
+			matched = append(matched, &income)
+			total += in.Amount
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].Date != matched[j].Date {
+			return matched[i].Date > matched[j].Date
+		}
+		return matched[i].BoxId < matched[j].BoxId
+	})
+
+	from, to := paginate(len(matched), page, pageSize)
+	return int64(len(matched)), total, matched[from:to], nil
+}
+
+func incomeOf(in *model.BoxIncome, incomeType int) model.Decimal {
+	switch incomeType {
+	case IncomeTypeBandwidth:
+		return in.BwAmount
+	case IncomeTypeActivity:
+		return in.ActivityIncome
+	default:
+		return in.Amount
+	}
+}
+
+// addIncome adds the income to the periods, the dates are the arguments built by incomePeriodsArgs.
+func addIncome(p *model.IncomePeriods, date model.Date, amount model.Decimal, dates []interface{}) {
+	d := string(date)
+	if d == dates[0] {
+		p.Today += amount
+	}
+	if d == dates[1] {
+		p.Yesterday += amount
+	}
+	if d >= dates[2].(string) {
+		p.ThisMonth += amount
+	}
+	if d >= dates[3].(string) && d < dates[4].(string) {
+		p.LastMonth += amount
+	}
+	p.Total += amount
+}
+
+func (m *MemoryStore) GetBoxIncomeSummary(ctx context.Context, username string, incomeType int, now time.Time) (*model.IncomeSummary, error) {
+	if !IsValidIncomeType(incomeType) {
+		return nil, fmt.Errorf("invalid income type: %d", incomeType)
+	}
+
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var (
+		out     model.IncomeSummary
+		dates   = incomePeriodsArgs(now)
+		remarks = make(map[string]*model.RemarkIncome)
+		types   []*model.IncomeTypeIncome
+	)
+
+	for _, it := range []int{IncomeTypeTotal, IncomeTypeBandwidth, IncomeTypeActivity} {
+		types = append(types, &model.IncomeTypeIncome{IncomeType: it})
+	}
+
+	for _, byDate := range m.incomes {
+		for _, in := range byDate {
+			if in.Username != username {
+				continue
+			}
+
+			amount := incomeOf(in, incomeType)
+			addIncome(&out.IncomePeriods, in.Date, amount, dates)
+
+			remark, ok := remarks[in.Remark]
+			if !ok {
+				remark = &model.RemarkIncome{Remark: in.Remark}
+				remarks[in.Remark] = remark
+				out.Remarks = append(out.Remarks, remark)
+			}
+			addIncome(&remark.IncomePeriods, in.Date, amount, dates)
+
+			for _, t := range types {
+				addIncome(&t.IncomePeriods, in.Date, incomeOf(in, t.IncomeType), dates)
+			}
+		}
+	}
+
+	sort.Slice(out.Remarks, func(i, j int) bool {
+		return out.Remarks[i].Total > out.Remarks[j].Total
+	})
+	out.IncomeTypes = types
+
+	return &out, nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxBandwidth(ctx context.Context, bandwidths []*model.BoxBandwidth) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, b := range bandwidths {
+		key := boxTimeKey{boxId: b.BoxId, time: b.Time}
+		bandwidth := *b
+		bandwidth.UpdatedAt = now
+		if old, ok := m.bandwidths[key]; ok {
+			bandwidth.Username = old.Username
+			bandwidth.SupplierBoxId = old.SupplierBoxId
+		}
+		m.bandwidths[key] = &bandwidth
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxQualities(ctx context.Context, qualities []*model.BoxQuality) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, q := range qualities {
+		key := boxTimeKey{boxId: q.BoxId, time: q.Time}
+		quality := *q
+		quality.UpdatedAt = now
+		if old, ok := m.qualities[key]; ok {
+			quality.Username = old.Username
+			quality.SupplierBoxId = old.SupplierBoxId
+		}
+		m.qualities[key] = &quality
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetBoxBandwidth(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidth, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.BoxBandwidth
+	for _, b := range m.bandwidths {
+		if b.Username != username || int64(b.Time) < start || int64(b.Time) > end ||
+			!matchAny(b.BoxId, boxIds, equal) || !matchAny(b.SupplierBoxId, supplierBoxIds, equal) {
+			continue
+		}
+
+		bandwidth := *b
+		out = append(out, &bandwidth)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BoxId != out[j].BoxId {
+			return out[i].BoxId < out[j].BoxId
+		}
+		return out[i].Time < out[j].Time
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetBoxQualities(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQuality, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.BoxQuality
+	for _, q := range m.qualities {
+		if q.Username != username || int64(q.Time) < start || int64(q.Time) > end ||
+			!matchAny(q.BoxId, boxIds, equal) || !matchAny(q.SupplierBoxId, supplierBoxIds, equal) {
+			continue
+		}
+
+		quality := *q
+		out = append(out, &quality)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BoxId != out[j].BoxId {
+			return out[i].BoxId < out[j].BoxId
+		}
+		return out[i].Time < out[j].Time
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxBandwidthRollups(ctx context.Context, granularity string, rollups []*model.BoxBandwidthRollup) error {
+	if _, err := rollupTable("box_bandwidth", granularity); err != nil {
+		return err
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, r := range rollups {
+		key := rollupKey{granularity, boxTimeKey{boxId: r.BoxId, time: r.Time}}
+		rollup := *r
+		rollup.UpdatedAt = now
+		if old, ok := m.bwRollups[key]; ok {
+			rollup.Username = old.Username
+			rollup.SupplierBoxId = old.SupplierBoxId
+		}
+		m.bwRollups[key] = &rollup
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) BulkUpsertBoxQualityRollups(ctx context.Context, granularity string, rollups []*model.BoxQualityRollup) error {
+	if _, err := rollupTable("box_quality", granularity); err != nil {
+		return err
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	now := time.Now()
+	for _, r := range rollups {
+		key := rollupKey{granularity, boxTimeKey{boxId: r.BoxId, time: r.Time}}
+		rollup := *r
+		rollup.UpdatedAt = now
+		if old, ok := m.qRollups[key]; ok {
+			rollup.Username = old.Username
+			rollup.SupplierBoxId = old.SupplierBoxId
+		}
+		m.qRollups[key] = &rollup
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetBoxBandwidthRollups(ctx context.Context, granularity, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidthRollup, error) {
+	if _, err := rollupTable("box_bandwidth", granularity); err != nil {
+		return nil, err
+	}
+
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	start = RollupBucket(granularity, start)
+
+	var out []*model.BoxBandwidthRollup
+	for key, r := range m.bwRollups {
+		if key.granularity != granularity || r.Username != username || int64(r.Time) < start || int64(r.Time) > end ||
+			!matchAny(r.BoxId, boxIds, equal) || !matchAny(r.SupplierBoxId, supplierBoxIds, equal) {
+			continue
+		}
+
+		rollup := *r
+		out = append(out, &rollup)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BoxId != out[j].BoxId {
+			return out[i].BoxId < out[j].BoxId
+		}
+		return out[i].Time < out[j].Time
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetBoxQualityRollups(ctx context.Context, granularity, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQualityRollup, error) {
+	if _, err := rollupTable("box_quality", granularity); err != nil {
+		return nil, err
+	}
+
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	start = RollupBucket(granularity, start)
+
+	var out []*model.BoxQualityRollup
+	for key, r := range m.qRollups {
+		if key.granularity != granularity || r.Username != username || int64(r.Time) < start || int64(r.Time) > end ||
+			!matchAny(r.BoxId, boxIds, equal) || !matchAny(r.SupplierBoxId, supplierBoxIds, equal) {
+			continue
+		}
+
+		rollup := *r
+		out = append(out, &rollup)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].BoxId != out[j].BoxId {
+			return out[i].BoxId < out[j].BoxId
+		}
+		return out[i].Time < out[j].Time
+	})
+
+	return out, nil
+}
+
+// expiredRows returns the rows of the table older than cutoff, ordered by time then box.
+func (m *MemoryStore) expiredRows(table string, cutoff time.Time) (*ExpiredRows, error) {
+	_, before, err := retentionCutoff(table, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &ExpiredRows{Table: table}
+	switch table {
+	case RetentionTableBandwidth, RetentionTableQuality:
+		var keys []boxTimeKey
+		if table == RetentionTableBandwidth {
+			for key := range m.bandwidths {
+				keys = append(keys, key)
+			}
+		} else {
+			for key := range m.qualities {
+				keys = append(keys, key)
+			}
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].time != keys[j].time {
+				return keys[i].time < keys[j].time
+			}
+			return keys[i].boxId < keys[j].boxId
+		})
+
+		for _, key := range keys {
+			if int64(key.time) >= before.(int64) {
+				break
+			}
+
+			if table == RetentionTableBandwidth {
+				bandwidth := *m.bandwidths[key]
+				out.Rows = append(out.Rows, &bandwidth)
+			} else {
+				quality := *m.qualities[key]
+				out.Rows = append(out.Rows, &quality)
+			}
+		}
+	case RetentionTableIncome:
+		var incomes []*model.BoxIncome
+		for _, byDate := range m.incomes {
+			for _, in := range byDate {
+				if string(in.Date) < before.(string) {
+					income := *in
+					incomes = append(incomes, &income)
+				}
+			}
+		}
+
+		sort.Slice(incomes, func(i, j int) bool {
+			if incomes[i].Date != incomes[j].Date {
+				return incomes[i].Date < incomes[j].Date
+			}
+			return incomes[i].BoxId < incomes[j].BoxId
+		})
+
+		for _, in := range incomes {
+			out.Rows = append(out.Rows, in)
+		}
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) CountExpiredRows(ctx context.Context, table string, cutoff time.Time) (int64, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	expired, err := m.expiredRows(table, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(expired.Rows)), nil
+}
+
+func (m *MemoryStore) GetExpiredRows(ctx context.Context, table string, cutoff time.Time, limit int) (*ExpiredRows, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	expired, err := m.expiredRows(table, cutoff)
+	if err != nil || len(expired.Rows) <= limit {
+		return expired, err
+	}
+
+	expired.Rows = expired.Rows[:limit]
+	return expired, nil
+}
+
+func (m *MemoryStore) DeleteExpiredRows(ctx context.Context, batch *ExpiredRows, cutoff time.Time) (int64, error) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	_, before, err := retentionCutoff(batch.Table, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, row := range batch.Rows {
+		switch r := row.(type) {
+		case *model.BoxBandwidth:
+			key := boxTimeKey{boxId: r.BoxId, time: r.Time}
+			if _, ok := m.bandwidths[key]; !ok || int64(r.Time) >= before.(int64) {
+				continue
+			}
+			delete(m.bandwidths, key)
+		case *model.BoxQuality:
+			key := boxTimeKey{boxId: r.BoxId, time: r.Time}
+			if _, ok := m.qualities[key]; !ok || int64(r.Time) >= before.(int64) {
+				continue
+			}
+			delete(m.qualities, key)
+		case *model.BoxIncome:
+			if _, ok := m.incomes[r.BoxId][r.Date]; !ok || string(r.Date) >= before.(string) {
+				continue
+			}
+			delete(m.incomes[r.BoxId], r.Date)
+		default:
+			continue
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (m *MemoryStore) SaveAlerts(ctx context.Context, alerts []*model.Alert) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, a := range alerts {
+		alert := *a
+		if alert.Id == 0 {
+			alert.Id = m.nextId
+			m.nextId++
+			m.alerts = append(m.alerts, &alert)
+			continue
+		}
+
+		for _, old := range m.alerts {
+			if old.Id == alert.Id {
+				old.Status, old.Value, old.Summary, old.ResolvedAt, old.UpdatedAt = alert.Status, alert.Value, alert.Summary, alert.ResolvedAt, alert.UpdatedAt
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *AlertFilter) match(a *model.Alert) bool {
+	if f == nil {
+		return true
+	}
+
+	return (f.Status == "" || a.Status == f.Status) && (f.Rule == "" || a.Rule == f.Rule) && matchAny(a.BoxId, f.BoxIds, equal)
+}
+
+func (m *MemoryStore) GetAlerts(ctx context.Context, username string, filter *AlertFilter, page, pageSize int64) (int64, []*model.Alert, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var matched []*model.Alert
+	for _, a := range m.alerts {
+		if a.Username == username && filter.match(a) {
+			alert := *a
+			matched = append(matched, &alert)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].StartsAt.Equal(matched[j].StartsAt) {
+			return matched[i].StartsAt.After(matched[j].StartsAt)
+		}
+		return matched[i].Id > matched[j].Id
+	})
+
+	from, to := paginate(len(matched), page, pageSize)
+	return int64(len(matched)), matched[from:to], nil
+}
+
+func (m *MemoryStore) GetFiringAlerts(ctx context.Context, username string) ([]*model.Alert, error) {
+	_, alerts, err := m.GetAlerts(ctx, username, &AlertFilter{Status: model.AlertStatusFiring}, 1, 1<<31)
+	return alerts, err
+}
+
+func (m *MemoryStore) CreateWebhookEndpoint(ctx context.Context, endpoint *model.WebhookEndpoint) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, ok := m.endpoints[endpoint.Id]; ok {
+		return fmt.Errorf("duplicate webhook endpoint: %s", endpoint.Id)
+	}
+
+	e := *endpoint
+	m.endpoints[e.Id] = &e
+	return nil
+}
+
+func (m *MemoryStore) GetWebhookEndpoints(ctx context.Context, username string) ([]*model.WebhookEndpoint, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.WebhookEndpoint
+	for _, e := range m.endpoints {
+		if e.Username == username {
+			endpoint := *e
+			out = append(out, &endpoint)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].Id < out[j].Id
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetWebhookEndpoint(ctx context.Context, id string) (*model.WebhookEndpoint, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	e, ok := m.endpoints[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	endpoint := *e
+	return &endpoint, nil
+}
+
+func (m *MemoryStore) DeleteWebhookEndpoint(ctx context.Context, username, id string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	e, ok := m.endpoints[id]
+	if !ok || e.Username != username {
+		return sql.ErrNoRows
+	}
+	delete(m.endpoints, id)
+
+	var deliveries []*model.WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.EndpointId != id {
+			deliveries = append(deliveries, d)
+		}
+	}
+	m.deliveries = deliveries
+
+	return nil
+}
+
+func (m *MemoryStore) AddWebhookDeliveries(ctx context.Context, deliveries []*model.WebhookDelivery) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, d := range deliveries {
+		delivery := *d
+		m.deliveries = append(m.deliveries, &delivery)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) UpdateWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, d := range m.deliveries {
+		if d.Id == delivery.Id {
+			d.Status, d.Attempts, d.ResponseCode, d.LastError = delivery.Status, delivery.Attempts, delivery.ResponseCode, delivery.LastError
+			d.NextAttemptAt, d.DeliveredAt, d.UpdatedAt = delivery.NextAttemptAt, delivery.DeliveredAt, delivery.UpdatedAt
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*model.WebhookDelivery, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.Status == model.WebhookDeliveryPending && !d.NextAttemptAt.After(now) {
+			delivery := *d
+			out = append(out, &delivery)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].NextAttemptAt.Equal(out[j].NextAttemptAt) {
+			return out[i].NextAttemptAt.Before(out[j].NextAttemptAt)
+		}
+		return out[i].Id < out[j].Id
+	})
+
+	return out[:min(limit, len(out))], nil
+}
+
+func (f *WebhookDeliveryFilter) match(d *model.WebhookDelivery) bool {
+	if f == nil {
+		return true
+	}
+
+	return (f.EndpointId == "" || d.EndpointId == f.EndpointId) && (f.Event == "" || d.Event == f.Event) && (f.Status == "" || d.Status == f.Status)
+}
+
+func (m *MemoryStore) GetWebhookDeliveries(ctx context.Context, username string, filter *WebhookDeliveryFilter, page, pageSize int64) (int64, []*model.WebhookDelivery, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var matched []*model.WebhookDelivery
+	for _, d := range m.deliveries {
+		if d.Username == username && filter.match(d) {
+			delivery := *d
+			matched = append(matched, &delivery)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].CreatedAt.Equal(matched[j].CreatedAt) {
+			return matched[i].CreatedAt.After(matched[j].CreatedAt)
+		}
+		return matched[i].Id > matched[j].Id
+	})
+
+	from, to := paginate(len(matched), page, pageSize)
+	return int64(len(matched)), matched[from:to], nil
+}
+
+func (m *MemoryStore) GetWebhookDelivery(ctx context.Context, username, id string) (*model.WebhookDelivery, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	for _, d := range m.deliveries {
+		if d.Username == username && d.Id == id {
+			delivery := *d
+			return &delivery, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) CreateNotifyChannel(ctx context.Context, channel *model.NotifyChannel) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, ok := m.channels[channel.Id]; ok {
+		return fmt.Errorf("duplicate notify channel: %s", channel.Id)
+	}
+
+	c := *channel
+	m.channels[c.Id] = &c
+	return nil
+}
+
+func (m *MemoryStore) UpdateNotifyChannel(ctx context.Context, channel *model.NotifyChannel) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	old, ok := m.channels[channel.Id]
+	if !ok || old.Username != channel.Username {
+		return sql.ErrNoRows
+	}
+
+	c := *channel
+	c.CreatedAt = old.CreatedAt
+	m.channels[c.Id] = &c
+	return nil
+}
+
+func (m *MemoryStore) GetNotifyChannels(ctx context.Context, username string) ([]*model.NotifyChannel, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.NotifyChannel
+	for _, c := range m.channels {
+		if c.Username == username {
+			channel := *c
+			out = append(out, &channel)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].Id < out[j].Id
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetNotifyChannel(ctx context.Context, username, id string) (*model.NotifyChannel, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	c, ok := m.channels[id]
+	if !ok || c.Username != username {
+		return nil, sql.ErrNoRows
+	}
+
+	channel := *c
+	return &channel, nil
+}
+
+func (m *MemoryStore) DeleteNotifyChannel(ctx context.Context, username, id string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	c, ok := m.channels[id]
+	if !ok || c.Username != username {
+		return sql.ErrNoRows
+	}
+
+	delete(m.channels, id)
+	return nil
+}
+
+func (m *MemoryStore) CreateAPIKey(ctx context.Context, key *model.APIKey) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, k := range m.apiKeys {
+		if k.Id == key.Id || k.AppKey == key.AppKey {
+			return fmt.Errorf("duplicate api key: %s", key.Id)
+		}
+	}
+
+	k := *key
+	m.apiKeys[k.Id] = &k
+	return nil
+}
+
+func (m *MemoryStore) UpdateAPIKey(ctx context.Context, key *model.APIKey) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	k, ok := m.apiKeys[key.Id]
+	if !ok || k.Username != key.Username {
+		return sql.ErrNoRows
+	}
+
+	k.Secret, k.PreviousSecret, k.PreviousExpiresAt = key.Secret, key.PreviousSecret, key.PreviousExpiresAt
+	k.RevokedAt, k.UpdatedAt = key.RevokedAt, key.UpdatedAt
+	return nil
+}
+
+func (m *MemoryStore) TouchAPIKey(ctx context.Context, id string, at time.Time, ip string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if k, ok := m.apiKeys[id]; ok {
+		k.LastUsedAt, k.LastUsedIp = &at, ip
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetAPIKeys(ctx context.Context, username string) ([]*model.APIKey, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.APIKey
+	for _, k := range m.apiKeys {
+		if k.Username == username {
+			key := *k
+			out = append(out, &key)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].CreatedAt.Equal(out[j].CreatedAt) {
+			return out[i].CreatedAt.Before(out[j].CreatedAt)
+		}
+		return out[i].Id < out[j].Id
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetAPIKey(ctx context.Context, username, id string) (*model.APIKey, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok || k.Username != username {
+		return nil, sql.ErrNoRows
+	}
+
+	key := *k
+	return &key, nil
+}
+
+func (m *MemoryStore) GetAPIKeyByAppKey(ctx context.Context, appKey string) (*model.APIKey, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	for _, k := range m.apiKeys {
+		if k.AppKey == appKey {
+			key := *k
+			return &key, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, session *model.Session) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if _, ok := m.sessions[session.Id]; ok {
+		return fmt.Errorf("duplicate session: %s", session.Id)
+	}
+
+	s := *session
+	m.sessions[s.Id] = &s
+	return nil
+}
+
+func (m *MemoryStore) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	session := *s
+	return &session, nil
+}
+
+func (m *MemoryStore) GetActiveSessions(ctx context.Context, username string, now time.Time) ([]*model.Session, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.Session
+	for _, s := range m.sessions {
+		if s.Username == username && s.RevokedAt == nil && s.ExpiresAt.After(now) {
+			session := *s
+			out = append(out, &session)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].LastSeenAt.Equal(out[j].LastSeenAt) {
+			return out[i].LastSeenAt.After(out[j].LastSeenAt)
+		}
+		return out[i].Id < out[j].Id
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) RotateSession(ctx context.Context, session *model.Session, oldHash string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	s, ok := m.sessions[session.Id]
+	if !ok || s.RefreshTokenHash != oldHash || s.RevokedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	s.RefreshTokenHash, s.PreviousTokenHash = session.RefreshTokenHash, session.PreviousTokenHash
+	s.UserAgent, s.Ip, s.LastSeenAt, s.ExpiresAt = session.UserAgent, session.Ip, session.LastSeenAt, session.ExpiresAt
+	return nil
+}
+
+func (m *MemoryStore) RevokeSession(ctx context.Context, username, id string, at time.Time) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	s, ok := m.sessions[id]
+	if !ok || s.Username != username || s.RevokedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	s.RevokedAt = &at
+	return nil
+}
+
+func (m *MemoryStore) RevokeUserSessions(ctx context.Context, username, exceptId string, at time.Time) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, s := range m.sessions {
+		if s.Username == username && s.Id != exceptId && s.RevokedAt == nil {
+			revokedAt := at
+			s.RevokedAt = &revokedAt
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) CreateUserTOTP(ctx context.Context, totp *model.UserTOTP) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if t, ok := m.totps[totp.Username]; ok && t.Enabled() {
+		return fmt.Errorf("duplicate user totp: %s", totp.Username)
+	}
+
+	t := *totp
+	m.totps[t.Username] = &t
+	return nil
+}
+
+func (m *MemoryStore) GetUserTOTP(ctx context.Context, username string) (*model.UserTOTP, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	t, ok := m.totps[username]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	totp := *t
+	return &totp, nil
+}
+
+func (m *MemoryStore) EnableUserTOTP(ctx context.Context, username string, step int64, at time.Time, codes []*model.BackupCode) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	t, ok := m.totps[username]
+	if !ok || t.Enabled() {
+		return sql.ErrNoRows
+	}
+
+	t.ConfirmedAt, t.LastStep, t.UpdatedAt = &at, step, at
+
+	kept := m.backupCodes[:0]
+	for _, c := range m.backupCodes {
+		if c.Username != username {
+			kept = append(kept, c)
+		}
+	}
+	m.backupCodes = kept
+
+	for _, c := range codes {
+		code := *c
+		m.backupCodes = append(m.backupCodes, &code)
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	t, ok := m.totps[username]
+	if !ok || t.LastStep >= step {
+		return sql.ErrNoRows
+	}
+
+	t.LastStep = step
+	return nil
+}
+
+func (m *MemoryStore) UseBackupCode(ctx context.Context, username, codeHash string, at time.Time) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	for _, c := range m.backupCodes {
+		if c.Username == username && c.CodeHash == codeHash && c.UsedAt == nil {
+			c.UsedAt = &at
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (m *MemoryStore) CountBackupCodes(ctx context.Context, username string) (int64, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var n int64
+	for _, c := range m.backupCodes {
+		if c.Username == username && c.UsedAt == nil {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (m *MemoryStore) DeleteUserTOTP(ctx context.Context, username string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	delete(m.totps, username)
+
+	kept := m.backupCodes[:0]
+	for _, c := range m.backupCodes {
+		if c.Username != username {
+			kept = append(kept, c)
+		}
+	}
+	m.backupCodes = kept
+
+	return nil
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, user *model.User) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	u := *user
+	u.Uid = m.nextUid
+	u.CreatedAt = time.Now()
+	m.nextUid++
+	m.users[u.Username] = &u
+
+	return nil
+}
+
+func (m *MemoryStore) GetUserByUsername(ctx context.Context, username string) (*model.User, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	u, ok := m.users[username]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	out := *u
+	return &out, nil
+}
+
+func (m *MemoryStore) UpdateUserPassword(ctx context.Context, username, password string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	u, ok := m.users[username]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	u.Password = password
+	return nil
+}
+
+func (m *MemoryStore) GetUsersWithAppKey(ctx context.Context) ([]*model.User, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.User
+	for _, u := range m.users {
+		if u.AppKey != "" {
+			user := *u
+			out = append(out, &user)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Username < out[j].Username
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) ClearUserAppKey(ctx context.Context, username string) error {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if u, ok := m.users[username]; ok {
+		u.AppKey, u.AppSecret = "", ""
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) GetUserKeys(ctx context.Context) ([]*model.PaiNetInfo, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.PaiNetInfo
+	for _, pi := range m.userKeys {
+		info := *pi
+		out = append(out, &info)
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) findUserKey(match func(pi *model.PaiNetInfo) bool) (*model.PaiNetInfo, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	for _, pi := range m.userKeys {
+		if match(pi) {
+			info := *pi
+			return &info, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryStore) GetUserKeyByAPIKey(ctx context.Context, key string) (*model.PaiNetInfo, error) {
+	return m.findUserKey(func(pi *model.PaiNetInfo) bool {
+		return pi.APIKey == key
+	})
+}
+
+func (m *MemoryStore) GetPaiNetInfoByUsername(ctx context.Context, username string) (*model.PaiNetInfo, error) {
+	return m.findUserKey(func(pi *model.PaiNetInfo) bool {
+		return pi.Username == username
+	})
+}
+
+func (m *MemoryStore) UpsertSyncCheckpoint(ctx context.Context, checkpoint *model.SyncCheckpoint) error {
+	if len(checkpoint.LastError) > maxLastErrorLength {
+		checkpoint.LastError = checkpoint.LastError[:maxLastErrorLength]
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	key := checkpointKey{checkpoint.PaiUsername, checkpoint.DataType, checkpoint.WindowStart, checkpoint.WindowEnd}
+	cp := *checkpoint
+	cp.CreatedAt = time.Now()
+	cp.UpdatedAt = cp.CreatedAt
+	if old, ok := m.checkpoints[key]; ok {
+		cp.CreatedAt = old.CreatedAt
+	}
+	m.checkpoints[key] = &cp
+
+	return nil
+}
+
+func (m *MemoryStore) GetSyncCheckpoint(ctx context.Context, paiUsername, dataType, windowStart, windowEnd string) (*model.SyncCheckpoint, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	cp, ok := m.checkpoints[checkpointKey{paiUsername, dataType, windowStart, windowEnd}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	out := *cp
+	return &out, nil
+}
+
+func (m *MemoryStore) GetSyncCheckpoints(ctx context.Context, paiUsername, dataType string) ([]*model.SyncCheckpoint, error) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	var out []*model.SyncCheckpoint
+	for key, cp := range m.checkpoints {
+		if key.paiUsername == paiUsername && key.dataType == dataType {
+			checkpoint := *cp
+			out = append(out, &checkpoint)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].WindowStart < out[j].WindowStart
+	})
+
+	return out, nil
+}
@@ -0,0 +1,259 @@
+package dao
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*/*.sql
+var migrationFS embed.FS
+
+var migrationFileRegexp = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned schema change, loaded from the embedded migrations directory.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int64      `db:"version"`
+	Name      string     `db:"name"`
+	AppliedAt *time.Time `db:"appliedAt"`
+}
+
+func loadMigrations(dialect Dialect) ([]*Migration, error) {
+	dir := path.Join("migrations", dialect.Name())
+	files, err := fs.ReadDir(migrationFS, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make(map[int64]*Migration)
+	for _, file := range files {
+		matches := migrationFileRegexp.FindStringSubmatch(file.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", file.Name())
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := fs.ReadFile(migrationFS, path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := migrations[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			migrations[version] = m
+		}
+
+		if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %s and %s", version, m.Name, matches[2])
+		}
+
+		if matches[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	var out []*Migration
+	for _, m := range migrations {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down step", m.Version, m.Name)
+		}
+		out = append(out, m)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+
+	return out, nil
+}
+
+// splitStatements splits a migration into single statements, since the driver runs one statement per call.
+func splitStatements(script string) []string {
+	var out []string
+	for _, stmt := range strings.Split(script, ";\n") {
+		stmt = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(stmt), ";"))
+		if stmt != "" {
+			out = append(out, stmt)
+		}
+	}
+	return out
+}
+
+func (s *SQLStore) ensureMigrationsTable(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.MigrationsTable())
+	return err
+}
+
+func (s *SQLStore) appliedMigrations(ctx context.Context) (map[int64]bool, error) {
+	if err := s.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var versions []int64
+	if err := s.db.SelectContext(ctx, &versions, s.rebind(`select version from schema_migrations`)); err != nil {
+		return nil, err
+	}
+
+	out := make(map[int64]bool)
+	for _, v := range versions {
+		out[v] = true
+	}
+
+	return out, nil
+}
+
+// execMigration runs a step of a migration along with the statement recording it in schema_migrations.
+// SQLite and Postgres run both in one transaction, so that a failed statement leaves the schema as it
+// was. MySQL commits every DDL statement implicitly and can not roll them back: its up scripts are written
+// to be run again over a schema they partially changed, and run on a single connection as they keep their
+// guards in session variables.
+func (s *SQLStore) execMigration(ctx context.Context, version int64, script, record string, args ...interface{}) error {
+	if !s.dialect.TransactionalDDL() {
+		conn, err := s.db.Connx(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		return execStatements(ctx, conn, version, script, record, args...)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := execStatements(ctx, tx, version, script, record, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func execStatements(ctx context.Context, db sqlx.ExecerContext, version int64, script, record string, args ...interface{}) error {
+	for _, stmt := range splitStatements(script) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+	}
+
+	_, err := db.ExecContext(ctx, record, args...)
+	return err
+}
+
+// Migrate applies the pending migrations in version order and returns how many were applied. A migration
+// failing on MySQL may leave some of its statements applied, see execMigration: running Migrate again
+// once the cause is fixed completes it.
+func (s *SQLStore) Migrate(ctx context.Context) (int, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		log.Infof("applying migration %d_%s", m.Version, m.Name)
+		record := s.rebind(`INSERT INTO schema_migrations(version, name, appliedAt) VALUES(?, ?, ` + s.dialect.Now() + `)`)
+		if err := s.execMigration(ctx, m.Version, m.Up, record, m.Version, m.Name); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and returns how many were reverted.
+func (s *SQLStore) MigrateDown(ctx context.Context, steps int) (int, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return 0, err
+	}
+
+	applied, err := s.appliedMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+		m := migrations[i]
+		if !applied[m.Version] {
+			continue
+		}
+
+		log.Infof("reverting migration %d_%s", m.Version, m.Name)
+		record := s.rebind(`DELETE FROM schema_migrations WHERE version = ?`)
+		if err := s.execMigration(ctx, m.Version, m.Down, record, m.Version); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// GetMigrationStatus lists every known migration along with the time it was applied, if it was.
+func (s *SQLStore) GetMigrationStatus(ctx context.Context) ([]*MigrationStatus, error) {
+	migrations, err := loadMigrations(s.dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ensureMigrationsTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var applied []*MigrationStatus
+	if err := s.db.SelectContext(ctx, &applied, s.rebind(`select * from schema_migrations`)); err != nil {
+		return nil, err
+	}
+
+	appliedAt := make(map[int64]*time.Time)
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	var out []*MigrationStatus
+	for _, m := range migrations {
+		out = append(out, &MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			AppliedAt: appliedAt[m.Version],
+		})
+	}
+
+	return out, nil
+}
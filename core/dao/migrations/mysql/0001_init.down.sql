@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS `user`;
+DROP TABLE IF EXISTS `pai_userkey`;
+DROP TABLE IF EXISTS `box_quality`;
+DROP TABLE IF EXISTS `box_bandwidth`;
+DROP TABLE IF EXISTS `box_income`;
+DROP TABLE IF EXISTS `box_diskinfo`;
+DROP TABLE IF EXISTS `box`;
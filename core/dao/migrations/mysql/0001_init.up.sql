@@ -1,5 +1,4 @@
-DROP TABLE IF EXISTS `box`;
-CREATE TABLE `box` (
+CREATE TABLE IF NOT EXISTS `box` (
 `username`  varchar(255) NOT NULL DEFAULT '',
 `boxId` varchar(255) NOT NULL DEFAULT '',
 `supplierBoxId` varchar(255) NOT NULL DEFAULT '',
@@ -34,8 +33,7 @@ CREATE TABLE `box` (
 PRIMARY KEY (`boxId`)
 );
 
-DROP TABLE IF EXISTS `box_diskinfo`;
-CREATE TABLE `box_diskinfo` (
+CREATE TABLE IF NOT EXISTS `box_diskinfo` (
 `boxId` varchar(255) NOT NULL DEFAULT '',
 `supplierBoxId` varchar(255) NOT NULL DEFAULT '',
 `diskId` varchar(255) NOT NULL DEFAULT '',
@@ -46,8 +44,7 @@ INDEX `idx_boxId` USING BTREE(`boxId`),
 UNIQUE KEY `uniq_boxid_diskid` (`boxId`, `diskId`) USING BTREE
 );
 
-DROP TABLE IF EXISTS `box_income`;
-CREATE TABLE `box_income` (
+CREATE TABLE IF NOT EXISTS `box_income` (
 username  varchar(255) NOT NULL DEFAULT '',
 boxId varchar(255) NOT NULL DEFAULT '',
 supplierBoxId varchar(255) NOT NULL DEFAULT '',
@@ -65,8 +62,7 @@ INDEX `idx_remark` USING BTREE(`remark`),
 UNIQUE KEY `uniq_boxid_date` (`boxId`, `date`) USING BTREE
 );
 
-DROP TABLE IF EXISTS `box_bandwidth`;
-CREATE TABLE `box_bandwidth` (
+CREATE TABLE IF NOT EXISTS `box_bandwidth` (
 username  varchar(255) NOT NULL DEFAULT '',
 boxId varchar(255) NOT NULL DEFAULT '',
 supplierBoxId varchar(255) NOT NULL DEFAULT '',
@@ -78,8 +74,7 @@ INDEX `idx_boxId_time` USING BTREE(`boxId`, `time`),
 UNIQUE KEY `uniq_boxid_time` (`boxId`, `time`) USING BTREE
 );
 
-DROP TABLE IF EXISTS `box_quality`;
-CREATE TABLE `box_quality` (
+CREATE TABLE IF NOT EXISTS `box_quality` (
 username  varchar(255) NOT NULL DEFAULT '',
 boxId varchar(255) NOT NULL DEFAULT '',
 supplierBoxId varchar(255) NOT NULL DEFAULT '',
@@ -96,8 +91,7 @@ UNIQUE KEY `uniq_boxid_time` (`boxId`, `time`) USING BTREE
 );
 
 
-DROP TABLE IF EXISTS `pai_userkey`;
-CREATE TABLE `pai_userkey` (
+CREATE TABLE IF NOT EXISTS `pai_userkey` (
 paiUsername varchar(255) NOT NULL DEFAULT '',
 username varchar(255) NOT NULL DEFAULT '',
 apiKey varchar(255) NOT NULL DEFAULT '',
@@ -105,8 +99,7 @@ apiSecret varchar(255) NOT NULL DEFAULT '',
 status tinyint(4) not null default 0
 );
 
-DROP TABLE IF EXISTS `user`;
-CREATE TABLE `user` (
+CREATE TABLE IF NOT EXISTS `user` (
 uid BIGINT(20) NOT NULL AUTO_INCREMENT,
 username varchar(255) NOT NULL DEFAULT '',
 password varchar(255) NOT NULL DEFAULT '',
@@ -122,4 +115,3 @@ inviterType tinyint(4) not null default 0,
 createdAt datetime(3) NOT NULL DEFAULT 0,
 PRIMARY KEY (`uid`)
 )ENGINE=InnoDB AUTO_INCREMENT=100000;
-
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `sync_checkpoint` (
+paiUsername varchar(255) NOT NULL DEFAULT '',
+dataType varchar(32) NOT NULL DEFAULT '',
+windowStart varchar(32) NOT NULL DEFAULT '',
+windowEnd varchar(32) NOT NULL DEFAULT '',
+status varchar(32) NOT NULL DEFAULT '',
+attempts bigint(20) NOT NULL DEFAULT 0,
+lastError varchar(1024) NOT NULL DEFAULT '',
+rowCount bigint(20) NOT NULL DEFAULT 0,
+createdAt datetime(3) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+INDEX `idx_status` USING BTREE(`status`),
+UNIQUE KEY `uniq_account_type_window` (`paiUsername`, `dataType`, `windowStart`, `windowEnd`) USING BTREE
+);
@@ -0,0 +1,17 @@
+ALTER TABLE box_quality
+    DROP INDEX `idx_username_time`,
+    MODIFY time varchar(255) NOT NULL DEFAULT '',
+    MODIFY packetLoss varchar(255) NOT NULL DEFAULT '';
+
+ALTER TABLE box_bandwidth
+    DROP INDEX `idx_username_time`,
+    MODIFY time varchar(255) NOT NULL DEFAULT '';
+
+ALTER TABLE box_income
+    DROP INDEX `idx_username_date`,
+    MODIFY date varchar(255) NOT NULL DEFAULT '',
+    MODIFY bw varchar(255) NOT NULL DEFAULT '',
+    MODIFY bwAmount varchar(255) NOT NULL DEFAULT '',
+    MODIFY amount varchar(255) NOT NULL DEFAULT '',
+    MODIFY activityIncome varchar(255) NOT NULL DEFAULT '',
+    MODIFY distPercent varchar(255) NOT NULL DEFAULT '';
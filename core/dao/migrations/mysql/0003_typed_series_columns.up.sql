@@ -0,0 +1,40 @@
+UPDATE box_income SET bw = '0' WHERE CAST(bw AS CHAR) = '';
+UPDATE box_income SET bwAmount = '0' WHERE CAST(bwAmount AS CHAR) = '';
+UPDATE box_income SET amount = '0' WHERE CAST(amount AS CHAR) = '';
+UPDATE box_income SET activityIncome = '0' WHERE CAST(activityIncome AS CHAR) = '';
+UPDATE box_income SET distPercent = '0' WHERE CAST(distPercent AS CHAR) = '';
+UPDATE box_income SET date = '1970-01-01' WHERE CAST(date AS CHAR) = '';
+ALTER TABLE box_income
+    MODIFY date DATE NOT NULL,
+    MODIFY bw DECIMAL(20,4) NOT NULL DEFAULT 0,
+    MODIFY bwAmount DECIMAL(20,4) NOT NULL DEFAULT 0,
+    MODIFY amount DECIMAL(20,4) NOT NULL DEFAULT 0,
+    MODIFY activityIncome DECIMAL(20,4) NOT NULL DEFAULT 0,
+    MODIFY distPercent DECIMAL(5,2) NOT NULL DEFAULT 0;
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'box_income' AND index_name = 'idx_username_date') = 0,
+    'ALTER TABLE box_income ADD INDEX `idx_username_date` USING BTREE(`username`, `date`)', 'DO 0');
+PREPARE ddl FROM @ddl;
+EXECUTE ddl;
+DEALLOCATE PREPARE ddl;
+
+UPDATE box_bandwidth SET time = UNIX_TIMESTAMP(time) WHERE time LIKE '%-%';
+UPDATE box_bandwidth SET time = '0' WHERE CAST(time AS CHAR) = '';
+ALTER TABLE box_bandwidth
+    MODIFY time BIGINT(20) NOT NULL DEFAULT 0;
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'box_bandwidth' AND index_name = 'idx_username_time') = 0,
+    'ALTER TABLE box_bandwidth ADD INDEX `idx_username_time` USING BTREE(`username`, `time`)', 'DO 0');
+PREPARE ddl FROM @ddl;
+EXECUTE ddl;
+DEALLOCATE PREPARE ddl;
+
+UPDATE box_quality SET time = UNIX_TIMESTAMP(time) WHERE time LIKE '%-%';
+UPDATE box_quality SET time = '0' WHERE CAST(time AS CHAR) = '';
+UPDATE box_quality SET packetLoss = '0' WHERE CAST(packetLoss AS CHAR) = '';
+ALTER TABLE box_quality
+    MODIFY time BIGINT(20) NOT NULL DEFAULT 0,
+    MODIFY packetLoss DECIMAL(10,4) NOT NULL DEFAULT 0;
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'box_quality' AND index_name = 'idx_username_time') = 0,
+    'ALTER TABLE box_quality ADD INDEX `idx_username_time` USING BTREE(`username`, `time`)', 'DO 0');
+PREPARE ddl FROM @ddl;
+EXECUTE ddl;
+DEALLOCATE PREPARE ddl;
@@ -0,0 +1,67 @@
+CREATE TABLE IF NOT EXISTS `box_bandwidth_hourly` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint(20) NOT NULL DEFAULT 0,
+samples bigint(20) NOT NULL DEFAULT 0,
+uploadAvg double NOT NULL DEFAULT 0,
+uploadMax double NOT NULL DEFAULT 0,
+uploadMin double NOT NULL DEFAULT 0,
+uploadP95 double NOT NULL DEFAULT 0,
+downloadAvg double NOT NULL DEFAULT 0,
+downloadMax double NOT NULL DEFAULT 0,
+downloadMin double NOT NULL DEFAULT 0,
+downloadP95 double NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+INDEX `idx_username_time` USING BTREE(`username`, `time`),
+UNIQUE KEY `uniq_boxid_time` (`boxId`, `time`) USING BTREE
+);
+
+CREATE TABLE IF NOT EXISTS `box_bandwidth_daily` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint(20) NOT NULL DEFAULT 0,
+samples bigint(20) NOT NULL DEFAULT 0,
+uploadAvg double NOT NULL DEFAULT 0,
+uploadMax double NOT NULL DEFAULT 0,
+uploadMin double NOT NULL DEFAULT 0,
+uploadP95 double NOT NULL DEFAULT 0,
+downloadAvg double NOT NULL DEFAULT 0,
+downloadMax double NOT NULL DEFAULT 0,
+downloadMin double NOT NULL DEFAULT 0,
+downloadP95 double NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+INDEX `idx_username_time` USING BTREE(`username`, `time`),
+UNIQUE KEY `uniq_boxid_time` (`boxId`, `time`) USING BTREE
+);
+
+CREATE TABLE IF NOT EXISTS `box_quality_hourly` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint(20) NOT NULL DEFAULT 0,
+samples bigint(20) NOT NULL DEFAULT 0,
+packetLossAvg double NOT NULL DEFAULT 0,
+cpuUsageAvg double NOT NULL DEFAULT 0,
+memoryUsageAvg double NOT NULL DEFAULT 0,
+diskUsageAvg double NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+INDEX `idx_username_time` USING BTREE(`username`, `time`),
+UNIQUE KEY `uniq_boxid_time` (`boxId`, `time`) USING BTREE
+);
+
+CREATE TABLE IF NOT EXISTS `box_quality_daily` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint(20) NOT NULL DEFAULT 0,
+samples bigint(20) NOT NULL DEFAULT 0,
+packetLossAvg double NOT NULL DEFAULT 0,
+cpuUsageAvg double NOT NULL DEFAULT 0,
+memoryUsageAvg double NOT NULL DEFAULT 0,
+diskUsageAvg double NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+INDEX `idx_username_time` USING BTREE(`username`, `time`),
+UNIQUE KEY `uniq_boxid_time` (`boxId`, `time`) USING BTREE
+);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `box_history` (
+id bigint(20) NOT NULL AUTO_INCREMENT,
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+field varchar(64) NOT NULL DEFAULT '',
+oldValue varchar(255) NOT NULL DEFAULT '',
+newValue varchar(255) NOT NULL DEFAULT '',
+changedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+INDEX `idx_boxid_changedat` USING BTREE(`boxId`, `changedAt`)
+);
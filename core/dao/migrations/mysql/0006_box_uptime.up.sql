@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `box_uptime` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+online tinyint(1) NOT NULL DEFAULT 0,
+startTime bigint(20) NOT NULL DEFAULT 0,
+endTime bigint(20) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+INDEX `idx_username_endtime` USING BTREE(`username`, `endTime`),
+UNIQUE KEY `uniq_boxid_starttime` (`boxId`, `startTime`) USING BTREE
+);
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS `alerts` (
+id bigint(20) NOT NULL AUTO_INCREMENT,
+username varchar(255) NOT NULL DEFAULT '',
+dedupKey varchar(255) NOT NULL DEFAULT '',
+rule varchar(64) NOT NULL DEFAULT '',
+severity varchar(32) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+status varchar(32) NOT NULL DEFAULT '',
+value double NOT NULL DEFAULT 0,
+summary varchar(1024) NOT NULL DEFAULT '',
+startsAt datetime(3) NOT NULL DEFAULT 0,
+resolvedAt datetime(3) NULL DEFAULT NULL,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+INDEX `idx_username_status` USING BTREE(`username`, `status`),
+INDEX `idx_dedupkey` USING BTREE(`dedupKey`)
+);
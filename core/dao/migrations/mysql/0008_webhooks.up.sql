@@ -0,0 +1,31 @@
+CREATE TABLE IF NOT EXISTS `webhook_endpoints` (
+id varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+url varchar(1024) NOT NULL DEFAULT '',
+secret varchar(255) NOT NULL DEFAULT '',
+events varchar(1024) NOT NULL DEFAULT '',
+createdAt datetime(3) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+INDEX `idx_username` USING BTREE(`username`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+id varchar(64) NOT NULL DEFAULT '',
+endpointId varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+event varchar(64) NOT NULL DEFAULT '',
+payload mediumtext NOT NULL,
+status varchar(32) NOT NULL DEFAULT '',
+attempts int(11) NOT NULL DEFAULT 0,
+responseCode int(11) NOT NULL DEFAULT 0,
+lastError varchar(1024) NOT NULL DEFAULT '',
+nextAttemptAt datetime(3) NOT NULL DEFAULT 0,
+deliveredAt datetime(3) NULL DEFAULT NULL,
+createdAt datetime(3) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+INDEX `idx_status_nextattemptat` USING BTREE(`status`, `nextAttemptAt`),
+INDEX `idx_username_createdat` USING BTREE(`username`, `createdAt`),
+INDEX `idx_endpointid` USING BTREE(`endpointId`)
+);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS `notify_channels` (
+id varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+name varchar(255) NOT NULL DEFAULT '',
+type varchar(32) NOT NULL DEFAULT '',
+target varchar(1024) NOT NULL DEFAULT '',
+secret varchar(255) NOT NULL DEFAULT '',
+severities varchar(255) NOT NULL DEFAULT '',
+template text NOT NULL,
+quietStart varchar(5) NOT NULL DEFAULT '',
+quietEnd varchar(5) NOT NULL DEFAULT '',
+createdAt datetime(3) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+INDEX `idx_username` USING BTREE(`username`)
+);
@@ -0,0 +1,5 @@
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = 'user' AND index_name = 'idx_appkey') = 0,
+    'ALTER TABLE `user` ADD INDEX `idx_appkey` USING BTREE(`appKey`)', 'DO 0');
+PREPARE ddl FROM @ddl;
+EXECUTE ddl;
+DEALLOCATE PREPARE ddl;
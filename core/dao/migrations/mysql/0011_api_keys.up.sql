@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS `api_keys` (
+id varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+name varchar(255) NOT NULL DEFAULT '',
+appKey varchar(64) NOT NULL DEFAULT '',
+secretHash varchar(64) NOT NULL DEFAULT '',
+previousSecretHash varchar(64) NOT NULL DEFAULT '',
+previousExpiresAt datetime(3) NULL DEFAULT NULL,
+scopes varchar(255) NOT NULL DEFAULT '',
+expiresAt datetime(3) NULL DEFAULT NULL,
+lastUsedAt datetime(3) NULL DEFAULT NULL,
+lastUsedIp varchar(64) NOT NULL DEFAULT '',
+revokedAt datetime(3) NULL DEFAULT NULL,
+createdAt datetime(3) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+UNIQUE INDEX `uniq_appkey` USING BTREE(`appKey`),
+INDEX `idx_username` USING BTREE(`username`)
+);
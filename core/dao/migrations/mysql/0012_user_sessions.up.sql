@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `user_sessions` (
+id varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+refreshTokenHash varchar(64) NOT NULL DEFAULT '',
+previousTokenHash varchar(64) NOT NULL DEFAULT '',
+userAgent varchar(512) NOT NULL DEFAULT '',
+ip varchar(64) NOT NULL DEFAULT '',
+createdAt datetime(3) NOT NULL DEFAULT 0,
+lastSeenAt datetime(3) NOT NULL DEFAULT 0,
+expiresAt datetime(3) NOT NULL DEFAULT 0,
+revokedAt datetime(3) NULL DEFAULT NULL,
+PRIMARY KEY (`id`),
+INDEX `idx_username` USING BTREE(`username`)
+);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS `user_totp` (
+username varchar(255) NOT NULL DEFAULT '',
+secret varchar(64) NOT NULL DEFAULT '',
+confirmedAt datetime(3) NULL DEFAULT NULL,
+lastStep bigint(20) NOT NULL DEFAULT 0,
+createdAt datetime(3) NOT NULL DEFAULT 0,
+updatedAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`username`)
+);
+
+CREATE TABLE IF NOT EXISTS `user_backup_codes` (
+id varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+codeHash varchar(64) NOT NULL DEFAULT '',
+usedAt datetime(3) NULL DEFAULT NULL,
+createdAt datetime(3) NOT NULL DEFAULT 0,
+PRIMARY KEY (`id`),
+INDEX `idx_username` USING BTREE(`username`)
+);
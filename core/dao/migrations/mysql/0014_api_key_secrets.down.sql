@@ -0,0 +1,5 @@
+ALTER TABLE `api_keys`
+    ADD COLUMN secretHash varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN previousSecretHash varchar(64) NOT NULL DEFAULT '';
+UPDATE `api_keys` SET revokedAt = now(3) WHERE revokedAt IS NULL;
+ALTER TABLE `api_keys` DROP COLUMN secret, DROP COLUMN previousSecret;
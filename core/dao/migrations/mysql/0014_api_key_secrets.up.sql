@@ -0,0 +1,11 @@
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'api_keys' AND column_name = 'secret') = 0,
+    'ALTER TABLE `api_keys` ADD COLUMN secret varchar(255) NOT NULL DEFAULT '''', ADD COLUMN previousSecret varchar(255) NOT NULL DEFAULT ''''', 'DO 0');
+PREPARE ddl FROM @ddl;
+EXECUTE ddl;
+DEALLOCATE PREPARE ddl;
+UPDATE `api_keys` SET revokedAt = now(3) WHERE revokedAt IS NULL AND secret = '';
+SET @ddl = IF((SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'api_keys' AND column_name = 'secretHash') = 1,
+    'ALTER TABLE `api_keys` DROP COLUMN secretHash, DROP COLUMN previousSecretHash', 'DO 0');
+PREPARE ddl FROM @ddl;
+EXECUTE ddl;
+DEALLOCATE PREPARE ddl;
@@ -0,0 +1,134 @@
+CREATE TABLE IF NOT EXISTS "box" (
+"username"  varchar(255) NOT NULL DEFAULT '',
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+"online" varchar(255) NOT NULL DEFAULT '',
+"tcpNatType" varchar(255) NOT NULL DEFAULT '',
+"udpNatType" varchar(255) NOT NULL DEFAULT '',
+"publicIp" varchar(255) NOT NULL DEFAULT '',
+"privateIp" varchar(255) NOT NULL DEFAULT '',
+"isp" varchar(255) NOT NULL DEFAULT '',
+"province" varchar(255) NOT NULL DEFAULT '',
+"city" varchar(255) NOT NULL DEFAULT '',
+"cpuArch" varchar(255) NOT NULL DEFAULT '',
+"cpuCores" varchar(255) NOT NULL DEFAULT '',
+"memorySize" varchar(255) NOT NULL DEFAULT '',
+"os" varchar(255) NOT NULL DEFAULT '',
+"pluginVersion" varchar(255) NOT NULL DEFAULT '',
+"pluginDeployTime" varchar(255) NOT NULL DEFAULT '',
+"processStatus" varchar(255) NOT NULL DEFAULT '',
+"fault" varchar(255) NOT NULL DEFAULT '',
+"upload" real NOT NULL DEFAULT 0,
+"download" real NOT NULL DEFAULT 0,
+"diskUsage" real NOT NULL DEFAULT 0,
+"upnp" boolean NOT NULL DEFAULT false,
+"notDeployReason" varchar(255) NOT NULL DEFAULT '',
+"reportUpBandwidth" varchar(255) NOT NULL DEFAULT '',
+"planTask" varchar(255) NOT NULL DEFAULT '',
+"pressBandwidth" varchar(255) NOT NULL DEFAULT '',
+"remark" varchar(255) NOT NULL DEFAULT '',
+"icmpv6Out" real NOT NULL DEFAULT 0,
+"createdAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+PRIMARY KEY ("boxId")
+);
+
+CREATE TABLE IF NOT EXISTS "box_diskinfo" (
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+"diskId" varchar(255) NOT NULL DEFAULT '',
+"diskSize" varchar(255) NOT NULL DEFAULT '',
+"diskMedia" varchar(255) NOT NULL DEFAULT '',
+"diskUsed" varchar(255) NOT NULL DEFAULT '',
+UNIQUE ("boxId", "diskId")
+);
+
+CREATE TABLE IF NOT EXISTS "box_income" (
+username  varchar(255) NOT NULL DEFAULT '',
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+date date NOT NULL DEFAULT '1970-01-01',
+remark varchar(255) NOT NULL DEFAULT '',
+bw decimal(20,4) NOT NULL DEFAULT 0,
+"bwAmount" decimal(20,4) NOT NULL DEFAULT 0,
+amount decimal(20,4) NOT NULL DEFAULT 0,
+"activityIncome" decimal(20,4) NOT NULL DEFAULT 0,
+"distPercent" decimal(5,2) NOT NULL DEFAULT 0,
+"inviterId" varchar(255) NOT NULL DEFAULT '',
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE ("boxId", "date")
+);
+
+CREATE INDEX IF NOT EXISTS "idx_box_income_remark" ON "box_income" ("remark");
+
+CREATE INDEX IF NOT EXISTS "idx_box_income_username_date" ON "box_income" ("username", "date");
+
+CREATE TABLE IF NOT EXISTS "box_bandwidth" (
+username  varchar(255) NOT NULL DEFAULT '',
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+time bigint NOT NULL DEFAULT 0,
+upload real NOT NULL DEFAULT 0,
+download real NOT NULL DEFAULT 0,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE ("boxId", "time")
+);
+
+CREATE INDEX IF NOT EXISTS "idx_box_bandwidth_username_time" ON "box_bandwidth" ("username", "time");
+
+CREATE TABLE IF NOT EXISTS "box_quality" (
+username  varchar(255) NOT NULL DEFAULT '',
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+time bigint NOT NULL DEFAULT 0,
+"packetLoss" decimal(10,4) NOT NULL DEFAULT 0,
+"tcpNatType" varchar(255) NOT NULL DEFAULT '',
+"udpNatType" varchar(255) NOT NULL DEFAULT '',
+"cpuUsage" real NOT NULL DEFAULT 0,
+"memoryUsage" real NOT NULL DEFAULT 0,
+"diskUsage" real NOT NULL DEFAULT 0,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE ("boxId", "time")
+);
+
+CREATE INDEX IF NOT EXISTS "idx_box_quality_username_time" ON "box_quality" ("username", "time");
+
+CREATE TABLE IF NOT EXISTS "pai_userkey" (
+"paiUsername" varchar(255) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+"apiKey" varchar(255) NOT NULL DEFAULT '',
+"apiSecret" varchar(255) NOT NULL DEFAULT '',
+status smallint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS "user" (
+uid bigint GENERATED BY DEFAULT AS IDENTITY (START WITH 100000) PRIMARY KEY,
+username varchar(255) NOT NULL DEFAULT '',
+password varchar(255) NOT NULL DEFAULT '',
+"appKey" varchar(255) NOT NULL DEFAULT '',
+"appSecret" varchar(255) NOT NULL DEFAULT '',
+"supplierType" bigint NOT NULL DEFAULT 0,
+"phoneNumber" varchar(255) NOT NULL DEFAULT '',
+"billingCycle" varchar(255) NOT NULL DEFAULT '',
+"parentId" varchar(255) NOT NULL DEFAULT '',
+"distPercent" bigint NOT NULL DEFAULT 0,
+"canInvite" boolean NOT NULL DEFAULT false,
+"inviterType" smallint NOT NULL DEFAULT 0,
+"createdAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS "sync_checkpoint" (
+"paiUsername" varchar(255) NOT NULL DEFAULT '',
+"dataType" varchar(32) NOT NULL DEFAULT '',
+"windowStart" varchar(32) NOT NULL DEFAULT '',
+"windowEnd" varchar(32) NOT NULL DEFAULT '',
+status varchar(32) NOT NULL DEFAULT '',
+attempts bigint NOT NULL DEFAULT 0,
+"lastError" varchar(1024) NOT NULL DEFAULT '',
+"rowCount" bigint NOT NULL DEFAULT 0,
+"createdAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE ("paiUsername", "dataType", "windowStart", "windowEnd")
+);
+
+CREATE INDEX IF NOT EXISTS "idx_sync_checkpoint_status" ON "sync_checkpoint" ("status");
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS "box_uptime" (
+"username" varchar(255) NOT NULL DEFAULT '',
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+"online" boolean NOT NULL DEFAULT false,
+"startTime" bigint NOT NULL DEFAULT 0,
+"endTime" bigint NOT NULL DEFAULT 0,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE ("boxId", "startTime")
+);
+
+CREATE INDEX IF NOT EXISTS "idx_box_uptime_username_endtime" ON "box_uptime" ("username", "endTime");
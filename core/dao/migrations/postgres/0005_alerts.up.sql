@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS "alerts" (
+"id" bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+"username" varchar(255) NOT NULL DEFAULT '',
+"dedupKey" varchar(255) NOT NULL DEFAULT '',
+"rule" varchar(64) NOT NULL DEFAULT '',
+"severity" varchar(32) NOT NULL DEFAULT '',
+"boxId" varchar(255) NOT NULL DEFAULT '',
+"supplierBoxId" varchar(255) NOT NULL DEFAULT '',
+"status" varchar(32) NOT NULL DEFAULT '',
+"value" double precision NOT NULL DEFAULT 0,
+"summary" varchar(1024) NOT NULL DEFAULT '',
+"startsAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+"resolvedAt" timestamp(3) NULL DEFAULT NULL,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS "idx_alerts_username_status" ON "alerts" ("username", "status");
+
+CREATE INDEX IF NOT EXISTS "idx_alerts_dedupkey" ON "alerts" ("dedupKey");
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS "api_keys" (
+"id" varchar(64) PRIMARY KEY,
+"username" varchar(255) NOT NULL DEFAULT '',
+"name" varchar(255) NOT NULL DEFAULT '',
+"appKey" varchar(64) NOT NULL DEFAULT '',
+"secretHash" varchar(64) NOT NULL DEFAULT '',
+"previousSecretHash" varchar(64) NOT NULL DEFAULT '',
+"previousExpiresAt" timestamp(3) NULL DEFAULT NULL,
+"scopes" varchar(255) NOT NULL DEFAULT '',
+"expiresAt" timestamp(3) NULL DEFAULT NULL,
+"lastUsedAt" timestamp(3) NULL DEFAULT NULL,
+"lastUsedIp" varchar(64) NOT NULL DEFAULT '',
+"revokedAt" timestamp(3) NULL DEFAULT NULL,
+"createdAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS "uniq_api_keys_appkey" ON "api_keys" ("appKey");
+CREATE INDEX IF NOT EXISTS "idx_api_keys_username" ON "api_keys" ("username");
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS "user_totp" (
+"username" varchar(255) PRIMARY KEY,
+"secret" varchar(64) NOT NULL DEFAULT '',
+"confirmedAt" timestamp(3) NULL DEFAULT NULL,
+"lastStep" bigint NOT NULL DEFAULT 0,
+"createdAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP,
+"updatedAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS "user_backup_codes" (
+"id" varchar(64) PRIMARY KEY,
+"username" varchar(255) NOT NULL DEFAULT '',
+"codeHash" varchar(64) NOT NULL DEFAULT '',
+"usedAt" timestamp(3) NULL DEFAULT NULL,
+"createdAt" timestamp(3) NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS "idx_user_backup_codes_username" ON "user_backup_codes" ("username");
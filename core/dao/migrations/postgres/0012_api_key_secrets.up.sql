@@ -0,0 +1,5 @@
+ALTER TABLE "api_keys"
+    ADD COLUMN "secret" varchar(255) NOT NULL DEFAULT '',
+    ADD COLUMN "previousSecret" varchar(255) NOT NULL DEFAULT '';
+UPDATE "api_keys" SET "revokedAt" = now() WHERE "revokedAt" IS NULL;
+ALTER TABLE "api_keys" DROP COLUMN "secretHash", DROP COLUMN "previousSecretHash";
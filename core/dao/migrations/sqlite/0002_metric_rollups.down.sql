@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS `box_quality_daily`;
+DROP TABLE IF EXISTS `box_quality_hourly`;
+DROP TABLE IF EXISTS `box_bandwidth_daily`;
+DROP TABLE IF EXISTS `box_bandwidth_hourly`;
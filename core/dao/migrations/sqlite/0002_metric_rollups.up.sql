@@ -0,0 +1,71 @@
+CREATE TABLE IF NOT EXISTS `box_bandwidth_hourly` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint NOT NULL DEFAULT 0,
+samples bigint NOT NULL DEFAULT 0,
+uploadAvg real NOT NULL DEFAULT 0,
+uploadMax real NOT NULL DEFAULT 0,
+uploadMin real NOT NULL DEFAULT 0,
+uploadP95 real NOT NULL DEFAULT 0,
+downloadAvg real NOT NULL DEFAULT 0,
+downloadMax real NOT NULL DEFAULT 0,
+downloadMin real NOT NULL DEFAULT 0,
+downloadP95 real NOT NULL DEFAULT 0,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE (boxId, time)
+);
+
+CREATE INDEX IF NOT EXISTS `idx_box_bandwidth_hourly_username_time` ON `box_bandwidth_hourly` (username, time);
+
+CREATE TABLE IF NOT EXISTS `box_bandwidth_daily` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint NOT NULL DEFAULT 0,
+samples bigint NOT NULL DEFAULT 0,
+uploadAvg real NOT NULL DEFAULT 0,
+uploadMax real NOT NULL DEFAULT 0,
+uploadMin real NOT NULL DEFAULT 0,
+uploadP95 real NOT NULL DEFAULT 0,
+downloadAvg real NOT NULL DEFAULT 0,
+downloadMax real NOT NULL DEFAULT 0,
+downloadMin real NOT NULL DEFAULT 0,
+downloadP95 real NOT NULL DEFAULT 0,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE (boxId, time)
+);
+
+CREATE INDEX IF NOT EXISTS `idx_box_bandwidth_daily_username_time` ON `box_bandwidth_daily` (username, time);
+
+CREATE TABLE IF NOT EXISTS `box_quality_hourly` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint NOT NULL DEFAULT 0,
+samples bigint NOT NULL DEFAULT 0,
+packetLossAvg real NOT NULL DEFAULT 0,
+cpuUsageAvg real NOT NULL DEFAULT 0,
+memoryUsageAvg real NOT NULL DEFAULT 0,
+diskUsageAvg real NOT NULL DEFAULT 0,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE (boxId, time)
+);
+
+CREATE INDEX IF NOT EXISTS `idx_box_quality_hourly_username_time` ON `box_quality_hourly` (username, time);
+
+CREATE TABLE IF NOT EXISTS `box_quality_daily` (
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+time bigint NOT NULL DEFAULT 0,
+samples bigint NOT NULL DEFAULT 0,
+packetLossAvg real NOT NULL DEFAULT 0,
+cpuUsageAvg real NOT NULL DEFAULT 0,
+memoryUsageAvg real NOT NULL DEFAULT 0,
+diskUsageAvg real NOT NULL DEFAULT 0,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+UNIQUE (boxId, time)
+);
+
+CREATE INDEX IF NOT EXISTS `idx_box_quality_daily_username_time` ON `box_quality_daily` (username, time);
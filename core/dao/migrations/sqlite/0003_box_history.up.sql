@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `box_history` (
+id INTEGER PRIMARY KEY AUTOINCREMENT,
+username varchar(255) NOT NULL DEFAULT '',
+boxId varchar(255) NOT NULL DEFAULT '',
+supplierBoxId varchar(255) NOT NULL DEFAULT '',
+field varchar(64) NOT NULL DEFAULT '',
+oldValue varchar(255) NOT NULL DEFAULT '',
+newValue varchar(255) NOT NULL DEFAULT '',
+changedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS `idx_box_history_boxid_changedat` ON `box_history` (boxId, changedAt);
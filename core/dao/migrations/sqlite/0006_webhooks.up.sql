@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS `webhook_endpoints` (
+id varchar(64) PRIMARY KEY NOT NULL,
+username varchar(255) NOT NULL DEFAULT '',
+url varchar(1024) NOT NULL DEFAULT '',
+secret varchar(255) NOT NULL DEFAULT '',
+events varchar(1024) NOT NULL DEFAULT '',
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS `idx_webhook_endpoints_username` ON `webhook_endpoints` (username);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+id varchar(64) PRIMARY KEY NOT NULL,
+endpointId varchar(64) NOT NULL DEFAULT '',
+username varchar(255) NOT NULL DEFAULT '',
+event varchar(64) NOT NULL DEFAULT '',
+payload text NOT NULL DEFAULT '',
+status varchar(32) NOT NULL DEFAULT '',
+attempts integer NOT NULL DEFAULT 0,
+responseCode integer NOT NULL DEFAULT 0,
+lastError varchar(1024) NOT NULL DEFAULT '',
+nextAttemptAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+deliveredAt datetime NULL DEFAULT NULL,
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_status_nextattemptat` ON `webhook_deliveries` (status, nextAttemptAt);
+
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_username_createdat` ON `webhook_deliveries` (username, createdAt);
+
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_endpointid` ON `webhook_deliveries` (endpointId);
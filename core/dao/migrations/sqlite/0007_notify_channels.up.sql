@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS `notify_channels` (
+id varchar(64) PRIMARY KEY NOT NULL,
+username varchar(255) NOT NULL DEFAULT '',
+name varchar(255) NOT NULL DEFAULT '',
+type varchar(32) NOT NULL DEFAULT '',
+target varchar(1024) NOT NULL DEFAULT '',
+secret varchar(255) NOT NULL DEFAULT '',
+severities varchar(255) NOT NULL DEFAULT '',
+template text NOT NULL DEFAULT '',
+quietStart varchar(5) NOT NULL DEFAULT '',
+quietEnd varchar(5) NOT NULL DEFAULT '',
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS `idx_notify_channels_username` ON `notify_channels` (username);
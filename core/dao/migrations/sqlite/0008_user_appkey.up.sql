@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS `idx_user_appkey` ON `user` (appKey);
@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS `api_keys` (
+id varchar(64) PRIMARY KEY NOT NULL,
+username varchar(255) NOT NULL DEFAULT '',
+name varchar(255) NOT NULL DEFAULT '',
+appKey varchar(64) NOT NULL DEFAULT '',
+secretHash varchar(64) NOT NULL DEFAULT '',
+previousSecretHash varchar(64) NOT NULL DEFAULT '',
+previousExpiresAt datetime NULL DEFAULT NULL,
+scopes varchar(255) NOT NULL DEFAULT '',
+expiresAt datetime NULL DEFAULT NULL,
+lastUsedAt datetime NULL DEFAULT NULL,
+lastUsedIp varchar(64) NOT NULL DEFAULT '',
+revokedAt datetime NULL DEFAULT NULL,
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS `uniq_api_keys_appkey` ON `api_keys` (appKey);
+CREATE INDEX IF NOT EXISTS `idx_api_keys_username` ON `api_keys` (username);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `user_sessions` (
+id varchar(64) PRIMARY KEY NOT NULL,
+username varchar(255) NOT NULL DEFAULT '',
+refreshTokenHash varchar(64) NOT NULL DEFAULT '',
+previousTokenHash varchar(64) NOT NULL DEFAULT '',
+userAgent varchar(512) NOT NULL DEFAULT '',
+ip varchar(64) NOT NULL DEFAULT '',
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+lastSeenAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+expiresAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+revokedAt datetime NULL DEFAULT NULL
+);
+
+CREATE INDEX IF NOT EXISTS `idx_user_sessions_username` ON `user_sessions` (username);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `user_backup_codes`;
+DROP TABLE IF EXISTS `user_totp`;
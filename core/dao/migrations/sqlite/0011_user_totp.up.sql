@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS `user_totp` (
+username varchar(255) PRIMARY KEY NOT NULL,
+secret varchar(64) NOT NULL DEFAULT '',
+confirmedAt datetime NULL DEFAULT NULL,
+lastStep integer NOT NULL DEFAULT 0,
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+updatedAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS `user_backup_codes` (
+id varchar(64) PRIMARY KEY NOT NULL,
+username varchar(255) NOT NULL DEFAULT '',
+codeHash varchar(64) NOT NULL DEFAULT '',
+usedAt datetime NULL DEFAULT NULL,
+createdAt datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS `idx_user_backup_codes_username` ON `user_backup_codes` (username);
@@ -0,0 +1,5 @@
+ALTER TABLE `api_keys` ADD COLUMN secret varchar(255) NOT NULL DEFAULT '';
+ALTER TABLE `api_keys` ADD COLUMN previousSecret varchar(255) NOT NULL DEFAULT '';
+UPDATE `api_keys` SET revokedAt = CURRENT_TIMESTAMP WHERE revokedAt IS NULL;
+ALTER TABLE `api_keys` DROP COLUMN secretHash;
+ALTER TABLE `api_keys` DROP COLUMN previousSecretHash;
@@ -0,0 +1,71 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+)
+
+func (s *SQLStore) CreateNotifyChannel(ctx context.Context, channel *model.NotifyChannel) error {
+	query := `INSERT INTO notify_channels(id, username, name, type, target, secret, severities, template, quietStart, quietEnd, createdAt, updatedAt)
+		VALUES(:id, :username, :name, :type, :target, :secret, :severities, :template, :quietStart, :quietEnd, :createdAt, :updatedAt)`
+
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), channel)
+	return err
+}
+
+// UpdateNotifyChannel returns sql.ErrNoRows when the user has no such channel.
+func (s *SQLStore) UpdateNotifyChannel(ctx context.Context, channel *model.NotifyChannel) error {
+	query := `UPDATE notify_channels SET name = :name, type = :type, target = :target, secret = :secret, severities = :severities,
+		template = :template, quietStart = :quietStart, quietEnd = :quietEnd, updatedAt = :updatedAt WHERE id = :id and username = :username`
+
+	result, err := s.db.NamedExecContext(ctx, s.rebind(query), channel)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *SQLStore) GetNotifyChannels(ctx context.Context, username string) ([]*model.NotifyChannel, error) {
+	var out []*model.NotifyChannel
+	query := `select * from notify_channels where username = ? order by createdAt, id`
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// GetNotifyChannel returns sql.ErrNoRows when the user has no such channel.
+func (s *SQLStore) GetNotifyChannel(ctx context.Context, username, id string) (*model.NotifyChannel, error) {
+	var out model.NotifyChannel
+	query := `select * from notify_channels where username = ? and id = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), username, id).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// DeleteNotifyChannel returns sql.ErrNoRows when the user has no such channel.
+func (s *SQLStore) DeleteNotifyChannel(ctx context.Context, username, id string) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(`delete from notify_channels where username = ? and id = ?`), username, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
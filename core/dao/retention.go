@@ -0,0 +1,160 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"strings"
+	"time"
+)
+
+const (
+	RetentionTableBandwidth = "box_bandwidth"
+	RetentionTableQuality   = "box_quality"
+	RetentionTableIncome    = "box_income"
+)
+
+// RetentionTables lists the time-series tables whose rows expire.
+var RetentionTables = []string{RetentionTableBandwidth, RetentionTableQuality, RetentionTableIncome}
+
+// retentionColumns maps the time-series tables to the column their rows expire by.
+var retentionColumns = map[string]string{
+	RetentionTableBandwidth: "time",
+	RetentionTableQuality:   "time",
+	RetentionTableIncome:    "date",
+}
+
+func IsRetentionTable(table string) bool {
+	_, ok := retentionColumns[table]
+	return ok
+}
+
+// retentionDeleteSize bounds the rows of one delete, to stay below the bind variable limits of the databases.
+const retentionDeleteSize = 500
+
+// ExpiredRows is a batch of expired rows of a time-series table, ordered by time then box.
+type ExpiredRows struct {
+	Table string
+	// Rows hold *model.BoxBandwidth, *model.BoxQuality or *model.BoxIncome depending on the table.
+	Rows []interface{}
+}
+
+// expiredRowKey returns the box and the time, or the date, which identify a row of the batch.
+func expiredRowKey(row interface{}) (string, interface{}) {
+	switch r := row.(type) {
+	case *model.BoxBandwidth:
+		return r.BoxId, r.Time
+	case *model.BoxQuality:
+		return r.BoxId, r.Time
+	case *model.BoxIncome:
+		return r.BoxId, r.Date
+	}
+	return "", nil
+}
+
+// retentionCutoff returns the column and the value the rows of the table older than cutoff are compared to.
+func retentionCutoff(table string, cutoff time.Time) (string, interface{}, error) {
+	column, ok := retentionColumns[table]
+	if !ok {
+		return "", nil, fmt.Errorf("invalid retention table: %s", table)
+	}
+
+	if column == "date" {
+		return column, cutoff.Format(time.DateOnly), nil
+	}
+	return column, cutoff.Unix(), nil
+}
+
+// CountExpiredRows returns the number of rows of the table older than cutoff.
+func (s *SQLStore) CountExpiredRows(ctx context.Context, table string, cutoff time.Time) (int64, error) {
+	column, before, err := retentionCutoff(table, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	query := fmt.Sprintf(`select count(*) from %s where %s < ?`, table, column)
+
+	var count int64
+	if err := s.db.GetContext(ctx, &count, s.rebind(query), before); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// GetExpiredRows returns the oldest rows of the table older than cutoff, at most limit.
+func (s *SQLStore) GetExpiredRows(ctx context.Context, table string, cutoff time.Time, limit int) (*ExpiredRows, error) {
+	column, before, err := retentionCutoff(table, cutoff)
+	if err != nil {
+		return nil, err
+	}
+
+	query := s.rebind(fmt.Sprintf(`select * from %s where %s < ? order by %s, boxId limit ?`, table, column, column))
+
+	out := &ExpiredRows{Table: table}
+	switch table {
+	case RetentionTableBandwidth:
+		var rows []*model.BoxBandwidth
+		if err := s.db.SelectContext(ctx, &rows, query, before, limit); err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			out.Rows = append(out.Rows, r)
+		}
+	case RetentionTableQuality:
+		var rows []*model.BoxQuality
+		if err := s.db.SelectContext(ctx, &rows, query, before, limit); err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			out.Rows = append(out.Rows, r)
+		}
+	case RetentionTableIncome:
+		var rows []*model.BoxIncome
+		if err := s.db.SelectContext(ctx, &rows, query, before, limit); err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			out.Rows = append(out.Rows, r)
+		}
+	}
+
+	return out, nil
+}
+
+// DeleteExpiredRows deletes the rows of the batch which are still older than cutoff, leaving alone the rows
+// written since the batch was read.
+func (s *SQLStore) DeleteExpiredRows(ctx context.Context, batch *ExpiredRows, cutoff time.Time) (int64, error) {
+	column, before, err := retentionCutoff(batch.Table, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for start := 0; start < len(batch.Rows); start += retentionDeleteSize {
+		rows := batch.Rows[start:min(start+retentionDeleteSize, len(batch.Rows))]
+
+		keys := make([]string, 0, len(rows))
+		args := []interface{}{before}
+		for _, row := range rows {
+			boxId, t := expiredRowKey(row)
+			keys = append(keys, `(?, ?)`)
+			args = append(args, boxId, t)
+		}
+
+		query := fmt.Sprintf(`delete from %s where %s < ? and (boxId, %s) in (%s)`, batch.Table, column, column, strings.Join(keys, ", "))
+
+		result, err := s.db.ExecContext(ctx, s.rebind(query), args...)
+		if err != nil {
+			return deleted, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,180 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/jmoiron/sqlx"
+	"time"
+)
+
+const (
+	GranularityRaw  = "raw"
+	GranularityHour = "hour"
+	GranularityDay  = "day"
+)
+
+// RollupGranularities lists the granularities kept in rollup tables, finest first.
+var RollupGranularities = []string{GranularityHour, GranularityDay}
+
+var (
+	// rollupPeriods maps the rollup granularities to the nominal length of their buckets in seconds, the
+	// days of the daylight saving changes being an hour shorter or longer.
+	rollupPeriods = map[string]int64{
+		GranularityHour: 3600,
+		GranularityDay:  86400,
+	}
+
+	rollupTableSuffixes = map[string]string{
+		GranularityHour: "hourly",
+		GranularityDay:  "daily",
+	}
+)
+
+func IsValidGranularity(granularity string) bool {
+	return granularity == GranularityRaw || rollupPeriods[granularity] > 0
+}
+
+// RollupBucket returns the start of the bucket of the granularity holding t. The buckets follow the local
+// time, the days starting at the local midnight like the daily incomes.
+func RollupBucket(granularity string, t int64) int64 {
+	lt := time.Unix(t, 0)
+	switch granularity {
+	case GranularityHour:
+		_, offset := lt.Zone()
+		return t - (t+int64(offset))%rollupPeriods[granularity]
+	case GranularityDay:
+		return time.Date(lt.Year(), lt.Month(), lt.Day(), 0, 0, 0, 0, time.Local).Unix()
+	}
+	return t
+}
+
+// RollupBucketEnd returns the start of the bucket following the one of the granularity holding t, t itself
+// for the raw points.
+func RollupBucketEnd(granularity string, t int64) int64 {
+	if granularity == GranularityDay {
+		lt := time.Unix(t, 0)
+		return time.Date(lt.Year(), lt.Month(), lt.Day()+1, 0, 0, 0, 0, time.Local).Unix()
+	}
+	return RollupBucket(granularity, t) + rollupPeriods[granularity]
+}
+
+func rollupTable(series, granularity string) (string, error) {
+	suffix, ok := rollupTableSuffixes[granularity]
+	if !ok {
+		return "", fmt.Errorf("invalid rollup granularity: %s", granularity)
+	}
+	return series + "_" + suffix, nil
+}
+
+// seriesWhere builds the where clause shared by the bandwidth and quality queries.
+func seriesWhere(username string, boxIds, supplierBoxIds []string, start, end int64) (string, []interface{}, error) {
+	var (
+		where = `where username = ? and time >= ? and time <= ? `
+		args  = []interface{}{username, start, end}
+	)
+
+	if len(boxIds) > 0 {
+		boxQuery, boxArgs, err := sqlx.In(` and boxId in (?)`, boxIds)
+		if err != nil {
+			return "", nil, err
+		}
+		where += boxQuery
+		args = append(args, boxArgs...)
+	}
+
+	if len(supplierBoxIds) > 0 {
+		supplierQuery, supplierArgs, err := sqlx.In(` and supplierBoxId in (?)`, supplierBoxIds)
+		if err != nil {
+			return "", nil, err
+		}
+		where += supplierQuery
+		args = append(args, supplierArgs...)
+	}
+
+	return where, args, nil
+}
+
+func (s *SQLStore) BulkUpsertBoxBandwidthRollups(ctx context.Context, granularity string, rollups []*model.BoxBandwidthRollup) error {
+	table, err := rollupTable("box_bandwidth", granularity)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO %s(username, boxId, supplierBoxId, time, samples, uploadAvg, uploadMax, uploadMin, uploadP95,
+		downloadAvg, downloadMax, downloadMin, downloadP95, updatedAt)
+	VALUES(:username, :boxId, :supplierBoxId, :time, :samples, :uploadAvg, :uploadMax, :uploadMin, :uploadP95,
+		:downloadAvg, :downloadMax, :downloadMin, :downloadP95, %s)`
+
+	query = fmt.Sprintf(query, table, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId", "time"},
+		"samples", "uploadAvg", "uploadMax", "uploadMin", "uploadP95", "downloadAvg", "downloadMax", "downloadMin", "downloadP95", "updatedAt")
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), rollups); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SQLStore) BulkUpsertBoxQualityRollups(ctx context.Context, granularity string, rollups []*model.BoxQualityRollup) error {
+	table, err := rollupTable("box_quality", granularity)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO %s(username, boxId, supplierBoxId, time, samples, packetLossAvg, cpuUsageAvg, memoryUsageAvg, diskUsageAvg, updatedAt)
+	VALUES(:username, :boxId, :supplierBoxId, :time, :samples, :packetLossAvg, :cpuUsageAvg, :memoryUsageAvg, :diskUsageAvg, %s)`
+
+	query = fmt.Sprintf(query, table, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId", "time"},
+		"samples", "packetLossAvg", "cpuUsageAvg", "memoryUsageAvg", "diskUsageAvg", "updatedAt")
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), rollups); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetBoxBandwidthRollups returns the rollups of the buckets overlapping the start ~ end range.
+func (s *SQLStore) GetBoxBandwidthRollups(ctx context.Context, granularity, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidthRollup, error) {
+	table, err := rollupTable("box_bandwidth", granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args, err := seriesWhere(username, boxIds, supplierBoxIds, RollupBucket(granularity, start), end)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `select * from ` + table + ` ` + where + ` order by boxId, time`
+
+	var out []*model.BoxBandwidthRollup
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// GetBoxQualityRollups returns the rollups of the buckets overlapping the start ~ end range.
+func (s *SQLStore) GetBoxQualityRollups(ctx context.Context, granularity, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQualityRollup, error) {
+	table, err := rollupTable("box_quality", granularity)
+	if err != nil {
+		return nil, err
+	}
+
+	where, args, err := seriesWhere(username, boxIds, supplierBoxIds, RollupBucket(granularity, start), end)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `select * from ` + table + ` ` + where + ` order by boxId, time`
+
+	var out []*model.BoxQualityRollup
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
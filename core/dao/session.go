@@ -0,0 +1,85 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"time"
+)
+
+func (s *SQLStore) CreateSession(ctx context.Context, session *model.Session) error {
+	query := `INSERT INTO user_sessions(id, username, refreshTokenHash, previousTokenHash, userAgent, ip, createdAt, lastSeenAt, expiresAt, revokedAt)
+		VALUES(:id, :username, :refreshTokenHash, :previousTokenHash, :userAgent, :ip, :createdAt, :lastSeenAt, :expiresAt, :revokedAt)`
+
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), session)
+	return err
+}
+
+// GetSession returns sql.ErrNoRows when the session does not exist.
+func (s *SQLStore) GetSession(ctx context.Context, id string) (*model.Session, error) {
+	var out model.Session
+	query := `select * from user_sessions where id = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), id).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// GetActiveSessions returns the sessions of the user neither revoked nor expired at now, the last seen first.
+func (s *SQLStore) GetActiveSessions(ctx context.Context, username string, now time.Time) ([]*model.Session, error) {
+	var out []*model.Session
+	query := `select * from user_sessions where username = ? and revokedAt is null and expiresAt > ? order by lastSeenAt desc, id`
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username, now); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// RotateSession saves the new refresh token of the session unless its token is no longer oldHash, or the
+// session was revoked meanwhile, in which case it returns sql.ErrNoRows.
+func (s *SQLStore) RotateSession(ctx context.Context, session *model.Session, oldHash string) error {
+	query := `UPDATE user_sessions SET refreshTokenHash = ?, previousTokenHash = ?, userAgent = ?, ip = ?, lastSeenAt = ?, expiresAt = ?
+		WHERE id = ? and refreshTokenHash = ? and revokedAt is null`
+
+	result, err := s.db.ExecContext(ctx, s.rebind(query), session.RefreshTokenHash, session.PreviousTokenHash, session.UserAgent,
+		session.Ip, session.LastSeenAt, session.ExpiresAt, session.Id, oldHash)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeSession returns sql.ErrNoRows when the user has no such session left to revoke.
+func (s *SQLStore) RevokeSession(ctx context.Context, username, id string, at time.Time) error {
+	query := `UPDATE user_sessions SET revokedAt = ? WHERE username = ? and id = ? and revokedAt is null`
+
+	result, err := s.db.ExecContext(ctx, s.rebind(query), at, username, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes every session of the user but the one of exceptId, which may be empty.
+func (s *SQLStore) RevokeUserSessions(ctx context.Context, username, exceptId string, at time.Time) error {
+	query := `UPDATE user_sessions SET revokedAt = ? WHERE username = ? and id <> ? and revokedAt is null`
+
+	_, err := s.db.ExecContext(ctx, s.rebind(query), at, username, exceptId)
+	return err
+}
@@ -0,0 +1,182 @@
+package dao
+
+import (
+	"context"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"time"
+)
+
+// BoxStore keeps the boxes of the PaiNet accounts along with their disks, the log of their changes and
+// their online intervals.
+type BoxStore interface {
+	BulkUpsertBoxes(ctx context.Context, boxes []*model.Box) error
+	BulkUpsertBoxDiskInfo(ctx context.Context, diskInfo []*model.DiskInfo) error
+	GetBoxesList(ctx context.Context, username string, filter *BoxFilter, page, pageSize int64) (int64, []*model.Box, error)
+	AddBoxChanges(ctx context.Context, changes []*model.BoxChange) error
+	GetBoxHistory(ctx context.Context, username, boxId string, page, pageSize int64) (int64, []*model.BoxChange, error)
+	GetLatestBoxChanges(ctx context.Context, username, field string) ([]*model.BoxChange, error)
+	BulkUpsertBoxUptimes(ctx context.Context, uptimes []*model.BoxUptime) error
+	GetLatestBoxUptimes(ctx context.Context, boxIds []string) ([]*model.BoxUptime, error)
+	GetBoxUptimes(ctx context.Context, username string, boxIds []string, start, end int64) ([]*model.BoxUptime, error)
+	GetBoxUptimeTotals(ctx context.Context, username string, filter *BoxFilter, periods [][2]int64) ([]*UptimeTotals, error)
+}
+
+// IncomeStore keeps the daily income of the boxes.
+type IncomeStore interface {
+	BulkUpsertBoxDayIncome(ctx context.Context, incomes []*model.BoxIncome) error
+	GetBoxIncomeV2(ctx context.Context, username string, boxIds, remarks, supplierBoxIds []string, start, end string, page, pageSize int64) (int64, model.Decimal, []*model.BoxIncome, error)
+	GetBoxIncomeSummary(ctx context.Context, username string, incomeType int, now time.Time) (*model.IncomeSummary, error)
+}
+
+// MetricsStore keeps the bandwidth and quality series of the boxes, along with their hourly and daily rollups.
+type MetricsStore interface {
+	BulkUpsertBoxBandwidth(ctx context.Context, bandwidths []*model.BoxBandwidth) error
+	BulkUpsertBoxQualities(ctx context.Context, qualities []*model.BoxQuality) error
+	GetBoxBandwidth(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidth, error)
+	GetBoxQualities(ctx context.Context, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQuality, error)
+	BulkUpsertBoxBandwidthRollups(ctx context.Context, granularity string, rollups []*model.BoxBandwidthRollup) error
+	BulkUpsertBoxQualityRollups(ctx context.Context, granularity string, rollups []*model.BoxQualityRollup) error
+	GetBoxBandwidthRollups(ctx context.Context, granularity, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxBandwidthRollup, error)
+	GetBoxQualityRollups(ctx context.Context, granularity, username string, boxIds, supplierBoxIds []string, start, end int64) ([]*model.BoxQualityRollup, error)
+}
+
+// RetentionStore expires the old rows of the time-series tables, in batches ordered by time.
+type RetentionStore interface {
+	CountExpiredRows(ctx context.Context, table string, cutoff time.Time) (int64, error)
+	GetExpiredRows(ctx context.Context, table string, cutoff time.Time, limit int) (*ExpiredRows, error)
+	DeleteExpiredRows(ctx context.Context, batch *ExpiredRows, cutoff time.Time) (int64, error)
+}
+
+// AlertStore keeps the alerts raised by the alert rules.
+type AlertStore interface {
+	SaveAlerts(ctx context.Context, alerts []*model.Alert) error
+	GetAlerts(ctx context.Context, username string, filter *AlertFilter, page, pageSize int64) (int64, []*model.Alert, error)
+	GetFiringAlerts(ctx context.Context, username string) ([]*model.Alert, error)
+}
+
+// WebhookStore keeps the webhook endpoints of the users and the outbox of the deliveries to them.
+type WebhookStore interface {
+	CreateWebhookEndpoint(ctx context.Context, endpoint *model.WebhookEndpoint) error
+	GetWebhookEndpoints(ctx context.Context, username string) ([]*model.WebhookEndpoint, error)
+	GetWebhookEndpoint(ctx context.Context, id string) (*model.WebhookEndpoint, error)
+	DeleteWebhookEndpoint(ctx context.Context, username, id string) error
+	AddWebhookDeliveries(ctx context.Context, deliveries []*model.WebhookDelivery) error
+	UpdateWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error
+	GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*model.WebhookDelivery, error)
+	GetWebhookDeliveries(ctx context.Context, username string, filter *WebhookDeliveryFilter, page, pageSize int64) (int64, []*model.WebhookDelivery, error)
+	GetWebhookDelivery(ctx context.Context, username, id string) (*model.WebhookDelivery, error)
+}
+
+// NotifyChannelStore keeps the chat and email channels the users receive their alerts on.
+type NotifyChannelStore interface {
+	CreateNotifyChannel(ctx context.Context, channel *model.NotifyChannel) error
+	UpdateNotifyChannel(ctx context.Context, channel *model.NotifyChannel) error
+	GetNotifyChannels(ctx context.Context, username string) ([]*model.NotifyChannel, error)
+	GetNotifyChannel(ctx context.Context, username, id string) (*model.NotifyChannel, error)
+	DeleteNotifyChannel(ctx context.Context, username, id string) error
+}
+
+// APIKeyStore keeps the named keys the users create for their machine clients.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, key *model.APIKey) error
+	UpdateAPIKey(ctx context.Context, key *model.APIKey) error
+	TouchAPIKey(ctx context.Context, id string, at time.Time, ip string) error
+	GetAPIKeys(ctx context.Context, username string) ([]*model.APIKey, error)
+	GetAPIKey(ctx context.Context, username, id string) (*model.APIKey, error)
+	GetAPIKeyByAppKey(ctx context.Context, appKey string) (*model.APIKey, error)
+}
+
+// SessionStore keeps the login sessions of the users, the revoked ones reject their access tokens.
+type SessionStore interface {
+	CreateSession(ctx context.Context, session *model.Session) error
+	GetSession(ctx context.Context, id string) (*model.Session, error)
+	GetActiveSessions(ctx context.Context, username string, now time.Time) ([]*model.Session, error)
+	RotateSession(ctx context.Context, session *model.Session, oldHash string) error
+	RevokeSession(ctx context.Context, username, id string, at time.Time) error
+	RevokeUserSessions(ctx context.Context, username, exceptId string, at time.Time) error
+}
+
+// TOTPStore keeps the TOTP secrets and the backup codes of the second factor of the users.
+type TOTPStore interface {
+	CreateUserTOTP(ctx context.Context, totp *model.UserTOTP) error
+	GetUserTOTP(ctx context.Context, username string) (*model.UserTOTP, error)
+	EnableUserTOTP(ctx context.Context, username string, step int64, at time.Time, codes []*model.BackupCode) error
+	UseTOTPStep(ctx context.Context, username string, step int64) error
+	UseBackupCode(ctx context.Context, username, codeHash string, at time.Time) error
+	CountBackupCodes(ctx context.Context, username string) (int64, error)
+	DeleteUserTOTP(ctx context.Context, username string) error
+}
+
+// UserStore keeps the users of the api and the PaiNet accounts bound to them.
+type UserStore interface {
+	CreateUser(ctx context.Context, user *model.User) error
+	GetUserByUsername(ctx context.Context, username string) (*model.User, error)
+	GetUsersWithAppKey(ctx context.Context) ([]*model.User, error)
+	ClearUserAppKey(ctx context.Context, username string) error
+	UpdateUserPassword(ctx context.Context, username, password string) error
+	GetUserKeys(ctx context.Context) ([]*model.PaiNetInfo, error)
+	GetUserKeyByAPIKey(ctx context.Context, key string) (*model.PaiNetInfo, error)
+	GetPaiNetInfoByUsername(ctx context.Context, username string) (*model.PaiNetInfo, error)
+}
+
+// CheckpointStore keeps the progress of the history syncs.
+type CheckpointStore interface {
+	UpsertSyncCheckpoint(ctx context.Context, checkpoint *model.SyncCheckpoint) error
+	GetSyncCheckpoint(ctx context.Context, paiUsername, dataType, windowStart, windowEnd string) (*model.SyncCheckpoint, error)
+	GetSyncCheckpoints(ctx context.Context, paiUsername, dataType string) ([]*model.SyncCheckpoint, error)
+}
+
+// Store is implemented by the backends holding every kind of data, such as SQLStore and MemoryStore.
+type Store interface {
+	BoxStore
+	IncomeStore
+	MetricsStore
+	RetentionStore
+	AlertStore
+	WebhookStore
+	NotifyChannelStore
+	APIKeyStore
+	SessionStore
+	TOTPStore
+	UserStore
+	CheckpointStore
+}
+
+var (
+	_ Store = (*SQLStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// Stores are the repositories injected into the api handlers and the data service.
+type Stores struct {
+	Boxes       BoxStore
+	Incomes     IncomeStore
+	Metrics     MetricsStore
+	Retention   RetentionStore
+	Alerts      AlertStore
+	Webhooks    WebhookStore
+	Channels    NotifyChannelStore
+	APIKeys     APIKeyStore
+	Sessions    SessionStore
+	TOTP        TOTPStore
+	Users       UserStore
+	Checkpoints CheckpointStore
+}
+
+// NewStores uses s for every repository.
+func NewStores(s Store) *Stores {
+	return &Stores{
+		Boxes:       s,
+		Incomes:     s,
+		Metrics:     s,
+		Retention:   s,
+		Alerts:      s,
+		Webhooks:    s,
+		Channels:    s,
+		APIKeys:     s,
+		Sessions:    s,
+		TOTP:        s,
+		Users:       s,
+		Checkpoints: s,
+	}
+}
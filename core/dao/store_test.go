@@ -0,0 +1,504 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// forEachStore runs the test against a new MemoryStore and a new migrated SQLite SQLStore, which must
+// behave the same.
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) Store
+	}{
+		{"memory", func(t *testing.T) Store { return NewMemoryStore() }},
+		{"sqlite", func(t *testing.T) Store {
+			s, err := Open("sqlite://" + filepath.Join(t.TempDir(), "store.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.Migrate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			t.Cleanup(func() { s.db.Close() })
+			return s
+		}},
+	}
+
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			test(t, st.open(t))
+		})
+	}
+}
+
+func boxIdsOf(boxes []*model.Box) []string {
+	ids := make([]string, 0, len(boxes))
+	for _, b := range boxes {
+		ids = append(ids, b.BoxId)
+	}
+	return ids
+}
+
+func TestGetBoxesList(t *testing.T) {
+	boxes := []*model.Box{
+		{Username: "u", BoxId: "b-1", SupplierBoxId: "s-1", Online: "1", Isp: "电信", Province: "广东", Remark: "room-a", Upload: 30},
+		{Username: "u", BoxId: "b-2", SupplierBoxId: "s-2", Online: "0", Isp: "联通", Province: "广东", Remark: "room-b", Upload: 10},
+		{Username: "u", BoxId: "b-10", SupplierBoxId: "s-10", Online: "1", Isp: "电信", Province: "浙江", Remark: "50%_off", Upload: 30},
+		{Username: "u", BoxId: "c-1", SupplierBoxId: "s-3", Online: "1", Isp: "移动", Province: "浙江", Remark: "", Upload: 20},
+		{Username: "v", BoxId: "b-3", SupplierBoxId: "s-4", Online: "1", Isp: "电信", Province: "广东", Remark: "room-a", Upload: 40},
+	}
+
+	cases := []struct {
+		name           string
+		filter         *BoxFilter
+		page, pageSize int64
+		wantTotal      int64
+		wantIds        []string
+	}{
+		{name: "no filter", wantTotal: 4, wantIds: []string{"b-1", "b-10", "b-2", "c-1"}},
+		{name: "exact box ids", filter: &BoxFilter{BoxIds: []string{"b-1", "b-3"}}, wantTotal: 1, wantIds: []string{"b-1"}},
+		{name: "box id prefix", filter: &BoxFilter{BoxIds: []string{"b-1"}, Fuzzy: true}, wantTotal: 2, wantIds: []string{"b-1", "b-10"}},
+		{name: "supplier box ids", filter: &BoxFilter{SupplierBoxIds: []string{"s-2", "s-3"}}, wantTotal: 2, wantIds: []string{"b-2", "c-1"}},
+		{name: "remark substring", filter: &BoxFilter{Remarks: []string{"room"}, Fuzzy: true}, wantTotal: 2, wantIds: []string{"b-1", "b-2"}},
+		{name: "remark wildcards are literal", filter: &BoxFilter{Remarks: []string{"%_"}, Fuzzy: true}, wantTotal: 1, wantIds: []string{"b-10"}},
+		{name: "isp and online", filter: &BoxFilter{Isp: []string{"电信", "移动"}, Online: []string{"1"}}, wantTotal: 3, wantIds: []string{"b-1", "b-10", "c-1"}},
+		{name: "province", filter: &BoxFilter{Province: []string{"广东"}}, wantTotal: 2, wantIds: []string{"b-1", "b-2"}},
+		{name: "box id desc", filter: &BoxFilter{Order: "desc"}, wantTotal: 4, wantIds: []string{"c-1", "b-2", "b-10", "b-1"}},
+		{name: "ties ordered by box id", filter: &BoxFilter{OrderField: "upload", Order: "desc"}, wantTotal: 4, wantIds: []string{"b-1", "b-10", "c-1", "b-2"}},
+		{name: "second page", filter: &BoxFilter{OrderField: "upload"}, page: 2, pageSize: 2, wantTotal: 4, wantIds: []string{"b-1", "b-10"}},
+		{name: "past the last page", page: 3, pageSize: 2, wantTotal: 4, wantIds: []string{}},
+	}
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if err := s.BulkUpsertBoxes(ctx, boxes); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range cases {
+			page, pageSize := c.page, c.pageSize
+			if page == 0 {
+				page, pageSize = 1, 10
+			}
+
+			total, got, err := s.GetBoxesList(ctx, "u", c.filter, page, pageSize)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+
+			if total != c.wantTotal || !reflect.DeepEqual(boxIdsOf(got), c.wantIds) {
+				t.Errorf("%s: got %v (total %d), want %v (total %d)", c.name, boxIdsOf(got), total, c.wantIds, c.wantTotal)
+			}
+		}
+	})
+}
+
+func mustDecimal(t *testing.T, s string) model.Decimal {
+	t.Helper()
+
+	d, err := model.ParseDecimal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestGetBoxIncomeSummary(t *testing.T) {
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.Local)
+
+	income := func(username, boxId, date, remark, bwAmount, activity string) *model.BoxIncome {
+		bw, act := mustDecimal(t, bwAmount), mustDecimal(t, activity)
+		return &model.BoxIncome{
+			Username: username, BoxId: boxId, SupplierBoxId: "s-" + boxId, Date: model.Date(date), Remark: remark,
+			Amount: bw + act, BwAmount: bw, ActivityIncome: act,
+		}
+	}
+
+	incomes := []*model.BoxIncome{
+		income("u", "b-1", "2024-05-15", "a", "0.1", "0.2"),
+		income("u", "b-2", "2024-05-15", "b", "0.1", "0"),
+		income("u", "b-1", "2024-05-14", "a", "1.0001", "0"),
+		income("u", "b-1", "2024-05-02", "a", "2", "0.5"),
+		income("u", "b-2", "2024-04-30", "b", "10", "0"),
+		income("u", "b-2", "2024-04-01", "b", "0.3", "0.3"),
+		income("u", "b-1", "2024-03-31", "a", "100", "0"),
+		income("v", "b-3", "2024-05-15", "a", "1000", "0"),
+	}
+
+	periods := func(today, yesterday, thisMonth, lastMonth, total string) model.IncomePeriods {
+		return model.IncomePeriods{
+			Today: mustDecimal(t, today), Yesterday: mustDecimal(t, yesterday), ThisMonth: mustDecimal(t, thisMonth),
+			LastMonth: mustDecimal(t, lastMonth), Total: mustDecimal(t, total),
+		}
+	}
+
+	cases := []struct {
+		name       string
+		incomeType int
+		want       model.IncomePeriods
+		wantRemark []string
+	}{
+		{name: "total", incomeType: IncomeTypeTotal, want: periods("0.4", "1.0001", "3.9001", "10.6", "114.5001"), wantRemark: []string{"a", "b"}},
+		{name: "bandwidth", incomeType: IncomeTypeBandwidth, want: periods("0.2", "1.0001", "3.2001", "10.3", "113.5001"), wantRemark: []string{"a", "b"}},
+		{name: "activity", incomeType: IncomeTypeActivity, want: periods("0.2", "0", "0.7", "0.3", "1"), wantRemark: []string{"a", "b"}},
+	}
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		if err := s.BulkUpsertBoxDayIncome(ctx, incomes); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range cases {
+			got, err := s.GetBoxIncomeSummary(ctx, "u", c.incomeType, now)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+
+			if got.IncomePeriods != c.want {
+				t.Errorf("%s: periods = %+v, want %+v", c.name, got.IncomePeriods, c.want)
+			}
+
+			var remarks []string
+			var remarksTotal model.Decimal
+			for _, r := range got.Remarks {
+				remarks = append(remarks, r.Remark)
+				remarksTotal += r.Total
+			}
+
+			if !reflect.DeepEqual(remarks, c.wantRemark) || remarksTotal != c.want.Total {
+				t.Errorf("%s: remarks %v sum to %s, want %v summing to %s", c.name, remarks, remarksTotal, c.wantRemark, c.want.Total)
+			}
+
+			if len(got.IncomeTypes) != 3 {
+				t.Fatalf("%s: %d income types, want 3", c.name, len(got.IncomeTypes))
+			}
+
+			for _, it := range got.IncomeTypes {
+				if it.IncomeType == c.incomeType && it.IncomePeriods != c.want {
+					t.Errorf("%s: income type %d periods = %+v, want %+v", c.name, it.IncomeType, it.IncomePeriods, c.want)
+				}
+			}
+		}
+
+		if _, err := s.GetBoxIncomeSummary(ctx, "u", 9, now); err == nil {
+			t.Error("invalid income type: no error")
+		}
+	})
+}
+
+func TestBoxUptimes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+
+		boxes := []*model.Box{
+			{Username: "u", BoxId: "a", Isp: "x"},
+			{Username: "u", BoxId: "b", Isp: "y"},
+			{Username: "v", BoxId: "c", Isp: "x"},
+		}
+		if err := s.BulkUpsertBoxes(ctx, boxes); err != nil {
+			t.Fatal(err)
+		}
+
+		uptimes := []*model.BoxUptime{
+			{Username: "u", BoxId: "a", Online: true, StartTime: 0, EndTime: 50},
+			{Username: "u", BoxId: "a", Online: false, StartTime: 100, EndTime: 150},
+			{Username: "u", BoxId: "a", Online: true, StartTime: 150, EndTime: 200},
+			{Username: "u", BoxId: "b", Online: false, StartTime: 50, EndTime: 250},
+			{Username: "v", BoxId: "c", Online: false, StartTime: 0, EndTime: 300},
+		}
+		if err := s.BulkUpsertBoxUptimes(ctx, uptimes); err != nil {
+			t.Fatal(err)
+		}
+
+		// extending the interval of a box replaces it, keyed by its box and start.
+		extended := []*model.BoxUptime{
+			{Username: "u", BoxId: "a", Online: true, StartTime: 150, EndTime: 300},
+			{Username: "u", BoxId: "a", Online: true, StartTime: 0, EndTime: 100},
+		}
+		if err := s.BulkUpsertBoxUptimes(ctx, extended); err != nil {
+			t.Fatal(err)
+		}
+
+		latest, err := s.GetLatestBoxUptimes(ctx, []string{"a", "b", "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		latestByBox := make(map[string]model.Timestamp)
+		for _, u := range latest {
+			latestByBox[u.BoxId] = u.EndTime
+		}
+
+		if want := map[string]model.Timestamp{"a": 300, "b": 250}; !reflect.DeepEqual(latestByBox, want) {
+			t.Errorf("latest uptimes end at %v, want %v", latestByBox, want)
+		}
+
+		rangeCases := []struct {
+			name       string
+			boxIds     []string
+			start, end int64
+			want       [][2]model.Timestamp
+		}{
+			{name: "all of a", boxIds: []string{"a"}, start: 0, end: 1000, want: [][2]model.Timestamp{{0, 100}, {100, 150}, {150, 300}}},
+			{name: "overlapping", boxIds: []string{"a", "b"}, start: 120, end: 160, want: [][2]model.Timestamp{{100, 150}, {150, 300}, {50, 250}}},
+			{name: "bounds exclusive", boxIds: []string{"a"}, start: 100, end: 150, want: [][2]model.Timestamp{{100, 150}}},
+			{name: "other user", boxIds: []string{"c"}, start: 0, end: 1000, want: nil},
+			{name: "no boxes", start: 0, end: 1000, want: nil},
+		}
+
+		for _, c := range rangeCases {
+			got, err := s.GetBoxUptimes(ctx, "u", c.boxIds, c.start, c.end)
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+
+			var intervals [][2]model.Timestamp
+			for _, u := range got {
+				intervals = append(intervals, [2]model.Timestamp{u.StartTime, u.EndTime})
+			}
+
+			if !reflect.DeepEqual(intervals, c.want) {
+				t.Errorf("%s: intervals = %v, want %v", c.name, intervals, c.want)
+			}
+		}
+
+		totalsCases := []struct {
+			name   string
+			filter *BoxFilter
+			want   []UptimeTotals
+		}{
+			{name: "fleet", want: []UptimeTotals{{250, 250, 2, 200}, {60, 120, 2, 90}}},
+			{name: "filtered", filter: &BoxFilter{Isp: []string{"x"}}, want: []UptimeTotals{{250, 50, 1, 50}, {60, 30, 1, 30}}},
+		}
+
+		for _, c := range totalsCases {
+			got, err := s.GetBoxUptimeTotals(ctx, "u", c.filter, [][2]int64{{0, 300}, {120, 210}})
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+
+			var totals []UptimeTotals
+			for _, g := range got {
+				totals = append(totals, *g)
+			}
+
+			if !reflect.DeepEqual(totals, c.want) {
+				t.Errorf("%s: totals = %+v, want %+v", c.name, totals, c.want)
+			}
+		}
+	})
+}
+
+func TestAPIKeyLookups(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	keys := []*model.APIKey{
+		{Id: "k1", Username: "u", Name: "ci", AppKey: "ak-1", Secret: "sealed-1", Scopes: "box:read", CreatedAt: now, UpdatedAt: now},
+		{Id: "k2", Username: "u", Name: "ops", AppKey: "ak-2", Secret: "sealed-2", Scopes: "box:read,box:write", CreatedAt: now.Add(time.Second), UpdatedAt: now},
+		{Id: "k3", Username: "v", Name: "ci", AppKey: "ak-3", Secret: "sealed-3", Scopes: "income:read", CreatedAt: now, UpdatedAt: now},
+	}
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		for _, k := range keys {
+			if err := s.CreateAPIKey(ctx, k); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		lookups := []struct {
+			name     string
+			lookup   func() (*model.APIKey, error)
+			wantId   string
+			notFound bool
+		}{
+			{name: "by app key", lookup: func() (*model.APIKey, error) { return s.GetAPIKeyByAppKey(ctx, "ak-2") }, wantId: "k2"},
+			{name: "unknown app key", lookup: func() (*model.APIKey, error) { return s.GetAPIKeyByAppKey(ctx, "ak-9") }, notFound: true},
+			{name: "by id", lookup: func() (*model.APIKey, error) { return s.GetAPIKey(ctx, "v", "k3") }, wantId: "k3"},
+			{name: "id of another user", lookup: func() (*model.APIKey, error) { return s.GetAPIKey(ctx, "u", "k3") }, notFound: true},
+		}
+
+		for _, c := range lookups {
+			got, err := c.lookup()
+			if c.notFound {
+				if !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("%s: error = %v, want sql.ErrNoRows", c.name, err)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("%s: %v", c.name, err)
+			}
+
+			if got.Id != c.wantId || got.Secret == "" || got.Scopes == "" {
+				t.Errorf("%s: got %+v, want key %s", c.name, got, c.wantId)
+			}
+		}
+
+		list, err := s.GetAPIKeys(ctx, "u")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ids []string
+		for _, k := range list {
+			ids = append(ids, k.Id)
+		}
+
+		if !reflect.DeepEqual(ids, []string{"k1", "k2"}) {
+			t.Errorf("keys of u = %v, want [k1 k2]", ids)
+		}
+
+		revoked := *keys[0]
+		revokedAt := now.Add(time.Minute)
+		revoked.RevokedAt = &revokedAt
+		if err := s.UpdateAPIKey(ctx, &revoked); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.TouchAPIKey(ctx, "k1", now.Add(2*time.Minute), "203.0.113.7"); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.GetAPIKeyByAppKey(ctx, "ak-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Status(now.Add(time.Hour)) != model.APIKeyStatusRevoked || got.LastUsedIp != "203.0.113.7" ||
+			got.LastUsedAt == nil || !got.LastUsedAt.Equal(now.Add(2*time.Minute)) {
+			t.Errorf("updated key = %+v, want revoked and last used from 203.0.113.7", got)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	session := func(id, username string, lastSeen, expires time.Duration) *model.Session {
+		return &model.Session{
+			Id: id, Username: username, RefreshTokenHash: "hash-" + id, UserAgent: "test", Ip: "203.0.113.1",
+			CreatedAt: now.Add(-time.Hour), LastSeenAt: now.Add(lastSeen), ExpiresAt: now.Add(expires),
+		}
+	}
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		ctx := context.Background()
+		for _, sess := range []*model.Session{
+			session("s1", "u", -3*time.Minute, time.Hour),
+			session("s2", "u", -time.Minute, time.Hour),
+			session("s3", "u", -2*time.Minute, -time.Second),
+			session("s4", "u", -4*time.Minute, time.Hour),
+			session("s5", "v", 0, time.Hour),
+		} {
+			if err := s.CreateSession(ctx, sess); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		active := func() []string {
+			t.Helper()
+
+			sessions, err := s.GetActiveSessions(ctx, "u", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, sess := range sessions {
+				ids = append(ids, sess.Id)
+			}
+			return ids
+		}
+
+		if got, want := active(), []string{"s2", "s1", "s4"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("active sessions = %v, want %v", got, want)
+		}
+
+		steps := []struct {
+			name    string
+			step    func() error
+			want    error
+			wantIds []string
+		}{
+			{
+				name: "rotate with a stale token",
+				step: func() error {
+					rotated := session("s1", "u", 0, 2*time.Hour)
+					rotated.RefreshTokenHash = "hash-s1-new"
+					return s.RotateSession(ctx, rotated, "hash-stale")
+				},
+				want:    sql.ErrNoRows,
+				wantIds: []string{"s2", "s1", "s4"},
+			},
+			{
+				name: "rotate",
+				step: func() error {
+					rotated := session("s1", "u", 0, 2*time.Hour)
+					rotated.RefreshTokenHash, rotated.PreviousTokenHash = "hash-s1-new", "hash-s1"
+					return s.RotateSession(ctx, rotated, "hash-s1")
+				},
+				wantIds: []string{"s1", "s2", "s4"},
+			},
+			{
+				name:    "revoke",
+				step:    func() error { return s.RevokeSession(ctx, "u", "s2", now) },
+				wantIds: []string{"s1", "s4"},
+			},
+			{
+				name:    "revoke again",
+				step:    func() error { return s.RevokeSession(ctx, "u", "s2", now) },
+				want:    sql.ErrNoRows,
+				wantIds: []string{"s1", "s4"},
+			},
+			{
+				name:    "revoke the session of another user",
+				step:    func() error { return s.RevokeSession(ctx, "u", "s5", now) },
+				want:    sql.ErrNoRows,
+				wantIds: []string{"s1", "s4"},
+			},
+			{
+				name:    "revoke all but one",
+				step:    func() error { return s.RevokeUserSessions(ctx, "u", "s4", now) },
+				wantIds: []string{"s4"},
+			},
+		}
+
+		for _, c := range steps {
+			if err := c.step(); !errors.Is(err, c.want) {
+				t.Fatalf("%s: error = %v, want %v", c.name, err, c.want)
+			}
+
+			if got := active(); !reflect.DeepEqual(got, c.wantIds) {
+				t.Errorf("%s: active sessions = %v, want %v", c.name, got, c.wantIds)
+			}
+		}
+
+		got, err := s.GetSession(ctx, "s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.RefreshTokenHash != "hash-s1-new" || got.PreviousTokenHash != "hash-s1" || got.RevokedAt == nil {
+			t.Errorf("session s1 = %+v, want rotated then revoked", got)
+		}
+
+		if _, err := s.GetSession(ctx, "missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("missing session: error = %v, want sql.ErrNoRows", err)
+		}
+
+		if other, err := s.GetActiveSessions(ctx, "v", now); err != nil || len(other) != 1 {
+			t.Errorf("active sessions of v = %d (%v), want 1", len(other), err)
+		}
+	})
+}
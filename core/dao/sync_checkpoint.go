@@ -0,0 +1,49 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+)
+
+const maxLastErrorLength = 1024
+
+func (s *SQLStore) UpsertSyncCheckpoint(ctx context.Context, checkpoint *model.SyncCheckpoint) error {
+	if len(checkpoint.LastError) > maxLastErrorLength {
+		checkpoint.LastError = checkpoint.LastError[:maxLastErrorLength]
+	}
+
+	query := `INSERT INTO sync_checkpoint(paiUsername, dataType, windowStart, windowEnd, status, attempts, lastError, rowCount, createdAt, updatedAt)
+	VALUES(:paiUsername, :dataType, :windowStart, :windowEnd, :status, :attempts, :lastError, :rowCount, %[1]s, %[1]s)`
+
+	query = fmt.Sprintf(query, s.dialect.Now()) + s.dialect.Upsert([]string{"paiUsername", "dataType", "windowStart", "windowEnd"},
+		"status", "attempts", "lastError", "rowCount", "updatedAt")
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), checkpoint); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *SQLStore) GetSyncCheckpoint(ctx context.Context, paiUsername, dataType, windowStart, windowEnd string) (*model.SyncCheckpoint, error) {
+	query := `select * from sync_checkpoint where paiUsername = ? and dataType = ? and windowStart = ? and windowEnd = ?`
+
+	var out model.SyncCheckpoint
+	if err := s.db.GetContext(ctx, &out, s.rebind(query), paiUsername, dataType, windowStart, windowEnd); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+func (s *SQLStore) GetSyncCheckpoints(ctx context.Context, paiUsername, dataType string) ([]*model.SyncCheckpoint, error) {
+	query := `select * from sync_checkpoint where paiUsername = ? and dataType = ? order by windowStart`
+
+	var out []*model.SyncCheckpoint
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), paiUsername, dataType); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,142 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"time"
+)
+
+// CreateUserTOTP enrolls the user, replacing an enrollment not confirmed yet.
+func (s *SQLStore) CreateUserTOTP(ctx context.Context, totp *model.UserTOTP) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`delete from user_totp where username = ? and confirmedAt is null`), totp.Username); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO user_totp(username, secret, confirmedAt, lastStep, createdAt, updatedAt)
+		VALUES(:username, :secret, :confirmedAt, :lastStep, :createdAt, :updatedAt)`
+	if _, err := tx.NamedExecContext(ctx, s.rebind(query), totp); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUserTOTP returns sql.ErrNoRows when the user is not enrolled.
+func (s *SQLStore) GetUserTOTP(ctx context.Context, username string) (*model.UserTOTP, error) {
+	var out model.UserTOTP
+	query := `select * from user_totp where username = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), username).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// EnableUserTOTP confirms the enrollment with the step of the code checked and replaces the backup codes,
+// it returns sql.ErrNoRows when the user has no enrollment to confirm.
+func (s *SQLStore) EnableUserTOTP(ctx context.Context, username string, step int64, at time.Time, codes []*model.BackupCode) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE user_totp SET confirmedAt = ?, lastStep = ?, updatedAt = ? WHERE username = ? and confirmedAt is null`
+	result, err := tx.ExecContext(ctx, s.rebind(query), at, step, at, username)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`delete from user_backup_codes where username = ?`), username); err != nil {
+		return err
+	}
+
+	if len(codes) > 0 {
+		query := `INSERT INTO user_backup_codes(id, username, codeHash, usedAt, createdAt) VALUES(:id, :username, :codeHash, :usedAt, :createdAt)`
+		if _, err := tx.NamedExecContext(ctx, s.rebind(query), codes); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the step of a code accepted, it returns sql.ErrNoRows when a code of the step or a
+// later one was already accepted.
+func (s *SQLStore) UseTOTPStep(ctx context.Context, username string, step int64) error {
+	query := `UPDATE user_totp SET lastStep = ? WHERE username = ? and lastStep < ?`
+
+	result, err := s.db.ExecContext(ctx, s.rebind(query), step, username, step)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// UseBackupCode consumes the backup code of the hash, it returns sql.ErrNoRows when the user has no such
+// code left.
+func (s *SQLStore) UseBackupCode(ctx context.Context, username, codeHash string, at time.Time) error {
+	query := `UPDATE user_backup_codes SET usedAt = ? WHERE username = ? and codeHash = ? and usedAt is null`
+
+	result, err := s.db.ExecContext(ctx, s.rebind(query), at, username, codeHash)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+func (s *SQLStore) CountBackupCodes(ctx context.Context, username string) (int64, error) {
+	var out int64
+	query := `select count(1) from user_backup_codes where username = ? and usedAt is null`
+	if err := s.db.GetContext(ctx, &out, s.rebind(query), username); err != nil {
+		return 0, err
+	}
+
+	return out, nil
+}
+
+// DeleteUserTOTP disables the second factor of the user along with its backup codes.
+func (s *SQLStore) DeleteUserTOTP(ctx context.Context, username string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`delete from user_backup_codes where username = ?`), username); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`delete from user_totp where username = ?`), username); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
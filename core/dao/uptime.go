@@ -0,0 +1,119 @@
+package dao
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"github.com/jmoiron/sqlx"
+	"strings"
+)
+
+func (s *SQLStore) BulkUpsertBoxUptimes(ctx context.Context, uptimes []*model.BoxUptime) error {
+	query := `INSERT INTO box_uptime(username, boxId, supplierBoxId, online, startTime, endTime, updatedAt)
+	VALUES(:username, :boxId, :supplierBoxId, :online, :startTime, :endTime, %s)`
+
+	query = fmt.Sprintf(query, s.dialect.Now()) + s.dialect.Upsert([]string{"boxId", "startTime"}, "online", "endTime", "updatedAt")
+
+	if _, err := s.db.NamedExecContext(ctx, s.rebind(query), uptimes); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetLatestBoxUptimes returns the most recent uptime interval of each of the boxes.
+func (s *SQLStore) GetLatestBoxUptimes(ctx context.Context, boxIds []string) ([]*model.BoxUptime, error) {
+	if len(boxIds) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(`select u.* from box_uptime u join (
+		select boxId, max(startTime) as startTime from box_uptime where boxId in (?) group by boxId
+	) l on u.boxId = l.boxId and u.startTime = l.startTime`, boxIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*model.BoxUptime
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// GetBoxUptimes returns the uptime intervals of the boxes overlapping the start ~ end range.
+func (s *SQLStore) GetBoxUptimes(ctx context.Context, username string, boxIds []string, start, end int64) ([]*model.BoxUptime, error) {
+	if len(boxIds) == 0 {
+		return nil, nil
+	}
+
+	query, args, err := sqlx.In(`select * from box_uptime where username = ? and endTime > ? and startTime < ? and boxId in (?)
+		order by boxId, startTime`, username, start, end, boxIds)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*model.BoxUptime
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// UptimeTotals sums the uptime intervals of several boxes over a period, in seconds.
+type UptimeTotals struct {
+	OnlineSeconds  int64
+	OfflineSeconds int64
+	Outages        int64
+	LongestOutage  int64
+}
+
+// GetBoxUptimeTotals sums the uptime intervals of the boxes matching the filter over each of the start ~ end
+// periods, clipped to the period, in a single aggregate query.
+func (s *SQLStore) GetBoxUptimeTotals(ctx context.Context, username string, filter *BoxFilter, periods [][2]int64) ([]*UptimeTotals, error) {
+	if len(periods) == 0 {
+		return nil, nil
+	}
+
+	where, whereArgs, err := filter.where(username, s.dialect)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		columns    []string
+		start, end = periods[0][0], periods[0][1]
+	)
+	for _, p := range periods {
+		start, end = min(start, p[0]), max(end, p[1])
+
+		// the periods are computed by the server, not taken from the request, and are inlined as such.
+		d := fmt.Sprintf(`((case when endTime < %d then endTime else %d end) - (case when startTime > %d then startTime else %d end))`,
+			p[1], p[1], p[0], p[0])
+		columns = append(columns,
+			fmt.Sprintf(`coalesce(sum(case when online and %s > 0 then %s else 0 end), 0)`, d, d),
+			fmt.Sprintf(`coalesce(sum(case when not online and %s > 0 then %s else 0 end), 0)`, d, d),
+			fmt.Sprintf(`coalesce(sum(case when not online and %s > 0 then 1 else 0 end), 0)`, d),
+			fmt.Sprintf(`coalesce(max(case when not online and %s > 0 then %s else 0 end), 0)`, d, d),
+		)
+	}
+
+	query := fmt.Sprintf(`select %s from box_uptime where username = ? and endTime > ? and startTime < ?
+		and boxId in (select boxId from box %s)`, strings.Join(columns, ", "), where)
+	args := append([]interface{}{username, start, end}, whereArgs...)
+
+	out := make([]*UptimeTotals, len(periods))
+	dest := make([]interface{}, 0, 4*len(periods))
+	for i := range out {
+		out[i] = &UptimeTotals{}
+		dest = append(dest, &out[i].OnlineSeconds, &out[i].OfflineSeconds, &out[i].Outages, &out[i].LongestOutage)
+	}
+
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), args...).Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -2,23 +2,59 @@ package dao
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"github.com/gnasnik/titan-box-api/core/generated/model"
 )
 
-func CreateUser(ctx context.Context, user *model.User) error {
+func (s *SQLStore) CreateUser(ctx context.Context, user *model.User) error {
 	query := `INSERT INTO user (username, password, appKey, appSecret, supplierType, phoneNumber, billingCycle, parentId, distPercent, canInvite, inviterType, createdAt)
-			VALUES (:username, :password, :appKey, :appSecret, :supplierType, :phoneNumber, :billingCycle, :parentId, :distPercent, :canInvite, :inviterType, now())`
+			VALUES (:username, :password, :appKey, :appSecret, :supplierType, :phoneNumber, :billingCycle, :parentId, :distPercent, :canInvite, :inviterType, %s)`
 
-	_, err := DB.NamedExecContext(ctx, query, user)
+	query = fmt.Sprintf(query, s.dialect.Now())
 
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), user)
+
+	return err
+}
+
+// UpdateUserPassword returns sql.ErrNoRows when the user does not exist.
+func (s *SQLStore) UpdateUserPassword(ctx context.Context, username, password string) error {
+	result, err := s.db.ExecContext(ctx, s.rebind(`UPDATE user SET password = ? WHERE username = ?`), password, username)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetUsersWithAppKey returns the users whose registration key pair was not moved to their api keys yet.
+func (s *SQLStore) GetUsersWithAppKey(ctx context.Context) ([]*model.User, error) {
+	var out []*model.User
+	if err := s.db.SelectContext(ctx, &out, s.rebind(`SELECT * FROM user WHERE appKey <> '' ORDER BY username`)); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// ClearUserAppKey forgets the registration key pair of the user.
+func (s *SQLStore) ClearUserAppKey(ctx context.Context, username string) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`UPDATE user SET appKey = '', appSecret = '' WHERE username = ?`), username)
 	return err
 }
 
-func GetUserByUsername(ctx context.Context, username string) (*model.User, error) {
+func (s *SQLStore) GetUserByUsername(ctx context.Context, username string) (*model.User, error) {
 	query := `SELECT * FROM user WHERE username = ?`
 
 	var out model.User
-	if err := DB.QueryRowxContext(ctx, query, username).StructScan(&out); err != nil {
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), username).StructScan(&out); err != nil {
 		return nil, err
 	}
 
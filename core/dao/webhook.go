@@ -0,0 +1,160 @@
+package dao
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"time"
+)
+
+type WebhookDeliveryFilter struct {
+	EndpointId string
+	Event      string
+	Status     string
+}
+
+func (f *WebhookDeliveryFilter) where(username string) (string, []interface{}) {
+	var (
+		where = `where username = ? `
+		args  = []interface{}{username}
+	)
+
+	if f == nil {
+		return where, args
+	}
+
+	if f.EndpointId != "" {
+		where += ` and endpointId = ?`
+		args = append(args, f.EndpointId)
+	}
+
+	if f.Event != "" {
+		where += ` and event = ?`
+		args = append(args, f.Event)
+	}
+
+	if f.Status != "" {
+		where += ` and status = ?`
+		args = append(args, f.Status)
+	}
+
+	return where, args
+}
+
+func (s *SQLStore) CreateWebhookEndpoint(ctx context.Context, endpoint *model.WebhookEndpoint) error {
+	query := `INSERT INTO webhook_endpoints(id, username, url, secret, events, createdAt, updatedAt)
+		VALUES(:id, :username, :url, :secret, :events, :createdAt, :updatedAt)`
+
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), endpoint)
+	return err
+}
+
+func (s *SQLStore) GetWebhookEndpoints(ctx context.Context, username string) ([]*model.WebhookEndpoint, error) {
+	var out []*model.WebhookEndpoint
+	query := `select * from webhook_endpoints where username = ? order by createdAt, id`
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), username); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// GetWebhookEndpoint returns sql.ErrNoRows when the endpoint does not exist.
+func (s *SQLStore) GetWebhookEndpoint(ctx context.Context, id string) (*model.WebhookEndpoint, error) {
+	var out model.WebhookEndpoint
+	query := `select * from webhook_endpoints where id = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), id).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// DeleteWebhookEndpoint deletes the endpoint of the user along with its deliveries, it returns sql.ErrNoRows
+// when the user has no such endpoint.
+func (s *SQLStore) DeleteWebhookEndpoint(ctx context.Context, username, id string) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, s.rebind(`delete from webhook_endpoints where username = ? and id = ?`), username, id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	if _, err := tx.ExecContext(ctx, s.rebind(`delete from webhook_deliveries where endpointId = ?`), id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLStore) AddWebhookDeliveries(ctx context.Context, deliveries []*model.WebhookDelivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	query := `INSERT INTO webhook_deliveries(id, endpointId, username, event, payload, status, attempts, responseCode, lastError, nextAttemptAt, deliveredAt, createdAt, updatedAt)
+		VALUES(:id, :endpointId, :username, :event, :payload, :status, :attempts, :responseCode, :lastError, :nextAttemptAt, :deliveredAt, :createdAt, :updatedAt)`
+
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), deliveries)
+	return err
+}
+
+func (s *SQLStore) UpdateWebhookDelivery(ctx context.Context, delivery *model.WebhookDelivery) error {
+	query := `UPDATE webhook_deliveries SET status = :status, attempts = :attempts, responseCode = :responseCode, lastError = :lastError,
+		nextAttemptAt = :nextAttemptAt, deliveredAt = :deliveredAt, updatedAt = :updatedAt WHERE id = :id`
+
+	_, err := s.db.NamedExecContext(ctx, s.rebind(query), delivery)
+	return err
+}
+
+// GetDueWebhookDeliveries returns the pending deliveries whose next attempt is due at now, oldest first.
+func (s *SQLStore) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]*model.WebhookDelivery, error) {
+	var out []*model.WebhookDelivery
+	query := `select * from webhook_deliveries where status = ? and nextAttemptAt <= ? order by nextAttemptAt, id limit ?`
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), model.WebhookDeliveryPending, now, limit); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// GetWebhookDeliveries returns the deliveries matching the filter, most recent first.
+func (s *SQLStore) GetWebhookDeliveries(ctx context.Context, username string, filter *WebhookDeliveryFilter, page, pageSize int64) (int64, []*model.WebhookDelivery, error) {
+	where, args := filter.where(username)
+
+	var total int64
+	if err := s.db.GetContext(ctx, &total, s.rebind(`select count(1) from webhook_deliveries `+where), args...); err != nil {
+		return 0, nil, err
+	}
+
+	query := fmt.Sprintf(`select * from webhook_deliveries %s order by createdAt desc, id desc limit %d offset %d`, where, pageSize, (page-1)*pageSize)
+
+	var out []*model.WebhookDelivery
+	if err := s.db.SelectContext(ctx, &out, s.rebind(query), args...); err != nil {
+		return 0, nil, err
+	}
+
+	return total, out, nil
+}
+
+// GetWebhookDelivery returns sql.ErrNoRows when the user has no such delivery.
+func (s *SQLStore) GetWebhookDelivery(ctx context.Context, username, id string) (*model.WebhookDelivery, error) {
+	var out model.WebhookDelivery
+	query := `select * from webhook_deliveries where username = ? and id = ?`
+	if err := s.db.QueryRowxContext(ctx, s.rebind(query), username, id).StructScan(&out); err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
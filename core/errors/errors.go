@@ -13,6 +13,15 @@ const (
 	InternalServer
 	PermissionNotAllowed
 	InvalidDeploymentName
+	WeakPassword
+	InvalidVerifyCode
+	VerifyCodeTooFrequent
+	InvalidCaptcha
+	TooManyAttempts
+	TOTPRequired
+	InvalidTOTPCode
+	TOTPEnabled
+	InvalidInviteCode
 
 	Unknown = -1
 )
@@ -26,6 +35,15 @@ var (
 	ErrInvalidPassword      = newError(InvalidPassword, "invalid password")
 	ErrInternalServer       = newError(InternalServer, "Server Busy")
 	ErrPermissionNotAllowed = newError(PermissionNotAllowed, "Permission Not Allowed")
+	ErrWeakPassword         = newError(WeakPassword, "password too weak")
+	ErrInvalidVerifyCode    = newError(InvalidVerifyCode, "invalid verify code")
+	ErrVerifyCodeFrequent   = newError(VerifyCodeTooFrequent, "verify code requested too frequently")
+	ErrInvalidCaptcha       = newError(InvalidCaptcha, "invalid captcha")
+	ErrTooManyAttempts      = newError(TooManyAttempts, "too many attempts, retry later")
+	ErrTOTPRequired         = newError(TOTPRequired, "totp code required")
+	ErrInvalidTOTPCode      = newError(InvalidTOTPCode, "invalid totp code")
+	ErrTOTPEnabled          = newError(TOTPEnabled, "two-factor authentication already enabled")
+	ErrInvalidInviteCode    = newError(InvalidInviteCode, "invalid invite code")
 )
 
 type ApiError struct {
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+const (
+	AlertStatusFiring   = "firing"
+	AlertStatusResolved = "resolved"
+)
+
+// Alert is raised by an alert rule for a box. It keeps firing, under the same DedupKey, for as long as
+// the rule matches the box and is resolved once it no longer does.
+type Alert struct {
+	Id            int64      `json:"id" db:"id"`
+	Username      string     `json:"-" db:"username"`
+	DedupKey      string     `json:"dedupKey" db:"dedupKey"`
+	Rule          string     `json:"rule" db:"rule"`
+	Severity      string     `json:"severity" db:"severity"`
+	BoxId         string     `json:"boxId" db:"boxId"`
+	SupplierBoxId string     `json:"supplierBoxId" db:"supplierBoxId"`
+	Status        string     `json:"status" db:"status"`
+	Value         float64    `json:"value" db:"value"`
+	Summary       string     `json:"summary" db:"summary"`
+	StartsAt      time.Time  `json:"startsAt" db:"startsAt"`
+	ResolvedAt    *time.Time `json:"resolvedAt,omitempty" db:"resolvedAt"`
+	UpdatedAt     time.Time  `json:"updatedAt" db:"updatedAt"`
+}
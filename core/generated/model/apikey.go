@@ -0,0 +1,90 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyScopeRead grants a read-only access to every group.
+	APIKeyScopeRead = "read"
+
+	APIKeyScopeBox     = "box"
+	APIKeyScopeIncome  = "income"
+	APIKeyScopeAlert   = "alert"
+	APIKeyScopeWebhook = "webhook"
+	APIKeyScopeNotify  = "notify"
+
+	// APIKeyScopeReadSuffix restricts the scope of a group to its read-only endpoints, as in box:read.
+	APIKeyScopeReadSuffix = ":read"
+)
+
+// APIKeyScopeGroups lists the groups of endpoints a key can be scoped to.
+var APIKeyScopeGroups = []string{
+	APIKeyScopeBox,
+	APIKeyScopeIncome,
+	APIKeyScopeAlert,
+	APIKeyScopeWebhook,
+	APIKeyScopeNotify,
+}
+
+const (
+	APIKeyStatusActive  = "active"
+	APIKeyStatusExpired = "expired"
+	APIKeyStatusRevoked = "revoked"
+)
+
+// APIKey is a named key a user creates for a machine client, which signs its requests with the secret. The
+// secret is returned once when the key is created or rotated. It is kept sealed with the encryption key of the
+// server rather than hashed, as the signatures are checked with it.
+type APIKey struct {
+	Id       string `json:"id" db:"id"`
+	Username string `json:"-" db:"username"`
+	Name     string `json:"name" db:"name"`
+	AppKey   string `json:"appKey" db:"appKey"`
+	Secret   string `json:"-" db:"secret"`
+	// PreviousSecret is the secret replaced by the last rotation, still accepted until PreviousExpiresAt.
+	PreviousSecret    string     `json:"-" db:"previousSecret"`
+	PreviousExpiresAt *time.Time `json:"previousExpiresAt,omitempty" db:"previousExpiresAt"`
+	// Scopes are the comma separated groups the key can call. The keys created with none, before a scope
+	// was required, can only read.
+	Scopes     string     `json:"scopes" db:"scopes"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty" db:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" db:"lastUsedAt"`
+	LastUsedIp string     `json:"lastUsedIp" db:"lastUsedIp"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" db:"revokedAt"`
+	CreatedAt  time.Time  `json:"createdAt" db:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt" db:"updatedAt"`
+}
+
+func (k *APIKey) Status(now time.Time) string {
+	switch {
+	case k.RevokedAt != nil:
+		return APIKeyStatusRevoked
+	case k.ExpiresAt != nil && !now.Before(*k.ExpiresAt):
+		return APIKeyStatusExpired
+	default:
+		return APIKeyStatusActive
+	}
+}
+
+// Allows reports whether the key can call the endpoints of the group, write tells the endpoints changing
+// the data of the user from the ones reading it.
+func (k *APIKey) Allows(group string, write bool) bool {
+	if k.Scopes == "" {
+		return !write
+	}
+
+	for _, s := range strings.Split(k.Scopes, ",") {
+		switch s {
+		case group:
+			return true
+		case APIKeyScopeRead, group + APIKeyScopeReadSuffix:
+			if !write {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -48,17 +48,17 @@ type DiskInfo struct {
 
 type BoxIncome struct {
 	Username       string    `json:"-" db:"username"`
-	Date           string    `json:"date" db:"date"`
+	Date           Date      `json:"date" db:"date"`
 	BoxId          string    `json:"boxId"  db:"boxId"`
 	Remark         string    `json:"remark" db:"remark"`
-	Bw             string    `json:"bw" db:"bw"`
-	Amount         string    `json:"amount" db:"amount"`
+	Bw             Decimal   `json:"bw" db:"bw"`
+	Amount         Decimal   `json:"amount" db:"amount"`
 	SupplierBoxId  string    `json:"supplierBoxId" db:"supplierBoxId"`
-	BwAmount       string    `json:"bwAmount" db:"bwAmount"`
-	ActivityIncome string    `json:"activityIncome" db:"activityIncome"`
+	BwAmount       Decimal   `json:"bwAmount" db:"bwAmount"`
+	ActivityIncome Decimal   `json:"activityIncome" db:"activityIncome"`
 	UserRemark     string    `json:"userRemark" db:"userRemark"`
 	DistAmount     string    `json:"distAmount" db:"distAmount"`
-	DistPercent    int       `json:"distPercent" db:"distPercent"`
+	DistPercent    float64   `json:"distPercent" db:"distPercent"`
 	InviterId      string    `json:"inviterId" db:"inviterId"`
 	UpdatedAt      time.Time `json:"-" db:"updatedAt"`
 }
@@ -67,7 +67,7 @@ type BoxBandwidth struct {
 	Username      string    `json:"-" db:"username"`
 	BoxId         string    `json:"-" db:"boxId"`
 	SupplierBoxId string    `json:"-" db:"supplierBoxId"`
-	Time          string    `json:"time" db:"time"`
+	Time          Timestamp `json:"time" db:"time"`
 	Upload        float64   `json:"upload" db:"upload"`
 	Download      float64   `json:"download" db:"download"`
 	UpdatedAt     time.Time `json:"-" db:"updatedAt"`
@@ -77,7 +77,7 @@ type BoxQuality struct {
 	Username      string    `json:"-" db:"username"`
 	BoxId         string    `json:"-" db:"boxId"`
 	SupplierBoxId string    `json:"-" db:"supplierBoxId"`
-	Time          string    `json:"time" db:"time"`
+	Time          Timestamp `json:"time" db:"time"`
 	PacketLoss    float64   `json:"packetLoss" db:"packetLoss"`
 	TcpNatType    string    `json:"tcpNatType" db:"tcpNatType"`
 	UdpNatType    string    `json:"udpNatType" db:"udpNatType"`
@@ -86,3 +86,83 @@ type BoxQuality struct {
 	DiskUsage     float64   `json:"diskUsage" db:"diskUsage"`
 	UpdatedAt     time.Time `json:"-" db:"updatedAt"`
 }
+
+// BoxBandwidthRollup aggregates the bandwidth points of a box over an hour or a day starting at Time.
+type BoxBandwidthRollup struct {
+	Username      string    `json:"-" db:"username"`
+	BoxId         string    `json:"-" db:"boxId"`
+	SupplierBoxId string    `json:"-" db:"supplierBoxId"`
+	Time          Timestamp `json:"time" db:"time"`
+	Samples       int64     `json:"samples" db:"samples"`
+	UploadAvg     float64   `json:"uploadAvg" db:"uploadAvg"`
+	UploadMax     float64   `json:"uploadMax" db:"uploadMax"`
+	UploadMin     float64   `json:"uploadMin" db:"uploadMin"`
+	UploadP95     float64   `json:"uploadP95" db:"uploadP95"`
+	DownloadAvg   float64   `json:"downloadAvg" db:"downloadAvg"`
+	DownloadMax   float64   `json:"downloadMax" db:"downloadMax"`
+	DownloadMin   float64   `json:"downloadMin" db:"downloadMin"`
+	DownloadP95   float64   `json:"downloadP95" db:"downloadP95"`
+	UpdatedAt     time.Time `json:"-" db:"updatedAt"`
+}
+
+// BoxQualityRollup aggregates the quality points of a box over an hour or a day starting at Time.
+type BoxQualityRollup struct {
+	Username       string    `json:"-" db:"username"`
+	BoxId          string    `json:"-" db:"boxId"`
+	SupplierBoxId  string    `json:"-" db:"supplierBoxId"`
+	Time           Timestamp `json:"time" db:"time"`
+	Samples        int64     `json:"samples" db:"samples"`
+	PacketLossAvg  float64   `json:"packetLossAvg" db:"packetLossAvg"`
+	CpuUsageAvg    float64   `json:"cpuUsageAvg" db:"cpuUsageAvg"`
+	MemoryUsageAvg float64   `json:"memoryUsageAvg" db:"memoryUsageAvg"`
+	DiskUsageAvg   float64   `json:"diskUsageAvg" db:"diskUsageAvg"`
+	UpdatedAt      time.Time `json:"-" db:"updatedAt"`
+}
+
+// BoxChange records a field of a box whose value changed between two syncs of the box list.
+type BoxChange struct {
+	Id            int64     `json:"id" db:"id"`
+	Username      string    `json:"-" db:"username"`
+	BoxId         string    `json:"boxId" db:"boxId"`
+	SupplierBoxId string    `json:"supplierBoxId" db:"supplierBoxId"`
+	Field         string    `json:"field" db:"field"`
+	OldValue      string    `json:"oldValue" db:"oldValue"`
+	NewValue      string    `json:"newValue" db:"newValue"`
+	ChangedAt     time.Time `json:"changedAt" db:"changedAt"`
+}
+
+// BoxUptime is an interval during which the successive syncs of the box list saw a box in the same
+// online state, from StartTime to EndTime.
+type BoxUptime struct {
+	Username      string    `json:"-" db:"username"`
+	BoxId         string    `json:"boxId" db:"boxId"`
+	SupplierBoxId string    `json:"supplierBoxId" db:"supplierBoxId"`
+	Online        bool      `json:"online" db:"online"`
+	StartTime     Timestamp `json:"startTime" db:"startTime"`
+	EndTime       Timestamp `json:"endTime" db:"endTime"`
+	UpdatedAt     time.Time `json:"-" db:"updatedAt"`
+}
+
+type IncomePeriods struct {
+	Today     Decimal `json:"today" db:"today"`
+	Yesterday Decimal `json:"yesterday" db:"yesterday"`
+	ThisMonth Decimal `json:"thisMonth" db:"thisMonth"`
+	LastMonth Decimal `json:"lastMonth" db:"lastMonth"`
+	Total     Decimal `json:"total" db:"total"`
+}
+
+type RemarkIncome struct {
+	Remark string `json:"remark" db:"remark"`
+	IncomePeriods
+}
+
+type IncomeTypeIncome struct {
+	IncomeType int `json:"incomeType" db:"-"`
+	IncomePeriods
+}
+
+type IncomeSummary struct {
+	IncomePeriods
+	Remarks     []*RemarkIncome     `json:"remarks"`
+	IncomeTypes []*IncomeTypeIncome `json:"incomeTypes"`
+}
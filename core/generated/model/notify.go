@@ -0,0 +1,49 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	NotifyChannelDingTalk = "dingtalk"
+	NotifyChannelFeishu   = "feishu"
+	NotifyChannelWeCom    = "wecom"
+	NotifyChannelTelegram = "telegram"
+	NotifyChannelEmail    = "email"
+)
+
+// NotifyChannel sends the alerts of a user to a chat bot or a mailbox.
+type NotifyChannel struct {
+	Id       string `json:"id" db:"id"`
+	Username string `json:"-" db:"username"`
+	Name     string `json:"name" db:"name"`
+	Type     string `json:"type" db:"type"`
+	// Target is the access token of the DingTalk, Feishu or WeCom bot, the Telegram chat id or the email address.
+	Target string `json:"target" db:"target"`
+	// Secret signs the DingTalk and Feishu messages, and replaces the configured Telegram bot token.
+	Secret string `json:"-" db:"secret"`
+	// Severities are the comma separated severities of the alerts sent to the channel, every one when empty.
+	Severities string `json:"severities" db:"severities"`
+	// Template is a text/template of the message executed with the alert, the default of the type when empty.
+	Template string `json:"template" db:"template"`
+	// QuietStart and QuietEnd, as 15:04, bound the quiet hours when only the critical alerts are sent.
+	QuietStart string    `json:"quietStart" db:"quietStart"`
+	QuietEnd   string    `json:"quietEnd" db:"quietEnd"`
+	CreatedAt  time.Time `json:"createdAt" db:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt" db:"updatedAt"`
+}
+
+func (c *NotifyChannel) Routes(severity string) bool {
+	if c.Severities == "" {
+		return true
+	}
+
+	for _, s := range strings.Split(c.Severities, ",") {
+		if s == severity {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// Session is a login of a user, it lasts as long as its refresh token is rotated before ExpiresAt. Only the
+// SHA-256 of the refresh tokens is kept.
+type Session struct {
+	Id               string `json:"id" db:"id"`
+	Username         string `json:"-" db:"username"`
+	RefreshTokenHash string `json:"-" db:"refreshTokenHash"`
+	// PreviousTokenHash is the refresh token replaced by the last rotation, presenting it again revokes the session.
+	PreviousTokenHash string     `json:"-" db:"previousTokenHash"`
+	UserAgent         string     `json:"userAgent" db:"userAgent"`
+	Ip                string     `json:"ip" db:"ip"`
+	CreatedAt         time.Time  `json:"createdAt" db:"createdAt"`
+	LastSeenAt        time.Time  `json:"lastSeenAt" db:"lastSeenAt"`
+	ExpiresAt         time.Time  `json:"expiresAt" db:"expiresAt"`
+	RevokedAt         *time.Time `json:"revokedAt,omitempty" db:"revokedAt"`
+}
+
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,39 @@
+package model
+
+import "time"
+
+const (
+	SyncDataTypeIncome    = "income"
+	SyncDataTypeBandwidth = "bandwidth"
+	SyncDataTypeQuality   = "quality"
+)
+
+const (
+	SyncStatusRunning = "running"
+	SyncStatusDone    = "done"
+	SyncStatusFailed  = "failed"
+)
+
+// SyncCheckpoint records the outcome of syncing one date window of a data type for a PaiNet account.
+type SyncCheckpoint struct {
+	PaiUsername string    `json:"paiUsername" db:"paiUsername"`
+	DataType    string    `json:"dataType" db:"dataType"`
+	WindowStart string    `json:"windowStart" db:"windowStart"`
+	WindowEnd   string    `json:"windowEnd" db:"windowEnd"`
+	Status      string    `json:"status" db:"status"`
+	Attempts    int64     `json:"attempts" db:"attempts"`
+	LastError   string    `json:"lastError" db:"lastError"`
+	RowCount    int64     `json:"rowCount" db:"rowCount"`
+	CreatedAt   time.Time `json:"createdAt" db:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt" db:"updatedAt"`
+}
+
+// Finished reports whether the window was synced successfully after it had closed, so its data can no longer change.
+// The windows follow the local days, while the stores may return the update time in UTC.
+func (c *SyncCheckpoint) Finished() bool {
+	if c.Status != SyncStatusDone {
+		return false
+	}
+
+	return c.UpdatedAt.Local().Format(time.DateOnly) > c.WindowEnd
+}
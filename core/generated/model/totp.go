@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// UserTOTP is the TOTP secret of a user, the second factor of its logins once confirmed.
+type UserTOTP struct {
+	Username    string     `json:"-" db:"username"`
+	Secret      string     `json:"-" db:"secret"`
+	ConfirmedAt *time.Time `json:"confirmedAt,omitempty" db:"confirmedAt"`
+	// LastStep is the time step of the last code accepted, the codes of the same or earlier steps are replays.
+	LastStep  int64     `json:"-" db:"lastStep"`
+	CreatedAt time.Time `json:"createdAt" db:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updatedAt"`
+}
+
+func (t *UserTOTP) Enabled() bool {
+	return t.ConfirmedAt != nil
+}
+
+// BackupCode replaces a TOTP code once, when the user lost its authenticator. Only its SHA-256 is kept.
+type BackupCode struct {
+	Id        string     `db:"id"`
+	Username  string     `db:"username"`
+	CodeHash  string     `db:"codeHash"`
+	UsedAt    *time.Time `db:"usedAt"`
+	CreatedAt time.Time  `db:"createdAt"`
+}
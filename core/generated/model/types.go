@@ -0,0 +1,214 @@
+package model
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// decimalScale is the number of fraction digits of the DECIMAL columns of the amounts.
+const decimalScale = 4
+
+var decimalUnit = int64(math.Pow10(decimalScale))
+
+// Decimal is an amount stored in a DECIMAL(20,4) column, held as a number of 1e-4 units so that the amounts
+// add up exactly. PaiNet encodes amounts as JSON strings, which may be empty, so Decimal accepts both
+// strings and numbers and is encoded back as a string.
+type Decimal int64
+
+// ParseDecimal parses a decimal number, the digits past the scale of the columns are rounded half away
+// from zero.
+func ParseDecimal(s string) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, err
+		}
+		return decimalOfFloat(f), nil
+	}
+
+	neg := strings.HasPrefix(s, "-")
+	whole, frac, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+"), ".")
+	if whole == "" {
+		whole = "0"
+	}
+
+	if !isDigits(whole) || !isDigits(frac) {
+		return 0, fmt.Errorf("invalid decimal %q", s)
+	}
+
+	round := len(frac) > decimalScale && frac[decimalScale] >= '5'
+	if len(frac) > decimalScale {
+		frac = frac[:decimalScale]
+	}
+	frac += strings.Repeat("0", decimalScale-len(frac))
+
+	units, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid decimal %q", s)
+	}
+
+	if round {
+		units++
+	}
+
+	if neg {
+		units = -units
+	}
+
+	return Decimal(units), nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func decimalOfFloat(f float64) Decimal {
+	return Decimal(math.Round(f * float64(decimalUnit)))
+}
+
+func (d Decimal) String() string {
+	units := int64(d)
+	sign := ""
+	if units < 0 {
+		sign, units = "-", -units
+	}
+
+	frac := strings.TrimRight(fmt.Sprintf("%0*d", decimalScale, units%decimalUnit), "0")
+	if frac == "" {
+		return fmt.Sprintf("%s%d", sign, units/decimalUnit)
+	}
+	return fmt.Sprintf("%s%d.%s", sign, units/decimalUnit, frac)
+}
+
+// Float64 returns the amount as a float, for the ratios between amounts.
+func (d Decimal) Float64() float64 {
+	return float64(d) / float64(decimalUnit)
+}
+
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Decimal) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	if s == "null" {
+		*d = 0
+		return nil
+	}
+
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return fmt.Errorf("invalid decimal %s: %w", data, err)
+	}
+
+	*d = v
+	return nil
+}
+
+// Scan reads the DECIMAL columns and sums, which MySQL and PostgreSQL return as text and SQLite as numbers.
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = 0
+	case []byte:
+		return d.scanString(string(v))
+	case string:
+		return d.scanString(v)
+	case int64:
+		*d = Decimal(v * decimalUnit)
+	case float64:
+		*d = decimalOfFloat(v)
+	default:
+		return fmt.Errorf("cannot scan %T into Decimal", src)
+	}
+	return nil
+}
+
+func (d *Decimal) scanString(s string) error {
+	v, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// Value binds the amount as a decimal string, which the databases convert to DECIMAL without rounding.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.String(), nil
+}
+
+// Date is a calendar day stored in a DATE column and encoded as YYYY-MM-DD.
+type Date string
+
+func (d *Date) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = ""
+	case time.Time:
+		*d = Date(v.Format(time.DateOnly))
+	case []byte:
+		*d = Date(truncateDate(string(v)))
+	case string:
+		*d = Date(truncateDate(v))
+	default:
+		return fmt.Errorf("cannot scan %T into Date", src)
+	}
+	return nil
+}
+
+func (d Date) Value() (driver.Value, error) {
+	return string(d), nil
+}
+
+func truncateDate(s string) string {
+	if len(s) > len(time.DateOnly) {
+		return s[:len(time.DateOnly)]
+	}
+	return s
+}
+
+// Timestamp is a point in time stored as unix seconds in a BIGINT column. PaiNet sends it as a string of
+// seconds, occasionally as a local date time, and it is encoded back as a string of seconds.
+type Timestamp int64
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strconv.FormatInt(int64(t), 10))
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	if s == "" || s == "null" {
+		*t = 0
+		return nil
+	}
+
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*t = Timestamp(seconds)
+		return nil
+	}
+
+	tm, err := time.ParseInLocation(time.DateTime, s, time.Local)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s: %w", data, err)
+	}
+
+	*t = Timestamp(tm.Unix())
+	return nil
+}
@@ -7,7 +7,7 @@ type User struct {
 	Username     string    `json:"username" db:"username"`
 	Password     string    `json:"-" db:"password"`
 	AppKey       string    `json:"appKey" db:"appKey"`
-	AppSecret    string    `json:"appSecret" db:"appSecret"`
+	AppSecret    string    `json:"-" db:"appSecret"`
 	SupplierType int       `json:"supplierType" db:"supplierType"`
 	PhoneNumber  string    `json:"phoneNumber" db:"phoneNumber"`
 	BillingCycle string    `json:"billingCycle" db:"billingCycle"`
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	WebhookEventBoxOffline    = "box.offline"
+	WebhookEventIncomeSynced  = "income.synced"
+	WebhookEventSyncFailed    = "sync.failed"
+	WebhookEventAlertFired    = "alert.fired"
+	WebhookEventAlertResolved = "alert.resolved"
+)
+
+// WebhookEvents lists the events an endpoint can subscribe to.
+var WebhookEvents = []string{
+	WebhookEventBoxOffline,
+	WebhookEventIncomeSynced,
+	WebhookEventSyncFailed,
+	WebhookEventAlertFired,
+	WebhookEventAlertResolved,
+}
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// WebhookEndpoint receives the events of a user, signed with its Secret.
+type WebhookEndpoint struct {
+	Id       string `json:"id" db:"id"`
+	Username string `json:"-" db:"username"`
+	URL      string `json:"url" db:"url"`
+	Secret   string `json:"secret,omitempty" db:"secret"`
+	// Events are the comma separated events the endpoint subscribes to, every event when empty.
+	Events    string    `json:"events" db:"events"`
+	CreatedAt time.Time `json:"createdAt" db:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt" db:"updatedAt"`
+}
+
+func (e *WebhookEndpoint) Subscribes(event string) bool {
+	if e.Events == "" {
+		return true
+	}
+
+	for _, ev := range strings.Split(e.Events, ",") {
+		if ev == event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WebhookDelivery is an event queued for an endpoint in the outbox, it stays pending until the endpoint
+// accepts it or the attempts run out.
+type WebhookDelivery struct {
+	Id            string     `json:"id" db:"id"`
+	EndpointId    string     `json:"endpointId" db:"endpointId"`
+	Username      string     `json:"-" db:"username"`
+	Event         string     `json:"event" db:"event"`
+	Payload       string     `json:"payload" db:"payload"`
+	Status        string     `json:"status" db:"status"`
+	Attempts      int64      `json:"attempts" db:"attempts"`
+	ResponseCode  int64      `json:"responseCode" db:"responseCode"`
+	LastError     string     `json:"lastError" db:"lastError"`
+	NextAttemptAt time.Time  `json:"nextAttemptAt" db:"nextAttemptAt"`
+	DeliveredAt   *time.Time `json:"deliveredAt,omitempty" db:"deliveredAt"`
+	CreatedAt     time.Time  `json:"createdAt" db:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt" db:"updatedAt"`
+}
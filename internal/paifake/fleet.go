@@ -0,0 +1,338 @@
+package paifake
+
+import (
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	isps      = []string{"电信", "联通", "移动"}
+	provinces = []string{"广东", "浙江", "江苏", "山东", "河南", "四川"}
+	natTypes  = []string{"NAT1", "NAT2", "NAT3", "NAT4"}
+	remarks   = []string{"", "room-a", "room-b", "room-c"}
+)
+
+// Fleet is a deterministic set of boxes owned by one supplier account. Income, bandwidth and quality
+// series are derived from the box id and the date, so repeated syncs observe the same values.
+type Fleet struct {
+	lk    sync.Mutex
+	boxes []*model.Box
+}
+
+func NewFleet(paiUsername string, size int) *Fleet {
+	r := rand.New(rand.NewSource(seed(paiUsername)))
+
+	f := &Fleet{}
+	for i := 0; i < size; i++ {
+		boxId := fmt.Sprintf("%s-box-%05d", paiUsername, i)
+		f.boxes = append(f.boxes, &model.Box{
+			BoxId:            boxId,
+			SupplierBoxId:    fmt.Sprintf("%s-sb-%05d", paiUsername, i),
+			Online:           strconv.Itoa(boolToInt(r.Intn(10) > 0)),
+			TcpNatType:       natTypes[r.Intn(len(natTypes))],
+			UdpNatType:       natTypes[r.Intn(len(natTypes))],
+			PublicIp:         fmt.Sprintf("203.0.%d.%d", r.Intn(256), r.Intn(254)+1),
+			PrivateIp:        fmt.Sprintf("192.168.%d.%d", r.Intn(256), r.Intn(254)+1),
+			Isp:              isps[r.Intn(len(isps))],
+			Province:         provinces[r.Intn(len(provinces))],
+			City:             "",
+			CpuArch:          "x86_64",
+			CpuCores:         strconv.Itoa(4 << r.Intn(3)),
+			MemorySize:       strconv.Itoa(8 << r.Intn(3)),
+			Os:               "linux",
+			PluginVersion:    "1.0.0",
+			PluginDeployTime: "2024-01-01 00:00:00",
+			ProcessStatus:    "running",
+			Upload:           float64(r.Intn(1000)),
+			Download:         float64(r.Intn(1000)),
+			DiskUsage:        float64(r.Intn(100)),
+			Upnp:             r.Intn(2) == 1,
+			Remark:           remarks[r.Intn(len(remarks))],
+			DiskInfos: []*model.DiskInfo{{
+				DiskId:    fmt.Sprintf("%s-disk-0", boxId),
+				DiskSize:  "1024",
+				DiskMedia: "SSD",
+				DiskUsed:  strconv.Itoa(r.Intn(1024)),
+			}},
+		})
+	}
+
+	return f
+}
+
+// Boxes returns a snapshot of the fleet.
+func (f *Fleet) Boxes() []*model.Box {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	out := make([]*model.Box, 0, len(f.boxes))
+	for _, b := range f.boxes {
+		box := *b
+		out = append(out, &box)
+	}
+
+	return out
+}
+
+// UpdateBox applies fn to the box with the given id, so later box list responses reflect the change.
+func (f *Fleet) UpdateBox(boxId string, fn func(box *model.Box)) bool {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	for _, b := range f.boxes {
+		if b.BoxId == boxId {
+			fn(b)
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Fleet) box(boxId string) *model.Box {
+	f.lk.Lock()
+	defer f.lk.Unlock()
+
+	for _, b := range f.boxes {
+		if b.BoxId == boxId {
+			box := *b
+			return &box
+		}
+	}
+
+	return nil
+}
+
+type boxListResponse struct {
+	Boxes []*model.Box `json:"boxes"`
+	Total string       `json:"total"`
+}
+
+func (s *Server) boxList(w http.ResponseWriter, r *http.Request, a *account) {
+	boxes := a.fleet.Boxes()
+	start, end := paginate(len(boxes), intParam(r, "page", 1), intParam(r, "pageSize", 10))
+
+	writeJSON(w, http.StatusOK, boxListResponse{
+		Boxes: boxes[start:end],
+		Total: strconv.Itoa(len(boxes)),
+	})
+}
+
+// IncomeRecord is the upstream wire format of a box income entry.
+type IncomeRecord struct {
+	Date           string `json:"date"`
+	BoxId          string `json:"boxId"`
+	Remark         string `json:"remark"`
+	Bw             string `json:"bw"`
+	Amount         string `json:"amount"`
+	SupplierBoxId  string `json:"supplierBoxId"`
+	BwAmount       string `json:"bwAmount"`
+	ActivityIncome string `json:"activityIncome"`
+	DistPercent    int    `json:"distPercent"`
+	InviterId      string `json:"inviterId"`
+}
+
+type incomeResponse struct {
+	List     []*IncomeRecord `json:"list"`
+	Total    string          `json:"total"`
+	TotalNum string          `json:"totalNum"`
+}
+
+// Income returns the income the fleet earned on each day between start and end inclusive.
+func (f *Fleet) Income(start, end time.Time) []*IncomeRecord {
+	var out []*IncomeRecord
+
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(time.DateOnly)
+		for _, b := range f.Boxes() {
+			r := rand.New(rand.NewSource(seed(b.BoxId, date)))
+			bwAmount := float64(r.Intn(10000)) / 100
+			activity := float64(r.Intn(500)) / 100
+
+			out = append(out, &IncomeRecord{
+				Date:           date,
+				BoxId:          b.BoxId,
+				Remark:         b.Remark,
+				Bw:             strconv.FormatFloat(float64(r.Intn(1000))/10, 'f', 1, 64),
+				Amount:         strconv.FormatFloat(bwAmount+activity, 'f', 2, 64),
+				SupplierBoxId:  b.SupplierBoxId,
+				BwAmount:       strconv.FormatFloat(bwAmount, 'f', 2, 64),
+				ActivityIncome: strconv.FormatFloat(activity, 'f', 2, 64),
+				DistPercent:    100,
+			})
+		}
+	}
+
+	return out
+}
+
+func (s *Server) income(w http.ResponseWriter, r *http.Request, a *account) {
+	start, err := time.ParseInLocation(time.DateOnly, r.URL.Query().Get("start"), time.Local)
+	if err != nil {
+		badRequest(w, "invalid start")
+		return
+	}
+
+	end, err := time.ParseInLocation(time.DateOnly, r.URL.Query().Get("end"), time.Local)
+	if err != nil {
+		badRequest(w, "invalid end")
+		return
+	}
+
+	records := a.fleet.Income(start, end)
+
+	var total float64
+	for _, rec := range records {
+		amount, _ := strconv.ParseFloat(rec.Amount, 64)
+		total += amount
+	}
+
+	from, to := paginate(len(records), intParam(r, "pageIndex", 1), intParam(r, "pageSize", 10))
+
+	writeJSON(w, http.StatusOK, incomeResponse{
+		List:     records[from:to],
+		Total:    strconv.FormatFloat(total, 'f', 2, 64),
+		TotalNum: strconv.Itoa(len(records)),
+	})
+}
+
+// BandwidthPoint is the upstream wire format of a bandwidth sample, taken every 5 minutes.
+type BandwidthPoint struct {
+	Time     string  `json:"time"`
+	Upload   float64 `json:"upload"`
+	Download float64 `json:"download"`
+}
+
+type boxBandwidths struct {
+	BoxId         string            `json:"boxId"`
+	SupplierBoxId string            `json:"supplierBoxId"`
+	Bandwidths    []*BandwidthPoint `json:"bandwidths"`
+}
+
+// Bandwidth returns the 5 minute bandwidth samples of a box on the given day.
+func (f *Fleet) Bandwidth(boxId string, day time.Time) []*BandwidthPoint {
+	r := rand.New(rand.NewSource(seed(boxId, day.Format(time.DateOnly), "bandwidth")))
+
+	var out []*BandwidthPoint
+	for t := day; t.Before(day.AddDate(0, 0, 1)); t = t.Add(5 * time.Minute) {
+		out = append(out, &BandwidthPoint{
+			Time:     strconv.FormatInt(t.Unix(), 10),
+			Upload:   float64(r.Intn(100000)) / 100,
+			Download: float64(r.Intn(10000)) / 100,
+		})
+	}
+
+	return out
+}
+
+func (s *Server) bandwidth(w http.ResponseWriter, r *http.Request, a *account) {
+	day, err := time.ParseInLocation(time.DateOnly, r.URL.Query().Get("date"), time.Local)
+	if err != nil {
+		badRequest(w, "invalid date")
+		return
+	}
+
+	out := make([]*boxBandwidths, 0)
+	for _, boxId := range r.URL.Query()["boxId"] {
+		b := a.fleet.box(boxId)
+		if b == nil {
+			continue
+		}
+
+		out = append(out, &boxBandwidths{
+			BoxId:         b.BoxId,
+			SupplierBoxId: b.SupplierBoxId,
+			Bandwidths:    a.fleet.Bandwidth(b.BoxId, day),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"boxBandwidths": out})
+}
+
+// QualityPoint is the upstream wire format of a quality sample, taken every 5 minutes.
+type QualityPoint struct {
+	Time        string  `json:"time"`
+	PacketLoss  float64 `json:"packetLoss"`
+	TcpNatType  string  `json:"tcpNatType"`
+	UdpNatType  string  `json:"udpNatType"`
+	CpuUsage    float64 `json:"cpuUsage"`
+	MemoryUsage float64 `json:"memoryUsage"`
+	DiskUsage   float64 `json:"diskUsage"`
+}
+
+type boxQualities struct {
+	BoxId         string          `json:"boxId"`
+	SupplierBoxId string          `json:"supplierBoxId"`
+	Qualities     []*QualityPoint `json:"qualities"`
+}
+
+// Quality returns the 5 minute quality samples of a box on the given day.
+func (f *Fleet) Quality(boxId string, day time.Time) []*QualityPoint {
+	b := f.box(boxId)
+	if b == nil {
+		return nil
+	}
+
+	r := rand.New(rand.NewSource(seed(boxId, day.Format(time.DateOnly), "quality")))
+
+	var out []*QualityPoint
+	for t := day; t.Before(day.AddDate(0, 0, 1)); t = t.Add(5 * time.Minute) {
+		out = append(out, &QualityPoint{
+			Time:        strconv.FormatInt(t.Unix(), 10),
+			PacketLoss:  float64(r.Intn(500)) / 100,
+			TcpNatType:  b.TcpNatType,
+			UdpNatType:  b.UdpNatType,
+			CpuUsage:    float64(r.Intn(10000)) / 100,
+			MemoryUsage: float64(r.Intn(10000)) / 100,
+			DiskUsage:   b.DiskUsage,
+		})
+	}
+
+	return out
+}
+
+func (s *Server) quality(w http.ResponseWriter, r *http.Request, a *account) {
+	day, err := time.ParseInLocation(time.DateOnly, r.URL.Query().Get("date"), time.Local)
+	if err != nil {
+		badRequest(w, "invalid date")
+		return
+	}
+
+	out := make([]*boxQualities, 0)
+	for _, boxId := range r.URL.Query()["boxId"] {
+		b := a.fleet.box(boxId)
+		if b == nil {
+			continue
+		}
+
+		out = append(out, &boxQualities{
+			BoxId:         b.BoxId,
+			SupplierBoxId: b.SupplierBoxId,
+			Qualities:     a.fleet.Quality(b.BoxId, day),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"boxQualities": out})
+}
+
+func seed(keys ...string) int64 {
+	h := fnv.New64a()
+	for _, k := range keys {
+		_, _ = h.Write([]byte(k))
+		_, _ = h.Write([]byte{0})
+	}
+	return int64(h.Sum64())
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
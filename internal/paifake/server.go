@@ -0,0 +1,257 @@
+// Package paifake implements an in-process stand-in for the PaiNet open api, so that the box,
+// income, bandwidth and quality syncs can run end-to-end without reaching openapi.painet.work.
+package paifake
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	BoxListPath   = "/boxsupplier/v1/box/list"
+	IncomePath    = "/boxsupplier/v1/supplier/income_v2"
+	BandwidthPath = "/boxsupplier/v1/box/bandwidth"
+	QualityPath   = "/boxsupplier/v1/box/quality"
+
+	// signatureTTL matches the window the api middleware grants a signed request.
+	signatureTTL = 5 * time.Minute
+)
+
+// Failure makes the next Times requests to Path fail with Status. Path may be empty to match any endpoint.
+type Failure struct {
+	Path       string
+	Status     int
+	Times      int
+	RetryAfter time.Duration
+	Code       int64
+	Reason     string
+	Message    string
+}
+
+type Server struct {
+	*httptest.Server
+
+	lk       sync.Mutex
+	accounts map[string]*account
+	failures []*Failure
+	requests map[string]int
+	now      func() time.Time
+}
+
+type account struct {
+	info  *model.PaiNetInfo
+	fleet *Fleet
+}
+
+type Option func(*Server)
+
+// WithClock overrides the clock used to validate request timestamps.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// NewServer starts a fake PaiNet server. Callers must Close it when done.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		accounts: make(map[string]*account),
+		requests: make(map[string]int),
+		now:      time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(BoxListPath, s.handle(s.boxList))
+	mux.HandleFunc(IncomePath, s.handle(s.income))
+	mux.HandleFunc(BandwidthPath, s.handle(s.bandwidth))
+	mux.HandleFunc(QualityPath, s.handle(s.quality))
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddAccount registers a supplier account with a generated fleet of the given size and returns the
+// credentials the sync should use to reach it.
+func (s *Server) AddAccount(paiUsername string, fleetSize int) *model.PaiNetInfo {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	info := &model.PaiNetInfo{
+		APIKey:      fmt.Sprintf("ak-%s", paiUsername),
+		APISecret:   fmt.Sprintf("as-%s", paiUsername),
+		Username:    paiUsername,
+		PaiUsername: paiUsername,
+	}
+
+	s.accounts[info.APIKey] = &account{
+		info:  info,
+		fleet: NewFleet(paiUsername, fleetSize),
+	}
+
+	out := *info
+	return &out
+}
+
+// Fleet returns the generated fleet of the account, or nil if the account is unknown.
+func (s *Server) Fleet(paiUsername string) *Fleet {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	for _, a := range s.accounts {
+		if a.info.PaiUsername == paiUsername {
+			return a.fleet
+		}
+	}
+
+	return nil
+}
+
+// InjectFailure queues a failure, failures are consumed in the order they were injected.
+func (s *Server) InjectFailure(f Failure) {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	if f.Times <= 0 {
+		f.Times = 1
+	}
+
+	s.failures = append(s.failures, &f)
+}
+
+// Requests returns how many requests reached path, including rejected ones.
+func (s *Server) Requests(path string) int {
+	s.lk.Lock()
+	defer s.lk.Unlock()
+
+	return s.requests[path]
+}
+
+type errorResponse struct {
+	Code    int64  `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (s *Server) handle(h func(w http.ResponseWriter, r *http.Request, a *account)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.lk.Lock()
+		s.requests[r.URL.Path]++
+		failure := s.nextFailure(r.URL.Path)
+		s.lk.Unlock()
+
+		if failure != nil {
+			if failure.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(failure.RetryAfter.Seconds())))
+			}
+			writeJSON(w, failure.Status, errorResponse{Code: failure.Code, Reason: failure.Reason, Message: failure.Message})
+			return
+		}
+
+		a, err := s.authenticate(r)
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, errorResponse{Code: http.StatusUnauthorized, Reason: "UNAUTHORIZED", Message: err.Error()})
+			return
+		}
+
+		h(w, r, a)
+	}
+}
+
+func (s *Server) nextFailure(path string) *Failure {
+	for i, f := range s.failures {
+		if f.Path != "" && f.Path != path {
+			continue
+		}
+
+		f.Times--
+		if f.Times <= 0 {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+		}
+		return f
+	}
+
+	return nil
+}
+
+func (s *Server) authenticate(r *http.Request) (*account, error) {
+	ak := r.Header.Get("ak")
+	timestampStr := r.Header.Get("timestamp")
+	sign := r.Header.Get("sign")
+
+	if ak == "" || timestampStr == "" || sign == "" {
+		return nil, fmt.Errorf("missing signature headers")
+	}
+
+	s.lk.Lock()
+	a, ok := s.accounts[ak]
+	s.lk.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown ak %s", ak)
+	}
+
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %s", timestampStr)
+	}
+
+	if Sign(a.info.APISecret, a.info.PaiUsername, timestamp) != sign {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+
+	if time.Unix(timestamp, 0).Add(signatureTTL).Before(s.now()) {
+		return nil, fmt.Errorf("signature expired")
+	}
+
+	return a, nil
+}
+
+// Sign computes the request signature the same way the PaiNet client does.
+func Sign(apiSecret, account string, timestamp int64) string {
+	text := fmt.Sprintf("%s#%d#%s", apiSecret, timestamp, account)
+	hash := md5.Sum([]byte(text))
+	return hex.EncodeToString(hash[:])
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func badRequest(w http.ResponseWriter, message string) {
+	writeJSON(w, http.StatusBadRequest, errorResponse{Code: http.StatusBadRequest, Reason: "BAD_REQUEST", Message: message})
+}
+
+func intParam(r *http.Request, key string, def int) int {
+	v, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || v <= 0 {
+		return def
+	}
+	return v
+}
+
+func paginate(total, page, pageSize int) (int, int) {
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+
+	return start, end
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
@@ -30,17 +31,86 @@ func main() {
 
 	config.Cfg = cfg
 
-	if err := dao.Init(&cfg); err != nil {
+	store, err := dao.Open(cfg.DatabaseURL)
+	if err != nil {
 		log.Fatalf("initital: %v\n", err)
 	}
+	defer store.Close()
 
-	go api.ServerAPI(&cfg)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), store, os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v\n", err)
+		}
+		return
+	}
+
+	if cfg.AutoMigrate {
+		if _, err := store.Migrate(context.Background()); err != nil {
+			log.Fatalf("migrate: %v\n", err)
+		}
+	}
+
+	stores := dao.NewStores(store)
+
+	retention, err := api.NewRetention(stores.Retention, cfg.Retention)
+	if err != nil {
+		log.Fatalf("retention: %v\n", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "retention" {
+		if err := runRetention(context.Background(), retention, os.Args[2:]); err != nil {
+			log.Fatalf("retention: %v\n", err)
+		}
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	ds := api.NewDataService()
-	go ds.Run(context.Background())
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		if err := api.ServerAPI(ctx, &cfg, stores); err != nil {
+			log.Printf("api server: %v\n", err)
+		}
+	}()
+
+	client := api.NewPaiNetClient(
+		api.WithBaseUrl(cfg.PaiNet.BaseURL),
+		api.WithTimeout(cfg.PaiNet.Timeout),
+		api.WithRateLimit(cfg.PaiNet.RateLimit, cfg.PaiNet.RateBurst),
+		api.WithRetry(cfg.PaiNet.MaxRetries, cfg.PaiNet.MinBackoff, cfg.PaiNet.MaxBackoff),
+		api.WithMaxRetryAfter(cfg.PaiNet.MaxRetryAfter),
+	)
+
+	ds := api.NewDataService(client, stores, cfg.Sync)
+	ds.Retention = retention
+
+	alerter, err := api.NewAlerter(stores, cfg.Alerts)
+	if err != nil {
+		log.Fatalf("alerts: %v\n", err)
+	}
+	ds.Alerter = alerter
+	ds.Webhooks = api.NewWebhooks(stores.Webhooks, cfg.Webhooks)
+	ds.Notifications = api.NewNotifications(stores.Channels, cfg.Notify)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ds.Run(ctx)
+	}()
 
 	signal.Notify(OsSignal, syscall.SIGINT, syscall.SIGTERM)
-	_ = <-OsSignal
+	select {
+	case <-OsSignal:
+		fmt.Printf("Exiting received OsSignal\n")
+	case <-ctx.Done():
+	}
 
-	fmt.Printf("Exiting received OsSignal\n")
+	cancel()
+	wg.Wait()
 }
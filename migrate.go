@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/core/dao"
+	"strconv"
+)
+
+const migrateUsage = `usage: titan-box-api migrate [up | down [steps] | status]`
+
+// runMigrate handles the migrate subcommand.
+func runMigrate(ctx context.Context, store *dao.SQLStore, args []string) error {
+	cmd := "up"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "up":
+		count, err := store.Migrate(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("applied %d migrations\n", count)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid steps %q\n%s", args[1], migrateUsage)
+			}
+			steps = n
+		}
+
+		count, err := store.MigrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("reverted %d migrations\n", count)
+	case "status":
+		status, err := store.GetMigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range status {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", s.Version, s.Name, appliedAt)
+		}
+	default:
+		return fmt.Errorf("unknown command %q\n%s", cmd, migrateUsage)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gnasnik/titan-box-api/api"
+	"time"
+)
+
+const retentionUsage = `usage: titan-box-api retention [report | run]`
+
+// runRetention handles the retention subcommand, report prints what the next run would remove.
+func runRetention(ctx context.Context, retention *api.Retention, args []string) error {
+	cmd := "report"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	var (
+		reports []*api.RetentionReport
+		err     error
+	)
+
+	switch cmd {
+	case "report":
+		reports, err = retention.Report(ctx, time.Now())
+	case "run":
+		reports, err = retention.Run(ctx, time.Now())
+	default:
+		return fmt.Errorf("unknown command %q\n%s", cmd, retentionUsage)
+	}
+
+	for _, r := range reports {
+		removed := r.Deleted
+		if r.DryRun {
+			removed = r.Expired
+		}
+		fmt.Printf("%-15s ttl %-10s before %s %10d rows %s\n", r.Table, r.TTL, r.Cutoff.Format("2006-01-02 15:04:05"), removed, r.Archive)
+	}
+
+	return err
+}
@@ -7,19 +7,24 @@ import (
 	"github.com/gnasnik/titan-box-api/api"
 	"github.com/gnasnik/titan-box-api/config"
 	"github.com/gnasnik/titan-box-api/core/dao"
+	"github.com/gnasnik/titan-box-api/core/generated/model"
 	"github.com/spf13/viper"
 	"log"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 
 	var (
 		dataType, username, from string
+		resume                   bool
 	)
 
 	flag.StringVar(&dataType, "type", "", "syncing the box data, including all, bandwidth, income, quality")
 	flag.StringVar(&username, "user", "", "specify the user")
 	flag.StringVar(&from, "from", "", "syncing from this day")
+	flag.BoolVar(&resume, "resume", false, "only retry the failed or missing windows recorded in the sync checkpoints")
 
 	flag.Parse()
 
@@ -37,40 +42,79 @@ func main() {
 
 	config.Cfg = cfg
 
-	if err := dao.Init(&cfg); err != nil {
+	store, err := dao.Open(cfg.DatabaseURL)
+	if err != nil {
 		log.Fatalf("initital: %v\n", err)
 	}
+	defer store.Close()
+
+	client := api.NewPaiNetClient(
+		api.WithBaseUrl(cfg.PaiNet.BaseURL),
+		api.WithTimeout(cfg.PaiNet.Timeout),
+		api.WithRateLimit(cfg.PaiNet.RateLimit, cfg.PaiNet.RateBurst),
+		api.WithRetry(cfg.PaiNet.MaxRetries, cfg.PaiNet.MinBackoff, cfg.PaiNet.MaxBackoff),
+		api.WithMaxRetryAfter(cfg.PaiNet.MaxRetryAfter),
+	)
 
-	ds := api.NewDataService()
+	ds := api.NewDataService(client, dao.NewStores(store), cfg.Sync)
 
-	apiKeys, err := dao.GetUserKeys(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	apiKeys, err := store.GetUserKeys(ctx)
 	if err != nil {
 		log.Fatalf("get user keys: %v", err)
 	}
 
 	for _, userKey := range apiKeys {
+		if ctx.Err() != nil {
+			break
+		}
+
 		if userKey.Status == 1 {
 			continue
 		}
 
 		fmt.Printf("start syncing %s\n", userKey.PaiUsername)
 
+		if resume {
+			resumeSync(ctx, ds, userKey, dataType, from)
+			continue
+		}
+
 		switch dataType {
 		case "all":
-			ds.StartSyncBoxList(userKey)
-			ds.StartSyncBoxIncomeHistoryFrom(userKey, from)
-			ds.StartSyncBoxDayBandwidthHistoryFrom(userKey, from)
-			ds.StartSyncBoxDayQualitiesHistoryFrom(userKey, from)
+			ds.StartSyncBoxList(ctx, userKey)
+			ds.StartSyncBoxIncomeHistoryFrom(ctx, userKey, from)
+			ds.StartSyncBoxDayBandwidthHistoryFrom(ctx, userKey, from)
+			ds.StartSyncBoxDayQualitiesHistoryFrom(ctx, userKey, from)
 		case "box":
-			ds.StartSyncBoxList(userKey)
+			ds.StartSyncBoxList(ctx, userKey)
 		case "income":
-			ds.StartSyncBoxIncomeHistoryFrom(userKey, from)
+			ds.StartSyncBoxIncomeHistoryFrom(ctx, userKey, from)
 		case "bandwidth":
-			ds.StartSyncBoxDayBandwidthHistoryFrom(userKey, from)
+			ds.StartSyncBoxDayBandwidthHistoryFrom(ctx, userKey, from)
 		case "qualities":
-			ds.StartSyncBoxDayQualitiesHistoryFrom(userKey, from)
+			ds.StartSyncBoxDayQualitiesHistoryFrom(ctx, userKey, from)
 		default:
 			log.Fatalf("unsupport data type")
 		}
 	}
 }
+
+func resumeSync(ctx context.Context, ds *api.DataService, userKey *model.PaiNetInfo, dataType, from string) {
+	switch dataType {
+	case "all":
+		ds.ResumeSyncHistory(ctx, userKey, model.SyncDataTypeIncome, from)
+		ds.ResumeSyncHistory(ctx, userKey, model.SyncDataTypeBandwidth, from)
+		ds.ResumeSyncHistory(ctx, userKey, model.SyncDataTypeQuality, from)
+	case "income":
+		ds.ResumeSyncHistory(ctx, userKey, model.SyncDataTypeIncome, from)
+	case "bandwidth":
+		ds.ResumeSyncHistory(ctx, userKey, model.SyncDataTypeBandwidth, from)
+	case "qualities":
+		ds.ResumeSyncHistory(ctx, userKey, model.SyncDataTypeQuality, from)
+	default:
+		log.Fatalf("unsupport data type for resume")
+	}
+}